@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/tidwall/gjson"
 	"github.com/twmb/murmur3"
 
 	"github.com/gobuffalo/pop/v6"
@@ -247,6 +248,12 @@ type Client struct {
 	// UpdatedAt returns the timestamp of the last update.
 	UpdatedAt time.Time `json:"updated_at,omitempty" db:"updated_at"`
 
+	// OAuth 2.0 Client Credentials Rotation Date
+	//
+	// CredentialsRotatedAt returns the timestamp of the last rotation of the client's credentials. Access and refresh
+	// tokens requested before it are no longer accepted.
+	CredentialsRotatedAt *time.Time `json:"credentials_rotated_at,omitempty" db:"credentials_rotated_at" structs:",omitempty" faker:"-"`
+
 	// OpenID Connect Front-Channel Logout URI
 	//
 	// RP URL that will cause the RP to log itself out when rendered in an iframe by the OP. An iss (issuer) query
@@ -584,6 +591,18 @@ func (c *Client) GetAccessTokenStrategy() config.AccessTokenStrategyType {
 	return s
 }
 
+// GetEncryptSessionData returns whether the sessions of the client's tokens are
+// encrypted at rest, as set by the boolean "encrypt_session_data" key of the
+// client's metadata. ok is false if the metadata does not set it, in which case
+// the global setting applies.
+func (c *Client) GetEncryptSessionData() (encrypt bool, ok bool) {
+	v := gjson.GetBytes(c.Metadata, "encrypt_session_data")
+	if !v.IsBool() {
+		return false, false
+	}
+	return v.Bool(), true
+}
+
 func AccessTokenStrategySource(client fosite.Client) config.AccessTokenStrategySource {
 	if source, ok := client.(config.AccessTokenStrategySource); ok {
 		return source
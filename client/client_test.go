@@ -31,3 +31,22 @@ func TestClient(t *testing.T) {
 	assert.Len(t, c.GetScopes(), 2)
 	assert.EqualValues(t, c.RedirectURIs, c.GetRedirectURIs())
 }
+
+func TestClient_GetEncryptSessionData(t *testing.T) {
+	for _, tc := range []struct {
+		metadata         string
+		encrypt, defined bool
+	}{
+		{metadata: ``},
+		{metadata: `{}`},
+		{metadata: `{"encrypt_session_data":"false"}`},
+		{metadata: `{"encrypt_session_data":false}`, encrypt: false, defined: true},
+		{metadata: `{"encrypt_session_data":true}`, encrypt: true, defined: true},
+	} {
+		t.Run("metadata="+tc.metadata, func(t *testing.T) {
+			encrypt, defined := (&Client{Metadata: []byte(tc.metadata)}).GetEncryptSessionData()
+			assert.Equal(t, tc.encrypt, encrypt)
+			assert.Equal(t, tc.defined, defined)
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/ory/hydra/v2/driver"
 	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/hydra/v2/x"
 	"github.com/ory/x/configx"
 	"github.com/ory/x/errorsx"
 )
@@ -32,6 +33,7 @@ const (
 	AccessLifespan         = "access-lifespan"
 	RefreshLifespan        = "refresh-lifespan"
 	ConsentRequestLifespan = "consent-request-lifespan"
+	TimeBudget             = "time-budget"
 	OnlyTokens             = "tokens"
 	OnlyRequests           = "requests"
 	OnlyGrants             = "grants"
@@ -105,6 +107,7 @@ func purge(cmd *cobra.Command, args []string, sl *servicelocatorx.Options, dOpts
 		AccessLifespan:         config.KeyAccessTokenLifespan,
 		RefreshLifespan:        config.KeyRefreshTokenLifespan,
 		ConsentRequestLifespan: config.KeyConsentRequestMaxAge,
+		TimeBudget:             config.KeyDBFlushTimeBudget,
 	}
 
 	for k, v := range keys {
@@ -168,8 +171,8 @@ func addRoutine(out io.Writer, p persistence.Persister, names ...string) []clean
 	for _, n := range names {
 		switch n {
 		case OnlyTokens:
-			routines = append(routines, cleanup(out, p.FlushInactiveAccessTokens, "access tokens"))
-			routines = append(routines, cleanup(out, p.FlushInactiveRefreshTokens, "refresh tokens"))
+			routines = append(routines, flushCleanup(out, p.FlushInactiveAccessTokens, "access tokens"))
+			routines = append(routines, flushCleanup(out, p.FlushInactiveRefreshTokens, "refresh tokens"))
 		case OnlyRequests:
 			routines = append(routines, cleanup(out, p.FlushInactiveLoginConsentRequests, "login-consent requests"))
 		case OnlyGrants:
@@ -191,6 +194,20 @@ func cleanup(out io.Writer, cr cleanupRoutine, routineName string) cleanupRoutin
 	}
 }
 
+type flushRoutine func(ctx context.Context, notAfter time.Time, limit int, batchSize int) (x.FlushResult, error)
+
+func flushCleanup(out io.Writer, fr flushRoutine, routineName string) cleanupRoutine {
+	return func(ctx context.Context, notAfter time.Time, limit int, batchSize int) error {
+		res, err := fr(ctx, notAfter, limit, batchSize)
+		if err != nil {
+			return errors.Wrap(errorsx.WithStack(err), fmt.Sprintf("Could not cleanup inactive %s", routineName))
+		}
+		fmt.Fprintf(out, "Successfully completed Janitor run on %s: deleted %d records in %d batches within %s (stopped: %s)\n",
+			routineName, res.Deleted, res.Batches, res.Duration, res.StoppedReason)
+		return nil
+	}
+}
+
 func cleanupRun(ctx context.Context, notAfter time.Time, limit int, batchSize int, routines ...cleanupRoutine) error {
 	if len(routines) == 0 {
 		return errors.New("clean up run received 0 routines")
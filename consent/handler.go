@@ -1132,6 +1132,7 @@ func (h *Handler) acceptUserCodeRequest(w http.ResponseWriter, r *http.Request,
 		DeviceCodeRequestID: userCodeRequest.GetID(),
 		RequestedScope:      []string(userCodeRequest.GetRequestedScopes()),
 		RequestedAudience:   []string(userCodeRequest.GetRequestedAudience()),
+		RequestedACR:        stringsx.Splitx(userCodeRequest.GetRequestForm().Get("acr_values"), " "),
 	}
 
 	// Append the client_id to the original RequestURL, as it is needed for the login flow
@@ -1159,7 +1160,7 @@ func (h *Handler) acceptUserCodeRequest(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	verifier, err := f.ToDeviceVerifier(ctx, h.r)
+	verifier, err := f.ToDeviceVerifier(ctx, h.r, h.r.Config().GetDeviceAuthMaxFlowSize(ctx))
 	if err != nil {
 		h.r.Writer().WriteError(w, r, err)
 		return
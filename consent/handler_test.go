@@ -318,11 +318,13 @@ func TestAcceptDeviceRequest(t *testing.T) {
 	f, err := reg.ConsentManager().CreateDeviceUserAuthRequest(ctx, &flow.DeviceUserAuthRequest{
 		Client:      cl,
 		ID:          challenge,
+		Verifier:    x.Must(flow.NewDeviceVerifier()),
+		CSRF:        x.Must(flow.NewDeviceVerifier()),
 		RequestURL:  requestURL,
 		RequestedAt: time.Now(),
 	})
 	require.NoError(t, err)
-	challenge, err = f.ToDeviceChallenge(ctx, reg)
+	challenge, err = f.ToDeviceChallenge(ctx, reg, 0)
 	require.NoError(t, err)
 
 	h := NewHandler(reg, conf)
@@ -378,11 +380,13 @@ func TestAcceptDuplicateDeviceRequest(t *testing.T) {
 	f, err := reg.ConsentManager().CreateDeviceUserAuthRequest(ctx, &flow.DeviceUserAuthRequest{
 		Client:      cl,
 		ID:          challenge,
+		Verifier:    x.Must(flow.NewDeviceVerifier()),
+		CSRF:        x.Must(flow.NewDeviceVerifier()),
 		RequestURL:  requestURL,
 		RequestedAt: time.Now(),
 	})
 	require.NoError(t, err)
-	challenge, err = f.ToDeviceChallenge(ctx, reg)
+	challenge, err = f.ToDeviceChallenge(ctx, reg, 0)
 	require.NoError(t, err)
 
 	h := NewHandler(reg, conf)
@@ -452,11 +456,13 @@ func TestAcceptCodeDeviceRequestFailure(t *testing.T) {
 	f, err := reg.ConsentManager().CreateDeviceUserAuthRequest(ctx, &flow.DeviceUserAuthRequest{
 		Client:      cl,
 		ID:          challenge,
+		Verifier:    x.Must(flow.NewDeviceVerifier()),
+		CSRF:        x.Must(flow.NewDeviceVerifier()),
 		RequestURL:  requestURL,
 		RequestedAt: time.Now(),
 	})
 	require.NoError(t, err)
-	challenge, err = f.ToDeviceChallenge(ctx, reg)
+	challenge, err = f.ToDeviceChallenge(ctx, reg, 0)
 	require.NoError(t, err)
 
 	h := NewHandler(reg, conf)
@@ -5,6 +5,7 @@ package consent
 
 import (
 	"context"
+	"time"
 
 	"github.com/gobuffalo/pop/v6"
 	"github.com/gofrs/uuid"
@@ -66,6 +67,9 @@ type (
 		GetDeviceUserAuthRequest(ctx context.Context, challenge string) (*flow.DeviceUserAuthRequest, error)
 		HandleDeviceUserAuthRequest(ctx context.Context, f *flow.Flow, challenge string, r *flow.HandledDeviceUserAuthRequest) (*flow.DeviceUserAuthRequest, error)
 		VerifyAndInvalidateDeviceUserAuthRequest(ctx context.Context, verifier string) (*flow.HandledDeviceUserAuthRequest, error)
+		GetDeviceFlowSubject(ctx context.Context, deviceChallenge string) (string, error)
+		ListApprovedUnpolledDeviceFlows(ctx context.Context, approvedBefore time.Time) ([]*flow.Flow, error)
+		FlushStaleDeviceFlows(ctx context.Context, notAfter time.Time, batchSize int) (int, error)
 
 		Transaction(context.Context, func(ctx context.Context, c *pop.Connection) error) error
 	}
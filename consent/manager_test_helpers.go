@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -133,8 +134,8 @@ func MockDeviceRequest(key string, network string) (c *flow.DeviceUserAuthReques
 		Client:      client,
 		RequestURL:  "https://request-url/path" + key,
 		ID:          makeID("challenge", network, key),
-		Verifier:    makeID("verifier", network, key),
-		CSRF:        "csrf" + key,
+		Verifier:    makeID("device-verifier-0123456789abcdef", network, key),
+		CSRF:        makeID("device-csrf-0123456789abcdefghijk", network, key),
 	}
 
 	f = flow.NewDeviceFlow(c)
@@ -505,7 +506,7 @@ func ManagerTests(deps Deps, m Manager, clientManager client.Manager, fositeMana
 				t.Run("key="+tc.key, func(t *testing.T) {
 					c, h, f := MockDeviceRequest(tc.key, network)
 					_ = clientManager.CreateClient(ctx, c.Client) // Ignore errors that are caused by duplication
-					deviceChallenge := x.Must(f.ToDeviceChallenge(ctx, deps))
+					deviceChallenge := x.Must(f.ToDeviceChallenge(ctx, deps, 0))
 
 					_, err := m.GetDeviceUserAuthRequest(ctx, deviceChallenge)
 					require.Error(t, err)
@@ -513,7 +514,7 @@ func ManagerTests(deps Deps, m Manager, clientManager client.Manager, fositeMana
 					f, err = m.CreateDeviceUserAuthRequest(ctx, c)
 					require.NoError(t, err)
 
-					deviceChallenge = x.Must(f.ToDeviceChallenge(ctx, deps))
+					deviceChallenge = x.Must(f.ToDeviceChallenge(ctx, deps, 0))
 
 					got1, err := m.GetDeviceUserAuthRequest(ctx, deviceChallenge)
 					require.NoError(t, err)
@@ -524,17 +525,36 @@ func ManagerTests(deps Deps, m Manager, clientManager client.Manager, fositeMana
 					require.NoError(t, err)
 					compareDeviceRequest(t, c, got1)
 
-					DeviceVerifier := x.Must(f.ToDeviceVerifier(ctx, deps))
+					DeviceVerifier := x.Must(f.ToDeviceVerifier(ctx, deps, 0))
 
 					got2, err := m.VerifyAndInvalidateDeviceUserAuthRequest(ctx, DeviceVerifier)
 					require.NoError(t, err)
 					compareDeviceRequest(t, c, got2.Request)
 
-					deviceChallenge = x.Must(f.ToDeviceChallenge(ctx, deps))
+					deviceChallenge = x.Must(f.ToDeviceChallenge(ctx, deps, 0))
 					_, err = m.GetDeviceUserAuthRequest(ctx, deviceChallenge)
 					require.NoError(t, err)
 				})
 			}
+
+			t.Run("case=rejects weak secrets", func(t *testing.T) {
+				strong := x.Must(flow.NewDeviceVerifier())
+				for _, tc := range []struct {
+					field, verifier, csrf string
+				}{
+					{field: "verifier", verifier: "", csrf: strong},
+					{field: "verifier", verifier: "short", csrf: strong},
+					{field: "csrf", verifier: strong, csrf: strings.Repeat("ab", 20)},
+				} {
+					c, _, _ := MockDeviceRequest("weak", network)
+					c.Verifier, c.CSRF = tc.verifier, tc.csrf
+
+					_, err := m.CreateDeviceUserAuthRequest(ctx, c)
+					var weak *flow.WeakDeviceVerifierError
+					require.ErrorAs(t, err, &weak)
+					assert.Equal(t, tc.field, weak.Field)
+				}
+			})
 		})
 
 		t.Run("case=auth-request", func(t *testing.T) {
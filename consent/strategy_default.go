@@ -7,6 +7,7 @@ import (
 	"context"
 	stderrs "errors"
 	"fmt"
+	"maps"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -1223,6 +1224,15 @@ func (s *DefaultStrategy) HandleOAuth2DeviceAuthorizationRequest(
 	if deviceFlow != nil {
 		ar.RequestedScope = fosite.Arguments(deviceFlow.RequestedScope)
 		ar.RequestedAudience = fosite.Arguments(deviceFlow.RequestedAudience)
+		if len(deviceFlow.RequestedACR) > 0 && ar.Form.Get("acr_values") == "" {
+			// The acr_values were sent with the device authorization request, so
+			// carry them over for the login and consent requests.
+			ar.Form = maps.Clone(ar.Form)
+			if ar.Form == nil {
+				ar.Form = url.Values{}
+			}
+			ar.Form.Set("acr_values", strings.Join(deviceFlow.RequestedACR, " "))
+		}
 	}
 
 	if loginVerifier == "" && consentVerifier == "" {
@@ -1246,9 +1256,7 @@ func (s *DefaultStrategy) HandleOAuth2DeviceAuthorizationRequest(
 		if err != nil {
 			return err
 		}
-		err = s.r.OAuth2Storage().UpdateAndInvalidateUserCodeSessionByRequestID(ctx, string(f.DeviceCodeRequestID), f.ID)
-
-		return err
+		return s.r.OAuth2Storage().ConsumeUserCodeSessionByRequestID(ctx, string(f.DeviceCodeRequestID), f.ID)
 	})
 
 	return consentSession, f, err
@@ -1288,9 +1296,15 @@ func (s *DefaultStrategy) requestDevice(ctx context.Context, w http.ResponseWrit
 
 func (s *DefaultStrategy) forwardDeviceRequest(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	// Set up csrf/challenge/verifier values
-	verifier := strings.Replace(uuid.New(), "-", "", -1)
+	verifier, err := flow.NewDeviceVerifier()
+	if err != nil {
+		return errorsx.WithStack(err)
+	}
+	csrf, err := flow.NewDeviceVerifier()
+	if err != nil {
+		return errorsx.WithStack(err)
+	}
 	challenge := strings.Replace(uuid.New(), "-", "", -1)
-	csrf := strings.Replace(uuid.New(), "-", "", -1)
 
 	// Generate the request URL
 	iu := s.getDeviceVerificationPath(ctx)
@@ -1310,7 +1324,7 @@ func (s *DefaultStrategy) forwardDeviceRequest(ctx context.Context, w http.Respo
 		return errorsx.WithStack(err)
 	}
 
-	encodedFlow, err := f.ToDeviceChallenge(ctx, s.r)
+	encodedFlow, err := f.ToDeviceChallenge(ctx, s.r, s.r.Config().GetDeviceAuthMaxFlowSize(ctx))
 	if err != nil {
 		return err
 	}
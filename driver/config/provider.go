@@ -59,6 +59,13 @@ const (
 	KeyBCryptCost                                = "oauth2.hashers.bcrypt.cost"
 	KeyPBKDF2Iterations                          = "oauth2.hashers.pbkdf2.iterations"
 	KeyEncryptSessionData                        = "oauth2.session.encrypt_at_rest"
+	KeySessionSerializationFormat                = "oauth2.session.serialization_format"
+	KeyAssumePlaintextSessionData                = "oauth2.session.assume_plaintext"
+	KeyAllowGrantedScopeErasure                  = "oauth2.session.allow_granted_scope_erasure"
+	KeySessionUnmarshalErrorStrategy             = "oauth2.session.unmarshal_error_strategy"
+	KeySessionUnmarshalMode                      = "oauth2.session.unmarshal_mode"
+	KeySessionSkipFormData                       = "oauth2.session.skip_form_data"
+	KeySessionMaxDecryptConcurrency              = "oauth2.session.max_decrypt_concurrency"
 	KeyCookieSameSiteMode                        = "serve.cookies.same_site_mode"
 	KeyCookieSameSiteLegacyWorkaround            = "serve.cookies.same_site_legacy_workaround"
 	KeyCookieDomain                              = "serve.cookies.domain"
@@ -75,6 +82,7 @@ const (
 	KeyIDTokenLifespan                           = "ttl.id_token"      // #nosec G101
 	KeyAuthCodeLifespan                          = "ttl.auth_code"
 	KeyDeviceAndUserCodeLifespan                 = "ttl.device_user_code"
+	KeyDeviceFlowErrorRetention                  = "ttl.device_flow_error"
 	KeyScopeStrategy                             = "strategies.scope"
 	KeyGetCookieSecrets                          = "secrets.cookie"
 	KeyGetSystemSecret                           = "secrets.system"
@@ -95,9 +103,41 @@ const (
 	KeyAccessTokenStrategy                       = "strategies.access_token"
 	KeyJWTScopeClaimStrategy                     = "strategies.jwt.scope_claim"
 	KeyDBIgnoreUnknownTableColumns               = "db.ignore_unknown_table_columns"
+	KeyDBFlushDSN                                = "db.flush_dsn"
+	KeyDBFlushTimeBudget                         = "db.flush_time_budget"
+	KeyDBFlushBatchTimeBudget                    = "db.flush_batch_time_budget"
+	KeyDBFlushMaxBatchSize                       = "db.flush_max_batch_size"
+	KeyDBFlushMinAge                             = "db.flush_min_age"
+	KeyDBFlushMaintenanceThreshold               = "db.flush_maintenance_threshold"
+	KeyDBBulkStatementTimeout                    = "db.bulk_statement_timeout"
+	KeyDBFlushMissingIndex                       = "db.flush_missing_index"
+	KeyDBInlineJTICleanup                        = "db.inline_jti_cleanup"
+	KeyDBStrictSignatureColumnCheck              = "db.strict_signature_column_check"
 	KeySubjectIdentifierAlgorithmSalt            = "oidc.subject_identifiers.pairwise.salt"
 	KeyPublicAllowDynamicRegistration            = "oidc.dynamic_client_registration.enabled"
 	KeyDeviceAuthTokenPollingInterval            = "oauth2.device_authorization.token_polling_interval" // #nosec G101
+	KeyDeviceAuthMaxFlowSize                     = "oauth2.device_authorization.max_flow_size"
+	KeyDeviceCompletionHook                      = "oauth2.device_authorization.completion_hook"
+	KeyDeviceAuthMaxActiveFlowsPerClient         = "oauth2.device_authorization.max_active_flows_per_client"
+	KeyDeviceAuthFutureHandledAt                 = "oauth2.device_authorization.future_handled_at"
+	KeyDeviceAuthEncryptSecretsAtRest            = "oauth2.device_authorization.encrypt_secrets_at_rest"
+	KeyRefreshTokenSlidingLifespan               = "oauth2.refresh_token.sliding_lifespan"            // #nosec G101
+	KeyRefreshTokenAbsoluteLifespan              = "oauth2.refresh_token.absolute_lifespan"           // #nosec G101
+	KeyRefreshTokenRequireOfflineAccess          = "oauth2.refresh_token.require_offline_access"      // #nosec G101
+	KeyRefreshTokenMaxChainLength                = "oauth2.refresh_token.max_chain_length"            // #nosec G101
+	KeyAccessTokenCacheSize                      = "oauth2.access_token_cache.size"                   // #nosec G101
+	KeyAccessTokenCacheTTL                       = "oauth2.access_token_cache.ttl"                    // #nosec G101
+	KeyAccessTokenMaxExtendedLifespan            = "oauth2.access_token_extension.max_lifespan"       // #nosec G101
+	KeyAccessTokenReadRepairEnabled              = "oauth2.access_token_read_repair.enabled"          // #nosec G101
+	KeyAccessTokenLegacyFallbackCutoff           = "oauth2.access_token_legacy_fallback.cutoff"       // #nosec G101
+	KeyAccessTokenLegacyFallbackMaxLifespan      = "oauth2.access_token_legacy_fallback.max_lifespan" // #nosec G101
+	KeyAccessTokenDeletionIncludeClientID        = "oauth2.access_token_deletion.include_client_id"   // #nosec G101
+	KeyFrozenTokenLifespansEnabled               = "oauth2.frozen_token_lifespans.enabled"            // #nosec G101
+	KeyClientSnapshotEnabled                     = "oauth2.client_snapshot.enabled"
+	KeyMaxRequestedAudience                      = "oauth2.requested_audience.max_count"
+	KeySubjectRequiredGrantTypes                 = "oauth2.subject_required.grant_types"
+	KeyOutboxEnabled                             = "oauth2.outbox.enabled"
+	KeySessionWriteTimeout                       = "oauth2.session_write_timeout"
 	KeyPKCEEnforced                              = "oauth2.pkce.enforced"
 	KeyPKCEEnforcedForPublicClients              = "oauth2.pkce.enforced_for_public_clients"
 	KeyLogLevel                                  = "log.level"
@@ -105,6 +145,7 @@ const (
 	KeyGrantAllClientCredentialsScopesPerDefault = "oauth2.client_credentials.default_grant_allowed_scope" // #nosec G101
 	KeyExposeOAuth2Debug                         = "oauth2.expose_internal_errors"
 	KeyExcludeNotBeforeClaim                     = "oauth2.exclude_not_before_claim"
+	KeyClientIDCaseInsensitive                   = "oauth2.client_id_case_insensitive"
 	KeyAllowedTopLevelClaims                     = "oauth2.allowed_top_level_claims"
 	KeyMirrorTopLevelClaims                      = "oauth2.mirror_top_level_claims"
 	KeyOAuth2GrantJWTIDOptional                  = "oauth2.grant.jwt.jti_optional"
@@ -117,6 +158,33 @@ const (
 
 const DSNMemory = "memory"
 
+const (
+	SessionSerializationFormatJSON    = "json"
+	SessionSerializationFormatMsgpack = "msgpack"
+)
+
+const (
+	SessionUnmarshalErrorStrategyFail    = "fail"
+	SessionUnmarshalErrorStrategySkip    = "skip"
+	SessionUnmarshalErrorStrategyPartial = "partial"
+)
+
+const (
+	SessionUnmarshalModeStrict   = "strict"
+	SessionUnmarshalModeTolerant = "tolerant"
+)
+
+const (
+	DeviceAuthFutureHandledAtClamp  = "clamp"
+	DeviceAuthFutureHandledAtReject = "reject"
+)
+
+const (
+	DbFlushMissingIndexWarn   = "warn"
+	DbFlushMissingIndexRefuse = "refuse"
+	DbFlushMissingIndexIgnore = "ignore"
+)
+
 var (
 	_ hasherx.PBKDF2Configurator = (*DefaultProvider)(nil)
 	_ hasherx.BCryptConfigurator = (*DefaultProvider)(nil)
@@ -281,10 +349,76 @@ func (p *DefaultProvider) DSN() string {
 	return ""
 }
 
+// EncryptSessionData returns whether OAuth2 and OpenID Connect session data is
+// encrypted at rest. Like all settings, it is resolved for the network of the
+// context, so multi-tenant deployments can encrypt the sessions of some
+// networks only.
 func (p *DefaultProvider) EncryptSessionData(ctx context.Context) bool {
 	return p.getProvider(ctx).BoolF(KeyEncryptSessionData, true)
 }
 
+// AssumePlaintextSessionData returns whether session data is read as plain JSON
+// without first detecting whether it is encrypted, which saves scanning every
+// session on reads. It only applies while EncryptSessionData is disabled, and
+// should only be enabled if no encrypted sessions are expected: encrypted
+// sessions are still read, but only after decoding them as JSON failed.
+func (p *DefaultProvider) AssumePlaintextSessionData(ctx context.Context) bool {
+	return !p.EncryptSessionData(ctx) && p.getProvider(ctx).BoolF(KeyAssumePlaintextSessionData, false)
+}
+
+// SessionSerializationFormat returns the format OAuth2 and OpenID Connect
+// session data is serialized with, either SessionSerializationFormatJSON or
+// SessionSerializationFormatMsgpack.
+func (p *DefaultProvider) SessionSerializationFormat(ctx context.Context) string {
+	return p.getProvider(ctx).StringF(KeySessionSerializationFormat, SessionSerializationFormatJSON)
+}
+
+// AllowGrantedScopeErasure returns whether updating an OpenID Connect session
+// may reduce its granted scopes to none. Defaults to false, which rejects such
+// updates.
+func (p *DefaultProvider) AllowGrantedScopeErasure(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyAllowGrantedScopeErasure, false)
+}
+
+// SessionUnmarshalErrorStrategy returns how methods listing several tokens
+// handle a token whose session cannot be decrypted or decoded:
+// SessionUnmarshalErrorStrategyFail aborts the listing,
+// SessionUnmarshalErrorStrategySkip (default) logs and omits the token, and
+// SessionUnmarshalErrorStrategyPartial logs and returns the token without its
+// session. Looking up a single token always fails on such errors.
+func (p *DefaultProvider) SessionUnmarshalErrorStrategy(ctx context.Context) string {
+	return p.getProvider(ctx).StringF(KeySessionUnmarshalErrorStrategy, SessionUnmarshalErrorStrategySkip)
+}
+
+// SessionUnmarshalMode returns how stored sessions which do not match the shape
+// of the session type are decoded: SessionUnmarshalModeStrict (default) fails,
+// while SessionUnmarshalModeTolerant decodes the fields which match and logs
+// the ones which do not.
+func (p *DefaultProvider) SessionUnmarshalMode(ctx context.Context) string {
+	return p.getProvider(ctx).StringF(KeySessionUnmarshalMode, SessionUnmarshalModeStrict)
+}
+
+// SessionSkipFormDataTables returns the token tables, e.g. "access" or
+// "refresh", for which the form data of the request is not persisted. Their
+// sessions are read back with an empty request form.
+func (p *DefaultProvider) SessionSkipFormDataTables(ctx context.Context) []string {
+	return p.getProvider(ctx).StringsF(KeySessionSkipFormData, []string{})
+}
+
+// SessionMaxDecryptConcurrency returns how many sessions of a token table
+// methods listing several tokens decrypt and decode at the same time. A value
+// of 1 decodes them one after another.
+func (p *DefaultProvider) SessionMaxDecryptConcurrency(ctx context.Context) int {
+	return max(p.getProvider(ctx).IntF(KeySessionMaxDecryptConcurrency, 2), 1)
+}
+
+// ClientIDCaseInsensitive returns whether client-scoped token queries, e.g.
+// DeleteAccessTokens, and loading the client of a stored token match client IDs
+// ignoring case. Defaults to false, which matches them exactly.
+func (p *DefaultProvider) ClientIDCaseInsensitive(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyClientIDCaseInsensitive, false)
+}
+
 func (p *DefaultProvider) ExcludeNotBeforeClaim(ctx context.Context) bool {
 	return p.getProvider(ctx).BoolF(KeyExcludeNotBeforeClaim, false)
 }
@@ -383,11 +517,166 @@ func (p *DefaultProvider) GetDeviceAndUserCodeLifespan(ctx context.Context) time
 	return p.p.DurationF(KeyDeviceAndUserCodeLifespan, time.Minute*15)
 }
 
+// GetDeviceFlowErrorRetention returns for how long erred device flows are kept
+// for diagnosis before FlushStaleDeviceFlows may delete them. Defaults to 0,
+// which flushes erred flows like all other terminal device flows.
+func (p *DefaultProvider) GetDeviceFlowErrorRetention(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyDeviceFlowErrorRetention, 0)
+}
+
+// GetRefreshTokenSlidingLifespan returns for how long a refresh token stays
+// valid after it was last used. Defaults to 0, which disables sliding expiry.
+func (p *DefaultProvider) GetRefreshTokenSlidingLifespan(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyRefreshTokenSlidingLifespan, 0)
+}
+
+// GetRefreshTokenAbsoluteLifespan returns for how long a refresh token chain
+// stays valid at most, no matter how often it is used. Defaults to 0, which
+// disables the absolute cap.
+func (p *DefaultProvider) GetRefreshTokenAbsoluteLifespan(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyRefreshTokenAbsoluteLifespan, 0)
+}
+
+// GetRefreshTokenMaxChainLength returns how often a refresh token chain may be
+// rotated before the end-user has to authenticate again. Defaults to 0, which
+// does not limit the chain length.
+func (p *DefaultProvider) GetRefreshTokenMaxChainLength(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyRefreshTokenMaxChainLength, 0)
+}
+
+// RefreshTokenRequireOfflineAccess returns whether refresh tokens may only be
+// stored if the offline_access scope was granted. Defaults to false.
+func (p *DefaultProvider) RefreshTokenRequireOfflineAccess(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyRefreshTokenRequireOfflineAccess, false)
+}
+
+// ClientSnapshotEnabled returns whether the name, scope and redirect URIs of the
+// client are recorded with each access and refresh token at issuance. Defaults
+// to false.
+func (p *DefaultProvider) ClientSnapshotEnabled(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyClientSnapshotEnabled, false)
+}
+
+// OutboxEnabled returns whether token issuance and revocation events are written
+// to the outbox table in the same transaction as the token change, for a relay
+// to publish. Defaults to false.
+func (p *DefaultProvider) OutboxEnabled(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyOutboxEnabled, false)
+}
+
+// GetSessionWriteTimeout returns how long storing an issued token may take
+// before the write is aborted. Defaults to 0, which disables the timeout.
+func (p *DefaultProvider) GetSessionWriteTimeout(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeySessionWriteTimeout, 0)
+}
+
+// GetMaxRequestedAudience returns how many audiences a single request may ask
+// for before it is rejected. Defaults to 0, which means unbounded.
+func (p *DefaultProvider) GetMaxRequestedAudience(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyMaxRequestedAudience, 0)
+}
+
+// SubjectRequiredGrantTypes returns the grant types, e.g.
+// "authorization_code", which may not issue tokens without a subject. Defaults
+// to none, so that any grant may issue tokens without a subject.
+func (p *DefaultProvider) SubjectRequiredGrantTypes(ctx context.Context) []string {
+	return p.getProvider(ctx).StringsF(KeySubjectRequiredGrantTypes, []string{})
+}
+
+// GetAccessTokenCacheSize returns how many active access tokens are cached in
+// memory to speed up repeated lookups. Defaults to 0, which disables the cache.
+func (p *DefaultProvider) GetAccessTokenCacheSize(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyAccessTokenCacheSize, 0)
+}
+
+// GetAccessTokenCacheTTL returns for how long an access token stays cached.
+// Defaults to 5 seconds.
+func (p *DefaultProvider) GetAccessTokenCacheTTL(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyAccessTokenCacheTTL, 5*time.Second)
+}
+
+// AccessTokenReadRepairEnabled returns whether access tokens which are found
+// under their legacy, unhashed signature are rewritten to the hashed form when
+// they are read. Defaults to false.
+func (p *DefaultProvider) AccessTokenReadRepairEnabled(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyAccessTokenReadRepairEnabled, false)
+}
+
+// AccessTokenLegacyFallbackDisabledAt returns when looking up access tokens
+// stops falling back to the signatures of previous signature strategies, e.g.
+// the legacy, unhashed signatures of older versions. It is the configured
+// cutoff, after which no more such tokens were issued, plus the maximum
+// lifespan of those tokens, which defaults to the access token lifespan. The
+// zero time is returned if no cutoff is configured, which never disables the
+// fallback.
+func (p *DefaultProvider) AccessTokenLegacyFallbackDisabledAt(ctx context.Context) time.Time {
+	cutoff, err := time.Parse(time.RFC3339, p.getProvider(ctx).String(KeyAccessTokenLegacyFallbackCutoff))
+	if err != nil {
+		return time.Time{}
+	}
+	lifespan := p.getProvider(ctx).DurationF(KeyAccessTokenLegacyFallbackMaxLifespan, 0)
+	if lifespan <= 0 {
+		lifespan = p.GetAccessTokenLifespan(ctx)
+	}
+	return cutoff.Add(lifespan)
+}
+
+// AccessTokenDeletionIncludeClientID returns whether the client ID of an access
+// token is read before the token is deleted by its signature, so that the
+// emitted deletion event includes it. Defaults to false, which skips the read.
+func (p *DefaultProvider) AccessTokenDeletionIncludeClientID(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyAccessTokenDeletionIncludeClientID, false)
+}
+
+// FrozenTokenLifespansEnabled returns whether the expiry of access and refresh
+// tokens is stored when they are issued, so that changing the configured
+// lifespans only affects tokens issued afterwards. Defaults to false.
+func (p *DefaultProvider) FrozenTokenLifespansEnabled(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyFrozenTokenLifespansEnabled, false)
+}
+
+// GetAccessTokenMaxExtendedLifespan returns the maximum lifespan, measured from
+// when the token was issued, which an access token can be extended to.
+// Defaults to 24 hours.
+func (p *DefaultProvider) GetAccessTokenMaxExtendedLifespan(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyAccessTokenMaxExtendedLifespan, 24*time.Hour)
+}
+
 // GetDeviceAuthTokenPollingInterval returns device grant token endpoint polling interval. Defaults to 5 seconds.
 func (p *DefaultProvider) GetDeviceAuthTokenPollingInterval(ctx context.Context) time.Duration {
 	return p.p.DurationF(KeyDeviceAuthTokenPollingInterval, time.Second*5)
 }
 
+// GetDeviceAuthMaxFlowSize returns the maximum size in bytes of encoded device
+// challenges and verifiers, which are transported in cookies and URLs. Zero or
+// less disables the limit, which is the default.
+func (p *DefaultProvider) GetDeviceAuthMaxFlowSize(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyDeviceAuthMaxFlowSize, 0)
+}
+
+// GetDeviceAuthFutureHandledAt returns how handled device user auth requests
+// claiming to have been handled in the future are treated:
+// DeviceAuthFutureHandledAtClamp (default) sets their handling time to now, and
+// DeviceAuthFutureHandledAtReject rejects them.
+func (p *DefaultProvider) GetDeviceAuthFutureHandledAt(ctx context.Context) string {
+	return p.getProvider(ctx).StringF(KeyDeviceAuthFutureHandledAt, DeviceAuthFutureHandledAtClamp)
+}
+
+// GetDeviceAuthMaxActiveFlowsPerClient returns how many device flows a client
+// may have pending at once, i.e. device codes which have neither expired nor
+// been exchanged for tokens yet. Zero or less disables the limit.
+func (p *DefaultProvider) GetDeviceAuthMaxActiveFlowsPerClient(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyDeviceAuthMaxActiveFlowsPerClient, 0)
+}
+
+// DeviceAuthEncryptSecretsAtRest returns whether the verifiers and CSRF tokens
+// of device flows are encrypted before they are stored. Reads detect whether a
+// value is encrypted, so the setting can be toggled at any time. Defaults to
+// false.
+func (p *DefaultProvider) DeviceAuthEncryptSecretsAtRest(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyDeviceAuthEncryptSecretsAtRest, false)
+}
+
 func (p *DefaultProvider) LoginURL(ctx context.Context) *url.URL {
 	return urlRoot(p.getProvider(ctx).URIF(KeyLoginURL, p.publicFallbackURL(ctx, "oauth2/fallbacks/login")))
 }
@@ -563,10 +852,87 @@ func (p *DefaultProvider) TokenRefreshHookConfig(ctx context.Context) *HookConfi
 	return p.getHookConfig(ctx, KeyRefreshTokenHook)
 }
 
+// DeviceCompletionHookConfig returns the hook which is notified once a user
+// approved a device flow, or nil if none is configured.
+func (p *DefaultProvider) DeviceCompletionHookConfig(ctx context.Context) *HookConfig {
+	return p.getHookConfig(ctx, KeyDeviceCompletionHook)
+}
+
 func (p *DefaultProvider) DbIgnoreUnknownTableColumns() bool {
 	return p.p.Bool(KeyDBIgnoreUnknownTableColumns)
 }
 
+// DbFlushDSN returns the data source name of the dedicated connection pool
+// used to flush inactive data, or an empty string if flushing should share
+// the regular connection pool.
+func (p *DefaultProvider) DbFlushDSN() string {
+	return p.p.String(KeyDBFlushDSN)
+}
+
+// DbFlushTimeBudget returns the wall-clock time after which flushing inactive
+// tokens stops, even if more tokens are eligible. Defaults to 0 (unbounded).
+func (p *DefaultProvider) DbFlushTimeBudget(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyDBFlushTimeBudget, 0)
+}
+
+// DbFlushBatchTimeBudget returns how long a single batch of a token flush
+// should take. Batches taking longer shrink the following ones. Defaults to 0,
+// which keeps the batch size fixed.
+func (p *DefaultProvider) DbFlushBatchTimeBudget(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyDBFlushBatchTimeBudget, 0)
+}
+
+// DbFlushMaxBatchSize returns the maximum number of tokens a single batch of a
+// token flush deletes. Larger batch sizes requested by the caller are split
+// into more batches, which bounds the rows each statement selects. Defaults to
+// 0, which uses the requested batch size.
+func (p *DefaultProvider) DbFlushMaxBatchSize(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyDBFlushMaxBatchSize, 0)
+}
+
+// DbBulkStatementTimeout returns how long a single bulk DELETE or UPDATE
+// statement, e.g. a flush batch, may run before the database aborts it. Only
+// PostgreSQL and CockroachDB support it. Defaults to 0 (no timeout).
+func (p *DefaultProvider) DbBulkStatementTimeout(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyDBBulkStatementTimeout, 0)
+}
+
+// DbFlushMissingIndex returns how flushing a token table without an index on
+// (nid, requested_at) is handled, which makes every flush batch scan the whole
+// table: DbFlushMissingIndexWarn (default) logs an error and flushes anyway,
+// DbFlushMissingIndexRefuse fails the flush, and DbFlushMissingIndexIgnore
+// skips the check.
+func (p *DefaultProvider) DbFlushMissingIndex(ctx context.Context) string {
+	return p.getProvider(ctx).StringF(KeyDBFlushMissingIndex, DbFlushMissingIndexWarn)
+}
+
+// DbFlushMinAge returns the minimum age of tokens which flushing inactive
+// tokens may delete, regardless of the requested cutoff. Defaults to 0 (no
+// floor).
+func (p *DefaultProvider) DbFlushMinAge(ctx context.Context) time.Duration {
+	return p.getProvider(ctx).DurationF(KeyDBFlushMinAge, 0)
+}
+
+// DbFlushMaintenanceThreshold returns how many tokens a flush must delete from
+// a table before the table is vacuumed and analyzed afterwards. Defaults to 0,
+// which disables the maintenance.
+func (p *DefaultProvider) DbFlushMaintenanceThreshold(ctx context.Context) int {
+	return p.getProvider(ctx).IntF(KeyDBFlushMaintenanceThreshold, 0)
+}
+
+// DbStrictSignatureColumnCheck returns whether startup fails if the signature
+// columns of the token tables are too narrow for hashed signatures, instead of
+// only logging a warning. Defaults to false.
+func (p *DefaultProvider) DbStrictSignatureColumnCheck(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyDBStrictSignatureColumnCheck, false)
+}
+
+// DbInlineJTICleanup returns whether expired client assertion JTIs are deleted
+// whenever a new JTI is stored. Defaults to true.
+func (p *DefaultProvider) DbInlineJTICleanup(ctx context.Context) bool {
+	return p.getProvider(ctx).BoolF(KeyDBInlineJTICleanup, true)
+}
+
 func (p *DefaultProvider) SubjectIdentifierAlgorithmSalt(ctx context.Context) string {
 	return p.getProvider(ctx).String(KeySubjectIdentifierAlgorithmSalt)
 }
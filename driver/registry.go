@@ -69,6 +69,7 @@ type Registry interface {
 	x.RegistryLogger
 	x.RegistryWriter
 	x.RegistryCookieStore
+	x.ClientAuthenticatorProvider
 	client.Registry
 	consent.Registry
 	jwk.Registry
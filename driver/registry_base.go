@@ -531,7 +531,9 @@ func (m *RegistryBase) Tracer(_ context.Context) *otelx.Tracer {
 			m.trc = t
 		}
 	}
-	if m.trc.Tracer() == nil {
+	// Fall back to a no-op tracer if initialization failed or the wrapper
+	// discarded it, so that callers never have to check for nil.
+	if !m.trc.IsLoaded() {
 		m.trc = otelx.NewNoop(m.l, m.Config().Tracing())
 	}
 
@@ -574,6 +576,10 @@ func (m *RegistryBase) AccessRequestHooks() []oauth2.AccessRequestHook {
 	return m.arhs
 }
 
+func (m *RegistryBase) DeviceCompletionHook() oauth2.DeviceCompletionHook {
+	return oauth2.DeviceCompletionWebhook(m)
+}
+
 func (m *RegistryBase) WithHsmContext(h hsm.Context) {
 	m.hsm = h
 }
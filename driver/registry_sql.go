@@ -75,36 +75,10 @@ func (m *RegistrySQL) Init(
 ) error {
 	if m.persister == nil {
 		m.WithContextualizer(ctxer)
-		var opts []instrumentedsql.Opt
-		if m.Tracer(ctx).IsLoaded() {
-			opts = []instrumentedsql.Opt{
-				instrumentedsql.WithTracer(otelsql.NewTracer()),
-				instrumentedsql.WithOmitArgs(), // don't risk leaking PII or secrets
-				instrumentedsql.WithOpsExcluded(instrumentedsql.OpSQLRowsNext),
-			}
-		}
-
 		// new db connection
-		pool, idlePool, connMaxLifetime, connMaxIdleTime, cleanedDSN := sqlcon.ParseConnectionOptions(
-			m.l, m.Config().DSN(),
-		)
-		c, err := pop.NewConnection(
-			&pop.ConnectionDetails{
-				URL:                       sqlcon.FinalizeDSN(m.l, cleanedDSN),
-				IdlePool:                  idlePool,
-				ConnMaxLifetime:           connMaxLifetime,
-				ConnMaxIdleTime:           connMaxIdleTime,
-				Pool:                      pool,
-				UseInstrumentedDriver:     m.Tracer(ctx).IsLoaded(),
-				InstrumentedDriverOptions: opts,
-				Unsafe:                    m.Config().DbIgnoreUnknownTableColumns(),
-			},
-		)
+		c, err := m.openConnection(ctx, m.Config().DSN())
 		if err != nil {
-			return errorsx.WithStack(err)
-		}
-		if err := resilience.Retry(m.l, 5*time.Second, 5*time.Minute, c.Open); err != nil {
-			return errorsx.WithStack(err)
+			return err
 		}
 
 		p, err := sql.NewPersister(ctx, c, m, m.Config(), extraMigrations, goMigrations)
@@ -141,6 +115,21 @@ func (m *RegistrySQL) Init(
 			}
 		}
 
+		if err := p.CheckSignatureColumns(ctx); err != nil {
+			if m.Config().DbStrictSignatureColumnCheck(ctx) {
+				return err
+			}
+			m.Logger().WithError(err).Warn("The signature columns of the token tables are too narrow, inserting tokens may fail or truncate their signatures.")
+		}
+
+		if dsn := m.Config().DbFlushDSN(); dsn != "" {
+			fc, err := m.openConnection(ctx, dsn)
+			if err != nil {
+				return err
+			}
+			p = p.WithFlushConnection(fc)
+		}
+
 		if skipNetworkInit {
 			m.persister = p
 		} else {
@@ -165,6 +154,40 @@ func (m *RegistrySQL) Init(
 	return nil
 }
 
+// openConnection opens a new connection pool for dsn, honoring the pool options
+// encoded in the DSN and the tracing configuration.
+func (m *RegistrySQL) openConnection(ctx context.Context, dsn string) (*pop.Connection, error) {
+	var opts []instrumentedsql.Opt
+	if m.Tracer(ctx).IsLoaded() {
+		opts = []instrumentedsql.Opt{
+			instrumentedsql.WithTracer(otelsql.NewTracer()),
+			instrumentedsql.WithOmitArgs(), // don't risk leaking PII or secrets
+			instrumentedsql.WithOpsExcluded(instrumentedsql.OpSQLRowsNext),
+		}
+	}
+
+	pool, idlePool, connMaxLifetime, connMaxIdleTime, cleanedDSN := sqlcon.ParseConnectionOptions(m.l, dsn)
+	c, err := pop.NewConnection(
+		&pop.ConnectionDetails{
+			URL:                       sqlcon.FinalizeDSN(m.l, cleanedDSN),
+			IdlePool:                  idlePool,
+			ConnMaxLifetime:           connMaxLifetime,
+			ConnMaxIdleTime:           connMaxIdleTime,
+			Pool:                      pool,
+			UseInstrumentedDriver:     m.Tracer(ctx).IsLoaded(),
+			InstrumentedDriverOptions: opts,
+			Unsafe:                    m.Config().DbIgnoreUnknownTableColumns(),
+		},
+	)
+	if err != nil {
+		return nil, errorsx.WithStack(err)
+	}
+	if err := resilience.Retry(m.l, 5*time.Second, 5*time.Minute, c.Open); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
+	return c, nil
+}
+
 func (m *RegistrySQL) alwaysCanHandle(dsn string) bool {
 	scheme := strings.Split(dsn, "://")[0]
 	s := dbal.Canonicalize(scheme)
@@ -115,6 +115,52 @@ func (e *RequestDeniedError) ToRFCError() *fosite.RFC6749Error {
 	}
 }
 
+// DeviceUserError is a device flow error rendered for the end-user, e.g. on
+// the device verification page. Unlike RequestDeniedError, it never contains
+// debug information.
+//
+// swagger:ignore
+type DeviceUserError struct {
+	// Code is the OAuth 2.0 error code, e.g. `access_denied`.
+	Code string `json:"error"`
+
+	// Description of the error in a human readable format.
+	Description string `json:"error_description"`
+
+	// Hint to help resolve the error.
+	Hint string `json:"error_hint,omitempty"`
+}
+
+// ToDeviceUserError renders the error for display to the end-user of a device
+// flow. Errors with a server error status code only reveal that an error
+// occurred, as their description and hint may contain internals. It returns nil
+// if e is not an error.
+func (e *RequestDeniedError) ToDeviceUserError() *DeviceUserError {
+	if !e.IsError() {
+		return nil
+	}
+
+	// ToRFCError sets the defaults on the error, which must not change here.
+	denied := *e
+	rfc := denied.ToRFCError()
+	if rfc.CodeField >= http.StatusInternalServerError {
+		return &DeviceUserError{
+			Code:        fosite.ErrServerError.ErrorField,
+			Description: fosite.ErrServerError.DescriptionField,
+		}
+	}
+
+	description := rfc.DescriptionField
+	if description == "" {
+		description = "The device login was denied."
+	}
+	return &DeviceUserError{
+		Code:        rfc.ErrorField,
+		Description: description,
+		Hint:        rfc.HintField,
+	}
+}
+
 func (e *RequestDeniedError) Scan(value any) error {
 	v := fmt.Sprintf("%s", value)
 	if len(v) == 0 || v == "{}" {
@@ -482,6 +528,9 @@ type DeviceUserAuthRequest struct {
 	RequestedScope sqlxx.StringSliceJSONFormat `json:"requested_scope"`
 	// RequestedAudience contains the access token audience as requested by the OAuth 2.0 Client.
 	RequestedAudience sqlxx.StringSliceJSONFormat `json:"requested_access_token_audience"`
+	// RequestedACR contains the Authentication Context Class References requested by the OAuth 2.0 Client
+	// using the acr_values parameter.
+	RequestedACR sqlxx.StringSliceJSONFormat `json:"requested_acr"`
 
 	RequestedAt time.Time      `json:"-"`
 	HandledAt   sqlxx.NullTime `json:"handled_at"`
@@ -503,9 +552,16 @@ type HandledDeviceUserAuthRequest struct {
 	RequestedScope sqlxx.StringSliceJSONFormat `json:"requested_scope"`
 	// RequestedAudience contains the access token audience as requested by the OAuth 2.0 Client.
 	RequestedAudience sqlxx.StringSliceJSONFormat `json:"requested_access_token_audience"`
+	// RequestedACR contains the Authentication Context Class References requested by the OAuth 2.0 Client
+	// using the acr_values parameter.
+	RequestedACR sqlxx.StringSliceJSONFormat `json:"requested_acr"`
 
 	DeviceCodeRequestID string `json:"device_code_request_id"`
 
+	// Subject is the identifier of the end-user who approved the device. It
+	// is only known once the end-user logged in.
+	Subject string `json:"subject,omitempty"`
+
 	// Client is the OAuth 2.0 Client that initiated the request.
 	Client *client.Client `json:"client"`
 
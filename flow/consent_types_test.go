@@ -4,7 +4,9 @@
 package flow
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -66,3 +68,55 @@ func TestRequestDeniedError(t *testing.T) {
 	require.NoError(t, err)
 	assert.EqualValues(t, "{}", fmt.Sprintf("%v", v))
 }
+
+func TestToDeviceUserError(t *testing.T) {
+	t.Run("case=access denied", func(t *testing.T) {
+		e := &RequestDeniedError{
+			Name:        fosite.ErrAccessDenied.ErrorField,
+			Description: "The user denied the device login.",
+			Hint:        "Try again on the device.",
+			Code:        http.StatusForbidden,
+			Debug:       "rejected by policy 1234",
+			Valid:       true,
+		}
+		assert.Equal(t, &DeviceUserError{
+			Code:        "access_denied",
+			Description: "The user denied the device login.",
+			Hint:        "Try again on the device.",
+		}, e.ToDeviceUserError())
+		assert.Equal(t, http.StatusForbidden, e.Code, "the error must not be modified")
+
+		body, err := json.Marshal(e.ToDeviceUserError())
+		require.NoError(t, err)
+		assert.NotContains(t, string(body), "policy 1234")
+	})
+
+	t.Run("case=defaults", func(t *testing.T) {
+		e := &RequestDeniedError{Valid: true}
+		assert.Equal(t, &DeviceUserError{
+			Code:        "request_denied",
+			Description: "The device login was denied.",
+		}, e.ToDeviceUserError())
+		assert.Empty(t, e.Name, "the error must not be modified")
+	})
+
+	t.Run("case=generic error", func(t *testing.T) {
+		e := &RequestDeniedError{
+			Name:        "database_unavailable",
+			Description: "Unable to connect to db.internal:5432.",
+			Hint:        "Check the connection pool.",
+			Code:        http.StatusInternalServerError,
+			Debug:       "dial tcp: connection refused",
+			Valid:       true,
+		}
+		assert.Equal(t, &DeviceUserError{
+			Code:        fosite.ErrServerError.ErrorField,
+			Description: fosite.ErrServerError.DescriptionField,
+		}, e.ToDeviceUserError())
+	})
+
+	t.Run("case=no error", func(t *testing.T) {
+		assert.Nil(t, (*RequestDeniedError)(nil).ToDeviceUserError())
+		assert.Nil(t, (&RequestDeniedError{Name: "access_denied"}).ToDeviceUserError())
+	})
+}
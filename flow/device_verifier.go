@@ -0,0 +1,75 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package flow
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ory/x/randx"
+)
+
+const (
+	// DeviceVerifierMinLength is the minimum length of device flow verifiers
+	// and CSRF tokens.
+	DeviceVerifierMinLength = 32
+
+	// deviceVerifierMinDistinct is the minimum number of distinct characters
+	// of device flow verifiers and CSRF tokens, which rejects repetitive
+	// values such as "aaaa...".
+	deviceVerifierMinDistinct = 8
+
+	// deviceVerifierLength is the length of generated verifiers. With 62
+	// possible characters it carries about 238 bits of entropy, while fitting
+	// into the VARCHAR(40) device_verifier and device_csrf columns.
+	deviceVerifierLength = 40
+)
+
+var deviceVerifierCharSet = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+
+// WeakDeviceVerifierError is returned when a device flow verifier or CSRF
+// token does not carry enough entropy.
+type WeakDeviceVerifierError struct {
+	// Field is the name of the rejected value, e.g. "verifier" or "csrf".
+	Field string
+	// Reason explains why the value was rejected.
+	Reason string
+}
+
+func (e *WeakDeviceVerifierError) Error() string {
+	return fmt.Sprintf("the device flow %s is too weak: %s", e.Field, e.Reason)
+}
+
+// NewDeviceVerifier generates a random value which passes
+// ValidateDeviceVerifier and can be used as device flow verifier or CSRF token.
+func NewDeviceVerifier() (string, error) {
+	v, err := randx.RuneSequence(deviceVerifierLength, deviceVerifierCharSet)
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+// ValidateDeviceVerifier rejects device flow verifiers and CSRF tokens which are
+// too short, contain characters outside of the URL-safe alphabet
+// [A-Za-z0-9_-], or are too repetitive to be unguessable. The field is used in
+// the returned *WeakDeviceVerifierError.
+func ValidateDeviceVerifier(field, value string) error {
+	if len(value) < DeviceVerifierMinLength {
+		return &WeakDeviceVerifierError{Field: field, Reason: fmt.Sprintf("it must be at least %d characters long", DeviceVerifierMinLength)}
+	}
+
+	distinct := make(map[rune]struct{})
+	for _, c := range value {
+		if !strings.ContainsRune(string(deviceVerifierCharSet), c) && c != '-' && c != '_' {
+			return &WeakDeviceVerifierError{Field: field, Reason: "it may only contain the characters A-Z, a-z, 0-9, '-' and '_'"}
+		}
+		distinct[c] = struct{}{}
+	}
+	if len(distinct) < deviceVerifierMinDistinct {
+		return &WeakDeviceVerifierError{Field: field, Reason: fmt.Sprintf("it must contain at least %d distinct characters", deviceVerifierMinDistinct)}
+	}
+
+	return nil
+}
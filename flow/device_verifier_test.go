@@ -0,0 +1,54 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package flow
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDeviceVerifier(t *testing.T) {
+	seen := map[string]struct{}{}
+	for i := 0; i < 100; i++ {
+		v, err := NewDeviceVerifier()
+		require.NoError(t, err)
+		require.NoError(t, ValidateDeviceVerifier("verifier", v))
+		require.LessOrEqual(t, len(v), 40, "generated verifiers must fit into the database columns")
+
+		_, ok := seen[v]
+		require.False(t, ok, "generated verifiers must be unique")
+		seen[v] = struct{}{}
+	}
+}
+
+func TestValidateDeviceVerifier(t *testing.T) {
+	for _, v := range []string{
+		"d1b3f5c7e9a24680b2c4d6e8f0a1b3c5",
+		"Xq3_Lm9-Zt7pRw2yVb8nKc4hJd6sFg1eA0uTo5iE",
+	} {
+		t.Run("case=accepts "+v, func(t *testing.T) {
+			assert.NoError(t, ValidateDeviceVerifier("verifier", v))
+		})
+	}
+
+	for _, tc := range []struct {
+		name, value string
+	}{
+		{"empty", ""},
+		{"too short", "d1b3f5c7e9a24680b2c4d6e8f0a1b3c"},
+		{"invalid characters", "d1b3f5c7e9a24680b2c4d6e8f0a1b3c5!"},
+		{"not URL safe", "d1b3f5c7e9a24680b2c4d6e8f0a1b3c5/"},
+		{"repetitive", strings.Repeat("abc", 20)},
+	} {
+		t.Run("case=rejects "+tc.name, func(t *testing.T) {
+			err := ValidateDeviceVerifier("csrf", tc.value)
+			var weak *WeakDeviceVerifierError
+			require.ErrorAs(t, err, &weak)
+			assert.Equal(t, "csrf", weak.Field)
+		})
+	}
+}
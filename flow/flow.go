@@ -5,12 +5,14 @@ package flow
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/gobuffalo/pop/v6"
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 
+	"github.com/ory/fosite"
 	"github.com/ory/hydra/v2/aead"
 	"github.com/ory/hydra/v2/client"
 	"github.com/ory/hydra/v2/oauth2/flowctx"
@@ -36,6 +38,14 @@ import (
 //	CONSENT_UNUSED --> CONSENT_UNUSED
 //	CONSENT_UNUSED --> CONSENT_USED
 //	CONSENT_UNUSED --> CONSENT_ERROR
+//
+// Device flows are never stored in one of the DeviceFlowState* states: they are
+// encoded into the device challenge and verifier, and a flow is only persisted
+// once its consent has been used. The state check constraint on
+// hydra_oauth2_flow rejects these states, so persisted device flows are in one
+// of the login or consent states. A device flow which erred before that is not
+// persisted at all, while persisted flows which erred are kept for
+// ttl.device_flow_error before they are flushed.
 const (
 	// FlowStateLoginInitialized applies before the login app either
 	// accepts or rejects the login request.
@@ -87,6 +97,16 @@ const (
 	FlowStateConsentError = int16(129)
 )
 
+// isDeviceFlowState reports whether the state is one of the DeviceFlowState*
+// states.
+func isDeviceFlowState(state int16) bool {
+	switch state {
+	case DeviceFlowStateInitialized, DeviceFlowStateUnused, DeviceFlowStateUsed, DeviceFlowStateError:
+		return true
+	}
+	return false
+}
+
 // Flow is an abstraction used in the persistence layer to unify LoginRequest,
 // HandledLoginRequest, ConsentRequest, and AcceptOAuth2ConsentRequest.
 //
@@ -237,6 +257,8 @@ type Flow struct {
 	DeviceHandledAt sqlxx.NullTime `db:"device_handled_at"`
 	// DeviceError contains any error that happened during the handling of the device flow
 	DeviceError *RequestDeniedError `db:"device_error"`
+	// RequestedACR contains the acr_values requested by the OAuth 2.0 Client in the device authorization request
+	RequestedACR sqlxx.StringSliceJSONFormat `db:"requested_acr"`
 
 	// ConsentChallengeID is the identifier ("authorization challenge") of the consent authorization request. It is used to
 	// identify the session.
@@ -288,6 +310,7 @@ func NewDeviceFlow(r *DeviceUserAuthRequest) *Flow {
 		RequestedAt:       r.RequestedAt,
 		RequestedScope:    r.RequestedScope,
 		RequestedAudience: r.RequestedAudience,
+		RequestedACR:      r.RequestedACR,
 		DeviceWasUsed:     sqlxx.NullBool{Bool: r.WasHandled, Valid: true},
 		DeviceHandledAt:   r.HandledAt,
 		State:             DeviceFlowStateInitialized,
@@ -309,11 +332,23 @@ func (f *Flow) GetDeviceUserAuthRequest() *DeviceUserAuthRequest {
 		RequestedAt:       f.RequestedAt,
 		RequestedScope:    f.RequestedScope,
 		RequestedAudience: f.RequestedAudience,
+		RequestedACR:      f.RequestedACR,
 		WasHandled:        f.DeviceWasUsed.Bool,
 		HandledAt:         f.DeviceHandledAt,
 	}
 }
 
+// DeviceTimeToHandle returns how long the user took from the initialization of
+// the device flow until its user code verification was handled, and whether
+// it was handled at all.
+func (f *Flow) DeviceTimeToHandle() (time.Duration, bool) {
+	handledAt := time.Time(f.DeviceHandledAt)
+	if f.DeviceChallengeID == "" || handledAt.IsZero() {
+		return 0, false
+	}
+	return handledAt.Sub(f.RequestedAt), true
+}
+
 // GetHandledDeviceUserAuthRequest return the HandledDeviceUserAuthRequest from a Flow.
 func (f *Flow) GetHandledDeviceUserAuthRequest() *HandledDeviceUserAuthRequest {
 	return &HandledDeviceUserAuthRequest{
@@ -321,16 +356,57 @@ func (f *Flow) GetHandledDeviceUserAuthRequest() *HandledDeviceUserAuthRequest {
 		Client:              f.Client,
 		Request:             f.GetDeviceUserAuthRequest(),
 		DeviceCodeRequestID: f.DeviceCodeRequestID.String(),
+		Subject:             f.Subject,
 		RequestURL:          f.RequestURL,
 		RequestedAt:         f.RequestedAt,
 		RequestedScope:      f.RequestedScope,
 		RequestedAudience:   f.RequestedAudience,
+		RequestedACR:        f.RequestedACR,
 		WasHandled:          f.DeviceWasUsed.Bool,
 		HandledAt:           f.DeviceHandledAt,
 		Error:               f.DeviceError,
 	}
 }
 
+// HandledAtSkewTolerance is how far the HandledAt of a handled device user auth
+// request may lie in the future, to allow for clock skew between Hydra and the
+// caller.
+const HandledAtSkewTolerance = 5 * time.Second
+
+// HandledAtInFutureError is returned by CheckHandledAt when a handled device
+// user auth request claims to have been handled in the future. It unwraps to
+// fosite.ErrInvalidRequest.
+type HandledAtInFutureError struct {
+	// HandledAt is the rejected time.
+	HandledAt time.Time
+	// Now is the time of the server when the request was rejected.
+	Now time.Time
+}
+
+func (e *HandledAtInFutureError) Error() string {
+	return fmt.Sprintf("the device user auth request claims to have been handled at %s, which is after %s", e.HandledAt.UTC(), e.Now.UTC())
+}
+
+func (e *HandledAtInFutureError) Unwrap() error {
+	return fosite.ErrInvalidRequest.WithHint("The device user auth request must not have been handled in the future.")
+}
+
+// CheckHandledAt guards against HandledAt lying in the future, which would
+// skew analytics and lifespans computed from it. If it is more than
+// HandledAtSkewTolerance after now, it is set to now, or a
+// *HandledAtInFutureError is returned if reject is set.
+func (h *HandledDeviceUserAuthRequest) CheckHandledAt(now time.Time, reject bool) error {
+	handledAt := time.Time(h.HandledAt)
+	if !handledAt.After(now.Add(HandledAtSkewTolerance)) {
+		return nil
+	}
+	if reject {
+		return &HandledAtInFutureError{HandledAt: handledAt, Now: now}
+	}
+	h.HandledAt = sqlxx.NullTime(now)
+	return nil
+}
+
 // HandleDeviceUserAuthRequest updates the flows fields from a handled request.
 func (f *Flow) HandleDeviceUserAuthRequest(h *HandledDeviceUserAuthRequest) error {
 	if f.DeviceWasUsed.Bool {
@@ -352,29 +428,111 @@ func (f *Flow) HandleDeviceUserAuthRequest(h *HandledDeviceUserAuthRequest) erro
 	f.Client = h.Client
 	f.ClientID = h.Client.GetID()
 	f.DeviceCodeRequestID = sqlxx.NullString(h.DeviceCodeRequestID)
+	// The subject is usually only known after the login, which sets it then.
+	if h.Subject != "" {
+		f.Subject = h.Subject
+	}
 	f.DeviceHandledAt = h.HandledAt
-	f.DeviceWasUsed = sqlxx.NullBool{Bool: h.WasHandled, Valid: true}
+	// The flow is marked as handled regardless of what the caller claims, so
+	// that the same flow can never be handled twice.
+	f.DeviceWasUsed = sqlxx.NullBool{Bool: true, Valid: true}
 	f.RequestedScope = h.RequestedScope
 	f.RequestedAudience = h.RequestedAudience
+	f.RequestedACR = h.RequestedACR
 	f.DeviceError = h.Error
 
 	return nil
 }
 
 // InvalidateDeviceRequest shifts the flow state to DeviceFlowStateUsed. This
-// transition is executed upon device completion.
-func (f *Flow) InvalidateDeviceRequest() error {
+// transition is executed upon device completion. Flows which expired at
+// expiresAt can no longer be completed and fail with x.ErrDeviceFlowExpired.
+// A zero expiresAt does not expire the flow.
+func (f *Flow) InvalidateDeviceRequest(expiresAt time.Time) error {
 	if f.State != DeviceFlowStateUnused && f.State != DeviceFlowStateError {
 		return errors.Errorf("invalid flow state: expected %d or %d, got %d", DeviceFlowStateUnused, DeviceFlowStateError, f.State)
 	}
-	if f.DeviceWasUsed.Bool {
-		return errors.New("device verifier has already been used")
+	if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return errors.WithStack(fosite.ErrDeviceExpiredToken.WithWrap(x.ErrDeviceFlowExpired).WithDebugf("The device flow expired at %s.", expiresAt.UTC().Format(time.RFC3339)))
 	}
+	// DeviceWasUsed is already set once the request was handled, so the state
+	// is what guards against using the device verifier twice.
 	f.DeviceWasUsed = sqlxx.NullBool{Bool: true, Valid: true}
 	f.State = DeviceFlowStateUsed
 	return nil
 }
 
+// ValidateDeviceState checks that the state of the flow agrees with whether
+// its device user auth request was handled: device flows are handled in every
+// state but DeviceFlowStateInitialized, including the login and consent states
+// they continue with, and flows without a device challenge are never handled
+// as device flows. It catches transitions which update only one of the two.
+//
+// Until their consent verifier is used, device flows are not written to the
+// database but encoded into their challenges and verifiers, so the check runs
+// whenever a device challenge or verifier is encoded as well as in BeforeSave.
+func (f *Flow) ValidateDeviceState() error {
+	wasHandled := f.DeviceWasUsed.Bool
+	switch {
+	case f.DeviceChallengeID == "":
+		if wasHandled || isDeviceFlowState(f.State) {
+			return errors.Errorf("invalid flow state: flow without device challenge is in state %d with device_was_used=%t", f.State, wasHandled)
+		}
+	case f.State == DeviceFlowStateInitialized:
+		if wasHandled {
+			return errors.Errorf("invalid flow state: device flow in state %d must not be handled yet", f.State)
+		}
+	default:
+		if !wasHandled {
+			return errors.Errorf("invalid flow state: device flow in state %d must have been handled", f.State)
+		}
+	}
+	return nil
+}
+
+// DeviceFlowNotReadyError is returned by CanIssueTokens when tokens must not
+// be issued for a device flow yet, or not at all. It unwraps to the OAuth 2.0
+// error to report to the client.
+type DeviceFlowNotReadyError struct {
+	// Reason explains why no tokens may be issued.
+	Reason string
+
+	cause *fosite.RFC6749Error
+}
+
+func (e *DeviceFlowNotReadyError) Error() string {
+	return "tokens cannot be issued for the device flow: " + e.Reason
+}
+
+func (e *DeviceFlowNotReadyError) Unwrap() error {
+	return e.cause
+}
+
+// CanIssueTokens returns nil if the device flow was completed and tokens may be
+// issued for its device code: the user code was verified, login and consent
+// were accepted, and the flow was requested less than lifespan ago. Otherwise, it returns a *DeviceFlowNotReadyError.
+func (f *Flow) CanIssueTokens(lifespan time.Duration) error {
+	if f.State == DeviceFlowStateError || f.DeviceError.IsError() {
+		return &DeviceFlowNotReadyError{Reason: "the user code verification was rejected", cause: fosite.ErrAccessDenied}
+	}
+	if f.State == FlowStateLoginError || f.LoginError.IsError() {
+		return &DeviceFlowNotReadyError{Reason: "the login request was rejected", cause: fosite.ErrAccessDenied}
+	}
+	if f.State == FlowStateConsentError || f.ConsentError.IsError() {
+		return &DeviceFlowNotReadyError{Reason: "the consent request was rejected", cause: fosite.ErrAccessDenied}
+	}
+	if !f.DeviceWasUsed.Bool || time.Time(f.DeviceHandledAt).IsZero() || f.DeviceCodeRequestID == "" {
+		return &DeviceFlowNotReadyError{Reason: "the user code was not verified", cause: fosite.ErrInvalidRequest}
+	}
+	if f.State != FlowStateConsentUnused && f.State != FlowStateConsentUsed {
+		return &DeviceFlowNotReadyError{Reason: fmt.Sprintf("expected flow state %d or %d, got %d", FlowStateConsentUnused, FlowStateConsentUsed, f.State), cause: fosite.ErrInvalidRequest}
+	}
+	if f.RequestedAt.Add(lifespan).Before(time.Now()) {
+		return &DeviceFlowNotReadyError{Reason: "the device code expired", cause: fosite.ErrDeviceExpiredToken}
+	}
+	return nil
+}
+
 func NewFlow(r *LoginRequest) *Flow {
 	return &Flow{
 		ID:                     r.ID,
@@ -606,6 +764,9 @@ func (Flow) TableName() string {
 }
 
 func (f *Flow) BeforeSave(_ *pop.Connection) error {
+	if err := f.ValidateDeviceState(); err != nil {
+		return err
+	}
 	if f.Client != nil {
 		f.ClientID = f.Client.GetID()
 	}
@@ -636,14 +797,38 @@ type CipherProvider interface {
 	FlowCipher() *aead.XChaCha20Poly1305
 }
 
-// ToDeviceChallenge converts the flow into a device challenge.
-func (f *Flow) ToDeviceChallenge(ctx context.Context, cipherProvider CipherProvider) (string, error) {
-	return flowctx.Encode(ctx, cipherProvider.FlowCipher(), f, flowctx.AsDeviceChallenge)
+// ErrFlowTooLargeForCookie is wrapped by the error returned when an encoded
+// device challenge or verifier exceeds the configured maximum size.
+var ErrFlowTooLargeForCookie = errors.New("the encoded flow is too large to be transported in cookies and URLs")
+
+// ToDeviceChallenge converts the flow into a device challenge. If maxSize is
+// positive, device challenges longer than maxSize bytes are rejected.
+func (f *Flow) ToDeviceChallenge(ctx context.Context, cipherProvider CipherProvider, maxSize int) (string, error) {
+	return f.toDeviceToken(ctx, cipherProvider, maxSize, flowctx.AsDeviceChallenge)
+}
+
+// ToDeviceVerifier converts the flow into a device verifier. If maxSize is
+// positive, device verifiers longer than maxSize bytes are rejected.
+func (f *Flow) ToDeviceVerifier(ctx context.Context, cipherProvider CipherProvider, maxSize int) (string, error) {
+	return f.toDeviceToken(ctx, cipherProvider, maxSize, flowctx.AsDeviceVerifier)
 }
 
-// ToDeviceVerifier converts the flow into a device verifier.
-func (f *Flow) ToDeviceVerifier(ctx context.Context, cipherProvider CipherProvider) (string, error) {
-	return flowctx.Encode(ctx, cipherProvider.FlowCipher(), f, flowctx.AsDeviceVerifier)
+func (f *Flow) toDeviceToken(ctx context.Context, cipherProvider CipherProvider, maxSize int, purpose flowctx.CodecOption) (string, error) {
+	if err := f.ValidateDeviceState(); err != nil {
+		return "", err
+	}
+	encoded, err := flowctx.Encode(ctx, cipherProvider.FlowCipher(), f, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	if maxSize > 0 && len(encoded) > maxSize {
+		return "", errors.WithStack(fosite.ErrServerError.
+			WithWrap(ErrFlowTooLargeForCookie).
+			WithHintf("The device flow encodes to %d bytes, but at most %d bytes are allowed.", len(encoded), maxSize).
+			WithDebug("Device flows are encoded into their challenges and verifiers and cannot be stored by handle in the database. Reduce the size of the flow, e.g. of the OAuth 2.0 Client's metadata or of the requested scopes and audiences, or raise the maximum flow size of the device authorization grant, or set it to 0 to disable the limit if the browsers and proxies in front of Ory Hydra accept larger cookies and URLs."))
+	}
+	return encoded, nil
 }
 
 // ToLoginChallenge converts the flow into a login challenge.
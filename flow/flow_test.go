@@ -4,14 +4,31 @@
 package flow
 
 import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-faker/faker/v4"
+	"github.com/gofrs/uuid"
 	"github.com/mohae/deepcopy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/v2/aead"
+	"github.com/ory/hydra/v2/client"
+	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/hydra/v2/x"
+	"github.com/ory/x/configx"
+	"github.com/ory/x/logrusx"
 	"github.com/ory/x/sqlxx"
 )
 
@@ -98,6 +115,7 @@ func (f *Flow) setDeviceRequest(r *DeviceUserAuthRequest) {
 	f.RequestedAt = r.RequestedAt
 	f.RequestedScope = r.RequestedScope
 	f.RequestedAudience = r.RequestedAudience
+	f.RequestedACR = r.RequestedACR
 	f.DeviceWasUsed = sqlxx.NullBool{Bool: r.WasHandled, Valid: true}
 	f.DeviceHandledAt = r.HandledAt
 }
@@ -109,9 +127,11 @@ func (f *Flow) setHandledDeviceRequest(r *HandledDeviceUserAuthRequest) {
 	f.RequestedAt = r.RequestedAt
 	f.RequestedScope = r.RequestedScope
 	f.RequestedAudience = r.RequestedAudience
+	f.RequestedACR = r.RequestedACR
 	f.DeviceError = r.Error
 	f.RequestedAt = r.RequestedAt
 	f.DeviceCodeRequestID = sqlxx.NullString(r.DeviceCodeRequestID)
+	f.Subject = r.Subject
 	f.DeviceWasUsed = sqlxx.NullBool{Bool: r.WasHandled, Valid: true}
 	f.DeviceHandledAt = r.HandledAt
 }
@@ -171,10 +191,248 @@ func TestFlow_HandleDeviceUserAuthRequest(t *testing.T) {
 			actual := f.GetHandledDeviceUserAuthRequest()
 			assert.NotEqual(t, r.RequestedAt, actual.RequestedAt)
 			r.Request = f.GetDeviceUserAuthRequest()
+			r.WasHandled = true
 			actual.RequestedAt = r.RequestedAt
 			assert.Equal(t, r, *actual)
 		},
 	)
+
+	t.Run(
+		"HandleDeviceUserAuthRequest should mark the flow as handled and reject a second call",
+		func(t *testing.T) {
+			f := Flow{}
+			assert.NoError(t, faker.FakeData(&f))
+			f.State = DeviceFlowStateInitialized
+			f.DeviceWasUsed = sqlxx.NullBool{Bool: false, Valid: true}
+
+			r := HandledDeviceUserAuthRequest{}
+			assert.NoError(t, faker.FakeData(&r))
+			r.ID = f.DeviceChallengeID.String()
+			r.Error = nil
+			r.WasHandled = false
+
+			require.NoError(t, f.HandleDeviceUserAuthRequest(&r))
+			assert.True(t, f.DeviceWasUsed.Bool)
+			assert.Equal(t, DeviceFlowStateUnused, f.State)
+
+			r.WasHandled = false
+			err := f.HandleDeviceUserAuthRequest(&r)
+			require.Error(t, err)
+			assert.ErrorIs(t, err, x.ErrConflict)
+		},
+	)
+
+	t.Run(
+		"InvalidateDeviceRequest should succeed once after the flow was handled",
+		func(t *testing.T) {
+			f := Flow{}
+			assert.NoError(t, faker.FakeData(&f))
+			f.State = DeviceFlowStateInitialized
+			f.DeviceWasUsed = sqlxx.NullBool{Bool: false, Valid: true}
+
+			r := HandledDeviceUserAuthRequest{}
+			assert.NoError(t, faker.FakeData(&r))
+			r.ID = f.DeviceChallengeID.String()
+			r.Error = nil
+
+			require.NoError(t, f.HandleDeviceUserAuthRequest(&r))
+			require.NoError(t, f.InvalidateDeviceRequest(time.Time{}))
+			assert.Equal(t, DeviceFlowStateUsed, f.State)
+			assert.Error(t, f.InvalidateDeviceRequest(time.Time{}))
+		},
+	)
+
+	t.Run(
+		"InvalidateDeviceRequest should fail once the flow expired",
+		func(t *testing.T) {
+			newFlow := func(t *testing.T) *Flow {
+				f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge"})
+				require.NoError(t, f.HandleDeviceUserAuthRequest(&HandledDeviceUserAuthRequest{ID: "challenge", Client: &client.Client{ID: "client"}}))
+				require.Equal(t, DeviceFlowStateUnused, f.State)
+				return f
+			}
+
+			f := newFlow(t)
+			require.NoError(t, f.InvalidateDeviceRequest(time.Now().Add(time.Minute)))
+			assert.Equal(t, DeviceFlowStateUsed, f.State)
+
+			f = newFlow(t)
+			err := f.InvalidateDeviceRequest(time.Now().Add(-time.Minute))
+			assert.ErrorIs(t, err, x.ErrDeviceFlowExpired)
+			assert.ErrorIs(t, err, fosite.ErrDeviceExpiredToken)
+			assert.Equal(t, DeviceFlowStateUnused, f.State, "expired flows are not completed")
+		},
+	)
+}
+
+func TestFlow_DeviceRequestedACR(t *testing.T) {
+	acr := sqlxx.StringSliceJSONFormat{"urn:example:loa:2", "urn:example:loa:3"}
+
+	f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge", Client: &client.Client{ID: "client"}, RequestedACR: acr})
+	assert.Equal(t, acr, f.RequestedACR)
+	assert.Equal(t, acr, f.GetDeviceUserAuthRequest().RequestedACR)
+
+	handled := &HandledDeviceUserAuthRequest{
+		ID:           "challenge",
+		Client:       f.Client,
+		RequestedACR: sqlxx.StringSliceJSONFormat{"urn:example:loa:1"},
+	}
+	require.NoError(t, f.HandleDeviceUserAuthRequest(handled))
+	assert.Equal(t, handled.RequestedACR, f.RequestedACR)
+
+	actual := f.GetHandledDeviceUserAuthRequest()
+	assert.Equal(t, handled.RequestedACR, actual.RequestedACR)
+	assert.Equal(t, handled.RequestedACR, actual.Request.RequestedACR)
+}
+
+type cipherProvider struct {
+	c *config.DefaultProvider
+}
+
+func (p *cipherProvider) FlowCipher() *aead.XChaCha20Poly1305 {
+	return aead.NewXChaCha20Poly1305(p.c)
+}
+
+func TestFlow_ToDeviceChallengeSize(t *testing.T) {
+	ctx := context.Background()
+	c := config.MustNew(ctx, logrusx.New("", ""), configx.SkipValidation())
+	c.MustSet(ctx, config.KeyGetSystemSecret, []string{"0123456789abcdef0123456789abcdef"})
+	deps := &cipherProvider{c: c}
+
+	// The limit is disabled by default.
+	assert.Zero(t, c.GetDeviceAuthMaxFlowSize(ctx))
+
+	f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge", Client: &client.Client{ID: "client"}})
+	// Random scopes do not compress, so they inflate the encoded flow.
+	for i := 0; i < 100; i++ {
+		f.RequestedScope = append(f.RequestedScope, uuid.Must(uuid.NewV4()).String())
+	}
+
+	challenge, err := f.ToDeviceChallenge(ctx, deps, 0)
+	require.NoError(t, err)
+	limit := len(challenge) - 1
+
+	for name, encode := range map[string]func(context.Context, CipherProvider, int) (string, error){
+		"challenge": f.ToDeviceChallenge,
+		"verifier":  f.ToDeviceVerifier,
+	} {
+		t.Run("case="+name, func(t *testing.T) {
+			_, err := encode(ctx, deps, limit)
+			assert.ErrorIs(t, err, ErrFlowTooLargeForCookie)
+			assert.ErrorIs(t, err, fosite.ErrServerError)
+			assert.Contains(t, fosite.ErrorToRFC6749Error(err).HintField, fmt.Sprintf("at most %d bytes", limit))
+			assert.Contains(t, fosite.ErrorToRFC6749Error(err).DebugField, "maximum flow size")
+
+			_, err = encode(ctx, deps, limit+1)
+			assert.NoError(t, err)
+
+			// A limit of 0 disables the check.
+			_, err = encode(ctx, deps, 0)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestFlow_CanIssueTokens(t *testing.T) {
+	lifespan := 15 * time.Minute
+	newCompletedFlow := func() *Flow {
+		return &Flow{
+			DeviceChallengeID:   "device-challenge",
+			DeviceCodeRequestID: "device-code-request",
+			DeviceWasUsed:       sqlxx.NullBool{Bool: true, Valid: true},
+			DeviceHandledAt:     sqlxx.NullTime(time.Now()),
+			RequestedAt:         time.Now(),
+			State:               FlowStateConsentUsed,
+		}
+	}
+
+	t.Run("case=completed flows may issue tokens", func(t *testing.T) {
+		f := newCompletedFlow()
+		assert.NoError(t, f.CanIssueTokens(lifespan))
+
+		f.State = FlowStateConsentUnused
+		assert.NoError(t, f.CanIssueTokens(lifespan))
+	})
+
+	for _, tc := range []struct {
+		name     string
+		modify   func(f *Flow)
+		expected error
+	}{
+		{
+			name:     "device error state",
+			modify:   func(f *Flow) { f.State = DeviceFlowStateError },
+			expected: fosite.ErrAccessDenied,
+		},
+		{
+			name:     "device error",
+			modify:   func(f *Flow) { f.DeviceError = &RequestDeniedError{Name: "access_denied", Valid: true} },
+			expected: fosite.ErrAccessDenied,
+		},
+		{
+			name:     "login error",
+			modify:   func(f *Flow) { f.State = FlowStateLoginError },
+			expected: fosite.ErrAccessDenied,
+		},
+		{
+			name: "consent error",
+			modify: func(f *Flow) {
+				f.State = FlowStateConsentError
+				f.ConsentError = &RequestDeniedError{Name: "access_denied", Valid: true}
+			},
+			expected: fosite.ErrAccessDenied,
+		},
+		{
+			name:     "user code not verified",
+			modify:   func(f *Flow) { f.DeviceWasUsed = sqlxx.NullBool{Bool: false, Valid: true} },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "user code not handled",
+			modify:   func(f *Flow) { f.DeviceHandledAt = sqlxx.NullTime{} },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "device code request missing",
+			modify:   func(f *Flow) { f.DeviceCodeRequestID = "" },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "device flow unused",
+			modify:   func(f *Flow) { f.State = DeviceFlowStateUnused },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "device flow used",
+			modify:   func(f *Flow) { f.State = DeviceFlowStateUsed },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "login unused",
+			modify:   func(f *Flow) { f.State = FlowStateLoginUnused },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "consent initialized",
+			modify:   func(f *Flow) { f.State = FlowStateConsentInitialized },
+			expected: fosite.ErrInvalidRequest,
+		},
+		{
+			name:     "expired",
+			modify:   func(f *Flow) { f.RequestedAt = time.Now().Add(-lifespan - time.Minute) },
+			expected: fosite.ErrDeviceExpiredToken,
+		},
+	} {
+		t.Run("case="+tc.name, func(t *testing.T) {
+			f := newCompletedFlow()
+			tc.modify(f)
+
+			err := f.CanIssueTokens(lifespan)
+			var notReady *DeviceFlowNotReadyError
+			require.ErrorAs(t, err, &notReady)
+			assert.ErrorIs(t, err, tc.expected)
+		})
+	}
 }
 
 func TestFlow_GetLoginRequest(t *testing.T) {
@@ -356,3 +614,187 @@ func TestFlow_GetHandledConsentRequest(t *testing.T) {
 		assert.Equal(t, expected, *actual)
 	})
 }
+
+// declaredFlowStates returns the values of the FlowState* and DeviceFlowState*
+// constants declared in flow.go, keyed by name, so that new states are checked
+// without having to be listed anywhere.
+func declaredFlowStates(t *testing.T) map[string]int64 {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "flow.go", nil, 0)
+	require.NoError(t, err)
+
+	isState := func(name string) bool {
+		return strings.HasPrefix(name, "FlowState") || strings.HasPrefix(name, "DeviceFlowState")
+	}
+
+	// Only the declarations of the states are type checked, as they do not
+	// depend on any imports.
+	decls := &ast.File{Name: f.Name}
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.CONST && slices.ContainsFunc(d.Specs, func(s ast.Spec) bool {
+			return slices.ContainsFunc(s.(*ast.ValueSpec).Names, func(n *ast.Ident) bool { return isState(n.Name) })
+		}) {
+			decls.Decls = append(decls.Decls, d)
+		}
+	}
+	pkg, err := new(types.Config).Check("flow", fset, []*ast.File{decls}, nil)
+	require.NoError(t, err)
+
+	states := make(map[string]int64)
+	for _, name := range pkg.Scope().Names() {
+		if !isState(name) {
+			continue
+		}
+		value, ok := constant.Int64Val(pkg.Scope().Lookup(name).(*types.Const).Val())
+		require.Truef(t, ok, "state %s is not an integer", name)
+		states[name] = value
+	}
+	return states
+}
+
+func TestFlowStates(t *testing.T) {
+	states := declaredFlowStates(t)
+	require.Equal(t, int64(DeviceFlowStateInitialized), states["DeviceFlowStateInitialized"])
+	require.Equal(t, int64(FlowStateConsentError), states["FlowStateConsentError"])
+
+	// Login, consent, and device flow states share the state column of
+	// hydra_oauth2_flow, so no two states may have the same value.
+	sorted := make([]string, 0, len(states))
+	for name := range states {
+		sorted = append(sorted, name)
+	}
+	slices.Sort(sorted)
+	names := make(map[int64]string, len(states))
+	for _, name := range sorted {
+		if other, ok := names[states[name]]; ok {
+			t.Errorf("flow states %s and %s share the value %d", other, name, states[name])
+		}
+		names[states[name]] = name
+	}
+
+	for name, value := range states {
+		assert.Equalf(t, strings.HasPrefix(name, "DeviceFlowState"), isDeviceFlowState(int16(value)), "isDeviceFlowState(%s)", name)
+	}
+}
+
+func TestFlow_DeviceTimeToHandle(t *testing.T) {
+	requestedAt := time.Now().UTC().Round(time.Second)
+
+	t.Run("case=not handled", func(t *testing.T) {
+		f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge", RequestedAt: requestedAt})
+		d, ok := f.DeviceTimeToHandle()
+		assert.False(t, ok)
+		assert.Zero(t, d)
+	})
+
+	t.Run("case=handled", func(t *testing.T) {
+		f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge", RequestedAt: requestedAt})
+		require.NoError(t, f.HandleDeviceUserAuthRequest(&HandledDeviceUserAuthRequest{
+			ID:        "challenge",
+			Client:    &client.Client{ID: "client"},
+			HandledAt: sqlxx.NullTime(requestedAt.Add(90 * time.Second)),
+		}))
+		d, ok := f.DeviceTimeToHandle()
+		assert.True(t, ok)
+		assert.Equal(t, 90*time.Second, d)
+	})
+
+	t.Run("case=not a device flow", func(t *testing.T) {
+		f := &Flow{RequestedAt: requestedAt, DeviceHandledAt: sqlxx.NullTime(requestedAt.Add(time.Minute))}
+		_, ok := f.DeviceTimeToHandle()
+		assert.False(t, ok)
+	})
+}
+
+func TestFlow_ValidateDeviceState(t *testing.T) {
+	handled := sqlxx.NullBool{Bool: true, Valid: true}
+	for _, tc := range []struct {
+		name       string
+		challenge  sqlxx.NullString
+		state      int16
+		wasHandled sqlxx.NullBool
+		valid      bool
+	}{
+		{name: "initialized", challenge: "device", state: DeviceFlowStateInitialized, valid: true},
+		{name: "unused", challenge: "device", state: DeviceFlowStateUnused, wasHandled: handled, valid: true},
+		{name: "used", challenge: "device", state: DeviceFlowStateUsed, wasHandled: handled, valid: true},
+		{name: "error", challenge: "device", state: DeviceFlowStateError, wasHandled: handled, valid: true},
+		{name: "continued with login", challenge: "device", state: FlowStateLoginInitialized, wasHandled: handled, valid: true},
+		{name: "continued with consent", challenge: "device", state: FlowStateConsentUsed, wasHandled: handled, valid: true},
+		{name: "login flow", state: FlowStateLoginInitialized, valid: true},
+		{name: "consent flow", state: FlowStateConsentUsed, valid: true},
+
+		{name: "initialized but handled", challenge: "device", state: DeviceFlowStateInitialized, wasHandled: handled},
+		{name: "unused but not handled", challenge: "device", state: DeviceFlowStateUnused},
+		{name: "used but not handled", challenge: "device", state: DeviceFlowStateUsed},
+		{name: "error but not handled", challenge: "device", state: DeviceFlowStateError},
+		{name: "continued with consent but not handled", challenge: "device", state: FlowStateConsentUsed},
+		{name: "device state without challenge", state: DeviceFlowStateUnused, wasHandled: handled},
+		{name: "handled without challenge", state: FlowStateConsentUsed, wasHandled: handled},
+	} {
+		t.Run("case="+tc.name, func(t *testing.T) {
+			f := &Flow{DeviceChallengeID: tc.challenge, State: tc.state, DeviceWasUsed: tc.wasHandled}
+			if tc.valid {
+				assert.NoError(t, f.ValidateDeviceState())
+			} else {
+				assert.Error(t, f.ValidateDeviceState())
+			}
+		})
+	}
+
+	t.Run("case=transitions keep the flow valid", func(t *testing.T) {
+		f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge"})
+		require.NoError(t, f.ValidateDeviceState())
+		require.NoError(t, f.HandleDeviceUserAuthRequest(&HandledDeviceUserAuthRequest{ID: "challenge", Client: &client.Client{ID: "client"}}))
+		require.NoError(t, f.ValidateDeviceState())
+		require.NoError(t, f.InvalidateDeviceRequest(time.Time{}))
+		require.NoError(t, f.ValidateDeviceState())
+	})
+
+	t.Run("case=invalid flows are not saved", func(t *testing.T) {
+		f := NewDeviceFlow(&DeviceUserAuthRequest{ID: "challenge"})
+		f.DeviceWasUsed = handled
+		assert.Error(t, f.BeforeSave(nil))
+	})
+}
+
+func TestHandledDeviceUserAuthRequest_CheckHandledAt(t *testing.T) {
+	now := time.Now().UTC().Round(time.Second)
+
+	for _, tc := range []struct {
+		name      string
+		handledAt time.Time
+		clamped   bool
+	}{
+		{name: "past", handledAt: now.Add(-time.Hour)},
+		{name: "present", handledAt: now},
+		{name: "within skew tolerance", handledAt: now.Add(HandledAtSkewTolerance)},
+		{name: "future", handledAt: now.Add(time.Hour), clamped: true},
+	} {
+		t.Run("case="+tc.name, func(t *testing.T) {
+			t.Run("mode=clamp", func(t *testing.T) {
+				h := &HandledDeviceUserAuthRequest{HandledAt: sqlxx.NullTime(tc.handledAt)}
+				require.NoError(t, h.CheckHandledAt(now, false))
+				if tc.clamped {
+					assert.Equal(t, now, time.Time(h.HandledAt))
+				} else {
+					assert.Equal(t, tc.handledAt, time.Time(h.HandledAt))
+				}
+			})
+
+			t.Run("mode=reject", func(t *testing.T) {
+				h := &HandledDeviceUserAuthRequest{HandledAt: sqlxx.NullTime(tc.handledAt)}
+				err := h.CheckHandledAt(now, true)
+				if !tc.clamped {
+					require.NoError(t, err)
+					return
+				}
+				var e *HandledAtInFutureError
+				require.ErrorAs(t, err, &e)
+				assert.Equal(t, tc.handledAt, e.HandledAt)
+				assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+				assert.Equal(t, tc.handledAt, time.Time(h.HandledAt))
+			})
+		})
+	}
+}
@@ -5,12 +5,12 @@ package fositex
 
 import (
 	"context"
-	"strings"
 
 	"github.com/ory/fosite"
 	foauth2 "github.com/ory/fosite/handler/oauth2"
 	"github.com/ory/hydra/v2/client"
 	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/hydra/v2/x"
 )
 
 var _ foauth2.CoreStrategy = (*TokenStrategy)(nil)
@@ -37,7 +37,7 @@ func (t TokenStrategy) gs(ctx context.Context, additionalSources ...config.Acces
 }
 
 func (t TokenStrategy) AccessTokenSignature(_ context.Context, token string) string {
-	return genericSignature(token)
+	return x.TokenSignature(token)
 }
 
 func (t TokenStrategy) GenerateAccessToken(ctx context.Context, requester fosite.Requester) (token string, signature string, err error) {
@@ -75,14 +75,3 @@ func (t TokenStrategy) ValidateAuthorizeCode(ctx context.Context, requester fosi
 func withRequester(requester fosite.Requester) config.AccessTokenStrategySource {
 	return client.AccessTokenStrategySource(requester.GetClient())
 }
-
-func genericSignature(token string) string {
-	switch parts := strings.Split(token, "."); len(parts) {
-	case 2:
-		return parts[1]
-	case 3:
-		return parts[2]
-	default:
-		return ""
-	}
-}
@@ -10,6 +10,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/ory/fosite/handler/oauth2"
+	"github.com/ory/hydra/v2/x"
 )
 
 // Test that the generic signature function implements the same signature as the
@@ -29,7 +30,7 @@ func TestAccessTokenSignature(t *testing.T) {
 			t.Run("case="+tc.token, func(t *testing.T) {
 				assert.Equal(t,
 					strategy.AccessTokenSignature(ctx, tc.token),
-					genericSignature(tc.token))
+					x.TokenSignature(tc.token))
 			})
 		}
 	})
@@ -45,7 +46,7 @@ func TestAccessTokenSignature(t *testing.T) {
 			t.Run("case="+tc.token, func(t *testing.T) {
 				assert.Equal(t,
 					strategy.AccessTokenSignature(ctx, tc.token),
-					genericSignature(tc.token))
+					x.TokenSignature(tc.token))
 			})
 		}
 	})
@@ -0,0 +1,106 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package oauth2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/hydra/v2/flow"
+	"github.com/ory/hydra/v2/x"
+	"github.com/ory/x/errorsx"
+
+	"github.com/ory/fosite"
+)
+
+// DeviceCompletionHookRequest is the request body sent to the device completion
+// hook.
+//
+// swagger:ignore
+type DeviceCompletionHookRequest struct {
+	// DeviceChallenge is the challenge of the approved device flow.
+	DeviceChallenge string `json:"device_challenge"`
+	// ClientID is the identifier of the OAuth 2.0 client.
+	ClientID string `json:"client_id"`
+	// Subject is the identifier of the authenticated end-user.
+	Subject string `json:"subject"`
+}
+
+// DeviceCompletionHook is called once the user approved a device flow.
+type DeviceCompletionHook func(ctx context.Context, f *flow.Flow) error
+
+// DeviceCompletionWebhook is a DeviceCompletionHook which notifies the
+// configured device completion hook endpoint, if any. Any 2xx response counts
+// as success, and the response body is ignored.
+func DeviceCompletionWebhook(reg interface {
+	config.Provider
+	x.HTTPClientProvider
+}) DeviceCompletionHook {
+	return func(ctx context.Context, f *flow.Flow) error {
+		hookConfig := reg.Config().DeviceCompletionHookConfig(ctx)
+		if hookConfig == nil {
+			return nil
+		}
+		return executeDeviceCompletionHook(ctx, reg, hookConfig, f)
+	}
+}
+
+func executeDeviceCompletionHook(ctx context.Context, reg x.HTTPClientProvider, hookConfig *config.HookConfig, f *flow.Flow) error {
+	reqBodyBytes, err := json.Marshal(&DeviceCompletionHookRequest{
+		DeviceChallenge: f.DeviceChallengeID.String(),
+		ClientID:        f.Client.GetID(),
+		Subject:         f.Subject,
+	})
+	if err != nil {
+		return errorsx.WithStack(
+			fosite.ErrServerError.
+				WithWrap(err).
+				WithDescription("An error occurred while encoding the device completion hook.").
+				WithDebugf("Unable to encode the device completion hook body: %s", err),
+		)
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, hookConfig.URL, bytes.NewReader(reqBodyBytes))
+	if err != nil {
+		return errorsx.WithStack(
+			fosite.ErrServerError.
+				WithWrap(err).
+				WithDescription("An error occurred while preparing the device completion hook.").
+				WithDebugf("Unable to prepare the HTTP Request: %s", err),
+		)
+	}
+	if err := applyAuth(req, hookConfig.Auth); err != nil {
+		return errorsx.WithStack(
+			fosite.ErrServerError.
+				WithWrap(err).
+				WithDescription("An error occurred while applying the device completion hook authentication.").
+				WithDebugf("Unable to apply the device completion hook authentication: %s", err))
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+
+	resp, err := reg.HTTPClient(ctx).Do(req)
+	if err != nil {
+		return errorsx.WithStack(
+			fosite.ErrServerError.
+				WithWrap(err).
+				WithDescription("An error occurred while executing the device completion hook.").
+				WithDebugf("Unable to execute HTTP Request: %s", err),
+		)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errorsx.WithStack(
+			fosite.ErrServerError.
+				WithDescription("The device completion hook target responded with an error.").
+				WithDebugf("Device completion hook responded with HTTP status code: %s", resp.Status),
+		)
+	}
+	return nil
+}
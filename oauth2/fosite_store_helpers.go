@@ -8,15 +8,20 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ory/hydra/v2/driver/config"
 	"github.com/ory/hydra/v2/flow"
 	"github.com/ory/hydra/v2/jwk"
 
 	"github.com/go-jose/go-jose/v3"
 	"github.com/gobuffalo/pop/v6"
 	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/ory/fosite/handler/rfc7523"
 
@@ -34,6 +39,7 @@ import (
 
 	"github.com/ory/fosite"
 	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
 	"github.com/ory/x/sqlcon"
 
 	"github.com/ory/hydra/v2/client"
@@ -43,11 +49,17 @@ func signatureFromJTI(jti string) string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(jti)))
 }
 
+// BlacklistedJTI is a JTI that must not be used again until it expires. Only
+// the SHA-256 hash of the JTI is persisted, so the table does not reveal the
+// JTIs themselves.
 type BlacklistedJTI struct {
 	JTI    string         `db:"-"`
 	ID     string         `db:"signature"`
 	Expiry time.Time      `db:"expires_at"`
 	NID    gofrsuuid.UUID `db:"nid"`
+	// ClientID is the client whose assertion used the JTI, if known, see
+	// DeleteClientAssertionJWTsByClient.
+	ClientID sqlxx.NullString `db:"client_id"`
 }
 
 func (j *BlacklistedJTI) AfterFind(_ *pop.Connection) error {
@@ -184,14 +196,38 @@ func TestHelperRunner(t *testing.T, store InternalRegistry, k string) {
 
 	}
 	t.Run(fmt.Sprintf("case=testHelperCreateGetDeleteAuthorizeCodes/db=%s", k), testHelperCreateGetDeleteAuthorizeCodes(store))
+	t.Run(fmt.Sprintf("case=testHelperAuthorizeCodeReuseMetric/db=%s", k), testHelperAuthorizeCodeReuseMetric(store))
+	t.Run(fmt.Sprintf("case=testHelperInvalidateAuthorizeCodeSessionsByRequestIDs/db=%s", k), testHelperInvalidateAuthorizeCodeSessionsByRequestIDs(store))
+	t.Run(fmt.Sprintf("case=testHelperRefreshTokenExpiry/db=%s", k), testHelperRefreshTokenExpiry(store))
+	t.Run(fmt.Sprintf("case=testHelperReduceRefreshTokenScope/db=%s", k), testHelperReduceRefreshTokenScope(store))
 	t.Run(fmt.Sprintf("case=testHelperCreateGetDeleteAccessTokenSession/db=%s", k), testHelperCreateGetDeleteAccessTokenSession(store))
 	t.Run(fmt.Sprintf("case=testHelperNilAccessToken/db=%s", k), testHelperNilAccessToken(store))
+	t.Run(fmt.Sprintf("case=testHelperDuplicateSignature/db=%s", k), testHelperDuplicateSignature(store))
 	t.Run(fmt.Sprintf("case=testHelperCreateGetDeleteOpenIDConnectSession/db=%s", k), testHelperCreateGetDeleteOpenIDConnectSession(store))
+	t.Run(fmt.Sprintf("case=testHelperSignatureNormalization/db=%s", k), testHelperSignatureNormalization(store))
+	t.Run(fmt.Sprintf("case=testHelperUpdateOpenIDConnectSessionByRequestID/db=%s", k), testHelperUpdateOpenIDConnectSessionByRequestID(store))
+	t.Run(fmt.Sprintf("case=testHelperUpsertOpenIDConnectSession/db=%s", k), testHelperUpsertOpenIDConnectSession(store))
 	t.Run(fmt.Sprintf("case=testHelperCreateGetDeleteRefreshTokenSession/db=%s", k), testHelperCreateGetDeleteRefreshTokenSession(store))
 	t.Run(fmt.Sprintf("case=testHelperRevokeRefreshToken/db=%s", k), testHelperRevokeRefreshToken(store))
+	t.Run(fmt.Sprintf("case=testHelperInvalidateRefreshTokenBySignature/db=%s", k), testHelperInvalidateRefreshTokenBySignature(store))
+	t.Run(fmt.Sprintf("case=testHelperRotateRefreshToken/db=%s", k), testHelperRotateRefreshToken(store))
+	t.Run(fmt.Sprintf("case=testHelperIsNonceUsed/db=%s", k), testHelperIsNonceUsed(store))
+	t.Run(fmt.Sprintf("case=testHelperGetActiveTokensByGrantedScope/db=%s", k), testHelperGetActiveTokensByGrantedScope(store))
+	t.Run(fmt.Sprintf("case=testHelperCheckIntrospectionAudience/db=%s", k), testHelperCheckIntrospectionAudience(store))
+	t.Run(fmt.Sprintf("case=testHelperRevokeDeviceGrantedTokens/db=%s", k), testHelperRevokeDeviceGrantedTokens(store))
+	t.Run(fmt.Sprintf("case=testHelperRevokeTokensByAMR/db=%s", k), testHelperRevokeTokensByAMR(store))
+	t.Run(fmt.Sprintf("case=testHelperGetLatestAccessTokenSession/db=%s", k), testHelperGetLatestAccessTokenSession(store))
+	t.Run(fmt.Sprintf("case=testHelperRevokeSessionForLogout/db=%s", k), testHelperRevokeSessionForLogout(store))
+	t.Run(fmt.Sprintf("case=testHelperRevokeSessionsBySID/db=%s", k), testHelperRevokeSessionsBySID(store))
+	t.Run(fmt.Sprintf("case=testHelperIsAuthTimeWithin/db=%s", k), testHelperIsAuthTimeWithin(store))
 	t.Run(fmt.Sprintf("case=testHelperCreateGetDeletePKCERequestSession/db=%s", k), testHelperCreateGetDeletePKCERequestSession(store))
+	t.Run(fmt.Sprintf("case=testHelperCheckDevicePollAllowed/db=%s", k), testHelperCheckDevicePollAllowed(store))
+	t.Run(fmt.Sprintf("case=testHelperConsumeUserCodeSession/db=%s", k), testHelperConsumeUserCodeSession(store))
+	t.Run(fmt.Sprintf("case=testHelperDeleteExpiredUserCodeSessions/db=%s", k), testHelperDeleteExpiredUserCodeSessions(store))
 	t.Run(fmt.Sprintf("case=testHelperFlushTokens/db=%s", k), testHelperFlushTokens(store, time.Hour))
 	t.Run(fmt.Sprintf("case=testHelperFlushTokensWithLimitAndBatchSize/db=%s", k), testHelperFlushTokensWithLimitAndBatchSize(store, 3, 2))
+	t.Run(fmt.Sprintf("case=testHelperFlushTokensWithTimeBudget/db=%s", k), testHelperFlushTokensWithTimeBudget(store))
+	t.Run(fmt.Sprintf("case=testHelperFlushTokensWithMinAge/db=%s", k), testHelperFlushTokensWithMinAge(store))
 	t.Run(fmt.Sprintf("case=testFositeStoreSetClientAssertionJWT/db=%s", k), testFositeStoreSetClientAssertionJWT(store))
 	t.Run(fmt.Sprintf("case=testFositeStoreClientAssertionJWTValid/db=%s", k), testFositeStoreClientAssertionJWTValid(store))
 	t.Run(fmt.Sprintf("case=testHelperDeleteAccessTokens/db=%s", k), testHelperDeleteAccessTokens(store))
@@ -251,6 +287,195 @@ func testHelperCreateGetDeleteOpenIDConnectSession(x InternalRegistry) func(t *t
 	}
 }
 
+func testHelperUpsertOpenIDConnectSession(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		updated := func(requestID string) *fosite.Request {
+			r := createTestRequest(requestID)
+			r.GrantedScope = fosite.Arguments{"openid", "offline"}
+			r.GrantedAudience = fosite.Arguments{"ad3"}
+			r.Session = &Session{DefaultSession: &openid.DefaultSession{Subject: "upserted"}}
+			return r
+		}
+
+		assertUpserted := func(t *testing.T, requestID string) {
+			res, err := m.GetOpenIDConnectSessionByRequestID(ctx, requestID, &Session{})
+			require.NoError(t, err)
+			assert.Equal(t, requestID, res.GetID())
+			assert.Equal(t, fosite.Arguments{"openid", "offline"}, res.GetGrantedScopes())
+			assert.Equal(t, fosite.Arguments{"ad3"}, res.GetGrantedAudience())
+			assert.Equal(t, "upserted", res.GetSession().GetSubject())
+		}
+
+		t.Run("case=updates existing session", func(t *testing.T) {
+			requestID, signature := uuid.New(), uuid.New()
+			require.NoError(t, m.CreateOpenIDConnectSession(ctx, signature, createTestRequest(requestID)))
+
+			require.NoError(t, m.UpsertOpenIDConnectSession(ctx, requestID, updated(requestID)))
+			assertUpserted(t, requestID)
+
+			// The existing session was updated in place.
+			res, err := m.GetOpenIDConnectSession(ctx, signature, &fosite.Request{Session: &Session{}})
+			require.NoError(t, err)
+			assert.Equal(t, "upserted", res.GetSession().GetSubject())
+		})
+
+		t.Run("case=creates missing session", func(t *testing.T) {
+			requestID := uuid.New()
+			require.NoError(t, m.UpsertOpenIDConnectSession(ctx, requestID, updated(requestID)))
+			assertUpserted(t, requestID)
+
+			// Upserting again updates the created session.
+			require.NoError(t, m.UpsertOpenIDConnectSession(ctx, requestID, updated(requestID)))
+			assertUpserted(t, requestID)
+		})
+	}
+}
+
+func testHelperUpdateOpenIDConnectSessionByRequestID(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		t.Run("case=update is persisted", func(t *testing.T) {
+			requestID := uuid.New()
+			require.NoError(t, m.CreateOpenIDConnectSession(ctx, uuid.New(), createTestRequest(requestID)))
+
+			updated := createTestRequest(requestID)
+			updated.GrantedScope = fosite.Arguments{"openid", "offline"}
+			updated.GrantedAudience = fosite.Arguments{"ad3"}
+			updated.Session = &Session{DefaultSession: &openid.DefaultSession{Subject: "updated"}}
+			require.NoError(t, m.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, updated))
+
+			// Updating with the same values again is no error.
+			require.NoError(t, m.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, updated))
+
+			res, err := m.GetOpenIDConnectSessionByRequestID(ctx, requestID, &Session{})
+			require.NoError(t, err)
+			assert.Equal(t, requestID, res.GetID())
+			assert.Equal(t, updated.GrantedScope, res.GetGrantedScopes())
+			assert.Equal(t, updated.GrantedAudience, res.GetGrantedAudience())
+			assert.Equal(t, "updated", res.GetSession().GetSubject())
+		})
+
+		t.Run("case=update erasing the granted scopes", func(t *testing.T) {
+			create := func(t *testing.T) (string, *fosite.Request) {
+				requestID := uuid.New()
+				require.NoError(t, m.CreateOpenIDConnectSession(ctx, uuid.New(), createTestRequest(requestID)))
+				erased := createTestRequest(requestID)
+				erased.GrantedScope = fosite.Arguments{}
+				return requestID, erased
+			}
+
+			t.Run("mode=guarded", func(t *testing.T) {
+				requestID, erased := create(t)
+				err := m.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, erased)
+				assert.ErrorIs(t, err, fosite.ErrServerError)
+				assert.ErrorIs(t, err, x.ErrGrantedScopeErasure)
+
+				res, err := m.GetOpenIDConnectSessionByRequestID(ctx, requestID, &Session{})
+				require.NoError(t, err)
+				assert.Equal(t, createTestRequest(requestID).GrantedScope, res.GetGrantedScopes())
+			})
+
+			t.Run("mode=allowed", func(t *testing.T) {
+				reg.Config().MustSet(ctx, config.KeyAllowGrantedScopeErasure, true)
+				t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAllowGrantedScopeErasure, false) })
+
+				requestID, erased := create(t)
+				require.NoError(t, m.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, erased))
+
+				res, err := m.GetOpenIDConnectSessionByRequestID(ctx, requestID, &Session{})
+				require.NoError(t, err)
+				assert.Empty(t, res.GetGrantedScopes())
+			})
+		})
+
+		t.Run("case=update without matching session fails", func(t *testing.T) {
+			requestID := uuid.New()
+			err := m.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, createTestRequest(requestID))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+			_, err = m.GetOpenIDConnectSessionByRequestID(ctx, requestID, &Session{})
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	}
+}
+
+func testHelperSignatureNormalization(x InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := x.OAuth2Storage()
+		ctx := context.Background()
+
+		for _, tc := range []struct {
+			name   string
+			create func(ctx context.Context, signature string, r fosite.Requester) error
+			get    func(ctx context.Context, signature string, s fosite.Session) (fosite.Requester, error)
+		}{
+			{name: "access", create: m.CreateAccessTokenSession, get: m.GetAccessTokenSession},
+			{name: "refresh", create: m.CreateRefreshTokenSession, get: m.GetRefreshTokenSession},
+			{name: "code", create: m.CreateAuthorizeCodeSession, get: m.GetAuthorizeCodeSession},
+		} {
+			t.Run("table="+tc.name, func(t *testing.T) {
+				id := strings.ReplaceAll(uuid.New(), "-", "")
+				stored := id + "-_x"
+				require.NoError(t, tc.create(ctx, stored, createTestRequest(id)))
+
+				for _, equivalent := range []string{stored, id + "+/x", id + "-_x==", id + "+/x="} {
+					res, err := tc.get(ctx, equivalent, &Session{})
+					require.NoError(t, err, equivalent)
+					assert.Equal(t, id, res.GetID())
+				}
+
+				// Signatures are case-sensitive: a different case encodes different bytes.
+				_, err := tc.get(ctx, strings.ToUpper(stored), &Session{})
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
+		}
+	}
+}
+
+func testHelperReduceRefreshTokenScope(x InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := x.OAuth2Storage()
+		ctx := context.Background()
+
+		create := func(t *testing.T) (string, string) {
+			requestID, signature := uuid.New(), uuid.New()
+			r := createTestRequest(requestID)
+			r.GrantedScope = fosite.Arguments{"openid", "offline", "email", "profile"}
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, signature, r))
+			return requestID, signature
+		}
+
+		t.Run("case=removes the given scopes", func(t *testing.T) {
+			requestID, signature := create(t)
+			require.NoError(t, m.ReduceRefreshTokenScope(ctx, requestID, []string{"email", "profile", "unknown"}))
+
+			res, err := m.GetRefreshTokenSession(ctx, signature, &Session{})
+			require.NoError(t, err)
+			assert.Equal(t, fosite.Arguments{"openid", "offline"}, res.GetGrantedScopes())
+			assert.Equal(t, fosite.Arguments{"fa", "ba"}, res.GetRequestedScopes())
+		})
+
+		t.Run("case=revokes the refresh token if no scope remains", func(t *testing.T) {
+			requestID, signature := create(t)
+			require.NoError(t, m.ReduceRefreshTokenScope(ctx, requestID, []string{"openid", "offline", "email", "profile"}))
+
+			_, err := m.GetRefreshTokenSession(ctx, signature, &Session{})
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+			assert.ErrorIs(t, m.ReduceRefreshTokenScope(ctx, requestID, []string{"email"}), fosite.ErrNotFound)
+		})
+
+		t.Run("case=unknown request", func(t *testing.T) {
+			assert.ErrorIs(t, m.ReduceRefreshTokenScope(ctx, uuid.New(), []string{"email"}), fosite.ErrNotFound)
+		})
+	}
+}
+
 func testHelperCreateGetDeleteRefreshTokenSession(x InternalRegistry) func(t *testing.T) {
 	return func(t *testing.T) {
 		m := x.OAuth2Storage()
@@ -322,6 +547,655 @@ func testHelperRevokeRefreshToken(x InternalRegistry) func(t *testing.T) {
 	}
 }
 
+func testHelperInvalidateRefreshTokenBySignature(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		requestID := uuid.New()
+		mockRequestForeignKey(t, requestID, m, false)
+		signature, sibling := uuid.New(), uuid.New()
+		for _, sig := range []string{signature, sibling} {
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, sig, &fosite.Request{
+				ID:          requestID,
+				Client:      &client.Client{ID: "foobar"},
+				RequestedAt: time.Now().UTC().Round(time.Second),
+				Session:     &Session{},
+			}))
+		}
+
+		t.Run("case=active", func(t *testing.T) {
+			require.NoError(t, store.InvalidateRefreshTokenBySignature(ctx, signature))
+
+			req, err := store.GetRefreshTokenSession(ctx, signature, &Session{})
+			assert.NotNil(t, req, "the refresh token is kept for audit")
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+			_, err = store.GetRefreshTokenSession(ctx, sibling, &Session{})
+			assert.NoError(t, err, "other refresh tokens of the same request stay active")
+		})
+
+		t.Run("case=already inactive", func(t *testing.T) {
+			assert.NoError(t, store.InvalidateRefreshTokenBySignature(ctx, signature))
+		})
+
+		t.Run("case=missing", func(t *testing.T) {
+			assert.ErrorIs(t, store.InvalidateRefreshTokenBySignature(ctx, uuid.New()), fosite.ErrNotFound)
+		})
+	}
+}
+
+func testHelperRotateRefreshToken(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		requestID := uuid.New()
+		mockRequestForeignKey(t, requestID, m, false)
+		newRequest := func(subject string) *fosite.Request {
+			r := createTestRequest(requestID)
+			r.Session = NewSession(subject)
+			return r
+		}
+		oldSignature := uuid.New()
+		require.NoError(t, store.CreateRefreshTokenSession(ctx, oldSignature, newRequest("old")))
+
+		t.Run("case=rotates the refresh token", func(t *testing.T) {
+			newSignature := uuid.New()
+			old, err := store.RotateRefreshToken(ctx, oldSignature, newSignature, newRequest("new"))
+			require.NoError(t, err)
+			assert.Equal(t, requestID, old.GetID())
+			assert.Equal(t, "old", old.GetSession().GetSubject())
+
+			_, err = store.GetRefreshTokenSession(ctx, oldSignature, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+			rotated, err := store.GetRefreshTokenSession(ctx, newSignature, NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, requestID, rotated.GetID(), "the new refresh token belongs to the same request")
+			assert.Equal(t, "new", rotated.GetSession().GetSubject())
+
+			oldSignature = newSignature
+		})
+
+		t.Run("case=rejects used refresh tokens", func(t *testing.T) {
+			used := uuid.New()
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, used, newRequest("used")))
+			require.NoError(t, store.InvalidateRefreshTokenBySignature(ctx, used))
+
+			newSignature := uuid.New()
+			_, err := store.RotateRefreshToken(ctx, used, newSignature, newRequest("new"))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+			_, err = store.GetRefreshTokenSession(ctx, newSignature, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=rejects unknown refresh tokens", func(t *testing.T) {
+			_, err := store.RotateRefreshToken(ctx, uuid.New(), uuid.New(), newRequest("new"))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=is atomic", func(t *testing.T) {
+			// Rotating onto an existing signature fails to store the new
+			// refresh token, which must roll back the deactivation.
+			taken := uuid.New()
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, taken, newRequest("taken")))
+
+			_, err := store.RotateRefreshToken(ctx, oldSignature, taken, newRequest("new"))
+			require.Error(t, err)
+
+			_, err = store.GetRefreshTokenSession(ctx, oldSignature, NewSession(""))
+			assert.NoError(t, err, "the old refresh token is still active")
+		})
+
+		t.Run("case=limits the chain length", func(t *testing.T) {
+			m.Config().MustSet(ctx, config.KeyRefreshTokenMaxChainLength, 2)
+			t.Cleanup(func() { m.Config().MustSet(ctx, config.KeyRefreshTokenMaxChainLength, 0) })
+
+			// The chain is linked through the request ID, so it must not
+			// share the request ID of the other cases.
+			chainRequestID := uuid.New()
+			mockRequestForeignKey(t, chainRequestID, m, false)
+			newChainRequest := func() *fosite.Request {
+				r := createTestRequest(chainRequestID)
+				r.Session = NewSession("chain")
+				return r
+			}
+
+			signature := uuid.New()
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, signature, newChainRequest()))
+			for i := 0; i < 2; i++ {
+				rotated := uuid.New()
+				_, err := store.RotateRefreshToken(ctx, signature, rotated, newChainRequest())
+				require.NoError(t, err, "rotation %d", i+1)
+				signature = rotated
+			}
+
+			rotated := uuid.New()
+			_, err := store.RotateRefreshToken(ctx, signature, rotated, newChainRequest())
+			var chainErr *x.RefreshTokenChainLengthError
+			require.ErrorAs(t, err, &chainErr)
+			assert.Equal(t, 2, chainErr.Limit)
+			assert.ErrorIs(t, err, fosite.ErrInvalidGrant)
+
+			_, err = store.GetRefreshTokenSession(ctx, signature, NewSession(""))
+			assert.NoError(t, err, "the last refresh token of the chain is still active")
+			_, err = store.GetRefreshTokenSession(ctx, rotated, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+			// Raising the limit allows the chain to continue.
+			m.Config().MustSet(ctx, config.KeyRefreshTokenMaxChainLength, 3)
+			_, err = store.RotateRefreshToken(ctx, signature, rotated, newChainRequest())
+			require.NoError(t, err)
+		})
+	}
+}
+
+func testHelperGetActiveTokensByGrantedScope(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		cl := &client.Client{ID: uuid.New()}
+		other := &client.Client{ID: uuid.New()}
+		require.NoError(t, m.ClientManager().CreateClient(ctx, cl))
+		require.NoError(t, m.ClientManager().CreateClient(ctx, other))
+
+		create := func(t *testing.T, c *client.Client, create func(context.Context, string, fosite.Requester) error, scopes ...string) string {
+			r := createTestRequest(uuid.New())
+			r.Client = c
+			r.GrantedScope = scopes
+			require.NoError(t, create(ctx, uuid.New(), r))
+			return r.ID
+		}
+
+		admin := create(t, cl, store.CreateAccessTokenSession, "admin")
+		adminRead := create(t, cl, store.CreateAccessTokenSession, "admin:read")
+		mixed := create(t, cl, store.CreateRefreshTokenSession, "read", "admin", "write")
+		create(t, cl, store.CreateAccessTokenSession, "superadmin", "admins")
+		create(t, other, store.CreateAccessTokenSession, "admin")
+		revoked := create(t, cl, store.CreateRefreshTokenSession, "admin")
+		require.NoError(t, store.RevokeRefreshToken(ctx, revoked))
+
+		for _, tc := range []struct {
+			scope    string
+			expected []string
+		}{
+			{scope: "admin", expected: []string{admin, mixed}},
+			{scope: "admin:read", expected: []string{adminRead}},
+			{scope: "adm"},
+			{scope: "read|admin"},
+		} {
+			t.Run("scope="+tc.scope, func(t *testing.T) {
+				requests, err := store.GetActiveTokensByGrantedScope(ctx, cl.GetID(), tc.scope)
+				require.NoError(t, err)
+
+				var actual []string
+				for _, r := range requests {
+					assert.True(t, r.GetGrantedScopes().Has(tc.scope))
+					actual = append(actual, r.GetID())
+				}
+				assert.ElementsMatch(t, tc.expected, actual)
+			})
+		}
+	}
+}
+
+func testHelperIsNonceUsed(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		used, err := store.IsNonceUsed(ctx, "foobar", "")
+		require.NoError(t, err)
+		assert.False(t, used, "empty nonces are never used")
+
+		t.Run("case=fresh nonce", func(t *testing.T) {
+			used, err := store.IsNonceUsed(ctx, "foobar", uuid.New())
+			require.NoError(t, err)
+			assert.False(t, used)
+		})
+
+		for _, tc := range []struct {
+			name   string
+			create func(ctx context.Context, signature string, r fosite.Requester) error
+		}{
+			{name: "openid", create: store.CreateOpenIDConnectSession},
+			{name: "code", create: store.CreateAuthorizeCodeSession},
+		} {
+			t.Run("case=repeated nonce/session="+tc.name, func(t *testing.T) {
+				nonce := uuid.New()
+				r := createTestRequest(uuid.New())
+				r.Form = url.Values{"nonce": {nonce}}
+				require.NoError(t, tc.create(ctx, uuid.New(), r))
+
+				used, err := store.IsNonceUsed(ctx, "foobar", nonce)
+				require.NoError(t, err)
+				assert.True(t, used)
+
+				used, err = store.IsNonceUsed(ctx, "other-client", nonce)
+				require.NoError(t, err)
+				assert.False(t, used, "nonces are scoped to the client")
+			})
+		}
+
+		t.Run("case=long nonce", func(t *testing.T) {
+			nonce := strings.Repeat(uuid.New(), 32)
+			r := createTestRequest(uuid.New())
+			r.Form = url.Values{"nonce": {nonce}}
+			require.NoError(t, store.CreateOpenIDConnectSession(ctx, uuid.New(), r))
+
+			used, err := store.IsNonceUsed(ctx, "foobar", nonce)
+			require.NoError(t, err)
+			assert.True(t, used)
+		})
+
+		t.Run("case=other tables are not considered", func(t *testing.T) {
+			nonce := uuid.New()
+			r := createTestRequest(uuid.New())
+			r.Form = url.Values{"nonce": {nonce}}
+			require.NoError(t, store.CreateAccessTokenSession(ctx, uuid.New(), r))
+
+			used, err := store.IsNonceUsed(ctx, "foobar", nonce)
+			require.NoError(t, err)
+			assert.False(t, used)
+		})
+	}
+}
+
+func testHelperCheckIntrospectionAudience(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		assert.ErrorIs(t, store.CheckIntrospectionAudience(ctx, "unknown", "rs-a"), fosite.ErrNotFound)
+
+		t.Run("case=unbound tokens may be introspected by anyone", func(t *testing.T) {
+			signature := uuid.New()
+			require.NoError(t, store.CreateAccessTokenSession(ctx, signature, createTestRequest(uuid.New())))
+			assert.NoError(t, store.CheckIntrospectionAudience(ctx, signature, "rs-a"))
+		})
+
+		t.Run("case=bound tokens", func(t *testing.T) {
+			signature := uuid.New()
+			r := createTestRequest(uuid.New())
+			r.Form = url.Values{"introspection_audience": {"rs-a  rs-b"}}
+			require.NoError(t, store.CreateAccessTokenSession(ctx, signature, r))
+
+			assert.NoError(t, store.CheckIntrospectionAudience(ctx, signature, "rs-a"))
+			assert.NoError(t, store.CheckIntrospectionAudience(ctx, signature, "rs-b"))
+
+			for _, rs := range []string{"rs-c", "rs", ""} {
+				err := store.CheckIntrospectionAudience(ctx, signature, rs)
+				var audErr *x.IntrospectionAudienceError
+				require.ErrorAs(t, err, &audErr, "%s", rs)
+				assert.Equal(t, rs, audErr.ResourceServer)
+				assert.ErrorIs(t, err, fosite.ErrRequestForbidden)
+			}
+		})
+	}
+}
+
+func testHelperDuplicateSignature(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		for table, create := range map[string]func(context.Context, string, fosite.Requester) error{
+			"access":  store.CreateAccessTokenSession,
+			"refresh": store.CreateRefreshTokenSession,
+		} {
+			t.Run("table="+table, func(t *testing.T) {
+				signature := uuid.New()
+				r := createTestRequest(uuid.New())
+				require.NoError(t, create(ctx, signature, r))
+
+				// Storing the same request again is not idempotent either.
+				for _, r := range []fosite.Requester{r, createTestRequest(uuid.New())} {
+					err := create(ctx, signature, r)
+					var dupErr *x.DuplicateSignatureError
+					require.ErrorAs(t, err, &dupErr)
+					assert.Equal(t, table, dupErr.Table)
+					assert.ErrorIs(t, err, fosite.ErrServerError)
+				}
+			})
+		}
+	}
+}
+
+func testHelperRevokeDeviceGrantedTokens(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		cl := &client.Client{ID: uuid.New()}
+		require.NoError(t, m.ClientManager().CreateClient(ctx, cl))
+
+		issue := func(grantType fosite.GrantType) (request *fosite.Request, accessSignature, refreshSignature string) {
+			request = createTestRequest(uuid.New())
+			request.Client = cl
+			request.Form = url.Values{"grant_type": {string(grantType)}}
+			accessSignature, refreshSignature = uuid.New(), uuid.New()
+			require.NoError(t, store.CreateAccessTokenSession(ctx, accessSignature, request))
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, refreshSignature, request))
+			return request, accessSignature, refreshSignature
+		}
+
+		device, deviceAccess, deviceRefresh := issue(fosite.GrantTypeDeviceCode)
+		_, codeAccess, codeRefresh := issue(fosite.GrantTypeAuthorizationCode)
+
+		// Refreshing keeps the grant the tokens originate from, which is
+		// carried on the session of the refresh token.
+		original, err := store.GetRefreshTokenSession(ctx, deviceRefresh, NewSession(""))
+		require.NoError(t, err)
+		refreshed := createTestRequest(device.ID)
+		refreshed.Client = cl
+		refreshed.Session = original.GetSession()
+		refreshed.Form = url.Values{"grant_type": {string(fosite.GrantTypeRefreshToken)}}
+		refreshedAccess, refreshedRefresh := uuid.New(), uuid.New()
+		require.NoError(t, store.RevokeAccessToken(ctx, device.ID))
+		_, err = store.RotateRefreshToken(ctx, deviceRefresh, refreshedRefresh, refreshed)
+		require.NoError(t, err)
+		require.NoError(t, store.CreateAccessTokenSession(ctx, refreshedAccess, refreshed))
+
+		require.NoError(t, store.RevokeDeviceGrantedTokens(ctx, cl.ID))
+
+		_, err = store.GetAccessTokenSession(ctx, deviceAccess, NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+		_, err = store.GetAccessTokenSession(ctx, refreshedAccess, NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+		_, err = store.GetRefreshTokenSession(ctx, refreshedRefresh, NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+		_, err = store.GetAccessTokenSession(ctx, codeAccess, NewSession(""))
+		assert.NoError(t, err)
+		_, err = store.GetRefreshTokenSession(ctx, codeRefresh, NewSession(""))
+		assert.NoError(t, err)
+
+		require.NoError(t, store.RevokeDeviceGrantedTokens(ctx, "unknown-client"))
+	}
+}
+
+func testHelperRevokeTokensByAMR(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		cl := &client.Client{ID: uuid.New()}
+		other := &client.Client{ID: uuid.New()}
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, cl))
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, other))
+
+		issue := func(c *client.Client, amr ...string) (accessSignature, refreshSignature string) {
+			request := createTestRequest(uuid.New())
+			request.Client = c
+			request.Session = &Session{DefaultSession: &openid.DefaultSession{
+				Subject: "bar",
+				Claims:  &jwt.IDTokenClaims{AuthenticationMethodsReferences: amr},
+			}}
+			accessSignature, refreshSignature = uuid.New(), uuid.New()
+			require.NoError(t, store.CreateAccessTokenSession(ctx, accessSignature, request))
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, refreshSignature, request))
+			return accessSignature, refreshSignature
+		}
+
+		smsAccess, smsRefresh := issue(cl, "pwd", "sms")
+		pwdAccess, pwdRefresh := issue(cl, "pwd")
+		// "sms_otp" contains "sms", but is a different method.
+		otpAccess, otpRefresh := issue(cl, "sms_otp")
+		noneAccess, noneRefresh := issue(cl)
+		otherAccess, otherRefresh := issue(other, "sms")
+
+		require.NoError(t, store.RevokeTokensByAMR(ctx, cl.GetID(), "sms"))
+
+		_, err := store.GetAccessTokenSession(ctx, smsAccess, NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+		_, err = store.GetRefreshTokenSession(ctx, smsRefresh, NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+		for _, signatures := range [][2]string{{pwdAccess, pwdRefresh}, {otpAccess, otpRefresh}, {noneAccess, noneRefresh}, {otherAccess, otherRefresh}} {
+			_, err = store.GetAccessTokenSession(ctx, signatures[0], NewSession(""))
+			assert.NoError(t, err)
+			_, err = store.GetRefreshTokenSession(ctx, signatures[1], NewSession(""))
+			assert.NoError(t, err)
+		}
+
+		require.NoError(t, store.RevokeTokensByAMR(ctx, cl.GetID(), "unknown-method"))
+		require.NoError(t, store.RevokeTokensByAMR(ctx, "unknown-client", "sms"))
+	}
+}
+
+func testHelperGetLatestAccessTokenSession(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		cl := &client.Client{ID: uuid.New()}
+		other := &client.Client{ID: uuid.New()}
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, cl))
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, other))
+		subject := uuid.New()
+
+		_, err := store.GetLatestAccessTokenSession(ctx, subject, cl.GetID())
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+		issue := func(c *client.Client, subject string, requestedAt time.Time) string {
+			request := createTestRequest(uuid.New())
+			request.Client = c
+			request.RequestedAt = requestedAt
+			request.Session = &Session{DefaultSession: &openid.DefaultSession{Subject: subject}}
+			require.NoError(t, store.CreateAccessTokenSession(ctx, uuid.New(), request))
+			return request.ID
+		}
+
+		now := time.Now().UTC().Round(time.Second)
+		issue(cl, subject, now.Add(-2*time.Hour))
+		latest := issue(cl, subject, now.Add(-time.Hour))
+		issue(cl, subject, now.Add(-3*time.Hour))
+		// Newer tokens of other subjects or clients are ignored.
+		issue(cl, uuid.New(), now)
+		otherLatest := issue(other, subject, now)
+
+		r, err := store.GetLatestAccessTokenSession(ctx, subject, cl.GetID())
+		require.NoError(t, err)
+		assert.Equal(t, latest, r.GetID())
+		assert.Equal(t, now.Add(-time.Hour), r.GetRequestedAt().UTC())
+		assert.Equal(t, subject, r.GetSession().GetSubject())
+
+		r, err = store.GetLatestAccessTokenSession(ctx, subject, other.GetID())
+		require.NoError(t, err)
+		assert.Equal(t, otherLatest, r.GetID())
+	}
+}
+
+func testHelperRevokeSessionForLogout(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		cl := &client.Client{ID: uuid.New()}
+		other := &client.Client{ID: uuid.New()}
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, cl))
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, other))
+
+		type issued struct{ requestID, access, refresh string }
+		issue := func(c *client.Client, subject, sid string) issued {
+			request := createTestRequest(uuid.New())
+			request.Client = c
+			request.Session = &Session{DefaultSession: &openid.DefaultSession{
+				Subject: subject,
+				Claims:  &jwt.IDTokenClaims{Extra: map[string]interface{}{"sid": sid}},
+			}}
+			i := issued{requestID: request.ID, access: uuid.New(), refresh: uuid.New()}
+			require.NoError(t, store.CreateAccessTokenSession(ctx, i.access, request))
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, i.refresh, request))
+			require.NoError(t, store.CreateOpenIDConnectSession(ctx, uuid.New(), request))
+			return i
+		}
+
+		sid := uuid.New()
+		loggedOut := []issued{issue(cl, "bar", sid), issue(cl, "bar", sid)}
+		kept := []issued{
+			issue(cl, "bar", uuid.New()),
+			issue(other, "bar", sid),
+			issue(cl, "other-subject", sid),
+		}
+
+		require.NoError(t, store.RevokeSessionForLogout(ctx, "bar", cl.GetID(), sid))
+
+		for _, i := range loggedOut {
+			_, err := store.GetAccessTokenSession(ctx, i.access, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			_, err = store.GetRefreshTokenSession(ctx, i.refresh, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+			_, err = store.GetOpenIDConnectSessionByRequestID(ctx, i.requestID, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		}
+		for _, i := range kept {
+			_, err := store.GetAccessTokenSession(ctx, i.access, NewSession(""))
+			assert.NoError(t, err)
+			_, err = store.GetRefreshTokenSession(ctx, i.refresh, NewSession(""))
+			assert.NoError(t, err)
+			_, err = store.GetOpenIDConnectSessionByRequestID(ctx, i.requestID, NewSession(""))
+			assert.NoError(t, err)
+		}
+
+		require.NoError(t, store.RevokeSessionForLogout(ctx, "bar", cl.GetID(), "unknown-sid"))
+
+		t.Run("case=a failure after the first table rolls back all tables", func(t *testing.T) {
+			// Deleting the access tokens fails, after the refresh tokens were
+			// revoked already.
+			conn := reg.Persister().Connection(ctx)
+			var inject, remove []string
+			switch conn.Dialect.Name() {
+			case "sqlite3":
+				inject = []string{"CREATE TRIGGER fail_access_delete BEFORE DELETE ON hydra_oauth2_access BEGIN SELECT RAISE(ABORT, 'forced failure'); END"}
+				remove = []string{"DROP TRIGGER fail_access_delete"}
+			case "postgres":
+				inject = []string{
+					"CREATE FUNCTION fail_access_delete() RETURNS trigger AS $$ BEGIN RAISE EXCEPTION 'forced failure'; END $$ LANGUAGE plpgsql",
+					"CREATE TRIGGER fail_access_delete BEFORE DELETE ON hydra_oauth2_access FOR EACH ROW EXECUTE PROCEDURE fail_access_delete()",
+				}
+				remove = []string{"DROP TRIGGER fail_access_delete ON hydra_oauth2_access", "DROP FUNCTION fail_access_delete()"}
+			case "mysql":
+				inject = []string{"CREATE TRIGGER fail_access_delete BEFORE DELETE ON hydra_oauth2_access FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'forced failure'"}
+				remove = []string{"DROP TRIGGER fail_access_delete"}
+			default:
+				t.Skipf("Failures cannot be injected into %s.", conn.Dialect.Name())
+			}
+
+			sid := uuid.New()
+			i := issue(cl, "bar", sid)
+
+			for _, stmt := range inject {
+				require.NoError(t, conn.RawQuery(stmt).Exec())
+			}
+			t.Cleanup(func() {
+				for _, stmt := range remove {
+					require.NoError(t, conn.RawQuery(stmt).Exec())
+				}
+			})
+
+			require.Error(t, store.RevokeSessionForLogout(ctx, "bar", cl.GetID(), sid))
+
+			// No table changed.
+			_, err := store.GetRefreshTokenSession(ctx, i.refresh, NewSession(""))
+			assert.NoError(t, err)
+			_, err = store.GetAccessTokenSession(ctx, i.access, NewSession(""))
+			assert.NoError(t, err)
+			_, err = store.GetOpenIDConnectSessionByRequestID(ctx, i.requestID, NewSession(""))
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func testHelperRevokeSessionsBySID(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		cl := &client.Client{ID: uuid.New()}
+		other := &client.Client{ID: uuid.New()}
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, cl))
+		require.NoError(t, reg.ClientManager().CreateClient(ctx, other))
+
+		type issued struct{ requestID, access, refresh string }
+		issue := func(c *client.Client, sid string) issued {
+			request := createTestRequest(uuid.New())
+			request.Client = c
+			request.Session = &Session{DefaultSession: &openid.DefaultSession{
+				Subject: "bar",
+				Claims:  &jwt.IDTokenClaims{Extra: map[string]interface{}{"sid": sid}},
+			}}
+			i := issued{requestID: request.ID, access: uuid.New(), refresh: uuid.New()}
+			require.NoError(t, store.CreateAccessTokenSession(ctx, i.access, request))
+			require.NoError(t, store.CreateRefreshTokenSession(ctx, i.refresh, request))
+			require.NoError(t, store.CreateOpenIDConnectSession(ctx, uuid.New(), request))
+			return i
+		}
+
+		sid := uuid.New()
+		// The tokens of all clients within the login session are revoked.
+		revoked := []issued{issue(cl, sid), issue(other, sid)}
+		kept := issue(cl, uuid.New())
+
+		require.NoError(t, store.RevokeSessionsBySID(ctx, sid))
+
+		for _, i := range revoked {
+			_, err := store.GetAccessTokenSession(ctx, i.access, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			_, err = store.GetRefreshTokenSession(ctx, i.refresh, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+			_, err = store.GetOpenIDConnectSessionByRequestID(ctx, i.requestID, NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		}
+
+		_, err := store.GetAccessTokenSession(ctx, kept.access, NewSession(""))
+		assert.NoError(t, err)
+		_, err = store.GetRefreshTokenSession(ctx, kept.refresh, NewSession(""))
+		assert.NoError(t, err)
+		_, err = store.GetOpenIDConnectSessionByRequestID(ctx, kept.requestID, NewSession(""))
+		assert.NoError(t, err)
+
+		require.NoError(t, store.RevokeSessionsBySID(ctx, "unknown-sid"))
+	}
+}
+
+func testHelperIsAuthTimeWithin(x InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := x.OAuth2Storage()
+		ctx := context.Background()
+
+		_, err := m.IsAuthTimeWithin(ctx, "auth-time-unknown", time.Hour)
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+		for k, tc := range []struct {
+			authTime time.Time
+			maxAge   time.Duration
+			expected bool
+		}{
+			{authTime: time.Now().Add(-time.Minute), maxAge: time.Hour, expected: true},
+			{authTime: time.Now().Add(-2 * time.Hour), maxAge: time.Hour, expected: false},
+			{authTime: time.Time{}, maxAge: time.Hour, expected: false},
+		} {
+			t.Run(fmt.Sprintf("case=%d", k), func(t *testing.T) {
+				signature := uuid.New()
+				req := createTestRequest(signature)
+				req.Session = &Session{DefaultSession: &openid.DefaultSession{
+					Subject: "bar",
+					Claims:  &jwt.IDTokenClaims{AuthTime: tc.authTime},
+				}}
+				require.NoError(t, m.CreateRefreshTokenSession(ctx, signature, req))
+
+				within, err := m.IsAuthTimeWithin(ctx, signature, tc.maxAge)
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, within)
+			})
+		}
+	}
+}
+
 func testHelperCreateGetDeleteAuthorizeCodes(x InternalRegistry) func(t *testing.T) {
 	return func(t *testing.T) {
 		m := x.OAuth2Storage()
@@ -350,6 +1224,173 @@ func testHelperCreateGetDeleteAuthorizeCodes(x InternalRegistry) func(t *testing
 	}
 }
 
+func testHelperRefreshTokenExpiry(x InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := x.OAuth2Storage()
+		ctx := context.Background()
+
+		x.Config().MustSet(ctx, config.KeyRefreshTokenSlidingLifespan, time.Hour)
+		x.Config().MustSet(ctx, config.KeyRefreshTokenAbsoluteLifespan, 2*time.Hour)
+		t.Cleanup(func() {
+			x.Config().MustSet(ctx, config.KeyRefreshTokenSlidingLifespan, 0)
+			x.Config().MustSet(ctx, config.KeyRefreshTokenAbsoluteLifespan, 0)
+		})
+
+		type expiry struct {
+			Sliding  time.Time `db:"sliding_expires_at"`
+			Absolute time.Time `db:"absolute_expires_at"`
+		}
+		getExpiry := func(t *testing.T, signature string) (e expiry) {
+			require.NoError(t, x.Persister().Connection(ctx).RawQuery(
+				"SELECT sliding_expires_at, absolute_expires_at FROM hydra_oauth2_refresh WHERE signature = ?", signature,
+			).First(&e))
+			return e
+		}
+		setExpiry := func(t *testing.T, signature string, e expiry) {
+			require.NoError(t, x.Persister().Connection(ctx).RawQuery(
+				"UPDATE hydra_oauth2_refresh SET sliding_expires_at = ?, absolute_expires_at = ? WHERE signature = ?", e.Sliding, e.Absolute, signature,
+			).Exec())
+		}
+		// refresh mimics fosite's refresh flow: the old token is revoked and a
+		// new one is issued for the same request.
+		refresh := func(t *testing.T, requestID string) string {
+			signature := uuid.New()
+			require.NoError(t, m.RevokeRefreshToken(ctx, requestID))
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, signature, createTestRequest(requestID)))
+			return signature
+		}
+
+		t.Run("case=sliding expiry is extended within the absolute cap", func(t *testing.T) {
+			requestID := uuid.New()
+			first := uuid.New()
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, first, createTestRequest(requestID)))
+			initial := getExpiry(t, first)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), initial.Sliding, time.Minute)
+			assert.WithinDuration(t, time.Now().Add(2*time.Hour), initial.Absolute, time.Minute)
+
+			// Pretend the first token was issued 30 minutes ago.
+			setExpiry(t, first, expiry{Sliding: initial.Sliding.Add(-30 * time.Minute), Absolute: initial.Absolute.Add(-30 * time.Minute)})
+			second := refresh(t, requestID)
+			extended := getExpiry(t, second)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), extended.Sliding, time.Minute)
+			assert.WithinDuration(t, initial.Absolute.Add(-30*time.Minute), extended.Absolute, time.Second)
+
+			_, err := m.GetRefreshTokenSession(ctx, second, &Session{})
+			require.NoError(t, err)
+
+			// Close to the absolute cap, the sliding expiry is capped.
+			capped := time.Now().UTC().Add(10 * time.Minute)
+			setExpiry(t, second, expiry{Sliding: extended.Sliding, Absolute: capped})
+			third := refresh(t, requestID)
+			actual := getExpiry(t, third)
+			assert.WithinDuration(t, capped, actual.Sliding, time.Second)
+			assert.WithinDuration(t, capped, actual.Absolute, time.Second)
+		})
+
+		t.Run("case=rejects tokens past the sliding expiry", func(t *testing.T) {
+			signature := uuid.New()
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, signature, createTestRequest(uuid.New())))
+			setExpiry(t, signature, expiry{Sliding: time.Now().UTC().Add(-time.Minute), Absolute: time.Now().UTC().Add(time.Hour)})
+
+			_, err := m.GetRefreshTokenSession(ctx, signature, &Session{})
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			assert.ErrorIs(t, err, fosite.ErrTokenExpired)
+		})
+
+		t.Run("case=rejects tokens past the absolute expiry", func(t *testing.T) {
+			requestID := uuid.New()
+			first := uuid.New()
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, first, createTestRequest(requestID)))
+			setExpiry(t, first, expiry{Sliding: time.Now().UTC().Add(time.Hour), Absolute: time.Now().UTC().Add(-time.Minute)})
+
+			_, err := m.GetRefreshTokenSession(ctx, first, &Session{})
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			assert.ErrorIs(t, err, fosite.ErrTokenExpired)
+
+			// Refreshing does not lift the absolute cap of the chain.
+			second := refresh(t, requestID)
+			_, err = m.GetRefreshTokenSession(ctx, second, &Session{})
+			assert.ErrorIs(t, err, fosite.ErrTokenExpired)
+		})
+
+		t.Run("case=ignores the expiry while no lifespan is configured", func(t *testing.T) {
+			signature := uuid.New()
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, signature, createTestRequest(uuid.New())))
+			setExpiry(t, signature, expiry{Sliding: time.Now().UTC().Add(-time.Minute), Absolute: time.Now().UTC().Add(-time.Minute)})
+
+			x.Config().MustSet(ctx, config.KeyRefreshTokenSlidingLifespan, 0)
+			x.Config().MustSet(ctx, config.KeyRefreshTokenAbsoluteLifespan, 0)
+			t.Cleanup(func() {
+				x.Config().MustSet(ctx, config.KeyRefreshTokenSlidingLifespan, time.Hour)
+				x.Config().MustSet(ctx, config.KeyRefreshTokenAbsoluteLifespan, 2*time.Hour)
+			})
+
+			_, err := m.GetRefreshTokenSession(ctx, signature, &Session{})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func testHelperAuthorizeCodeReuseMetric(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		s := m.OAuth2Storage()
+		ctx := context.Background()
+		counter := x.AuthorizeCodeReuseDetections
+
+		signature := uuid.New()
+		require.NoError(t, s.CreateAuthorizeCodeSession(ctx, signature, createTestRequest(signature)))
+
+		before := testutil.ToFloat64(counter)
+		_, err := s.GetAuthorizeCodeSession(ctx, signature, &Session{})
+		require.NoError(t, err)
+		assert.Equal(t, before, testutil.ToFloat64(counter), "first use must not be counted")
+
+		require.NoError(t, s.InvalidateAuthorizeCodeSession(ctx, signature))
+		_, err = s.GetAuthorizeCodeSession(ctx, signature, &Session{})
+		require.ErrorIs(t, err, fosite.ErrInvalidatedAuthorizeCode)
+		assert.Equal(t, before+1, testutil.ToFloat64(counter), "replayed code must be counted")
+	}
+}
+
+func testHelperInvalidateAuthorizeCodeSessionsByRequestIDs(reg InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := reg.OAuth2Storage()
+		ctx := context.Background()
+
+		create := func(t *testing.T) string {
+			signature := uuid.New()
+			require.NoError(t, m.CreateAuthorizeCodeSession(ctx, signature, createTestRequest(signature)))
+			return signature
+		}
+
+		t.Run("case=mixed existing and nonexistent request IDs", func(t *testing.T) {
+			first, second, kept := create(t), create(t), create(t)
+
+			invalidated, err := m.InvalidateAuthorizeCodeSessionsByRequestIDs(ctx, []string{first, uuid.New(), second, uuid.New()})
+			require.NoError(t, err)
+			assert.Equal(t, 2, invalidated)
+
+			for _, signature := range []string{first, second} {
+				_, err := m.GetAuthorizeCodeSession(ctx, signature, &Session{})
+				assert.ErrorIs(t, err, fosite.ErrInvalidatedAuthorizeCode)
+			}
+			_, err = m.GetAuthorizeCodeSession(ctx, kept, &Session{})
+			assert.NoError(t, err)
+
+			// Already invalidated codes are not counted again.
+			invalidated, err = m.InvalidateAuthorizeCodeSessionsByRequestIDs(ctx, []string{first, second, kept})
+			require.NoError(t, err)
+			assert.Equal(t, 1, invalidated)
+		})
+
+		t.Run("case=empty list", func(t *testing.T) {
+			invalidated, err := m.InvalidateAuthorizeCodeSessionsByRequestIDs(ctx, nil)
+			require.NoError(t, err)
+			assert.Zero(t, invalidated)
+		})
+	}
+}
+
 func testHelperNilAccessToken(x InternalRegistry) func(t *testing.T) {
 	return func(t *testing.T) {
 		m := x.OAuth2Storage()
@@ -456,6 +1497,144 @@ func testHelperCreateGetDeletePKCERequestSession(x InternalRegistry) func(t *tes
 	}
 }
 
+func testHelperCheckDevicePollAllowed(x InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		m := x.OAuth2Storage()
+		ctx := context.Background()
+
+		_, _, err := m.CheckDevicePollAllowed(ctx, "unknown-device-code", time.Second)
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+		t.Run("case=rapid polls are rejected", func(t *testing.T) {
+			signature := uuid.New()
+			require.NoError(t, m.CreateDeviceCodeSession(ctx, signature, createTestRequest(signature)))
+
+			allowed, retryAfter, err := m.CheckDevicePollAllowed(ctx, signature, time.Hour)
+			require.NoError(t, err)
+			assert.True(t, allowed)
+			assert.Zero(t, retryAfter)
+
+			allowed, retryAfter, err = m.CheckDevicePollAllowed(ctx, signature, time.Hour)
+			require.NoError(t, err)
+			assert.False(t, allowed)
+			assert.Greater(t, retryAfter, time.Duration(0))
+			assert.LessOrEqual(t, retryAfter, time.Hour)
+		})
+
+		t.Run("case=spaced polls are allowed", func(t *testing.T) {
+			signature := uuid.New()
+			require.NoError(t, m.CreateDeviceCodeSession(ctx, signature, createTestRequest(signature)))
+
+			for i := 0; i < 3; i++ {
+				allowed, _, err := m.CheckDevicePollAllowed(ctx, signature, 0)
+				require.NoError(t, err)
+				assert.True(t, allowed)
+			}
+		})
+
+		t.Run("case=concurrent polls are accepted once", func(t *testing.T) {
+			signature := uuid.New()
+			require.NoError(t, m.CreateDeviceCodeSession(ctx, signature, createTestRequest(signature)))
+
+			var wg sync.WaitGroup
+			var accepted atomic.Int32
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					allowed, _, err := m.CheckDevicePollAllowed(ctx, signature, time.Hour)
+					if assert.NoError(t, err) && allowed {
+						accepted.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			assert.EqualValues(t, 1, accepted.Load())
+		})
+	}
+}
+
+func testHelperConsumeUserCodeSession(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+
+		err := store.ConsumeUserCodeSessionByRequestID(ctx, "unknown-request-id", "challenge")
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+		t.Run("case=user code is consumed once", func(t *testing.T) {
+			requestID := uuid.New()
+			require.NoError(t, store.CreateUserCodeSession(ctx, uuid.New(), createTestRequest(requestID)))
+
+			require.NoError(t, store.ConsumeUserCodeSessionByRequestID(ctx, requestID, "challenge"))
+			assert.ErrorIs(t, store.ConsumeUserCodeSessionByRequestID(ctx, requestID, "challenge"), x.ErrConflict)
+		})
+
+		t.Run("case=concurrent consumers consume the user code once", func(t *testing.T) {
+			requestID := uuid.New()
+			require.NoError(t, store.CreateUserCodeSession(ctx, uuid.New(), createTestRequest(requestID)))
+
+			var wg sync.WaitGroup
+			var consumed, conflicts atomic.Int32
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := store.ConsumeUserCodeSessionByRequestID(ctx, requestID, uuid.New())
+					if err == nil {
+						consumed.Add(1)
+					} else if assert.ErrorIs(t, err, x.ErrConflict) {
+						conflicts.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			assert.EqualValues(t, 1, consumed.Load())
+			assert.EqualValues(t, 1, conflicts.Load())
+		})
+	}
+}
+
+func testHelperDeleteExpiredUserCodeSessions(m InternalRegistry) func(t *testing.T) {
+	return func(t *testing.T) {
+		store := m.OAuth2Storage()
+		ctx := context.Background()
+		lifespan := m.Config().GetDeviceAndUserCodeLifespan(ctx)
+
+		create := func(t *testing.T, requestedAt time.Time) string {
+			signature := uuid.New()
+			r := createTestRequest(uuid.New())
+			r.RequestedAt = requestedAt
+			require.NoError(t, store.CreateUserCodeSession(ctx, signature, r))
+			return signature
+		}
+
+		var expired []string
+		for i := 0; i < 5; i++ {
+			expired = append(expired, create(t, time.Now().UTC().Add(-lifespan-time.Duration(i+1)*time.Minute).Round(time.Second)))
+		}
+		valid := create(t, time.Now().UTC().Round(time.Second))
+
+		_, err := store.DeleteExpiredUserCodeSessions(ctx, 0)
+		assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+
+		deleted, err := store.DeleteExpiredUserCodeSessions(ctx, 2)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, deleted, len(expired))
+
+		for _, signature := range expired {
+			_, err := store.GetUserCodeSession(ctx, signature, &Session{})
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		}
+		_, err = store.GetUserCodeSession(ctx, valid, &Session{})
+		assert.NoError(t, err)
+
+		deleted, err = store.DeleteExpiredUserCodeSessions(ctx, 2)
+		require.NoError(t, err)
+		assert.Zero(t, deleted)
+	}
+}
+
 func testHelperFlushTokens(x InternalRegistry, lifespan time.Duration) func(t *testing.T) {
 	m := x.OAuth2Storage()
 	ds := &Session{}
@@ -469,15 +1648,17 @@ func testHelperFlushTokens(x InternalRegistry, lifespan time.Duration) func(t *t
 			require.NoError(t, err)
 		}
 
-		require.NoError(t, m.FlushInactiveAccessTokens(ctx, time.Now().Add(-time.Hour*24), 100, 10))
-		_, err := m.GetAccessTokenSession(ctx, "flush-1", ds)
+		_, err := m.FlushInactiveAccessTokens(ctx, time.Now().Add(-time.Hour*24), 100, 10)
+		require.NoError(t, err)
+		_, err = m.GetAccessTokenSession(ctx, "flush-1", ds)
 		require.NoError(t, err)
 		_, err = m.GetAccessTokenSession(ctx, "flush-2", ds)
 		require.NoError(t, err)
 		_, err = m.GetAccessTokenSession(ctx, "flush-3", ds)
 		require.NoError(t, err)
 
-		require.NoError(t, m.FlushInactiveAccessTokens(ctx, time.Now().Add(-(lifespan+time.Hour/2)), 100, 10))
+		_, err = m.FlushInactiveAccessTokens(ctx, time.Now().Add(-(lifespan + time.Hour/2)), 100, 10)
+		require.NoError(t, err)
 		_, err = m.GetAccessTokenSession(ctx, "flush-1", ds)
 		require.NoError(t, err)
 		_, err = m.GetAccessTokenSession(ctx, "flush-2", ds)
@@ -485,7 +1666,8 @@ func testHelperFlushTokens(x InternalRegistry, lifespan time.Duration) func(t *t
 		_, err = m.GetAccessTokenSession(ctx, "flush-3", ds)
 		require.Error(t, err)
 
-		require.NoError(t, m.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10))
+		_, err = m.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+		require.NoError(t, err)
 		_, err = m.GetAccessTokenSession(ctx, "flush-1", ds)
 		require.NoError(t, err)
 		_, err = m.GetAccessTokenSession(ctx, "flush-2", ds)
@@ -517,7 +1699,13 @@ func testHelperFlushTokensWithLimitAndBatchSize(x InternalRegistry, limit int, b
 			requests = append(requests, r)
 		}
 
-		require.NoError(t, m.FlushInactiveAccessTokens(ctx, time.Now(), limit, batchSize))
+		res, err := m.FlushInactiveAccessTokens(ctx, time.Now(), limit, batchSize)
+		require.NoError(t, err)
+		assert.Equal(t, limit, res.Deleted)
+		assert.Equal(t, (limit+batchSize-1)/batchSize, res.Batches)
+		assert.EqualValues(t, "limit", res.StoppedReason)
+		assert.Positive(t, res.Duration)
+
 		var notFoundCount, foundCount int
 		for i := range requests {
 			if _, err := m.GetAccessTokenSession(ctx, requests[i].ID, ds); err == nil {
@@ -532,6 +1720,92 @@ func testHelperFlushTokensWithLimitAndBatchSize(x InternalRegistry, limit int, b
 	}
 }
 
+func testHelperFlushTokensWithTimeBudget(x InternalRegistry) func(t *testing.T) {
+	m := x.OAuth2Storage()
+	ds := &Session{}
+
+	return func(t *testing.T) {
+		ctx := context.Background()
+		x.Config().MustSet(ctx, config.KeyDBFlushTimeBudget, time.Nanosecond)
+		t.Cleanup(func() { x.Config().MustSet(ctx, config.KeyDBFlushTimeBudget, 0) })
+
+		var requests []*fosite.Request
+
+		// create five expired requests
+		id := uuid.New()
+		totalCount := 5
+		for i := 0; i < totalCount; i++ {
+			r := createTestRequest(fmt.Sprintf("%s-%d", id, i+1))
+			r.RequestedAt = time.Now().Add(-2 * time.Hour)
+			mockRequestForeignKey(t, r.ID, x, false)
+			require.NoError(t, m.CreateAccessTokenSession(ctx, r.ID, r))
+			requests = append(requests, r)
+		}
+
+		// The budget is exhausted after the first batch, so the flush stops early instead of
+		// deleting all eligible tokens.
+		res, err := m.FlushInactiveAccessTokens(ctx, time.Now(), 100, 2)
+		require.NoError(t, err)
+		assert.EqualValues(t, "deadline", res.StoppedReason)
+		assert.Equal(t, 1, res.Batches)
+
+		var foundCount int
+		for i := range requests {
+			if _, err := m.GetAccessTokenSession(ctx, requests[i].ID, ds); err == nil {
+				foundCount++
+			} else {
+				require.ErrorIs(t, err, fosite.ErrNotFound)
+			}
+		}
+		assert.GreaterOrEqual(t, foundCount, totalCount-2, "should have stopped after the first batch")
+	}
+}
+
+func testHelperFlushTokensWithMinAge(reg InternalRegistry) func(t *testing.T) {
+	m := reg.OAuth2Storage()
+	ds := &Session{}
+
+	return func(t *testing.T) {
+		ctx := context.Background()
+		// The short lifespans no longer protect recent tokens, only the minimum age does.
+		accessLifespan, refreshLifespan := reg.Config().GetAccessTokenLifespan(ctx), reg.Config().GetRefreshTokenLifespan(ctx)
+		reg.Config().MustSet(ctx, config.KeyDBFlushMinAge, time.Hour)
+		reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, time.Second)
+		reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, time.Second)
+		t.Cleanup(func() {
+			reg.Config().MustSet(ctx, config.KeyDBFlushMinAge, 0)
+			reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, accessLifespan)
+			reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, refreshLifespan)
+		})
+
+		create := func(t *testing.T, age time.Duration) *fosite.Request {
+			r := createTestRequest(uuid.New())
+			r.RequestedAt = time.Now().Add(-age).UTC().Round(time.Second)
+			mockRequestForeignKey(t, r.ID, reg, false)
+			require.NoError(t, m.CreateAccessTokenSession(ctx, r.ID, r))
+			require.NoError(t, m.CreateRefreshTokenSession(ctx, r.ID, r))
+			return r
+		}
+		recent, old := create(t, 30*time.Minute), create(t, 2*time.Hour)
+
+		// A cutoff in the future would otherwise delete all tokens.
+		_, err := m.FlushInactiveAccessTokens(ctx, time.Now().Add(time.Hour), 100, 10)
+		require.NoError(t, err)
+		_, err = m.FlushInactiveRefreshTokens(ctx, time.Now().Add(time.Hour), 100, 10)
+		require.NoError(t, err)
+
+		_, err = m.GetAccessTokenSession(ctx, recent.ID, ds)
+		assert.NoError(t, err)
+		_, err = m.GetRefreshTokenSession(ctx, recent.ID, ds)
+		assert.NoError(t, err)
+
+		_, err = m.GetAccessTokenSession(ctx, old.ID, ds)
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+		_, err = m.GetRefreshTokenSession(ctx, old.ID, ds)
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+	}
+}
+
 func testFositeSqlStoreTransactionCommitAccessToken(m InternalRegistry) func(t *testing.T) {
 	return func(t *testing.T) {
 		{
@@ -712,6 +1986,25 @@ func testFositeStoreSetClientAssertionJWT(m InternalRegistry) func(*testing.T) {
 			assert.Equal(t, newJTI, cmp)
 		})
 
+		t.Run("case=keeps expired JTIs without inline cleanup", func(t *testing.T) {
+			ctx := context.Background()
+			m.Config().MustSet(ctx, config.KeyDBInlineJTICleanup, false)
+			t.Cleanup(func() { m.Config().MustSet(ctx, config.KeyDBInlineJTICleanup, true) })
+
+			store, ok := m.OAuth2Storage().(AssertionJWTReader)
+			require.True(t, ok)
+			expiredJTI := NewBlacklistedJTI("retained expired jti", time.Now().Add(-time.Minute))
+			require.NoError(t, store.SetClientAssertionJWTRaw(ctx, expiredJTI))
+			newJTI := NewBlacklistedJTI("another new jti", time.Now().Add(time.Minute))
+
+			require.NoError(t, store.SetClientAssertionJWT(ctx, newJTI.JTI, newJTI.Expiry))
+
+			_, err := store.GetClientAssertionJWT(ctx, expiredJTI.JTI)
+			require.NoError(t, err)
+			_, err = store.GetClientAssertionJWT(ctx, newJTI.JTI)
+			require.NoError(t, err)
+		})
+
 		t.Run("case=inserts same JTI if expired", func(t *testing.T) {
 			store, ok := m.OAuth2Storage().(AssertionJWTReader)
 			require.True(t, ok)
@@ -724,6 +2017,26 @@ func testFositeStoreSetClientAssertionJWT(m InternalRegistry) func(*testing.T) {
 			assert.NoError(t, err)
 			assert.Equal(t, jti, cmp)
 		})
+
+		t.Run("case=stores only the hashed JTI", func(t *testing.T) {
+			store, ok := m.OAuth2Storage().(AssertionJWTReader)
+			require.True(t, ok)
+			ctx := context.Background()
+			jti := "sensitive jti"
+
+			require.NoError(t, store.SetClientAssertionJWT(ctx, jti, time.Now().Add(time.Minute)))
+
+			conn := m.Persister().Connection(ctx)
+			count, err := conn.Where("signature = ?", jti).Count(&BlacklistedJTI{})
+			require.NoError(t, err)
+			assert.Zero(t, count)
+			count, err = conn.Where("signature = ?", signatureFromJTI(jti)).Count(&BlacklistedJTI{})
+			require.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			assert.ErrorIs(t, store.SetClientAssertionJWT(ctx, jti, time.Now().Add(time.Minute)), fosite.ErrJTIKnown)
+			assert.ErrorIs(t, store.ClientAssertionJWTValid(ctx, jti), fosite.ErrJTIKnown)
+		})
 	}
 }
 
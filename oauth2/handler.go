@@ -746,6 +746,12 @@ func (h *Handler) performOAuth2DeviceVerificationFlow(w http.ResponseWriter, r *
 		return
 	}
 
+	if err := f.CanIssueTokens(h.c.GetDeviceAndUserCodeLifespan(ctx)); err != nil {
+		x.LogAudit(r, err, h.r.AuditLogger())
+		h.r.Writer().WriteError(w, r, err)
+		return
+	}
+
 	// TODO(nsklikas): We need to add a db transaction here
 	req, err := h.r.OAuth2Storage().GetDeviceCodeSessionByRequestID(ctx, f.DeviceCodeRequestID.String(), &Session{})
 	if err != nil {
@@ -777,7 +783,7 @@ func (h *Handler) performOAuth2DeviceVerificationFlow(w http.ResponseWriter, r *
 	// TODO evaluate if an OpenID Connect session is necessary for device flow.
 	// Update the OpenID Connect session if "openid" scope is granted
 	if req.GetGrantedScopes().Has("openid") {
-		err = h.r.OAuth2Storage().UpdateOpenIDConnectSessionByRequestID(ctx, f.DeviceCodeRequestID.String(), req)
+		err = h.r.OAuth2Storage().UpsertOpenIDConnectSession(ctx, f.DeviceCodeRequestID.String(), req)
 		if err != nil {
 			x.LogError(r, err, h.r.Logger())
 			h.r.Writer().WriteError(w, r, err)
@@ -785,6 +791,12 @@ func (h *Handler) performOAuth2DeviceVerificationFlow(w http.ResponseWriter, r *
 		}
 	}
 
+	// The device flow is approved at this point, so a failing hook must not
+	// fail it.
+	if err := h.r.DeviceCompletionHook()(ctx, f); err != nil {
+		h.r.Logger().WithRequest(r).WithError(err).Error("Unable to notify the device completion hook.")
+	}
+
 	redirectURL := urlx.SetQuery(h.c.DeviceDoneURL(ctx), url.Values{"client_id": {f.Client.GetID()}}).String()
 	http.Redirect(w, r, redirectURL, http.StatusFound)
 }
@@ -871,6 +883,11 @@ func (h *Handler) oAuth2DeviceFlow(w http.ResponseWriter, r *http.Request) {
 
 	resp, err := h.r.OAuth2Provider().NewDeviceResponse(ctx, request, session)
 	if err != nil {
+		// Fosite reports all storage errors as server errors.
+		var limitErr *x.DeviceFlowLimitError
+		if errors.As(err, &limitErr) {
+			err = limitErr
+		}
 		h.r.OAuth2Provider().WriteAccessError(ctx, w, request, err)
 		return
 	}
@@ -1000,6 +1017,15 @@ func (h *Handler) introspectOAuth2Token(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	if tt == fosite.AccessToken {
+		if err := h.checkIntrospectionAudience(ctx, r, token); err != nil {
+			x.LogAudit(r, err, h.r.Logger())
+			err := errorsx.WithStack(fosite.ErrInactiveToken.WithHint("The token may not be introspected by this client.").WithDebug(err.Error()))
+			h.r.OAuth2Provider().WriteIntrospectionError(ctx, w, err)
+			return
+		}
+	}
+
 	resp := &fosite.IntrospectionResponse{
 		Active:          true,
 		AccessRequester: ar,
@@ -1139,10 +1165,16 @@ type oAuth2TokenExchange struct {
 //	  default: errorOAuth2
 func (h *Handler) oauth2TokenExchange(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	// The JTI of a client assertion is only stored once the assertion was
+	// verified, and thus its issuer is the authenticated client.
+	ctx = x.WithClientAssertionClientID(ctx, x.UnverifiedJWTIssuer(r.PostFormValue("client_assertion")))
 	session := NewSessionWithCustomClaims(ctx, h.c, "")
 
 	accessRequest, err := h.r.OAuth2Provider().NewAccessRequest(ctx, r, session)
 	if err != nil {
+		if r.PostForm.Get("grant_type") == string(fosite.GrantTypeDeviceCode) {
+			err = unwrapDeviceCodeError(err)
+		}
 		h.logOrAudit(err, r)
 		h.r.OAuth2Provider().WriteAccessError(ctx, w, accessRequest, err)
 		events.Trace(ctx, events.TokenExchangeError)
@@ -1193,6 +1225,14 @@ func (h *Handler) oauth2TokenExchange(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// fosite stores tokens without the form of the request, so the grant they
+	// originate from is recorded in the session. Tokens issued by the refresh
+	// grant inherit it from the session of the refresh token.
+	if s, ok := accessRequest.GetSession().(*Session); ok && s.OriginGrantType == "" &&
+		len(accessRequest.GetGrantTypes()) == 1 && !accessRequest.GetGrantTypes().ExactOne(string(fosite.GrantTypeRefreshToken)) {
+		s.OriginGrantType = accessRequest.GetGrantTypes()[0]
+	}
+
 	for _, hook := range h.r.AccessRequestHooks() {
 		if err := hook(ctx, accessRequest); err != nil {
 			h.logOrAudit(err, r)
@@ -1204,6 +1244,11 @@ func (h *Handler) oauth2TokenExchange(w http.ResponseWriter, r *http.Request) {
 
 	accessResponse, err := h.r.OAuth2Provider().NewAccessResponse(ctx, accessRequest)
 	if err != nil {
+		// Fosite reports all storage errors as server errors.
+		var chainErr *x.RefreshTokenChainLengthError
+		if errors.As(err, &chainErr) {
+			err = chainErr
+		}
 		h.logOrAudit(err, r)
 		h.r.OAuth2Provider().WriteAccessError(ctx, w, accessRequest, err)
 		events.Trace(ctx, events.TokenExchangeError, events.WithRequest(accessRequest))
@@ -1416,10 +1461,47 @@ func (h *Handler) updateSessionWithRequest(
 	session.AllowedTopLevelClaims = h.c.AllowedTopLevelClaims(ctx)
 	session.MirrorTopLevelClaims = h.c.MirrorTopLevelClaims(ctx)
 	session.Flow = flow
+	if flow != nil {
+		session.DeviceChallenge = flow.DeviceChallengeID.String()
+	}
 
 	return session, nil
 }
 
+// checkIntrospectionAudience returns an error unless the access token may be
+// introspected by the client authenticating the introspection request. Clients
+// only need to authenticate to introspect tokens which are bound to an
+// introspection audience, see x.FositeStorer.CheckIntrospectionAudience. The
+// credentials of other introspection requests are not looked at, as they were
+// never required by the admin endpoint.
+func (h *Handler) checkIntrospectionAudience(ctx context.Context, r *http.Request, token string) error {
+	signature := x.TokenSignature(token)
+	if err := h.r.OAuth2Storage().CheckIntrospectionAudience(ctx, signature, ""); !errors.As(err, new(*x.IntrospectionAudienceError)) {
+		return err
+	}
+
+	c, err := h.r.ClientAuthenticator().AuthenticateClient(ctx, r, r.PostForm)
+	if err != nil {
+		return err
+	}
+	return h.r.OAuth2Storage().CheckIntrospectionAudience(ctx, signature, c.GetID())
+}
+
+// unwrapDeviceCodeError returns the RFC 8628 error wrapped in err, if any. The
+// device code storage reports pending, denied and expired device codes, which
+// fosite wraps in a server error that would otherwise hide them from the device.
+func unwrapDeviceCodeError(err error) error {
+	if !errors.Is(err, fosite.ErrServerError) {
+		return err
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if rfcErr, ok := e.(*fosite.RFC6749Error); ok && (rfcErr.Is(fosite.ErrAuthorizationPending) || rfcErr.Is(fosite.ErrAccessDenied) || rfcErr.Is(fosite.ErrDeviceExpiredToken)) {
+			return rfcErr
+		}
+	}
+	return err
+}
+
 func (h *Handler) logOrAudit(err error, r *http.Request) {
 	if errors.Is(err, fosite.ErrServerError) || errors.Is(err, fosite.ErrTemporarilyUnavailable) || errors.Is(err, fosite.ErrMisconfiguration) {
 		x.LogError(r, err, h.r.Logger())
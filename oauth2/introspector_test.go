@@ -6,16 +6,21 @@ package oauth2_test
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/tidwall/gjson"
+
 	hydra "github.com/ory/hydra-client-go/v2"
 
 	"github.com/ory/x/httprouterx"
 
+	"github.com/ory/hydra/v2/oauth2"
 	"github.com/ory/hydra/v2/x"
 	"github.com/ory/x/contextx"
 
@@ -165,3 +170,74 @@ func TestIntrospectorSDK(t *testing.T) {
 		}
 	})
 }
+
+func TestIntrospectionAudience(t *testing.T) {
+	ctx := context.Background()
+	conf := internal.NewConfigurationWithDefaults()
+	reg := internal.NewRegistryMemory(t, conf, &contextx.Default{})
+	internal.AddFositeExamples(reg)
+
+	router := x.NewRouterAdmin(conf.AdminURL)
+	reg.OAuth2Handler().SetRoutes(router, &httprouterx.RouterPublic{Router: router.Router}, func(h http.Handler) http.Handler {
+		return h
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tokens := Tokens(reg.OAuth2ProviderConfig(), 2)
+	create := func(token string, form url.Values) {
+		ar := fosite.NewAccessRequest(oauth2.NewSession("alice"))
+		ar.RequestedAt = time.Now().UTC().Round(time.Minute)
+		ar.Client = &fosite.DefaultClient{ID: "my-client"}
+		ar.Session.SetExpiresAt(fosite.AccessToken, time.Now().UTC().Add(time.Hour))
+		ar.Form = form
+		require.NoError(t, reg.OAuth2Storage().CreateAccessTokenSession(ctx, token, ar))
+	}
+	create(tokens[0][0], url.Values{"introspection_audience": {"my-client"}})
+	create(tokens[1][0], nil)
+
+	introspect := func(t *testing.T, token string, auth func(r *http.Request)) bool {
+		req, err := http.NewRequest("POST", server.URL+"/admin"+oauth2.IntrospectPath, strings.NewReader(url.Values{"token": {token}}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth != nil {
+			auth(req)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode, "%s", body)
+		return gjson.GetBytes(body, "active").Bool()
+	}
+	basicAuth := func(id, secret string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.SetBasicAuth(url.QueryEscape(id), url.QueryEscape(secret))
+		}
+	}
+
+	t.Run("case=bound token introspected by its audience", func(t *testing.T) {
+		assert.True(t, introspect(t, tokens[0][1], basicAuth("my-client", "foobar")))
+	})
+
+	t.Run("case=bound token introspected by another client", func(t *testing.T) {
+		assert.False(t, introspect(t, tokens[0][1], basicAuth("encoded:client", "encoded&password")))
+	})
+
+	t.Run("case=bound token introspected without authentication", func(t *testing.T) {
+		assert.False(t, introspect(t, tokens[0][1], nil))
+	})
+
+	t.Run("case=bound token introspected with invalid credentials", func(t *testing.T) {
+		assert.False(t, introspect(t, tokens[0][1], basicAuth("my-client", "wrong")))
+	})
+
+	t.Run("case=unbound token introspected without authentication", func(t *testing.T) {
+		assert.True(t, introspect(t, tokens[1][1], nil))
+	})
+
+	t.Run("case=unbound token introspected with invalid credentials", func(t *testing.T) {
+		assert.True(t, introspect(t, tokens[1][1], basicAuth("my-client", "wrong")))
+	})
+}
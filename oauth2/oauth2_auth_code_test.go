@@ -330,6 +330,36 @@ func TestAuthCodeWithDefaultStrategy(t *testing.T) {
 		})
 	})
 
+	t.Run("case=rejects refreshing beyond the maximum chain length", func(t *testing.T) {
+		reg.Config().MustSet(ctx, config.KeyRefreshTokenMaxChainLength, 1)
+		t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyRefreshTokenMaxChainLength, 0) })
+
+		c, conf := newOAuth2Client(t, reg, testhelpers.NewCallbackURL(t, "callback", testhelpers.HTTPServerNotImplementedHandler))
+		testhelpers.NewLoginConsentUI(t, reg.Config(),
+			acceptLoginHandler(t, c, subject, nil),
+			acceptConsentHandler(t, c, subject, nil),
+		)
+
+		code, _ := getAuthorizeCode(t, conf, nil)
+		require.NotEmpty(t, code)
+		token, err := conf.Exchange(context.Background(), code)
+		require.NoError(t, err)
+
+		token.Expiry = token.Expiry.Add(-time.Hour * 24)
+		refreshedToken, err := conf.TokenSource(context.Background(), token).Token()
+		require.NoError(t, err)
+
+		refreshedToken.Expiry = refreshedToken.Expiry.Add(-time.Hour * 24)
+		_, err = conf.TokenSource(context.Background(), refreshedToken).Token()
+		retrieveError := new(oauth2.RetrieveError)
+		require.ErrorAs(t, err, &retrieveError)
+		assert.Equal(t, http.StatusBadRequest, retrieveError.Response.StatusCode)
+		assert.Contains(t, string(retrieveError.Body), "invalid_grant")
+
+		i := testhelpers.IntrospectToken(t, conf, refreshedToken.RefreshToken, adminTS)
+		assert.True(t, i.Get("active").Bool(), "the last refresh token of the chain is still active: %s", i)
+	})
+
 	t.Run("case=perform authorize code flow with verifable credentials", func(t *testing.T) {
 		// Make sure we test against all crypto suites that we advertise.
 		cfg, _, err := publicClient.OidcApi.DiscoverOidcConfiguration(ctx).Execute()
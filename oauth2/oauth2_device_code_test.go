@@ -5,13 +5,19 @@ package oauth2_test
 
 import (
 	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 
 	"github.com/ory/fosite/token/jwt"
 
@@ -431,6 +437,76 @@ func TestDeviceCodeWithDefaultStrategy(t *testing.T) {
 		require.Equal(t, devErr.Response.StatusCode, http.StatusBadRequest)
 	})
 
+	t.Run("case=reports expired device codes", func(t *testing.T) {
+		testhelpers.NewLoginConsentUI(t, reg.Config(), testhelpers.HTTPServerNoExpectedCallHandler(t), testhelpers.HTTPServerNoExpectedCallHandler(t))
+		lifespan := reg.Config().GetDeviceAndUserCodeLifespan(ctx)
+		reg.Config().MustSet(ctx, config.KeyDeviceAndUserCodeLifespan, time.Second)
+		t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyDeviceAndUserCodeLifespan, lifespan) })
+
+		_, conf := newDeviceClient(t, reg)
+		resp, err := getDeviceCode(t, conf, nil)
+		require.NoError(t, err)
+		time.Sleep(1500 * time.Millisecond)
+
+		// Poll once by hand, as the client library gives up once the device
+		// code expired without asking the server.
+		res, err := http.PostForm(conf.Endpoint.TokenURL, url.Values{
+			"client_id":   {conf.ClientID},
+			"grant_type":  {string(fosite.GrantTypeDeviceCode)},
+			"device_code": {resp.DeviceCode},
+		})
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "%s", body)
+		assert.Equal(t, "expired_token", gjson.GetBytes(body, "error").String(), "%s", body)
+	})
+
+	t.Run("case=reports pending device codes", func(t *testing.T) {
+		testhelpers.NewLoginConsentUI(t, reg.Config(), testhelpers.HTTPServerNoExpectedCallHandler(t), testhelpers.HTTPServerNoExpectedCallHandler(t))
+		_, conf := newDeviceClient(t, reg)
+		resp, err := getDeviceCode(t, conf, nil)
+		require.NoError(t, err)
+
+		// Poll before the user approved the device flow.
+		res, err := http.PostForm(conf.Endpoint.TokenURL, url.Values{
+			"client_id":   {conf.ClientID},
+			"grant_type":  {string(fosite.GrantTypeDeviceCode)},
+			"device_code": {resp.DeviceCode},
+		})
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, "%s", body)
+		assert.Equal(t, "authorization_pending", gjson.GetBytes(body, "error").String(), "%s", body)
+	})
+
+	t.Run("case=limits pending device flows per client", func(t *testing.T) {
+		testhelpers.NewLoginConsentUI(t, reg.Config(), testhelpers.HTTPServerNoExpectedCallHandler(t), testhelpers.HTTPServerNoExpectedCallHandler(t))
+		reg.Config().MustSet(ctx, config.KeyDeviceAuthMaxActiveFlowsPerClient, 2)
+		t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyDeviceAuthMaxActiveFlowsPerClient, 0) })
+
+		_, conf := newDeviceClient(t, reg)
+		for i := 0; i < 2; i++ {
+			_, err := getDeviceCode(t, conf, nil)
+			require.NoError(t, err)
+		}
+
+		resp, err := getDeviceCode(t, conf, nil)
+		require.Error(t, err)
+		require.Nil(t, resp)
+		devErr := err.(*oauth2.RetrieveError)
+		assert.Equal(t, http.StatusTooManyRequests, devErr.Response.StatusCode)
+		assert.Equal(t, "slow_down", gjson.GetBytes(devErr.Body, "error").String(), "%s", devErr.Body)
+
+		// The limit applies per client.
+		_, otherConf := newDeviceClient(t, reg)
+		_, err = getDeviceCode(t, otherConf, nil)
+		require.NoError(t, err)
+	})
+
 	subject := "aeneas-rekkas"
 	nonce := uuid.New()
 	t.Run("case=perform device flow with ID token and refresh tokens", func(t *testing.T) {
@@ -544,6 +620,145 @@ func TestDeviceCodeWithDefaultStrategy(t *testing.T) {
 		assertIDToken(t, token, conf, subject, nonce, time.Now().Add(reg.Config().GetIDTokenLifespan(ctx)))
 	})
 
+	t.Run("case=records and revokes tokens by device challenge", func(t *testing.T) {
+		reg.Config().MustSet(ctx, config.KeyAccessTokenStrategy, "opaque")
+		c, conf := newDeviceClient(t, reg)
+
+		var deviceChallenge string
+		acceptDevice := acceptDeviceHandler(t, c)
+		testhelpers.NewDeviceLoginConsentUI(t, reg.Config(),
+			func(w http.ResponseWriter, r *http.Request) {
+				f, err := reg.ConsentManager().GetDeviceUserAuthRequest(ctx, r.URL.Query().Get("device_challenge"))
+				require.NoError(t, err)
+				deviceChallenge = f.ID
+				acceptDevice(w, r)
+			},
+			acceptLoginHandler(t, c, subject, nil),
+			acceptConsentHandler(t, c, subject, nil),
+		)
+
+		resp, err := getDeviceCode(t, conf, nil)
+		require.NoError(t, err)
+		acceptUserCode(t, conf, nil, resp)
+		token, err := conf.DeviceAccessToken(context.Background(), resp)
+		require.NoError(t, err)
+		introspectAccessToken(t, conf, token, subject)
+		require.NotEmpty(t, deviceChallenge)
+
+		tokens, err := reg.OAuth2Storage().GetTokensByDeviceChallenge(ctx, deviceChallenge)
+		require.NoError(t, err)
+		require.Len(t, tokens, 2, "expected the access and the refresh token")
+		for _, r := range tokens {
+			assert.Equal(t, c.GetID(), r.GetClient().GetID())
+			assert.Equal(t, deviceChallenge, r.GetSession().(*hydraoauth2.Session).DeviceChallenge)
+		}
+
+		t.Run("followup=the approving subject is recorded", func(t *testing.T) {
+			actual, err := reg.ConsentManager().GetDeviceFlowSubject(ctx, deviceChallenge)
+			require.NoError(t, err)
+			assert.Equal(t, subject, actual)
+		})
+
+		t.Run("followup=refreshed tokens keep the device challenge", func(t *testing.T) {
+			token.Expiry = token.Expiry.Add(-time.Hour * 24)
+			refreshedToken, err := conf.TokenSource(context.Background(), token).Token()
+			require.NoError(t, err)
+			token = refreshedToken
+
+			tokens, err := reg.OAuth2Storage().GetTokensByDeviceChallenge(ctx, deviceChallenge)
+			require.NoError(t, err)
+			assert.Len(t, tokens, 2, "expected only the refreshed access and refresh token")
+		})
+
+		t.Run("followup=revoking the device challenge revokes its tokens", func(t *testing.T) {
+			require.NoError(t, reg.OAuth2Storage().RevokeTokensByDeviceChallenge(ctx, deviceChallenge))
+
+			i := testhelpers.IntrospectToken(t, conf, token.AccessToken, adminTS)
+			assert.False(t, i.Get("active").Bool(), "%s", i)
+			_, err := conf.TokenSource(context.Background(), &oauth2.Token{RefreshToken: token.RefreshToken}).Token()
+			assert.Error(t, err)
+
+			tokens, err := reg.OAuth2Storage().GetTokensByDeviceChallenge(ctx, deviceChallenge)
+			require.NoError(t, err)
+			assert.Empty(t, tokens)
+		})
+
+		t.Run("followup=unknown device challenges match no tokens", func(t *testing.T) {
+			tokens, err := reg.OAuth2Storage().GetTokensByDeviceChallenge(ctx, "unknown-challenge")
+			require.NoError(t, err)
+			assert.Empty(t, tokens)
+			require.NoError(t, reg.OAuth2Storage().RevokeTokensByDeviceChallenge(ctx, "unknown-challenge"))
+		})
+	})
+
+	t.Run("case=notifies the device completion hook", func(t *testing.T) {
+		run := func(t *testing.T, status int) (*oauth2.Config, *oauth2.Token) {
+			var received hydraoauth2.DeviceCompletionHookRequest
+			hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, r.Header.Get("Content-Type"), "application/json; charset=UTF-8")
+				assert.Equal(t, r.Header.Get("Authorization"), "Bearer secret value")
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+				w.WriteHeader(status)
+			}))
+			defer hs.Close()
+
+			reg.Config().MustSet(ctx, config.KeyDeviceCompletionHook, &config.HookConfig{
+				URL: hs.URL,
+				Auth: &config.Auth{
+					Type: "api_key",
+					Config: config.AuthConfig{
+						In:    "header",
+						Name:  "Authorization",
+						Value: "Bearer secret value",
+					},
+				},
+			})
+			defer reg.Config().MustSet(ctx, config.KeyDeviceCompletionHook, nil)
+
+			c, conf := newDeviceClient(t, reg)
+			var deviceChallenge string
+			acceptDevice := acceptDeviceHandler(t, c)
+			testhelpers.NewDeviceLoginConsentUI(t, reg.Config(),
+				func(w http.ResponseWriter, r *http.Request) {
+					f, err := reg.ConsentManager().GetDeviceUserAuthRequest(ctx, r.URL.Query().Get("device_challenge"))
+					require.NoError(t, err)
+					deviceChallenge = f.ID
+					acceptDevice(w, r)
+				},
+				acceptLoginHandler(t, c, subject, nil),
+				acceptConsentHandler(t, c, subject, nil),
+			)
+
+			resp, err := getDeviceCode(t, conf, nil)
+			require.NoError(t, err)
+			acceptUserCode(t, conf, nil, resp)
+			token, err := conf.DeviceAccessToken(context.Background(), resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, deviceChallenge, received.DeviceChallenge)
+			assert.Equal(t, c.GetID(), received.ClientID)
+			assert.Equal(t, subject, received.Subject)
+			return conf, token
+		}
+
+		t.Run("case=hook succeeds", func(t *testing.T) {
+			conf, token := run(t, http.StatusNoContent)
+			introspectAccessToken(t, conf, token, subject)
+		})
+
+		t.Run("case=hook error is logged but does not fail the flow", func(t *testing.T) {
+			logs := logrustest.NewLocal(reg.Logger().Logger)
+			conf, token := run(t, http.StatusInternalServerError)
+			introspectAccessToken(t, conf, token, subject)
+
+			var logged bool
+			for _, e := range logs.AllEntries() {
+				logged = logged || (e.Level == logrus.ErrorLevel && e.Message == "Unable to notify the device completion hook.")
+			}
+			assert.True(t, logged, "expected the hook error to be logged")
+		})
+	})
+
 	t.Run("case=respects client token lifespan configuration", func(t *testing.T) {
 		run := func(t *testing.T, strategy string, c *client.Client, conf *oauth2.Config, expectedLifespans client.Lifespans) {
 			testhelpers.NewDeviceLoginConsentUI(
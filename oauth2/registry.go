@@ -24,6 +24,7 @@ type InternalRegistry interface {
 	x.RegistryLogger
 	consent.Registry
 	persistence.Provider
+	x.ClientAuthenticatorProvider
 	Registry
 	FlowCipher() *aead.XChaCha20Poly1305
 }
@@ -35,6 +36,7 @@ type Registry interface {
 	AccessTokenJWTStrategy() jwk.JWTSigner
 	OpenIDConnectRequestValidator() *openid.OpenIDConnectRequestValidator
 	AccessRequestHooks() []AccessRequestHook
+	DeviceCompletionHook() DeviceCompletionHook
 	OAuth2ProviderConfig() fosite.Configurator
 	RFC8628HMACStrategy() rfc8628.RFC8628CodeStrategy
 }
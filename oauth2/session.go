@@ -36,6 +36,14 @@ type Session struct {
 	MirrorTopLevelClaims   bool                   `json:"mirror_top_level_claims"`
 	BrowserFlowCompleted   bool                   `json:"browser_flow_completed"`
 
+	// DeviceChallenge is the device challenge through which the tokens of the
+	// session were granted, and OriginGrantType the grant they originate from.
+	// They are stored in the device_challenge and grant_type columns of the
+	// token tables rather than in the session data, so that they do not
+	// change the session payloads sent to hooks.
+	DeviceChallenge string `json:"-"`
+	OriginGrantType string `json:"-"`
+
 	Flow *flow.Flow `json:"-"`
 }
 
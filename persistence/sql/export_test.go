@@ -0,0 +1,70 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+
+	"github.com/gobuffalo/pop/v6"
+
+	"github.com/ory/fosite"
+)
+
+type TableName = tableName
+
+var (
+	RunShardFlushes         = runShardFlushes
+	SignatureShardCondition = signatureShardCondition
+	HandleDeleteError       = handleDeleteError
+)
+
+const (
+	MaxSignatureShards = maxSignatureShards
+
+	SQLTableAccess  = sqlTableAccess
+	SQLTableRefresh = sqlTableRefresh
+	SQLTableCode    = sqlTableCode
+	SQLTableOpenID  = sqlTableOpenID
+	SQLTablePKCE    = sqlTablePKCE
+
+	SQLTableDeviceCode = sqlTableDeviceCode
+)
+
+func (p *Persister) DeleteSessionBySignature(ctx context.Context, signature string, table tableName) error {
+	return p.deleteSessionBySignature(ctx, signature, table)
+}
+
+func (p *Persister) DeleteSessionByRequestID(ctx context.Context, requestID string, table tableName) error {
+	return p.deleteSessionByRequestID(ctx, requestID, table)
+}
+
+func (p *Persister) DecryptConcurrently(ctx context.Context, n int, decrypt func(ctx context.Context, i int) error) error {
+	return p.decryptConcurrently(ctx, n, decrypt)
+}
+
+func (p *Persister) GetClientIgnoringCase(ctx context.Context, id string) (fosite.Client, error) {
+	return p.getClientIgnoringCase(ctx, id)
+}
+
+func (p *Persister) DeleteAccessTokensByCTID(ctx context.Context, clientID string, batchSize int) (int, error) {
+	return p.deleteAccessTokensByCTID(ctx, clientID, batchSize)
+}
+
+func (p *Persister) ExecBulkStatement(ctx context.Context, c *pop.Connection, exec func(c *pop.Connection) (int, error)) (int, error) {
+	return p.execBulkStatement(ctx, c, exec)
+}
+
+// MarshalSessionAs serializes the session in the format, as marshalSession does
+// for encrypted sessions.
+func MarshalSessionAs(format string, session fosite.Session) ([]byte, error) {
+	return sessionSerializers[format].Marshal(session)
+}
+
+var UnmarshalSession = unmarshalSession
+
+var (
+	StatementTimeoutStatement  = statementTimeoutStatement
+	FlushMaintenanceStatements = flushMaintenanceStatements
+	AdaptFlushBatchSize        = adaptFlushBatchSize
+)
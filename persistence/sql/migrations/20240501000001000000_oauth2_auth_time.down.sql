@@ -0,0 +1,7 @@
+ALTER TABLE hydra_oauth2_oidc DROP COLUMN auth_time;
+ALTER TABLE hydra_oauth2_access DROP COLUMN auth_time;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN auth_time;
+ALTER TABLE hydra_oauth2_code DROP COLUMN auth_time;
+ALTER TABLE hydra_oauth2_pkce DROP COLUMN auth_time;
+ALTER TABLE hydra_oauth2_device_code DROP COLUMN auth_time;
+ALTER TABLE hydra_oauth2_user_code DROP COLUMN auth_time;
@@ -0,0 +1,7 @@
+ALTER TABLE hydra_oauth2_oidc ADD COLUMN auth_time TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_access ADD COLUMN auth_time TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN auth_time TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_code ADD COLUMN auth_time TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_pkce ADD COLUMN auth_time TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_device_code ADD COLUMN auth_time TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_user_code ADD COLUMN auth_time TIMESTAMP NULL;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_device_code DROP COLUMN last_polled_at;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_device_code ADD COLUMN last_polled_at TIMESTAMP NULL;
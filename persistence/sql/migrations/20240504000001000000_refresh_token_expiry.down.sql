@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN absolute_expires_at;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN sliding_expires_at;
@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN sliding_expires_at TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN absolute_expires_at TIMESTAMP NULL;
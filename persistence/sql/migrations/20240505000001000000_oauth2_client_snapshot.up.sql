@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_access ADD COLUMN client_snapshot TEXT NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN client_snapshot TEXT NULL;
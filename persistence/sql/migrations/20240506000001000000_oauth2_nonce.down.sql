@@ -0,0 +1,5 @@
+DROP INDEX hydra_oauth2_oidc_nonce_hash_idx;
+DROP INDEX hydra_oauth2_code_nonce_hash_idx;
+
+ALTER TABLE hydra_oauth2_oidc DROP COLUMN nonce_hash;
+ALTER TABLE hydra_oauth2_code DROP COLUMN nonce_hash;
@@ -0,0 +1,5 @@
+ALTER TABLE hydra_oauth2_oidc ADD COLUMN nonce_hash VARCHAR(64) NULL;
+ALTER TABLE hydra_oauth2_code ADD COLUMN nonce_hash VARCHAR(64) NULL;
+
+CREATE INDEX hydra_oauth2_oidc_nonce_hash_idx ON hydra_oauth2_oidc (nid, client_id, nonce_hash);
+CREATE INDEX hydra_oauth2_code_nonce_hash_idx ON hydra_oauth2_code (nid, client_id, nonce_hash);
@@ -0,0 +1 @@
+DROP INDEX hydra_oauth2_flow_device_code_request_id_idx;
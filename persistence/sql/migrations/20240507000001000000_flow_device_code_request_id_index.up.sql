@@ -0,0 +1 @@
+CREATE INDEX hydra_oauth2_flow_device_code_request_id_idx ON hydra_oauth2_flow (device_code_request_id, nid);
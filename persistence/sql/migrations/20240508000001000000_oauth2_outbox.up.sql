@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS hydra_oauth2_outbox
+(
+    id         UUID         NOT NULL PRIMARY KEY,
+    nid        UUID         NOT NULL,
+    event      VARCHAR(64)  NOT NULL,
+    token_type VARCHAR(32)  NOT NULL,
+    request_id VARCHAR(40)  NOT NULL,
+    client_id  VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+    FOREIGN KEY (nid) REFERENCES networks(id) ON UPDATE RESTRICT ON DELETE CASCADE
+);
+
+CREATE INDEX hydra_oauth2_outbox_nid_created_at_idx ON hydra_oauth2_outbox (nid, created_at);
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_access DROP COLUMN introspection_audience;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_access ADD COLUMN introspection_audience TEXT NULL;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_flow DROP COLUMN requested_acr;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_flow ADD COLUMN requested_acr TEXT NOT NULL DEFAULT '[]';
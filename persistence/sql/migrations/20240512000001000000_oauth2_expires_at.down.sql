@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_access DROP COLUMN expires_at;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN expires_at;
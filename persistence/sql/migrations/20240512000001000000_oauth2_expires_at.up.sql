@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_access ADD COLUMN expires_at TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN expires_at TIMESTAMP NULL;
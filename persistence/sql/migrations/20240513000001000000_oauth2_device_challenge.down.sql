@@ -0,0 +1,5 @@
+DROP INDEX hydra_oauth2_access_device_challenge_idx;
+DROP INDEX hydra_oauth2_refresh_device_challenge_idx;
+
+ALTER TABLE hydra_oauth2_access DROP COLUMN device_challenge;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN device_challenge;
@@ -0,0 +1,5 @@
+ALTER TABLE hydra_oauth2_access ADD COLUMN device_challenge VARCHAR(255) NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN device_challenge VARCHAR(255) NULL;
+
+CREATE INDEX hydra_oauth2_access_device_challenge_idx ON hydra_oauth2_access (nid, device_challenge);
+CREATE INDEX hydra_oauth2_refresh_device_challenge_idx ON hydra_oauth2_refresh (nid, device_challenge);
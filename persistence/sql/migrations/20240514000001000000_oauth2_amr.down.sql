@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_access DROP COLUMN amr;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN amr;
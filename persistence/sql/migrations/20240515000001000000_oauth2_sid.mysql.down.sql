@@ -0,0 +1,7 @@
+DROP INDEX hydra_oauth2_access_sid_idx ON hydra_oauth2_access;
+DROP INDEX hydra_oauth2_refresh_sid_idx ON hydra_oauth2_refresh;
+DROP INDEX hydra_oauth2_oidc_sid_idx ON hydra_oauth2_oidc;
+
+ALTER TABLE hydra_oauth2_oidc DROP COLUMN sid;
+ALTER TABLE hydra_oauth2_access DROP COLUMN sid;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN sid;
@@ -0,0 +1,7 @@
+ALTER TABLE hydra_oauth2_oidc ADD COLUMN sid VARCHAR(255) NULL;
+ALTER TABLE hydra_oauth2_access ADD COLUMN sid VARCHAR(255) NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN sid VARCHAR(255) NULL;
+
+CREATE INDEX hydra_oauth2_access_sid_idx ON hydra_oauth2_access (nid, sid);
+CREATE INDEX hydra_oauth2_refresh_sid_idx ON hydra_oauth2_refresh (nid, sid);
+CREATE INDEX hydra_oauth2_oidc_sid_idx ON hydra_oauth2_oidc (nid, sid);
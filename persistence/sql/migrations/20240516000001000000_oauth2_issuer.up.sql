@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_access ADD COLUMN issuer VARCHAR(255) NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN issuer VARCHAR(255) NULL;
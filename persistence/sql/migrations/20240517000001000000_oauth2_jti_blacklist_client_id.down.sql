@@ -0,0 +1,3 @@
+DROP INDEX hydra_oauth2_jti_blacklist_client_id_idx;
+
+ALTER TABLE hydra_oauth2_jti_blacklist DROP COLUMN client_id;
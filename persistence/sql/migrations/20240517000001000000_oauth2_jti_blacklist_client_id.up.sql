@@ -0,0 +1,3 @@
+ALTER TABLE hydra_oauth2_jti_blacklist ADD COLUMN client_id VARCHAR(255) NULL;
+
+CREATE INDEX hydra_oauth2_jti_blacklist_client_id_idx ON hydra_oauth2_jti_blacklist (nid, client_id);
@@ -0,0 +1 @@
+ALTER TABLE hydra_client ADD COLUMN credentials_rotated_at TIMESTAMP NULL;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN chain_length;
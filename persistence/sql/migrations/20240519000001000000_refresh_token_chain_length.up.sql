@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN chain_length INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+ALTER TABLE hydra_oauth2_access DROP COLUMN flagged_reason;
+ALTER TABLE hydra_oauth2_access DROP COLUMN flagged_at;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN flagged_reason;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN flagged_at;
@@ -0,0 +1,4 @@
+ALTER TABLE hydra_oauth2_access ADD COLUMN flagged_at TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_access ADD COLUMN flagged_reason TEXT NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN flagged_at TIMESTAMP NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN flagged_reason TEXT NULL;
@@ -0,0 +1,3 @@
+DROP INDEX hydra_oauth2_access_nid_subject_idx;
+DROP INDEX hydra_oauth2_refresh_nid_subject_idx;
+DROP INDEX hydra_oauth2_oidc_nid_subject_idx;
@@ -0,0 +1,3 @@
+CREATE INDEX hydra_oauth2_access_nid_subject_idx ON hydra_oauth2_access (nid, subject);
+CREATE INDEX hydra_oauth2_refresh_nid_subject_idx ON hydra_oauth2_refresh (nid, subject);
+CREATE INDEX hydra_oauth2_oidc_nid_subject_idx ON hydra_oauth2_oidc (nid, subject);
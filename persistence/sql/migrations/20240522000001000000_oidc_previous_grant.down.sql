@@ -0,0 +1,3 @@
+ALTER TABLE hydra_oauth2_oidc DROP COLUMN grant_updated_at;
+ALTER TABLE hydra_oauth2_oidc DROP COLUMN previous_granted_audience;
+ALTER TABLE hydra_oauth2_oidc DROP COLUMN previous_granted_scope;
@@ -0,0 +1,3 @@
+ALTER TABLE hydra_oauth2_oidc ADD COLUMN previous_granted_scope TEXT NULL;
+ALTER TABLE hydra_oauth2_oidc ADD COLUMN previous_granted_audience TEXT NULL;
+ALTER TABLE hydra_oauth2_oidc ADD COLUMN grant_updated_at TIMESTAMP NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN revoked_at;
+ALTER TABLE hydra_oauth2_refresh DROP COLUMN revocation_reason;
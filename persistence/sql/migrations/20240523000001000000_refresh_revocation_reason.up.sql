@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN revocation_reason TEXT NULL;
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN revoked_at TIMESTAMP NULL;
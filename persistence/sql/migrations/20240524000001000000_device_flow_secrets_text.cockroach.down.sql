@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_flow ALTER COLUMN device_verifier TYPE VARCHAR(40);
+ALTER TABLE hydra_oauth2_flow ALTER COLUMN device_csrf TYPE VARCHAR(40);
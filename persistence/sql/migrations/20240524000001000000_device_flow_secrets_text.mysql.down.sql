@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_flow MODIFY device_verifier VARCHAR(40) NULL;
+ALTER TABLE hydra_oauth2_flow MODIFY device_csrf VARCHAR(40) NULL;
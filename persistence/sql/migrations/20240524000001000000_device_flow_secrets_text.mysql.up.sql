@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_flow MODIFY device_verifier TEXT NULL;
+ALTER TABLE hydra_oauth2_flow MODIFY device_csrf TEXT NULL;
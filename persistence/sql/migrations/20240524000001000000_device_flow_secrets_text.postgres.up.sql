@@ -0,0 +1,2 @@
+ALTER TABLE hydra_oauth2_flow ALTER COLUMN device_verifier TYPE TEXT;
+ALTER TABLE hydra_oauth2_flow ALTER COLUMN device_csrf TYPE TEXT;
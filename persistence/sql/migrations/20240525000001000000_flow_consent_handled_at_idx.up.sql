@@ -0,0 +1 @@
+CREATE INDEX hydra_oauth2_flow_nid_consent_handled_at_idx ON hydra_oauth2_flow (nid, consent_handled_at);
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_refresh ADD COLUMN graced_until TIMESTAMP NULL;
@@ -0,0 +1 @@
+ALTER TABLE hydra_oauth2_device_code ADD COLUMN device_challenge VARCHAR(255) NULL;
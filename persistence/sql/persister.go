@@ -47,6 +47,13 @@ type (
 		l           *logrusx.Logger
 		fallbackNID uuid.UUID
 		p           *networkx.Manager
+		flushConn   *pop.Connection
+
+		accessTokenCache    *accessTokenCache
+		sessionBackends     map[tableName]SessionBackend
+		flushArchiveSink    FlushArchiveSink
+		tokenTableNames     map[tableName]string
+		signatureStrategies []SignatureStrategy
 	}
 	Dependencies interface {
 		ClientHasher() fosite.Hasher
@@ -57,8 +64,22 @@ type (
 		x.RegistryLogger
 		x.TracingProvider
 	}
+
+	// tracerFallback falls back to a no-op tracer if the registry has none,
+	// e.g. because tracing failed to initialize, so that issuing tokens never
+	// fails because of tracing.
+	tracerFallback struct {
+		Dependencies
+	}
 )
 
+func (d tracerFallback) Tracer(ctx context.Context) *otelx.Tracer {
+	if t := d.Dependencies.Tracer(ctx); t.IsLoaded() {
+		return t
+	}
+	return otelx.NewNoop(d.Logger(), nil)
+}
+
 func (p *Persister) BeginTX(ctx context.Context) (_ context.Context, err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.BeginTX")
 	defer otelx.End(span, &err)
@@ -108,6 +129,7 @@ func (p *Persister) Rollback(ctx context.Context) (err error) {
 }
 
 func NewPersister(ctx context.Context, c *pop.Connection, r Dependencies, config *config.DefaultProvider, extraMigrations []fs.FS, goMigrations []popx.Migration) (*Persister, error) {
+	r = tracerFallback{Dependencies: r}
 	mb, err := popx.NewMigrationBox(
 		fsx.Merge(append([]fs.FS{Migrations}, extraMigrations...)...),
 		popx.NewMigrator(c, r.Logger(), r.Tracer(ctx), 0),
@@ -123,6 +145,8 @@ func NewPersister(ctx context.Context, c *pop.Connection, r Dependencies, config
 		config: config,
 		l:      r.Logger(),
 		p:      networkx.NewManager(c, r.Logger(), r.Tracer(ctx)),
+
+		accessTokenCache: newAccessTokenCache(),
 	}, nil
 }
 
@@ -135,6 +159,14 @@ func (p Persister) WithFallbackNetworkID(nid uuid.UUID) persistence.Persister {
 	return &p
 }
 
+// WithFlushConnection returns a copy of the persister which runs the
+// FlushInactive* maintenance queries on c instead of the connection pool used
+// to serve requests.
+func (p Persister) WithFlushConnection(c *pop.Connection) *Persister {
+	p.flushConn = c
+	return &p
+}
+
 func (p *Persister) CreateWithNetwork(ctx context.Context, v interface{}) error {
 	n := p.NetworkID(ctx)
 	return p.Connection(ctx).Create(p.mustSetNetwork(n, v))
@@ -165,6 +197,20 @@ func (p *Persister) Connection(ctx context.Context) *pop.Connection {
 	return popx.GetConnection(ctx, p.conn)
 }
 
+// FlushConnection returns the connection used by the FlushInactive* methods.
+// A transaction in the context takes precedence over the dedicated flush
+// connection, which in turn falls back to the regular connection.
+func (p *Persister) FlushConnection(ctx context.Context) *pop.Connection {
+	if p.flushConn == nil {
+		return p.Connection(ctx)
+	}
+	return popx.GetConnection(ctx, p.flushConn)
+}
+
+func (p *Persister) flushQueryWithNetwork(ctx context.Context) *pop.Query {
+	return p.FlushConnection(ctx).Where("nid = ?", p.NetworkID(ctx))
+}
+
 func (p *Persister) Ping() error {
 	type pinger interface{ Ping() error }
 	return p.conn.Store.(pinger).Ping()
@@ -0,0 +1,172 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+type (
+	// accessTokenCache is a bounded, in-memory LRU cache of active access token
+	// rows, keyed by network and signature. It is shared by all copies of a
+	// persister and only lives in the current process, so revocations on other
+	// nodes become visible after the TTL at the latest.
+	accessTokenCache struct {
+		sync.Mutex
+		entries map[string]*list.Element
+		lru     *list.List
+	}
+	accessTokenCacheEntry struct {
+		key       string
+		row       OAuth2RequestSQL
+		expiresAt time.Time
+	}
+)
+
+func newAccessTokenCache() *accessTokenCache {
+	return &accessTokenCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func accessTokenCacheKey(nid uuid.UUID, signature string) string {
+	return nid.String() + "/" + signature
+}
+
+// get returns a copy of the cached row, if it exists and has not expired.
+func (c *accessTokenCache) get(key string) (OAuth2RequestSQL, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return OAuth2RequestSQL{}, false
+	}
+	entry := e.Value.(*accessTokenCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeElement(e)
+		return OAuth2RequestSQL{}, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.row, true
+}
+
+// add caches the row for ttl, evicting the least recently used rows once the
+// cache holds more than size rows.
+func (c *accessTokenCache) add(key string, row OAuth2RequestSQL, ttl time.Duration, size int) {
+	c.Lock()
+	defer c.Unlock()
+
+	entry := &accessTokenCacheEntry{key: key, row: row, expiresAt: time.Now().Add(ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+	} else {
+		c.entries[key] = c.lru.PushFront(entry)
+	}
+	for c.lru.Len() > size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove evicts the row with the given key.
+func (c *accessTokenCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// removeRequest evicts all rows of the request in the network.
+func (c *accessTokenCache) removeRequest(nid uuid.UUID, requestID string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if row := e.Value.(*accessTokenCacheEntry).row; row.NID == nid && row.Request == requestID {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+// removeConsentChallenge evicts all rows issued from the consent challenge in
+// the network.
+func (c *accessTokenCache) removeConsentChallenge(nid uuid.UUID, challenge string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if row := e.Value.(*accessTokenCacheEntry).row; row.NID == nid && row.ConsentChallenge.Valid && row.ConsentChallenge.String == challenge {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+// removeNetwork evicts all rows of the network, for deletions which do not know
+// the affected rows individually, such as bulk or cascading deletes.
+func (c *accessTokenCache) removeNetwork(nid uuid.UUID) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*accessTokenCacheEntry).row.NID == nid {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+func (c *accessTokenCache) removeElement(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*accessTokenCacheEntry).key)
+}
+
+// cachedAccessToken returns the cached row of the access token, if caching is
+// enabled.
+func (p *Persister) cachedAccessToken(ctx context.Context, signature string) (*OAuth2RequestSQL, bool) {
+	if p.accessTokenCache == nil || p.config.GetAccessTokenCacheSize(ctx) <= 0 {
+		return nil, false
+	}
+	row, ok := p.accessTokenCache.get(accessTokenCacheKey(p.NetworkID(ctx), signature))
+	if !ok {
+		return nil, false
+	}
+	return &row, true
+}
+
+// cacheAccessToken caches the row of the access token if caching is enabled.
+// Only active tokens are cached, so that revoked tokens are never served from
+// the cache.
+func (p *Persister) cacheAccessToken(ctx context.Context, signature string, row *OAuth2RequestSQL) {
+	size := p.config.GetAccessTokenCacheSize(ctx)
+	if p.accessTokenCache == nil || size <= 0 || !row.Active {
+		return
+	}
+	p.accessTokenCache.add(accessTokenCacheKey(p.NetworkID(ctx), signature), *row, p.config.GetAccessTokenCacheTTL(ctx), size)
+}
@@ -5,6 +5,7 @@ package sql
 
 import (
 	"context"
+	"sync"
 
 	"github.com/ory/hydra/v2/x/events"
 
@@ -34,6 +35,56 @@ func (p *Persister) GetClient(ctx context.Context, id string) (fosite.Client, er
 	return p.GetConcreteClient(ctx, id)
 }
 
+// getClientIgnoringCase returns the client whose ID equals id when ignoring
+// case. Should several clients match, the first one by ID is returned.
+func (p *Persister) getClientIgnoringCase(ctx context.Context, id string) (fosite.Client, error) {
+	var cl client.Client
+	if err := p.QueryWithNetwork(ctx).Where("LOWER(id) = LOWER(?)", id).Order("id").First(&cl); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return &cl, nil
+}
+
+type (
+	clientCacheKey struct{}
+	clientCache    struct {
+		sync.Mutex
+		clients map[string]fosite.Client
+	}
+)
+
+// WithClientCache returns a context in which clients loaded for token sessions
+// are memoized, so that repeatedly reading sessions of the same client within
+// one request queries the client only once. The cache lives as long as the
+// returned context and is never invalidated, so it should be scoped to a
+// single request.
+func WithClientCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientCacheKey{}, &clientCache{clients: make(map[string]fosite.Client)})
+}
+
+// getCachedClient returns the client from the cache in the context, loading it
+// on a miss. Without a cache in the context, the client is always loaded.
+func (p *Persister) getCachedClient(ctx context.Context, id string) (fosite.Client, error) {
+	cache, ok := ctx.Value(clientCacheKey{}).(*clientCache)
+	if !ok {
+		return p.GetClient(ctx, id)
+	}
+
+	key := p.NetworkID(ctx).String() + "/" + id
+	cache.Lock()
+	defer cache.Unlock()
+	if c, ok := cache.clients[key]; ok {
+		return c, nil
+	}
+
+	c, err := p.GetClient(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	cache.clients[key] = c
+	return c, nil
+}
+
 func (p *Persister) UpdateClient(ctx context.Context, cl *client.Client) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.UpdateClient")
 	defer otelx.End(span, &err)
@@ -119,6 +170,8 @@ func (p *Persister) CreateClient(ctx context.Context, c *client.Client) (err err
 func (p *Persister) DeleteClient(ctx context.Context, id string) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteClient")
 	defer otelx.End(span, &err)
+	// Deleting the client deletes its access tokens, too.
+	defer p.accessTokenCache.removeNetwork(p.NetworkID(ctx))
 
 	c, err := p.GetConcreteClient(ctx, id)
 	if err != nil {
@@ -0,0 +1,85 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// CompatPath is a code path taken by the persister to stay compatible with data
+// written by older versions or under another configuration, or the modern path
+// it replaces, as recorded in a CompatReport.
+type CompatPath string
+
+const (
+	// CompatPathHashedSignature is taken when an access token is found under
+	// the signature of the current signature strategy.
+	CompatPathHashedSignature CompatPath = "hashed_signature"
+	// CompatPathLegacySignature is taken when an access token is only found
+	// under the signature of a previous signature strategy, e.g. the
+	// unhashed signatures of older versions.
+	CompatPathLegacySignature CompatPath = "legacy_signature"
+	// CompatPathEncryptedWrite is taken when session data is encrypted
+	// before it is stored.
+	CompatPathEncryptedWrite CompatPath = "encrypted_write"
+	// CompatPathPlaintextWrite is taken when session data is stored
+	// unencrypted.
+	CompatPathPlaintextWrite CompatPath = "plaintext_write"
+	// CompatPathDecryptedRead is taken when stored session data is decrypted.
+	CompatPathDecryptedRead CompatPath = "decrypted_read"
+	// CompatPathPlaintextRead is taken when stored session data is read
+	// without decrypting it.
+	CompatPathPlaintextRead CompatPath = "plaintext_read"
+	// CompatPathPlaintextAssumptionFallback is taken when session data is
+	// assumed to be unencrypted, see AssumePlaintextSessionData, but turns
+	// out to be encrypted and is decrypted after all.
+	CompatPathPlaintextAssumptionFallback CompatPath = "plaintext_assumption_fallback"
+)
+
+type compatReportKey struct{}
+
+// CompatReport records which CompatPaths the persister took while handling a
+// request, e.g. to track how far a migration of the stored data progressed.
+// It is safe for concurrent use.
+type CompatReport struct {
+	mu     sync.Mutex
+	counts map[CompatPath]int
+}
+
+// WithCompatReport returns a context in which the persister records the
+// CompatPaths it takes into the returned report. Without a report in the
+// context, nothing is recorded. The report lives as long as the returned
+// context, so it should be scoped to a single request.
+func WithCompatReport(ctx context.Context) (context.Context, *CompatReport) {
+	r := &CompatReport{counts: make(map[CompatPath]int)}
+	return context.WithValue(ctx, compatReportKey{}, r), r
+}
+
+// Counts returns how often each path was taken. Paths which were not taken
+// are absent.
+func (r *CompatReport) Counts() map[CompatPath]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.counts)
+}
+
+// Took reports whether the path was taken at least once.
+func (r *CompatReport) Took(path CompatPath) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[path] > 0
+}
+
+// recordCompatPath records the path into the report of the context, if any.
+func recordCompatPath(ctx context.Context, path CompatPath) {
+	r, ok := ctx.Value(compatReportKey{}).(*CompatReport)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[path]++
+}
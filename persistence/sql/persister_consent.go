@@ -24,6 +24,7 @@ import (
 	"github.com/ory/fosite"
 	"github.com/ory/hydra/v2/client"
 	"github.com/ory/hydra/v2/consent"
+	"github.com/ory/hydra/v2/driver/config"
 	"github.com/ory/hydra/v2/flow"
 	"github.com/ory/hydra/v2/x"
 	"github.com/ory/x/sqlcon"
@@ -34,6 +35,8 @@ var _ consent.Manager = &Persister{}
 func (p *Persister) RevokeSubjectConsentSession(ctx context.Context, user string) error {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeSubjectConsentSession")
 	defer span.End()
+	// Deleting the flows deletes the access tokens issued from them, too.
+	defer p.accessTokenCache.removeNetwork(p.NetworkID(ctx))
 
 	return p.Transaction(ctx, p.revokeConsentSession("consent_challenge_id IS NOT NULL AND subject = ?", user))
 }
@@ -41,6 +44,7 @@ func (p *Persister) RevokeSubjectConsentSession(ctx context.Context, user string
 func (p *Persister) RevokeSubjectClientConsentSession(ctx context.Context, user, client string) error {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeSubjectClientConsentSession")
 	defer span.End()
+	defer p.accessTokenCache.removeNetwork(p.NetworkID(ctx))
 
 	return p.Transaction(ctx, p.revokeConsentSession("consent_challenge_id IS NOT NULL AND subject = ? AND client_id = ?", user, client))
 }
@@ -226,6 +230,12 @@ func (p *Persister) CreateDeviceUserAuthRequest(ctx context.Context, req *flow.D
 	if nid == uuid.Nil {
 		return nil, errorsx.WithStack(x.ErrNotFound)
 	}
+	if err := flow.ValidateDeviceVerifier("verifier", req.Verifier); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
+	if err := flow.ValidateDeviceVerifier("csrf", req.CSRF); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
 	f := flow.NewDeviceFlow(req)
 	f.NID = nid
 
@@ -263,6 +273,9 @@ func (p *Persister) HandleDeviceUserAuthRequest(ctx context.Context, f *flow.Flo
 	if f.NID != p.NetworkID(ctx) {
 		return nil, errorsx.WithStack(x.ErrNotFound)
 	}
+	if err := r.CheckHandledAt(time.Now().UTC(), p.config.GetDeviceAuthFutureHandledAt(ctx) == config.DeviceAuthFutureHandledAtReject); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
 	err := f.HandleDeviceUserAuthRequest(r)
 	if err != nil {
 		return nil, err
@@ -284,13 +297,175 @@ func (p *Persister) VerifyAndInvalidateDeviceUserAuthRequest(ctx context.Context
 		return nil, errorsx.WithStack(sqlcon.ErrNoRows)
 	}
 
-	if err = f.InvalidateDeviceRequest(); err != nil {
+	if err = f.InvalidateDeviceRequest(f.RequestedAt.Add(p.config.ConsentRequestMaxAge(ctx))); errors.Is(err, x.ErrDeviceFlowExpired) {
+		return nil, err
+	} else if err != nil {
 		return nil, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebug(err.Error()))
 	}
 
 	return f.GetHandledDeviceUserAuthRequest(), nil
 }
 
+// GetDeviceFlowSubject returns the subject who approved the device flow of the
+// device challenge. Device flows are only persisted once their consent was
+// handled, so it returns x.ErrNotFound for all others.
+func (p *Persister) GetDeviceFlowSubject(ctx context.Context, deviceChallenge string) (_ string, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetDeviceFlowSubject")
+	defer otelx.End(span, &err)
+
+	var row struct {
+		Subject string `db:"subject"`
+	}
+	/* #nosec G201 table is static */
+	err = p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT subject FROM %s WHERE device_challenge_id = ? AND nid = ? AND subject <> '' LIMIT 1", (&flow.Flow{}).TableName()),
+		deviceChallenge,
+		p.NetworkID(ctx),
+	).First(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", errorsx.WithStack(x.ErrNotFound)
+	} else if err != nil {
+		return "", sqlcon.HandleError(err)
+	}
+	return row.Subject, nil
+}
+
+// ListApprovedUnpolledDeviceFlows returns the device flows whose consent was
+// granted before approvedBefore, but whose device has neither exchanged its
+// device code for tokens nor polled since, ordered by when they were approved.
+// It surfaces devices which never came back after the end-user approved them,
+// including those whose device code expired meanwhile.
+//
+// Device flows are only persisted once their consent verifier is used, so an
+// approved flow is stored as FlowStateConsentUsed rather than in an "unused"
+// state. Whether the device came back is therefore taken from its device code,
+// which stays active until it is exchanged, and from its last poll.
+func (p *Persister) ListApprovedUnpolledDeviceFlows(ctx context.Context, approvedBefore time.Time) (_ []*flow.Flow, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ListApprovedUnpolledDeviceFlows")
+	defer otelx.End(span, &err)
+
+	flowTable := (&flow.Flow{}).TableName()
+	var fs []flow.Flow
+	/* #nosec G201 the flow table is static and the device code table name is validated by SetTokenTableNames */
+	if err := p.QueryWithNetwork(ctx).
+		Where(
+			fmt.Sprintf(`device_challenge_id IS NOT NULL AND (state = ? OR state = ?) AND consent_handled_at < ? AND EXISTS (
+SELECT 1 FROM %[1]s WHERE %[1]s.request_id = %[2]s.device_code_request_id AND %[1]s.nid = %[2]s.nid AND %[1]s.active = ?
+AND (%[1]s.last_polled_at IS NULL OR %[1]s.last_polled_at < %[2]s.consent_handled_at))`, p.tokenTable(ctx, sqlTableDeviceCode).TableName(), flowTable),
+			flow.FlowStateConsentUnused,
+			flow.FlowStateConsentUsed,
+			approvedBefore.UTC(),
+			true,
+		).
+		Order("consent_handled_at ASC").
+		All(&fs); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	flows := make([]*flow.Flow, len(fs))
+	for i := range fs {
+		if err := p.decryptDeviceSecrets(ctx, &fs[i]); err != nil {
+			return nil, err
+		}
+		flows[i] = &fs[i]
+	}
+	return flows, nil
+}
+
+// FlushStaleDeviceFlows deletes the device flows of the network which were
+// requested before notAfter and can no longer make progress, in batches of
+// batchSize, and returns how many it deleted. These are flows in a terminal
+// state, i.e. used or erred, and flows which are still waiting for the login
+// or consent but expired because they are older than ttl.login_consent_request.
+// Erred flows are additionally kept for ttl.device_flow_error, so that the
+// failure reason remains available for diagnosis.
+//
+// Tokens reference the flow they were granted through and are deleted with
+// it, so used flows are only deleted once the device exchanged its device code
+// and no access or refresh token of the flow is left. A freshly used flow whose
+// device has not fetched its tokens yet is therefore never deleted.
+func (p *Persister) FlushStaleDeviceFlows(ctx context.Context, notAfter time.Time, batchSize int) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushStaleDeviceFlows")
+	defer otelx.End(span, &err)
+
+	if maxBatchSize := p.config.DbFlushMaxBatchSize(ctx); maxBatchSize > 0 && batchSize > maxBatchSize {
+		batchSize = maxBatchSize
+	}
+
+	expiredBefore := time.Now().Add(-p.config.ConsentRequestMaxAge(ctx))
+	if notAfter.Before(expiredBefore) {
+		expiredBefore = notAfter
+	}
+	erredBefore := time.Now().Add(-p.config.GetDeviceFlowErrorRetention(ctx))
+	if notAfter.Before(erredBefore) {
+		erredBefore = notAfter
+	}
+
+	flowTable := (&flow.Flow{}).TableName()
+	erred := `(state IN (?)
+	OR (device_error IS NOT NULL AND device_error <> '{}' AND device_error <> '')
+	OR (login_error IS NOT NULL AND login_error <> '{}' AND login_error <> '')
+	OR (consent_error IS NOT NULL AND consent_error <> '{}' AND consent_error <> ''))`
+	/* #nosec G201 tables are static */
+	query := fmt.Sprintf(`SELECT login_challenge FROM %[1]s
+WHERE device_challenge_id IS NOT NULL AND nid = ? AND requested_at < ? AND (
+	(%[2]s AND requested_at < ?)
+	OR (NOT %[2]s AND state = ?
+		AND NOT EXISTS (SELECT 1 FROM %[3]s WHERE %[3]s.request_id = %[1]s.device_code_request_id AND %[3]s.nid = %[1]s.nid AND %[3]s.active = ?)
+		AND NOT EXISTS (SELECT 1 FROM %[4]s WHERE %[4]s.challenge_id = %[1]s.consent_challenge_id)
+		AND NOT EXISTS (SELECT 1 FROM %[5]s WHERE %[5]s.challenge_id = %[1]s.consent_challenge_id))
+	OR (NOT %[2]s AND state <> ? AND requested_at < ?)
+)
+ORDER BY login_challenge
+LIMIT %[6]d`,
+		flowTable,
+		erred,
+		p.tokenTable(ctx, sqlTableDeviceCode).TableName(),
+		p.tokenTable(ctx, sqlTableAccess).TableName(),
+		p.tokenTable(ctx, sqlTableRefresh).TableName(),
+		batchSize,
+	)
+
+	erredStates := []int16{flow.FlowStateLoginError, flow.FlowStateConsentError, flow.DeviceFlowStateError}
+	deleted := 0
+	for {
+		var challenges []string
+		if err := p.FlushConnection(ctx).RawQuery(query,
+			p.NetworkID(ctx),
+			notAfter,
+			erredStates,
+			erredBefore,
+			erredStates,
+			flow.FlowStateConsentUsed,
+			true,
+			erredStates,
+			flow.FlowStateConsentUsed,
+			expiredBefore,
+		).All(&challenges); err != nil {
+			return deleted, sqlcon.HandleError(err)
+		}
+		if len(challenges) == 0 {
+			return deleted, nil
+		}
+
+		count, err := p.execBulkStatement(ctx, p.FlushConnection(ctx), func(c *pop.Connection) (int, error) {
+			/* #nosec G201 table is static */
+			return c.RawQuery(
+				fmt.Sprintf("DELETE FROM %s WHERE login_challenge IN (?) AND nid = ?", flowTable),
+				challenges,
+				p.NetworkID(ctx),
+			).ExecWithCount()
+		})
+		deleted += count
+		if err != nil {
+			return deleted, sqlcon.HandleError(err)
+		}
+		if len(challenges) < batchSize {
+			return deleted, nil
+		}
+	}
+}
+
 func (p *Persister) CreateLoginRequest(ctx context.Context, f *flow.Flow, req *flow.LoginRequest) (*flow.Flow, error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateLoginRequest")
 	defer span.End()
@@ -336,6 +511,9 @@ func (p *Persister) GetFlow(ctx context.Context, loginChallenge string) (*flow.F
 		}
 		return nil, sqlcon.HandleError(err)
 	}
+	if err := p.decryptDeviceSecrets(ctx, &f); err != nil {
+		return nil, err
+	}
 	return &f, nil
 }
 
@@ -401,6 +579,9 @@ func (p *Persister) VerifyAndInvalidateConsentRequest(ctx context.Context, verif
 	// without encoding the whole flow.
 	f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
 
+	if err = p.encryptDeviceSecrets(ctx, f); err != nil {
+		return nil, err
+	}
 	if err = p.Connection(ctx).Create(f); err != nil {
 		return nil, sqlcon.HandleError(err)
 	}
@@ -858,7 +1039,7 @@ func (p *Persister) FlushInactiveLoginConsentRequests(ctx context.Context, notAf
 	// - flow.consent_error has valid error (consent rejected)
 	// AND timed-out
 	// - flow.requested_at < minimum of ttl.login_consent_request and notAfter
-	q := p.Connection(ctx).RawQuery(fmt.Sprintf(queryFormat, limit), flow.FlowStateConsentUsed, notAfter, p.NetworkID(ctx))
+	q := p.FlushConnection(ctx).RawQuery(fmt.Sprintf(queryFormat, limit), flow.FlowStateConsentUsed, notAfter, p.NetworkID(ctx))
 
 	if err := q.All(&challenges); err == sql.ErrNoRows {
 		return errors.Wrap(fosite.ErrNotFound, "")
@@ -871,13 +1052,13 @@ func (p *Persister) FlushInactiveLoginConsentRequests(ctx context.Context, notAf
 			j = len(challenges)
 		}
 
-		q := p.Connection(ctx).RawQuery(
-			fmt.Sprintf("DELETE FROM %s WHERE login_challenge in (?) AND nid = ?", (&f).TableName()),
-			challenges[i:j],
-			p.NetworkID(ctx),
-		)
-
-		if err := q.Exec(); err != nil {
+		if _, err := p.execBulkStatement(ctx, p.FlushConnection(ctx), func(c *pop.Connection) (int, error) {
+			return c.RawQuery(
+				fmt.Sprintf("DELETE FROM %s WHERE login_challenge in (?) AND nid = ?", (&f).TableName()),
+				challenges[i:j],
+				p.NetworkID(ctx),
+			).ExecWithCount()
+		}); err != nil {
 			return sqlcon.HandleError(err)
 		}
 	}
@@ -0,0 +1,66 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ory/hydra/v2/flow"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/sqlxx"
+)
+
+// encryptedDeviceSecretPrefix marks encrypted device flow verifiers and CSRF
+// tokens. Plaintext values only consist of the characters allowed by
+// flow.ValidateDeviceVerifier, so they never start with it, which lets reads
+// tell both apart while encryption is rolled out.
+const encryptedDeviceSecretPrefix = "aead:"
+
+// encryptDeviceSecrets encrypts the device verifier and CSRF token of the flow
+// before it is stored, if enabled by the configuration.
+func (p *Persister) encryptDeviceSecrets(ctx context.Context, f *flow.Flow) (err error) {
+	if !p.config.DeviceAuthEncryptSecretsAtRest(ctx) {
+		return nil
+	}
+	if f.DeviceVerifier, err = p.encryptDeviceSecret(ctx, f.DeviceVerifier); err != nil {
+		return err
+	}
+	f.DeviceCSRF, err = p.encryptDeviceSecret(ctx, f.DeviceCSRF)
+	return err
+}
+
+func (p *Persister) encryptDeviceSecret(ctx context.Context, secret sqlxx.NullString) (sqlxx.NullString, error) {
+	if secret == "" || strings.HasPrefix(string(secret), encryptedDeviceSecretPrefix) {
+		return secret, nil
+	}
+	ciphertext, err := p.r.KeyCipher().Encrypt(ctx, []byte(secret), nil)
+	if err != nil {
+		return "", errorsx.WithStack(err)
+	}
+	return sqlxx.NullString(encryptedDeviceSecretPrefix + ciphertext), nil
+}
+
+// decryptDeviceSecrets decrypts the device verifier and CSRF token of a flow
+// read from the database. Values stored in plaintext, e.g. before encryption
+// was enabled, are left as-is regardless of the configuration.
+func (p *Persister) decryptDeviceSecrets(ctx context.Context, f *flow.Flow) (err error) {
+	if f.DeviceVerifier, err = p.decryptDeviceSecret(ctx, f.DeviceVerifier); err != nil {
+		return err
+	}
+	f.DeviceCSRF, err = p.decryptDeviceSecret(ctx, f.DeviceCSRF)
+	return err
+}
+
+func (p *Persister) decryptDeviceSecret(ctx context.Context, secret sqlxx.NullString) (sqlxx.NullString, error) {
+	ciphertext, ok := strings.CutPrefix(string(secret), encryptedDeviceSecretPrefix)
+	if !ok {
+		return secret, nil
+	}
+	plaintext, err := p.r.KeyCipher().Decrypt(ctx, ciphertext, nil)
+	if err != nil {
+		return "", errorsx.WithStack(err)
+	}
+	return sqlxx.NullString(plaintext), nil
+}
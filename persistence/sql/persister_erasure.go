@@ -0,0 +1,90 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gobuffalo/pop/v6"
+
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// ErasureReport is the number of rows ErasureBySubject deleted per table.
+type ErasureReport map[string]int
+
+// erasureTables are the tables besides the token tables which hold data of a
+// subject, in the order they are erased: flows reference login sessions.
+var erasureTables = []string{
+	"hydra_oauth2_flow",
+	"hydra_oauth2_logout_request",
+	"hydra_oauth2_obfuscated_authentication_session",
+	"hydra_oauth2_authentication_session",
+	"hydra_oauth2_trusted_jwt_bearer_issuer",
+}
+
+// ErasureBySubject deletes all data of the subject in the current network, e.g.
+// for right-to-erasure requests: all token sessions, login, consent and device
+// flows, login and logout sessions, obfuscated subjects, and trust
+// relationships allowing issuers to assert the subject. It returns the number
+// of deleted rows per table for auditing. Erasing a subject again deletes
+// nothing.
+//
+// Rows are matched by their subject column, as session data may be encrypted.
+// Used JTIs are not erased, as they are only stored by client, and neither are
+// outbox events, which hold no subject.
+func (p *Persister) ErasureBySubject(ctx context.Context, subject string) (_ ErasureReport, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ErasureBySubject")
+	defer otelx.End(span, &err)
+
+	if err := p.requireSQLSessionBackend(tokenTables...); err != nil {
+		return nil, err
+	}
+
+	report := make(ErasureReport)
+	var requestIDs []string
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		// Tokens reference their flow, so they are erased first.
+		tables := make([]string, 0, len(tokenTables)+len(erasureTables))
+		for _, table := range tokenTables {
+			tables = append(tables, p.tokenTable(ctx, table).TableName())
+		}
+		tables = append(tables, erasureTables...)
+
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := c.RawQuery(
+			fmt.Sprintf("SELECT DISTINCT request_id FROM %s WHERE subject = ? AND nid = ?", p.tokenTable(ctx, sqlTableAccess).TableName()),
+			subject,
+			p.NetworkID(ctx),
+		).All(&requestIDs); err != nil {
+			return sqlcon.HandleError(err)
+		}
+
+		for _, table := range tables {
+			n, err := p.execBulkStatement(ctx, c, func(c *pop.Connection) (int, error) {
+				/* #nosec G201 token table names are validated by SetTokenTableNames */
+				return c.RawQuery(
+					fmt.Sprintf("DELETE FROM %s WHERE subject = ? AND nid = ?", table),
+					subject,
+					p.NetworkID(ctx),
+				).ExecWithCount()
+			})
+			if err != nil {
+				return sqlcon.HandleError(err)
+			}
+			report[table] = n
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return report, nil
+}
@@ -0,0 +1,134 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/v2/oauth2"
+	"github.com/ory/hydra/v2/x/events"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/otelx/semconv"
+	"github.com/ory/x/sqlcon"
+)
+
+// replayIssuanceEventsPageSize is the number of rows ReplayIssuanceEvents reads
+// from the database at once.
+const replayIssuanceEventsPageSize = 1000
+
+// issuanceEvents maps the token tables to the events emitted when their tokens
+// are issued.
+var issuanceEvents = map[tableName]semconv.Event{
+	sqlTableAccess:  events.AccessTokenIssued,
+	sqlTableRefresh: events.RefreshTokenIssued,
+	sqlTableOpenID:  events.IdentityTokenIssued,
+}
+
+// IssuanceEvent is an issuance event reconstructed from a stored token by
+// ReplayIssuanceEvents.
+type IssuanceEvent struct {
+	// Name is the name of the event emitted at issuance.
+	Name semconv.Event
+	// Attributes are the attributes of the event emitted at issuance, apart
+	// from those taken from the context of the issuing request.
+	Attributes []attribute.KeyValue
+	// IssuedAt is when the token was issued.
+	IssuedAt time.Time
+	// RequestID is the ID of the request which issued the token.
+	RequestID string
+}
+
+// ReplayIssuanceEvents reconstructs the issuance events of the tokens of the
+// table in the current network which were issued after since, and passes them
+// to fn in the order the tokens were issued, e.g. to backfill an event sink
+// which was down. Revoked tokens are replayed as well, as their issuance was
+// emitted, too. Only the access, refresh and OpenID Connect tables emit
+// issuance events. Replaying stops at the first error returned by fn.
+func (p *Persister) ReplayIssuanceEvents(ctx context.Context, table tableName, since time.Time, fn func(IssuanceEvent) error) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ReplayIssuanceEvents")
+	defer otelx.End(span, &err)
+
+	name, ok := issuanceEvents[table]
+	if !ok {
+		return errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Tokens of table %q do not emit issuance events.", table))
+	}
+
+	// Only access and refresh tokens record the grant they originate from.
+	grantType := "NULL AS grant_type"
+	if slices.Contains(optionalTokenTableColumns[table], "grant_type") {
+		grantType = "grant_type"
+	}
+
+	since = since.UTC()
+	lastRequestedAt, lastSignature := since, ""
+	for {
+		var rows []struct {
+			Signature   string         `db:"signature"`
+			Request     string         `db:"request_id"`
+			RequestedAt time.Time      `db:"requested_at"`
+			Client      string         `db:"client_id"`
+			Subject     string         `db:"subject"`
+			Form        string         `db:"form_data"`
+			GrantType   sql.NullString `db:"grant_type"`
+		}
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf(`SELECT signature, request_id, requested_at, client_id, subject, form_data, %s FROM %s
+				WHERE nid = ? AND requested_at > ? AND (requested_at > ? OR (requested_at = ? AND signature > ?))
+				ORDER BY requested_at, signature LIMIT %d`, grantType, p.tokenTable(ctx, table).TableName(), replayIssuanceEventsPageSize),
+			p.NetworkID(ctx),
+			since,
+			lastRequestedAt, lastRequestedAt, lastSignature,
+		).All(&rows); err != nil {
+			return sqlcon.HandleError(err)
+		}
+
+		for _, row := range rows {
+			form, err := url.ParseQuery(row.Form)
+			if err != nil {
+				return errorsx.WithStack(err)
+			}
+			if row.GrantType.Valid {
+				form.Set("grant_type", row.GrantType.String)
+			}
+			requester := &fosite.Request{
+				ID:          row.Request,
+				RequestedAt: row.RequestedAt,
+				Client:      &fosite.DefaultClient{ID: row.Client},
+				Form:        form,
+				Session:     oauth2.NewSession(row.Subject),
+			}
+
+			// Mirror the options of the Create*Session methods.
+			opts := toEventOptions(requester)
+			if table == sqlTableAccess {
+				opts = append(opts, events.WithGrantType(form.Get("grant_type")))
+			}
+			config := trace.NewEventConfig(opts...)
+
+			if err := fn(IssuanceEvent{
+				Name:       name,
+				Attributes: config.Attributes(),
+				IssuedAt:   row.RequestedAt,
+				RequestID:  row.Request,
+			}); err != nil {
+				return err
+			}
+		}
+		if len(rows) < replayIssuanceEventsPageSize {
+			return nil
+		}
+		lastRequestedAt, lastSignature = rows[len(rows)-1].RequestedAt, rows[len(rows)-1].Signature
+	}
+}
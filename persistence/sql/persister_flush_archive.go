@@ -0,0 +1,100 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ory/x/sqlcon"
+	"github.com/ory/x/stringsx"
+)
+
+// FlushArchiveRecord is the metadata of a token which is about to be flushed.
+// It contains no secrets: neither the signature, nor the session or form data.
+type FlushArchiveRecord struct {
+	RequestID         string
+	RequestedAt       time.Time
+	ClientID          string
+	Subject           string
+	RequestedScope    []string
+	GrantedScope      []string
+	RequestedAudience []string
+	GrantedAudience   []string
+	Active            bool
+}
+
+// FlushArchiveSink archives the metadata of flushed tokens, e.g. to ship it to
+// cold storage for retention requirements.
+type FlushArchiveSink interface {
+	// Archive is called with each batch of tokens of the table before the
+	// batch is deleted. If it returns an error, the batch is not deleted and
+	// the flush is aborted.
+	Archive(ctx context.Context, table string, records []FlushArchiveRecord) error
+}
+
+// SetFlushArchiveSink archives the metadata of flushed tokens to the sink
+// before deleting them. Passing a nil sink disables archival, which is the
+// default. It must be called before the persister handles requests.
+func (p *Persister) SetFlushArchiveSink(sink FlushArchiveSink) {
+	p.flushArchiveSink = sink
+}
+
+// flushArchivedBatch deletes up to limit tokens of the table matching the
+// flush selection after handing their metadata to the archive sink.
+func (p *Persister) flushArchivedBatch(ctx context.Context, table tableName, condition string, conditionArgs []interface{}, notAfter time.Time, limit int) (int, error) {
+	t := p.tokenTable(ctx, table).TableName()
+
+	var rows []struct {
+		Signature         string    `db:"signature"`
+		Request           string    `db:"request_id"`
+		RequestedAt       time.Time `db:"requested_at"`
+		Client            string    `db:"client_id"`
+		Subject           string    `db:"subject"`
+		Scopes            string    `db:"scope"`
+		GrantedScope      string    `db:"granted_scope"`
+		RequestedAudience string    `db:"requested_audience"`
+		GrantedAudience   string    `db:"granted_audience"`
+		Active            bool      `db:"active"`
+	}
+	/* #nosec G201 table and condition are static */
+	if err := p.FlushConnection(ctx).RawQuery(
+		fmt.Sprintf(`SELECT signature, request_id, requested_at, client_id, subject, scope, granted_scope, requested_audience, granted_audience, active
+			FROM %s WHERE requested_at < ? AND nid = ? AND (%s) ORDER BY requested_at LIMIT %d`, t, condition, limit),
+		append([]interface{}{notAfter, p.NetworkID(ctx)}, conditionArgs...)...,
+	).All(&rows); err != nil {
+		return 0, sqlcon.HandleError(err)
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+
+	records := make([]FlushArchiveRecord, len(rows))
+	signatures := make([]string, len(rows))
+	for i, row := range rows {
+		records[i] = FlushArchiveRecord{
+			RequestID:         row.Request,
+			RequestedAt:       row.RequestedAt,
+			ClientID:          row.Client,
+			Subject:           row.Subject,
+			RequestedScope:    stringsx.Splitx(row.Scopes, "|"),
+			GrantedScope:      stringsx.Splitx(row.GrantedScope, "|"),
+			RequestedAudience: stringsx.Splitx(row.RequestedAudience, "|"),
+			GrantedAudience:   stringsx.Splitx(row.GrantedAudience, "|"),
+			Active:            row.Active,
+		}
+		signatures[i] = row.Signature
+	}
+	if err := p.flushArchiveSink.Archive(ctx, string(table), records); err != nil {
+		return 0, err
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	return p.FlushConnection(ctx).RawQuery(
+		fmt.Sprintf("DELETE FROM %s WHERE signature IN (?) AND nid = ?", t),
+		signatures,
+		p.NetworkID(ctx),
+	).ExecWithCount()
+}
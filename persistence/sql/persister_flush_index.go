@@ -0,0 +1,101 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/hydra/v2/x"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/sqlcon"
+)
+
+// flushIndexColumns are the columns an index must lead with, in any order, to
+// support selecting the tokens to flush.
+var flushIndexColumns = []string{"nid", "requested_at"}
+
+// indexColumn is a column of an index, as returned by indexColumns.
+type indexColumn struct {
+	Index  string `db:"index_name"`
+	Seq    int    `db:"seq"`
+	Column string `db:"column_name"`
+}
+
+// indexColumns returns the columns of all indexes of the table, ordered by
+// index and position within the index.
+func (p *Persister) indexColumns(ctx context.Context, table string) ([]indexColumn, error) {
+	c := p.FlushConnection(ctx)
+
+	var query string
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		query = "SELECT il.name AS index_name, ii.seqno AS seq, ii.name AS column_name FROM pragma_index_list(?) il JOIN pragma_index_info(il.name) ii ORDER BY il.name, ii.seqno"
+	case "postgres":
+		query = `SELECT c.relname AS index_name, k.n AS seq, a.attname AS column_name FROM pg_index ix
+			JOIN pg_class t ON t.oid = ix.indrelid
+			JOIN pg_class c ON c.oid = ix.indexrelid
+			CROSS JOIN LATERAL unnest(ix.indkey::int2[]) WITH ORDINALITY AS k(attnum, n)
+			JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = k.attnum
+			WHERE t.relname = ? AND pg_table_is_visible(t.oid) ORDER BY c.relname, k.n`
+	case "mysql":
+		query = "SELECT index_name, seq_in_index AS seq, column_name FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? ORDER BY index_name, seq_in_index"
+	default:
+		query = "SELECT index_name, seq_in_index AS seq, column_name FROM information_schema.statistics WHERE table_schema = current_schema() AND table_name = ? ORDER BY index_name, seq_in_index"
+	}
+
+	var columns []indexColumn
+	if err := c.RawQuery(query, table).All(&columns); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return columns, nil
+}
+
+// hasFlushIndex reports whether one of the indexes leads with
+// flushIndexColumns.
+func hasFlushIndex(columns []indexColumn) bool {
+	leading := map[string][]string{}
+	for _, c := range columns {
+		if len(leading[c.Index]) < len(flushIndexColumns) {
+			leading[c.Index] = append(leading[c.Index], strings.ToLower(c.Column))
+		}
+	}
+	for _, l := range leading {
+		if len(l) == len(flushIndexColumns) && !slices.ContainsFunc(flushIndexColumns, func(c string) bool { return !slices.Contains(l, c) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFlushIndex verifies that the token table has an index supporting the
+// selection of tokens to flush. Without it, every flush batch scans the whole
+// table. Depending on DbFlushMissingIndex, a missing index is logged or the
+// flush is refused with an error wrapping x.ErrFlushIndexMissing.
+func (p *Persister) checkFlushIndex(ctx context.Context, table tableName) error {
+	mode := p.config.DbFlushMissingIndex(ctx)
+	if mode == config.DbFlushMissingIndexIgnore {
+		return nil
+	}
+
+	name := p.tokenTable(ctx, table).TableName()
+	columns, err := p.indexColumns(ctx, name)
+	if err != nil {
+		return err
+	} else if hasFlushIndex(columns) {
+		return nil
+	}
+
+	if mode == config.DbFlushMissingIndexRefuse {
+		return errorsx.WithStack(fosite.ErrServerError.
+			WithWrap(x.ErrFlushIndexMissing).
+			WithDebugf("The table %s has no index on (%s), so flushing it would scan the whole table. Restore the index by running the migrations, or set %s to %q to flush anyway.", name, strings.Join(flushIndexColumns, ", "), config.KeyDBFlushMissingIndex, config.DbFlushMissingIndexWarn))
+	}
+	p.l.WithField("table", name).WithField("columns", flushIndexColumns).
+		Error("The table has no index supporting the flush, so every flush batch scans the whole table. Restore the index by running the migrations.")
+	return nil
+}
@@ -247,5 +247,5 @@ func (p *Persister) FlushInactiveGrants(ctx context.Context, notAfter time.Time,
 	if deleteUntil.After(notAfter) {
 		deleteUntil = notAfter
 	}
-	return sqlcon.HandleError(p.QueryWithNetwork(ctx).Where("expires_at < ?", deleteUntil).Delete(&trust.SQLData{}))
+	return sqlcon.HandleError(p.flushQueryWithNetwork(ctx).Where("expires_at < ?", deleteUntil).Delete(&trust.SQLData{}))
 }
@@ -5,6 +5,7 @@ package sql
 
 import (
 	"context"
+	"crypto/sha512"
 	"embed"
 	"fmt"
 	"strconv"
@@ -12,10 +13,12 @@ import (
 	"time"
 
 	"github.com/gobuffalo/pop/v6"
+	"github.com/pkg/errors"
 
 	"github.com/ory/x/popx"
 
 	"github.com/ory/x/errorsx"
+	"github.com/ory/x/otelx"
 
 	"github.com/ory/x/sqlcon"
 )
@@ -40,6 +43,154 @@ func (p *Persister) MigrationStatus(ctx context.Context) (popx.MigrationStatuses
 	return status, nil
 }
 
+// optionalTokenTableColumns lists the columns which were added to the token
+// tables by later migrations, keyed by table.
+var optionalTokenTableColumns = map[tableName][]string{
+	sqlTableAccess:     {"auth_time", "client_snapshot", "introspection_audience", "grant_type", "expires_at", "device_challenge", "amr", "sid", "issuer", "flagged_at", "flagged_reason"},
+	sqlTableRefresh:    {"auth_time", "client_snapshot", "grant_type", "expires_at", "device_challenge", "amr", "sid", "issuer", "flagged_at", "flagged_reason", "sliding_expires_at", "absolute_expires_at", "chain_length", "revocation_reason", "revoked_at", "graced_until"},
+	sqlTableCode:       {"auth_time", "nonce_hash"},
+	sqlTableOpenID:     {"auth_time", "nonce_hash", "sid", "previous_granted_scope", "previous_granted_audience", "grant_updated_at"},
+	sqlTablePKCE:       {"auth_time"},
+	sqlTableDeviceCode: {"auth_time", "last_polled_at", "device_challenge"},
+	sqlTableUserCode:   {"auth_time"},
+}
+
+// SchemaInfo reports a snapshot of the storage schema for diagnostics: the
+// migration state, the number of rows per token table in the current network,
+// which optional columns exist, and whether session data is encrypted at rest.
+//
+// Column presence is probed with queries which fail if a column is missing, so
+// SchemaInfo should not be called within a transaction.
+func (p *Persister) SchemaInfo(ctx context.Context) (_ map[string]any, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.SchemaInfo")
+	defer otelx.End(span, &err)
+
+	if err := p.requireSQLSessionBackend(tokenTables...); err != nil {
+		return nil, err
+	}
+
+	status, err := p.MigrationStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var latest string
+	pending := 0
+	for _, m := range status {
+		switch m.State {
+		case popx.Applied:
+			latest = m.Version
+		case popx.Pending:
+			pending++
+		}
+	}
+
+	tables := make(map[string]any, len(optionalTokenTableColumns))
+	for table, optional := range optionalTokenTableColumns {
+		name := p.tokenTable(ctx, table).TableName()
+
+		rows, err := p.QueryWithNetwork(ctx).Count(p.tokenTable(ctx, table))
+		if err != nil {
+			return nil, sqlcon.HandleError(err)
+		}
+
+		columns := make(map[string]bool, len(optional))
+		for _, column := range optional {
+			/* #nosec G201 table and column are static */
+			columns[column] = p.Connection(ctx).RawQuery(fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", column, name)).Exec() == nil
+		}
+
+		tables[name] = map[string]any{
+			"rows":    rows,
+			"columns": columns,
+		}
+	}
+
+	return map[string]any{
+		"migrations": map[string]any{
+			"latest_applied": latest,
+			"pending":        pending,
+		},
+		"tables":               tables,
+		"encrypt_session_data": p.config.EncryptSessionData(ctx),
+	}, nil
+}
+
+// minSignatureColumnWidth is the width the signature columns of the token
+// tables need at least to hold hashed signatures, see SignatureHash.
+const minSignatureColumnWidth = sha512.Size384 * 2
+
+// CheckSignatureColumns returns an error if the signature column of any token
+// table is declared narrower than hashed signatures, e.g. because a migration
+// was altered or skipped, which would make inserts fail or, on databases not
+// enforcing strict mode, silently truncate signatures. Tables which do not
+// exist yet, and columns without a declared width, are not reported.
+func (p *Persister) CheckSignatureColumns(ctx context.Context) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CheckSignatureColumns")
+	defer otelx.End(span, &err)
+
+	var narrow []string
+	for _, table := range tokenTables {
+		name := p.tokenTable(ctx, table).TableName()
+		width, err := p.signatureColumnWidth(ctx, name)
+		if err != nil {
+			return err
+		}
+		if width > 0 && width < minSignatureColumnWidth {
+			narrow = append(narrow, fmt.Sprintf("%s (%d)", name, width))
+		}
+	}
+	if len(narrow) > 0 {
+		return errors.Errorf("the signature columns of the token tables must hold at least %d characters, but are narrower in: %s", minSignatureColumnWidth, strings.Join(narrow, ", "))
+	}
+	return nil
+}
+
+// signatureColumnWidth returns the declared width of the signature column of
+// the table, or 0 if the table does not exist or the width is unbounded.
+func (p *Persister) signatureColumnWidth(ctx context.Context, table string) (int, error) {
+	c := p.Connection(ctx)
+
+	var query string
+	switch c.Dialect.Name() {
+	case "sqlite3":
+		var declared []string
+		if err := c.RawQuery("SELECT type FROM pragma_table_info(?) WHERE name = 'signature'", table).All(&declared); err != nil {
+			return 0, sqlcon.HandleError(err)
+		}
+		if len(declared) == 0 {
+			return 0, nil
+		}
+		return declaredColumnWidth(declared[0]), nil
+	case "mysql":
+		query = "SELECT COALESCE(character_maximum_length, 0) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'signature'"
+	default:
+		query = "SELECT COALESCE(character_maximum_length, 0) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = 'signature'"
+	}
+
+	var widths []int
+	if err := c.RawQuery(query, table).All(&widths); err != nil {
+		return 0, sqlcon.HandleError(err)
+	}
+	if len(widths) == 0 {
+		return 0, nil
+	}
+	return widths[0], nil
+}
+
+// declaredColumnWidth parses the width of a declared column type such as
+// "VARCHAR(255)", returning 0 if there is none.
+func declaredColumnWidth(declared string) int {
+	start, end := strings.Index(declared, "("), strings.Index(declared, ")")
+	if start < 0 || end < start {
+		return 0
+	}
+	width, err := strconv.Atoi(strings.TrimSpace(declared[start+1 : end]))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
 func (p *Persister) MigrateDown(ctx context.Context, steps int) error {
 	return errorsx.WithStack(p.mb.Down(ctx, steps))
 }
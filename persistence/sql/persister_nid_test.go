@@ -4,9 +4,16 @@
 package sql_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,14 +25,23 @@ import (
 	"github.com/ory/x/assertx"
 
 	"github.com/go-jose/go-jose/v3"
+	"github.com/gobuffalo/pop/v6"
 	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"github.com/tidwall/gjson"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 
 	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
+	"github.com/ory/fosite/token/jwt"
 	"github.com/ory/hydra/v2/client"
 	"github.com/ory/hydra/v2/consent"
 	"github.com/ory/hydra/v2/driver"
+	"github.com/ory/hydra/v2/driver/config"
 	"github.com/ory/hydra/v2/flow"
 	"github.com/ory/hydra/v2/internal"
 	"github.com/ory/hydra/v2/jwk"
@@ -33,9 +49,16 @@ import (
 	"github.com/ory/hydra/v2/oauth2/trust"
 	persistencesql "github.com/ory/hydra/v2/persistence/sql"
 	"github.com/ory/hydra/v2/x"
+	"github.com/ory/hydra/v2/x/events"
+	"github.com/ory/x/configx"
 	"github.com/ory/x/contextx"
 	"github.com/ory/x/dbal"
+	"github.com/ory/x/logrusx"
 	"github.com/ory/x/networkx"
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/pointerx"
+	"github.com/ory/x/servicelocatorx"
+	"github.com/ory/x/sqlcon"
 	"github.com/ory/x/sqlxx"
 )
 
@@ -80,6 +103,20 @@ func (s *PersisterTestSuite) TearDownTest() {
 	}
 }
 
+// forEachPersister runs f for every database of the suite. f gets a registry of
+// its own on the database, so that neither the configuration nor the tracer or
+// token table names set by f leak into other tests. The rows f creates are
+// deleted by TearDownTest.
+func (s *PersisterTestSuite) forEachPersister(t *testing.T, f func(t *testing.T, reg driver.Registry, p *persistencesql.Persister)) {
+	for k, r := range s.registries {
+		t.Run("dialect="+k, func(t *testing.T) {
+			reg := internal.NewRegistrySQLFromURL(t, r.Config().DSN(), false, &contextx.TestContextualizer{})
+			t.Cleanup(func() { _ = reg.Persister().Connection(context.Background()).Close() })
+			f(t, reg, reg.Persister().(*persistencesql.Persister))
+		})
+	}
+}
+
 func (s *PersisterTestSuite) TestAcceptLogoutRequest() {
 	t := s.T()
 	lr := newLogoutRequest()
@@ -311,6 +348,332 @@ func (s *PersisterTestSuite) TestCountSubjectsGrantedConsentRequests() {
 	}
 }
 
+func (s *PersisterTestSuite) TestGetDeviceFlowSubject() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
+
+			f := newFlow(s.t1NID, client.ID, "device-approver", sqlxx.NullString(sessionID))
+			f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+			f.DeviceChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+			f.DeviceWasUsed = sqlxx.NullBool{Bool: true, Valid: true}
+			f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+			f.ConsentRememberFor = pointerx.Ptr(0)
+			f.SessionIDToken = sqlxx.MapStringInterface{}
+			f.SessionAccessToken = sqlxx.MapStringInterface{}
+			f.State = flow.FlowStateConsentUsed
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
+
+			subject, err := r.Persister().GetDeviceFlowSubject(s.t1, f.DeviceChallengeID.String())
+			require.NoError(t, err)
+			assert.Equal(t, "device-approver", subject)
+
+			_, err = r.Persister().GetDeviceFlowSubject(s.t2, f.DeviceChallengeID.String())
+			assert.ErrorIs(t, err, x.ErrNotFound)
+
+			_, err = r.Persister().GetDeviceFlowSubject(s.t1, uuid.Must(uuid.NewV4()).String())
+			assert.ErrorIs(t, err, x.ErrNotFound)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestListApprovedUnpolledDeviceFlows() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			p := r.Persister()
+			cl := createClient(s.t1, t, p, "client-id")
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			persistLoginSession(s.t1, t, p, &flow.LoginSession{ID: sessionID})
+
+			now := time.Now().UTC().Round(time.Second)
+			// approve stores a device code and the device flow whose consent was
+			// handled at approvedAt, and returns the signature of the device code.
+			approve := func(t *testing.T, approvedAt time.Time, state int16) (*flow.Flow, string) {
+				signature, requestID := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+				request := fosite.NewRequest()
+				request.ID = requestID
+				request.RequestedAt = approvedAt.Add(-time.Minute)
+				request.Client = cl
+				request.Session = oauth2.NewSession("sub")
+				require.NoError(t, p.CreateDeviceCodeSession(s.t1, signature, request))
+
+				f := newFlow(s.t1NID, cl.ID, "sub", sqlxx.NullString(sessionID))
+				f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceCodeRequestID = sqlxx.NullString(requestID)
+				f.DeviceWasUsed = sqlxx.NullBool{Bool: true, Valid: true}
+				f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+				f.ConsentRememberFor = pointerx.Ptr(0)
+				f.ConsentHandledAt = sqlxx.NullTime(approvedAt)
+				f.SessionIDToken = sqlxx.MapStringInterface{}
+				f.SessionAccessToken = sqlxx.MapStringInterface{}
+				f.State = state
+				require.NoError(t, p.Connection(context.Background()).Create(f))
+				return f, signature
+			}
+			poll := func(t *testing.T, signature string, at time.Time) {
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_device_code SET last_polled_at = ? WHERE signature = ?", at, signature).
+					Exec())
+			}
+
+			stuck, _ := approve(t, now.Add(-2*time.Hour), flow.FlowStateConsentUsed)
+			polledBefore, signature := approve(t, now.Add(-3*time.Hour), flow.FlowStateConsentUnused)
+			poll(t, signature, now.Add(-4*time.Hour))
+
+			// Recently approved flows may still be polled.
+			approve(t, now.Add(-time.Minute), flow.FlowStateConsentUsed)
+			// Devices which polled after the approval came back.
+			_, signature = approve(t, now.Add(-2*time.Hour), flow.FlowStateConsentUsed)
+			poll(t, signature, now.Add(-time.Hour))
+			// Exchanged device codes are done.
+			_, signature = approve(t, now.Add(-2*time.Hour), flow.FlowStateConsentUsed)
+			require.NoError(t, p.InvalidateDeviceCodeSession(s.t1, signature))
+			// Denied flows were not approved.
+			approve(t, now.Add(-2*time.Hour), flow.FlowStateConsentError)
+
+			flows, err := p.ListApprovedUnpolledDeviceFlows(s.t1, now.Add(-time.Hour))
+			require.NoError(t, err)
+			require.Len(t, flows, 2)
+			assert.Equal(t, polledBefore.ID, flows[0].ID)
+			assert.Equal(t, stuck.ID, flows[1].ID)
+			assert.Equal(t, cl.ID, flows[1].Client.GetID())
+
+			flows, err = p.ListApprovedUnpolledDeviceFlows(s.t2, now.Add(-time.Hour))
+			require.NoError(t, err)
+			assert.Empty(t, flows)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestFlushStaleDeviceFlows() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			p := r.Persister()
+			cl := createClient(s.t1, t, p, "client-id")
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			persistLoginSession(s.t1, t, p, &flow.LoginSession{ID: sessionID})
+
+			now := time.Now().UTC().Round(time.Second)
+			// create stores a device flow in the state which was requested at
+			// requestedAt, and a device code of the flow.
+			create := func(t *testing.T, requestedAt time.Time, state int16) (*flow.Flow, string) {
+				signature, requestID := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+				request := fosite.NewRequest()
+				request.ID = requestID
+				request.RequestedAt = requestedAt
+				request.Client = cl
+				request.Session = oauth2.NewSession("sub")
+				require.NoError(t, p.CreateDeviceCodeSession(s.t1, signature, request))
+
+				f := newFlow(s.t1NID, cl.ID, "sub", sqlxx.NullString(sessionID))
+				f.RequestedAt = requestedAt
+				f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceCodeRequestID = sqlxx.NullString(requestID)
+				f.DeviceWasUsed = sqlxx.NullBool{Bool: true, Valid: true}
+				f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+				f.ConsentRememberFor = pointerx.Ptr(0)
+				f.SessionIDToken = sqlxx.MapStringInterface{}
+				f.SessionAccessToken = sqlxx.MapStringInterface{}
+				f.State = state
+				require.NoError(t, p.Connection(context.Background()).Create(f))
+				return f, signature
+			}
+			exists := func(t *testing.T, f *flow.Flow) bool {
+				count, err := p.Connection(context.Background()).Where("login_challenge = ?", f.ID).Count(&flow.Flow{})
+				require.NoError(t, err)
+				return count > 0
+			}
+
+			old := now.Add(-2 * time.Hour)
+			usedAndExchanged, signature := create(t, old, flow.FlowStateConsentUsed)
+			require.NoError(t, p.InvalidateDeviceCodeSession(s.t1, signature))
+			erred, _ := create(t, old, flow.FlowStateConsentError)
+			expired, _ := create(t, old, flow.FlowStateConsentUnused)
+
+			// Used flows whose device has not fetched its tokens are kept.
+			usedAndPending, _ := create(t, old, flow.FlowStateConsentUsed)
+			// Flows newer than the cutoff are kept in every state.
+			usedRecently, signature := create(t, now.Add(-time.Minute), flow.FlowStateConsentUsed)
+			require.NoError(t, p.InvalidateDeviceCodeSession(s.t1, signature))
+			erredRecently, _ := create(t, now.Add(-time.Minute), flow.FlowStateConsentError)
+			// Unused flows within the login and consent TTL are kept.
+			unused, _ := create(t, now.Add(-10*time.Minute), flow.FlowStateConsentUnused)
+			// Flows which are not device flows are kept.
+			loginConsent := newFlow(s.t1NID, cl.ID, "sub", sqlxx.NullString(sessionID))
+			loginConsent.RequestedAt = old
+			loginConsent.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+			require.NoError(t, p.Connection(context.Background()).Create(loginConsent))
+
+			deleted, err := p.FlushStaleDeviceFlows(s.t2, now.Add(-5*time.Minute), 100)
+			require.NoError(t, err)
+			assert.Zero(t, deleted)
+
+			deleted, err = p.FlushStaleDeviceFlows(s.t1, now.Add(-5*time.Minute), 2)
+			require.NoError(t, err)
+			assert.Equal(t, 3, deleted)
+
+			for _, f := range []*flow.Flow{usedAndExchanged, erred, expired} {
+				assert.False(t, exists(t, f), "flow in state %d must be deleted", f.State)
+			}
+			for _, f := range []*flow.Flow{usedAndPending, usedRecently, erredRecently, unused, loginConsent} {
+				assert.True(t, exists(t, f), "flow in state %d must be kept", f.State)
+			}
+
+			// Erred flows are kept for longer than successful ones if configured.
+			r.Config().MustSet(s.t1, config.KeyDeviceFlowErrorRetention, 24*time.Hour)
+			t.Cleanup(func() { r.Config().MustSet(s.t1, config.KeyDeviceFlowErrorRetention, 0) })
+
+			erredWithinRetention, _ := create(t, old, flow.FlowStateConsentError)
+			erredPastRetention, _ := create(t, now.Add(-48*time.Hour), flow.FlowStateConsentError)
+			usedWithinRetention, signature := create(t, old, flow.FlowStateConsentUsed)
+			require.NoError(t, p.InvalidateDeviceCodeSession(s.t1, signature))
+
+			deleted, err = p.FlushStaleDeviceFlows(s.t1, now.Add(-5*time.Minute), 100)
+			require.NoError(t, err)
+			assert.Equal(t, 2, deleted)
+			assert.True(t, exists(t, erredWithinRetention))
+			assert.False(t, exists(t, erredPastRetention))
+			assert.False(t, exists(t, usedWithinRetention))
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestErasureBySubject() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			store, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+
+			// seed stores data of the subject in every table which is erased,
+			// and returns the signature of its access token.
+			seed := func(ctx context.Context, nid uuid.UUID, subject string) string {
+				cl := &client.Client{ID: "erasure-" + uuid.Must(uuid.NewV4()).String()}
+				require.NoError(t, store.CreateClient(ctx, cl))
+
+				ls := &flow.LoginSession{ID: uuid.Must(uuid.NewV4()).String(), Subject: subject}
+				persistLoginSession(ctx, t, store, ls)
+				f := newFlow(nid, cl.ID, subject, sqlxx.NullString(ls.ID))
+				f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceWasUsed = sqlxx.NullBool{Bool: true, Valid: true}
+				f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+				f.ConsentRememberFor = pointerx.Ptr(0)
+				f.SessionIDToken = sqlxx.MapStringInterface{}
+				f.SessionAccessToken = sqlxx.MapStringInterface{}
+				f.State = flow.FlowStateConsentUsed
+				require.NoError(t, store.Connection(ctx).Create(f))
+
+				lr := newLogoutRequest()
+				lr.Subject, lr.Verifier = subject, uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, store.CreateLogoutRequest(ctx, lr))
+				require.NoError(t, store.CreateForcedObfuscatedLoginSession(ctx, &consent.ForcedObfuscatedLoginSession{ClientID: cl.ID, Subject: subject, SubjectObfuscated: uuid.Must(uuid.NewV4()).String()}))
+
+				ks := newKeySet(uuid.Must(uuid.NewV4()).String(), "sig")
+				require.NoError(t, store.AddKeySet(ctx, ks.Keys[0].KeyID, ks))
+				grant := newGrant(ks.Keys[0].KeyID, ks.Keys[0].KeyID)
+				grant.Issuer, grant.Subject = "https://issuer.example.com", subject
+				require.NoError(t, store.CreateGrant(ctx, grant, ks.Keys[0].Public()))
+
+				request := &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: time.Now().UTC(),
+					Client:      cl,
+					Session:     oauth2.NewSession(subject),
+				}
+				accessSignature := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, store.CreateAccessTokenSession(ctx, accessSignature, request))
+				require.NoError(t, store.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				require.NoError(t, store.CreateOpenIDConnectSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				require.NoError(t, store.CreateAuthorizeCodeSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				require.NoError(t, store.CreatePKCERequestSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				require.NoError(t, store.CreateDeviceCodeSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				require.NoError(t, store.CreateUserCodeSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				return accessSignature
+			}
+
+			subject := "erased-" + uuid.Must(uuid.NewV4()).String()
+			seed(s.t1, s.t1NID, subject)
+			otherSubject := seed(s.t1, s.t1NID, "kept-"+uuid.Must(uuid.NewV4()).String())
+			otherNetwork := seed(s.t2, s.t2NID, subject)
+
+			report, err := store.ErasureBySubject(s.t1, subject)
+			require.NoError(t, err)
+			assert.Equal(t, persistencesql.ErasureReport{
+				"hydra_oauth2_oidc":                              1,
+				"hydra_oauth2_access":                            1,
+				"hydra_oauth2_refresh":                           1,
+				"hydra_oauth2_code":                              1,
+				"hydra_oauth2_pkce":                              1,
+				"hydra_oauth2_device_code":                       1,
+				"hydra_oauth2_user_code":                         1,
+				"hydra_oauth2_flow":                              1,
+				"hydra_oauth2_logout_request":                    1,
+				"hydra_oauth2_obfuscated_authentication_session": 1,
+				"hydra_oauth2_authentication_session":            1,
+				"hydra_oauth2_trusted_jwt_bearer_issuer":         1,
+			}, report)
+
+			// Erasing again deletes nothing.
+			report, err = store.ErasureBySubject(s.t1, subject)
+			require.NoError(t, err)
+			for table, n := range report {
+				assert.Zero(t, n, table)
+			}
+
+			// Other subjects and networks are not affected.
+			_, err = store.GetAccessTokenSession(s.t1, otherSubject, oauth2.NewSession(""))
+			assert.NoError(t, err)
+			_, err = store.GetAccessTokenSession(s.t2, otherNetwork, oauth2.NewSession(""))
+			assert.NoError(t, err)
+			report, err = store.ErasureBySubject(s.t2, subject)
+			require.NoError(t, err)
+			assert.Equal(t, 1, report["hydra_oauth2_authentication_session"])
+			assert.Equal(t, 1, report["hydra_oauth2_access"])
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestListNetworksWithTokens() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			store, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+
+			nids, err := store.ListNetworksWithTokens(s.t1)
+			require.NoError(t, err)
+			assert.Empty(t, nids)
+
+			for ctx, create := range map[context.Context]func(context.Context, string, fosite.Requester) error{
+				s.t1: store.CreateAccessTokenSession,
+				s.t2: store.CreatePKCERequestSession,
+			} {
+				cl := createClient(ctx, t, store, "client-id")
+				request := fosite.NewRequest()
+				request.Client = cl
+				request.Session = oauth2.NewSession("sub")
+				for i := 0; i < 2; i++ {
+					request.ID = uuid.Must(uuid.NewV4()).String()
+					require.NoError(t, create(ctx, uuid.Must(uuid.NewV4()).String(), request))
+				}
+			}
+
+			nids, err = store.ListNetworksWithTokens(s.t1)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []uuid.UUID{s.t1NID, s.t2NID}, nids)
+		})
+	}
+}
+
 func (s *PersisterTestSuite) TestCreateAccessTokenSession() {
 	t := s.T()
 	for k, r := range s.registries {
@@ -595,6 +958,238 @@ func (s *PersisterTestSuite) TestDeleteAccessTokens() {
 	}
 }
 
+func (s *PersisterTestSuite) TestBulkStatementTimeout() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			p := r.Persister().(*persistencesql.Persister)
+			r.Config().MustSet(s.t1, config.KeyDBBulkStatementTimeout, 100*time.Millisecond)
+			t.Cleanup(func() { r.Config().MustSet(s.t1, config.KeyDBBulkStatementTimeout, 0) })
+
+			t.Run("case=flush", func(t *testing.T) {
+				cl := createClient(s.t1, t, p, "bulk-statement-timeout")
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: time.Now().UTC().Add(-48 * time.Hour).Round(time.Second),
+					Client:      cl,
+					Session:     oauth2.NewSession("sub"),
+				}))
+
+				_, err := p.FlushInactiveAccessTokens(s.t1, time.Now(), 100, 10)
+				require.NoError(t, err)
+				var count int
+				require.NoError(t, p.Connection(s.t1).RawQuery("SELECT COUNT(*) FROM hydra_oauth2_access WHERE nid = ?", s.t1NID).First(&count))
+				assert.Zero(t, count)
+			})
+
+			showTimeout := func(c *pop.Connection) (timeout string) {
+				require.NoError(t, c.RawQuery("SHOW statement_timeout").First(&timeout))
+				return timeout
+			}
+
+			switch p.Connection(s.t1).Dialect.Name() {
+			case "postgres", "cockroach":
+			default:
+				n, err := p.ExecBulkStatement(s.t1, p.Connection(s.t1), func(c *pop.Connection) (int, error) {
+					return 1, c.RawQuery("DELETE FROM hydra_oauth2_access WHERE nid = ?", s.t1NID).Exec()
+				})
+				require.NoError(t, err)
+				assert.Equal(t, 1, n)
+				return
+			}
+
+			t.Run("case=own transaction", func(t *testing.T) {
+				_, err := p.ExecBulkStatement(s.t1, p.Connection(s.t1), func(c *pop.Connection) (int, error) {
+					assert.NotNil(t, c.TX, "the statement runs in a transaction")
+					assert.NotEqual(t, "0", showTimeout(c))
+					return 0, c.RawQuery("SELECT pg_sleep(1)").Exec()
+				})
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "statement timeout")
+				assert.Equal(t, "0", showTimeout(p.Connection(s.t1)))
+			})
+
+			t.Run("case=caller transaction", func(t *testing.T) {
+				require.NoError(t, p.Transaction(s.t1, func(ctx context.Context, c *pop.Connection) error {
+					_, err := p.ExecBulkStatement(ctx, c, func(c *pop.Connection) (int, error) {
+						assert.NotEqual(t, "0", showTimeout(c))
+						return 0, nil
+					})
+					require.NoError(t, err)
+					assert.Equal(t, "0", showTimeout(c), "the timeout does not apply to the remaining statements")
+					return nil
+				}))
+			})
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestEstimateSessionTableSize() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			p := r.Persister().(*persistencesql.Persister)
+			for ctx, n := range map[context.Context]int{s.t1: 3, s.t2: 1} {
+				require.NoError(t, p.CreateClient(ctx, &client.Client{ID: "estimate-table-size"}))
+				for i := 0; i < n; i++ {
+					fr := fosite.NewRequest()
+					fr.Client = &fosite.DefaultClient{ID: "estimate-table-size"}
+					require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), fr))
+				}
+			}
+
+			size, err := p.CountSessions(s.t1, persistencesql.SQLTableAccess)
+			require.NoError(t, err)
+			assert.EqualValues(t, 3, size)
+			size, err = p.CountSessions(s.t2, persistencesql.SQLTableAccess)
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, size)
+			size, err = p.CountSessions(s.t1, persistencesql.SQLTableRefresh)
+			require.NoError(t, err)
+			assert.Zero(t, size)
+			_, err = p.CountSessions(s.t1, "unknown")
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+
+			c := p.Connection(context.Background())
+			switch c.Dialect.Name() {
+			case "postgres":
+				require.NoError(t, c.RawQuery("ANALYZE hydra_oauth2_access").Exec())
+			case "mysql":
+				require.NoError(t, c.RawQuery("ANALYZE TABLE hydra_oauth2_access").Exec())
+			}
+			size, err = p.EstimateSessionTableSizeAcrossNetworks(s.t1, persistencesql.SQLTableAccess)
+			require.NoError(t, err)
+			assert.EqualValues(t, 4, size)
+			_, err = p.EstimateSessionTableSizeAcrossNetworks(s.t1, "unknown")
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestDeleteAccessTokensInBulk() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			p := r.Persister().(*persistencesql.Persister)
+			for _, ctx := range []context.Context{s.t1, s.t2} {
+				require.NoError(t, p.CreateClient(ctx, &client.Client{ID: "bulk-client"}))
+				require.NoError(t, p.CreateClient(ctx, &client.Client{ID: "other-client"}))
+			}
+			createTokens := func(ctx context.Context, clientID string, n int) {
+				for i := 0; i < n; i++ {
+					fr := fosite.NewRequest()
+					fr.Client = &fosite.DefaultClient{ID: clientID}
+					require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), fr))
+				}
+			}
+			count := func(nid uuid.UUID, clientID string) (n int) {
+				require.NoError(t, p.Connection(context.Background()).RawQuery(
+					"SELECT COUNT(*) FROM hydra_oauth2_access WHERE client_id = ? AND nid = ?", clientID, nid,
+				).First(&n))
+				return n
+			}
+
+			createTokens(s.t1, "bulk-client", 5)
+			createTokens(s.t2, "bulk-client", 1)
+			createTokens(s.t1, "other-client", 1)
+			require.NoError(t, p.DeleteAccessTokens(s.t1, "bulk-client"))
+			assert.Equal(t, 0, count(s.t1NID, "bulk-client"))
+			assert.Equal(t, 1, count(s.t2NID, "bulk-client"))
+			assert.Equal(t, 1, count(s.t1NID, "other-client"))
+
+			if p.Connection(context.Background()).Dialect.Name() != "postgres" {
+				return
+			}
+
+			t.Run("case=batches", func(t *testing.T) {
+				createTokens(s.t1, "bulk-client", 5)
+				deleted, err := p.DeleteAccessTokensByCTID(s.t1, "bulk-client", 2)
+				require.NoError(t, err)
+				assert.Equal(t, 5, deleted)
+				assert.Equal(t, 0, count(s.t1NID, "bulk-client"))
+				assert.Equal(t, 1, count(s.t2NID, "bulk-client"))
+				assert.Equal(t, 1, count(s.t1NID, "other-client"))
+			})
+
+			t.Run("case=batches are committed separately", func(t *testing.T) {
+				c := p.Connection(context.Background())
+				// Deleting the last token fails, after the batches before it were
+				// committed.
+				require.NoError(t, c.RawQuery(`CREATE FUNCTION reject_poisoned_access_token() RETURNS trigger AS $$
+BEGIN
+	IF OLD.subject = 'poisoned' THEN
+		RAISE EXCEPTION 'poisoned access token';
+	END IF;
+	RETURN OLD;
+END;
+$$ LANGUAGE plpgsql`).Exec())
+				require.NoError(t, c.RawQuery("CREATE TRIGGER reject_poisoned_access_token BEFORE DELETE ON hydra_oauth2_access FOR EACH ROW EXECUTE FUNCTION reject_poisoned_access_token()").Exec())
+				t.Cleanup(func() {
+					require.NoError(t, c.RawQuery("DROP TRIGGER reject_poisoned_access_token ON hydra_oauth2_access").Exec())
+					require.NoError(t, c.RawQuery("DROP FUNCTION reject_poisoned_access_token()").Exec())
+					require.NoError(t, c.RawQuery("DELETE FROM hydra_oauth2_access WHERE subject = 'poisoned'").Exec())
+				})
+
+				createTokens(s.t1, "bulk-client", 4)
+				fr := fosite.NewRequest()
+				fr.Client = &fosite.DefaultClient{ID: "bulk-client"}
+				fr.Session = oauth2.NewSession("poisoned")
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, uuid.Must(uuid.NewV4()).String(), fr))
+
+				deleted, err := p.DeleteAccessTokensByCTID(s.t1, "bulk-client", 2)
+				require.Error(t, err)
+				assert.Equal(t, 4, deleted)
+				assert.Equal(t, 1, count(s.t1NID, "bulk-client"))
+			})
+
+			t.Run("case=in one transaction", func(t *testing.T) {
+				createTokens(s.t1, "bulk-client", 5)
+				ctx, err := p.BeginTX(s.t1)
+				require.NoError(t, err)
+				deleted, err := p.DeleteAccessTokensByCTID(ctx, "bulk-client", 2)
+				require.NoError(t, err)
+				assert.Equal(t, 5, deleted)
+				require.NoError(t, p.Rollback(ctx))
+				assert.Equal(t, 5, count(s.t1NID, "bulk-client"))
+			})
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestDeleteClientAssertionJWTsByClient() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			exp := time.Now().Add(24 * time.Hour)
+			set := func(ctx context.Context, clientID string) string {
+				jti := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, r.Persister().SetClientAssertionJWT(x.WithClientAssertionClientID(ctx, clientID), jti, exp))
+				return jti
+			}
+
+			decommissioned := []string{set(s.t1, "decommissioned"), set(s.t1, "decommissioned")}
+			otherClient := set(s.t1, "other")
+			otherNetwork := set(s.t2, "decommissioned")
+			unattributed := set(s.t1, "")
+
+			n, err := r.Persister().DeleteClientAssertionJWTsByClient(s.t1, "decommissioned")
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+
+			for _, jti := range decommissioned {
+				assert.NoError(t, r.Persister().ClientAssertionJWTValid(s.t1, jti))
+			}
+			assert.Error(t, r.Persister().ClientAssertionJWTValid(s.t1, otherClient))
+			assert.Error(t, r.Persister().ClientAssertionJWTValid(s.t2, otherNetwork))
+			assert.Error(t, r.Persister().ClientAssertionJWTValid(s.t1, unattributed))
+
+			n, err = r.Persister().DeleteClientAssertionJWTsByClient(s.t1, "decommissioned")
+			require.NoError(t, err)
+			assert.Equal(t, 0, n)
+		})
+	}
+}
+
 func (s *PersisterTestSuite) TestDeleteClient() {
 	t := s.T()
 	for k, r := range s.registries {
@@ -673,7 +1268,7 @@ func (s *PersisterTestSuite) TestDeleteOpenIDConnectSession() {
 
 			actual := persistencesql.OAuth2RequestSQL{Table: "oidc"}
 
-			require.NoError(t, r.Persister().DeleteOpenIDConnectSession(s.t2, authorizeCode))
+			require.ErrorIs(t, r.Persister().DeleteOpenIDConnectSession(s.t2, authorizeCode), fosite.ErrNotFound)
 			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, authorizeCode))
 			require.NoError(t, r.Persister().DeleteOpenIDConnectSession(s.t1, authorizeCode))
 			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, authorizeCode))
@@ -696,7 +1291,7 @@ func (s *PersisterTestSuite) TestDeletePKCERequestSession() {
 
 			actual := persistencesql.OAuth2RequestSQL{Table: "pkce"}
 
-			require.NoError(t, r.Persister().DeletePKCERequestSession(s.t2, authorizeCode))
+			require.ErrorIs(t, r.Persister().DeletePKCERequestSession(s.t2, authorizeCode), fosite.ErrNotFound)
 			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, authorizeCode))
 			require.NoError(t, r.Persister().DeletePKCERequestSession(s.t1, authorizeCode))
 			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, authorizeCode))
@@ -719,7 +1314,7 @@ func (s *PersisterTestSuite) TestDeleteRefreshTokenSession() {
 
 			actual := persistencesql.OAuth2RequestSQL{Table: "refresh"}
 
-			require.NoError(t, r.Persister().DeleteRefreshTokenSession(s.t2, signature))
+			require.ErrorIs(t, r.Persister().DeleteRefreshTokenSession(s.t2, signature), fosite.ErrNotFound)
 			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
 			require.NoError(t, r.Persister().DeleteRefreshTokenSession(s.t1, signature))
 			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
@@ -837,9 +1432,13 @@ func (s *PersisterTestSuite) TestFlushInactiveAccessTokens() {
 
 			actual := persistencesql.OAuth2RequestSQL{Table: "access"}
 
-			require.NoError(t, r.Persister().FlushInactiveAccessTokens(s.t2, time.Now().Add(time.Hour), 100, 100))
+			_, err := r.Persister().FlushInactiveAccessTokens(s.t2, time.Now().Add(time.Hour), 100, 100)
+			require.NoError(t, err)
 			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, persistencesql.SignatureHash(sig)))
-			require.NoError(t, r.Persister().FlushInactiveAccessTokens(s.t1, time.Now().Add(time.Hour), 100, 100))
+			res, err := r.Persister().FlushInactiveAccessTokens(s.t1, time.Now().Add(time.Hour), 100, 100)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, res.Deleted, 1)
+			assert.Equal(t, x.FlushStoppedDrained, res.StoppedReason)
 			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, persistencesql.SignatureHash(sig)))
 		})
 	}
@@ -923,9 +1522,11 @@ func (s *PersisterTestSuite) TestFlushInactiveRefreshTokens() {
 
 			actual := persistencesql.OAuth2RequestSQL{Table: "refresh"}
 
-			require.NoError(t, r.Persister().FlushInactiveRefreshTokens(s.t2, time.Now(), 100, 100))
+			_, err := r.Persister().FlushInactiveRefreshTokens(s.t2, time.Now(), 100, 100)
+			require.NoError(t, err)
 			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
-			require.NoError(t, r.Persister().FlushInactiveRefreshTokens(s.t1, time.Now(), 100, 100))
+			_, err = r.Persister().FlushInactiveRefreshTokens(s.t1, time.Now(), 100, 100)
+			require.NoError(t, err)
 			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
 		})
 	}
@@ -1265,6 +1866,33 @@ func (s *PersisterTestSuite) TestGetOpenIDConnectSession() {
 	}
 }
 
+func (s *PersisterTestSuite) TestGetOpenIDConnectSessionByRequestID() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			client := &client.Client{ID: "client-id"}
+			request := fosite.NewRequest()
+			request.SetID(uuid.Must(uuid.NewV4()).String())
+			request.Client = &fosite.DefaultClient{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			require.NoError(t, r.Persister().CreateOpenIDConnectSession(s.t1, uuid.Must(uuid.NewV4()).String(), request))
+
+			actual, err := r.Persister().GetOpenIDConnectSessionByRequestID(s.t2, request.GetID(), oauth2.NewSession(""))
+			require.ErrorIs(t, err, fosite.ErrNotFound)
+			require.Nil(t, actual)
+
+			actual, err = r.Persister().GetOpenIDConnectSessionByRequestID(s.t1, "unknown-request-id", oauth2.NewSession(""))
+			require.ErrorIs(t, err, fosite.ErrNotFound)
+			require.Nil(t, actual)
+
+			actual, err = r.Persister().GetOpenIDConnectSessionByRequestID(s.t1, request.GetID(), oauth2.NewSession(""))
+			require.NoError(t, err)
+			require.Equal(t, request.GetID(), actual.GetID())
+			require.Equal(t, client.ID, actual.GetClient().GetID())
+		})
+	}
+}
+
 func (s *PersisterTestSuite) TestGetPKCERequestSession() {
 	t := s.T()
 	for k, r := range s.registries {
@@ -1384,788 +2012,5650 @@ func (s *PersisterTestSuite) TestGetRefreshTokenSession() {
 	}
 }
 
-func (s *PersisterTestSuite) TestGetRememberedLoginSession() {
+func (s *PersisterTestSuite) TestGetSessionsByRequestID() {
 	t := s.T()
+	tables := func(sessions map[string]fosite.Requester) []string {
+		var ts []string
+		for table := range sessions {
+			ts = append(ts, table)
+		}
+		return ts
+	}
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			ls := flow.LoginSession{ID: uuid.Must(uuid.NewV4()).String(), Remember: true}
-			require.NoError(t, r.Persister().CreateLoginSession(s.t1, &ls))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			get := func(ctx context.Context, requestID string) map[string]fosite.Requester {
+				sessions, err := p.GetSessionsByRequestID(ctx, requestID, oauth2.NewSession(""))
+				require.NoError(t, err)
+				res := make(map[string]fosite.Requester, len(sessions))
+				for table, req := range sessions {
+					res[fmt.Sprintf("%s", table)] = req
+				}
+				return res
+			}
 
-			actual, err := r.Persister().GetRememberedLoginSession(s.t2, &ls, ls.ID)
-			require.Error(t, err)
-			require.Nil(t, actual)
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, p.CreateClient(s.t1, client))
+
+			full := fosite.NewRequest()
+			full.SetID("full-request-id")
+			full.Client = client
+			full.Session = oauth2.NewSession("sub")
+			require.NoError(t, p.CreateAccessTokenSession(s.t1, "full-access", full))
+			require.NoError(t, p.CreateRefreshTokenSession(s.t1, "full-refresh", full))
+			require.NoError(t, p.CreateOpenIDConnectSession(s.t1, "full-oidc", full))
+			require.NoError(t, p.CreatePKCERequestSession(s.t1, "full-pkce", full))
+			require.NoError(t, p.RevokeRefreshToken(s.t1, full.GetID()))
+
+			partial := fosite.NewRequest()
+			partial.SetID("partial-request-id")
+			partial.Client = client
+			partial.Session = oauth2.NewSession("sub")
+			require.NoError(t, p.CreateAccessTokenSession(s.t1, "partial-access", partial))
+			require.NoError(t, p.CreateRefreshTokenSession(s.t1, "partial-refresh", partial))
+
+			actual := get(s.t1, full.GetID())
+			assert.ElementsMatch(t, []string{"access", "refresh", "oidc", "pkce"}, tables(actual))
+			for _, req := range actual {
+				assert.Equal(t, full.GetID(), req.GetID())
+				assert.Equal(t, "sub", req.GetSession().GetSubject())
+			}
 
-			actual, err = r.Persister().GetRememberedLoginSession(s.t1, &ls, ls.ID)
-			require.NoError(t, err)
-			require.NotNil(t, actual)
+			actual = get(s.t1, partial.GetID())
+			assert.ElementsMatch(t, []string{"access", "refresh"}, tables(actual))
+
+			assert.Empty(t, get(s.t2, full.GetID()))
+			assert.Empty(t, get(s.t1, "unknown-request-id"))
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestHandleConsentRequest() {
+func (s *PersisterTestSuite) TestWithClientCache() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			sessionID := uuid.Must(uuid.NewV4()).String()
-			c1 := &client.Client{ID: uuidx.NewV4().String()}
-			f := newFlow(s.t1NID, c1.ID, "sub", sqlxx.NullString(sessionID))
-			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
-			require.NoError(t, r.Persister().CreateClient(s.t1, c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, c1))
+			cl := &client.Client{ID: "client-id", Name: "before"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, cl))
+			request := fosite.NewRequest()
+			request.SetID("request-id")
+			request.Client = cl
+			sig := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, r.Persister().CreateAccessTokenSession(s.t1, sig, request))
 
-			req := &flow.OAuth2ConsentRequest{
-				ID:             "consent-request-id",
-				LoginChallenge: sqlxx.NullString(f.ID),
-				Skip:           false,
-				Verifier:       "verifier",
-				CSRF:           "csrf",
+			clientName := func(ctx context.Context) string {
+				actual, err := r.Persister().GetAccessTokenSession(ctx, sig, &fosite.DefaultSession{})
+				require.NoError(t, err)
+				return actual.GetClient().(*client.Client).Name
 			}
 
-			hcr := &flow.AcceptOAuth2ConsentRequest{
-				ID:        req.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
-			}
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t1, f, req))
+			cached := persistencesql.WithClientCache(s.t1)
+			assert.Equal(t, "before", clientName(cached))
 
-			actualCR, err := r.Persister().HandleConsentRequest(s.t2, f, hcr)
-			require.Error(t, err)
-			require.Nil(t, actualCR)
-			actual, err := r.Persister().FindGrantedAndRememberedConsentRequests(s.t1, c1.ID, f.Subject)
-			require.Error(t, err)
-			require.Equal(t, 0, len(actual))
+			// Change the client behind the persister's back: reads using the
+			// cache must not query the client again.
+			require.NoError(t, r.Persister().Connection(context.Background()).
+				RawQuery("UPDATE hydra_client SET client_name = ? WHERE id = ? AND nid = ?", "after", cl.ID, s.t1NID).
+				Exec())
 
-			actualCR, err = r.Persister().HandleConsentRequest(s.t1, f, hcr)
-			require.NoError(t, err)
-			require.NotNil(t, actualCR)
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
-			actual, err = r.Persister().FindGrantedAndRememberedConsentRequests(s.t1, c1.ID, f.Subject)
-			require.NoError(t, err)
-			require.Equal(t, 1, len(actual))
+			assert.Equal(t, "before", clientName(cached))
+			assert.Equal(t, "before", clientName(cached))
+			assert.Equal(t, "after", clientName(s.t1))
+			assert.Equal(t, "after", clientName(persistencesql.WithClientCache(s.t1)))
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestInvalidateAuthorizeCodeSession() {
+func (s *PersisterTestSuite) TestDeleteAccessTokenSessionMetrics() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			cl := &client.Client{ID: uuidx.NewV4().String()}
-			require.NoError(t, r.Persister().CreateClient(s.t1, cl))
-			require.NoError(t, r.Persister().CreateClient(s.t2, cl))
-			sig := uuid.Must(uuid.NewV4()).String()
-			fr := fosite.NewRequest()
-			fr.Client = &fosite.DefaultClient{ID: cl.ID}
-			require.NoError(t, r.Persister().CreateAuthorizeCodeSession(s.t1, sig, fr))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+			request := fosite.NewRequest()
+			request.Client = cl
 
-			require.NoError(t, r.Persister().InvalidateAuthorizeCodeSession(s.t2, sig))
-			actual := persistencesql.OAuth2RequestSQL{Table: "code"}
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, sig))
-			require.Equal(t, true, actual.Active)
+			hashed := x.AccessTokenDeletions.WithLabelValues("hashed")
+			legacy := x.AccessTokenDeletions.WithLabelValues("legacy")
 
-			require.NoError(t, r.Persister().InvalidateAuthorizeCodeSession(s.t1, sig))
-			actual = persistencesql.OAuth2RequestSQL{Table: "code"}
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, sig))
-			require.Equal(t, false, actual.Active)
+			t.Run("case=hashed", func(t *testing.T) {
+				sig := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+
+				hashedBefore, legacyBefore := testutil.ToFloat64(hashed), testutil.ToFloat64(legacy)
+				require.NoError(t, p.DeleteAccessTokenSession(s.t1, sig))
+				assert.Equal(t, hashedBefore+1, testutil.ToFloat64(hashed))
+				assert.Equal(t, legacyBefore, testutil.ToFloat64(legacy))
+			})
+
+			t.Run("case=legacy", func(t *testing.T) {
+				sig := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+				// Store the signature unhashed, like older versions did.
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", sig, persistencesql.SignatureHash(sig)).
+					Exec())
+
+				hashedBefore, legacyBefore := testutil.ToFloat64(hashed), testutil.ToFloat64(legacy)
+				require.NoError(t, p.DeleteAccessTokenSession(s.t1, sig))
+				assert.Equal(t, hashedBefore, testutil.ToFloat64(hashed))
+				assert.Equal(t, legacyBefore+1, testutil.ToFloat64(legacy))
+			})
+
+			t.Run("case=no match", func(t *testing.T) {
+				hashedBefore, legacyBefore := testutil.ToFloat64(hashed), testutil.ToFloat64(legacy)
+				require.ErrorIs(t, p.DeleteAccessTokenSession(s.t1, uuid.Must(uuid.NewV4()).String()), fosite.ErrNotFound)
+				assert.Equal(t, hashedBefore, testutil.ToFloat64(hashed))
+				assert.Equal(t, legacyBefore, testutil.ToFloat64(legacy))
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestIsJWTUsed() {
+func (s *PersisterTestSuite) TestVerifyAccessTokenSignature() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			jti := oauth2.NewBlacklistedJTI(uuid.Must(uuid.NewV4()).String(), time.Now().Add(24*time.Hour))
-			require.NoError(t, r.Persister().SetClientAssertionJWT(s.t1, jti.JTI, jti.Expiry))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+			request := fosite.NewRequest()
+			request.Client = cl
 
-			actual, err := r.Persister().IsJWTUsed(s.t2, jti.JTI)
-			require.NoError(t, err)
-			require.False(t, actual)
+			t.Run("case=hashed", func(t *testing.T) {
+				sig := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
 
-			actual, err = r.Persister().IsJWTUsed(s.t1, jti.JTI)
-			require.NoError(t, err)
-			require.True(t, actual)
-		})
+				exists, hashed, err := p.VerifyAccessTokenSignature(s.t1, sig)
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.True(t, hashed)
+
+				exists, _, err = p.VerifyAccessTokenSignature(s.t2, sig)
+				require.NoError(t, err)
+				assert.False(t, exists)
+			})
+
+			t.Run("case=legacy", func(t *testing.T) {
+				sig := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+				// Store the signature unhashed, like older versions did.
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", sig, persistencesql.SignatureHash(sig)).
+					Exec())
+
+				exists, hashed, err := p.VerifyAccessTokenSignature(s.t1, sig)
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.False(t, hashed)
+			})
+
+			t.Run("case=no match", func(t *testing.T) {
+				exists, hashed, err := p.VerifyAccessTokenSignature(s.t1, uuid.Must(uuid.NewV4()).String())
+				require.NoError(t, err)
+				assert.False(t, exists)
+				assert.False(t, hashed)
+			})
+		})
 	}
 }
 
-func (s *PersisterTestSuite) TestListUserAuthenticatedClientsWithBackChannelLogout() {
+func (s *PersisterTestSuite) TestConsentChallengeRoundTrip() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			c1 := &client.Client{ID: "client-1", BackChannelLogoutURI: "not-null"}
-			c2 := &client.Client{ID: "client-2", BackChannelLogoutURI: "not-null"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, c2))
+			cl := createClient(s.t1, t, r.Persister(), "client-id")
 
-			t1f1 := newFlow(s.t1NID, c1.ID, "sub", sqlxx.NullString(uuid.Must(uuid.NewV4()).String()))
-			t1f1.ConsentChallengeID = "t1f1-consent-challenge"
-			t1f1.LoginVerifier = "t1f1-login-verifier"
-			t1f1.ConsentVerifier = "t1f1-consent-verifier"
+			f := newFlow(s.t1NID, cl.ID, "sub", sqlxx.NullString(""))
+			f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+			f.ConsentVerifier = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+			f.LoginVerifier = uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
+			challenge := f.ConsentChallengeID.String()
+
+			create := func(t *testing.T) string {
+				sig := uuid.Must(uuid.NewV4()).String()
+				request := fosite.NewRequest()
+				request.Client = cl
+				session := oauth2.NewSession("sub")
+				session.ConsentChallenge = challenge
+				request.Session = session
+				require.NoError(t, r.Persister().CreateAccessTokenSession(s.t1, sig, request))
+				return sig
+			}
+			get := func(t *testing.T, sig string) string {
+				actual, err := r.Persister().GetAccessTokenSession(s.t1, sig, oauth2.NewSession(""))
+				require.NoError(t, err)
+				return actual.GetSession().(*oauth2.Session).ConsentChallenge
+			}
 
-			t2f1 := newFlow(s.t2NID, c1.ID, "sub", t1f1.SessionID)
-			t2f1.ConsentChallengeID = "t2f1-consent-challenge"
-			t2f1.LoginVerifier = "t2f1-login-verifier"
-			t2f1.ConsentVerifier = "t2f1-consent-verifier"
+			t.Run("case=round trip", func(t *testing.T) {
+				assert.Equal(t, challenge, get(t, create(t)))
+			})
 
-			t2f2 := newFlow(s.t2NID, c2.ID, "sub", t1f1.SessionID)
-			t2f2.ConsentChallengeID = "t2f2-consent-challenge"
-			t2f2.LoginVerifier = "t2f2-login-verifier"
-			t2f2.ConsentVerifier = "t2f2-consent-verifier"
+			t.Run("case=restored from the challenge column", func(t *testing.T) {
+				sig := create(t)
+				require.NoError(t, r.Persister().Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET session_data = ? WHERE signature = ?", `{"id_token":{},"extra":{}}`, persistencesql.SignatureHash(sig)).
+					Exec())
+				assert.Equal(t, challenge, get(t, sig))
+			})
+		})
+	}
+}
 
-			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: t1f1.SessionID.String()})
+func (s *PersisterTestSuite) TestRelinkSessionsConsentChallenge() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			cl := createClient(s.t1, t, r.Persister(), "client-id")
+
+			createFlow := func(t *testing.T) string {
+				f := newFlow(s.t1NID, cl.ID, "relinked-subject", sqlxx.NullString(""))
+				f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.ConsentVerifier = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.LoginVerifier = uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
+				return f.ConsentChallengeID.String()
+			}
+			oldChallenge, newChallenge := createFlow(t), createFlow(t)
 
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(t1f1))
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f1))
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f2))
+			request := fosite.NewRequest()
+			request.ID = uuid.Must(uuid.NewV4()).String()
+			request.Client = cl
+			session := oauth2.NewSession("relinked-subject")
+			session.ConsentChallenge = oldChallenge
+			request.Session = session
+			accessSignature, refreshSignature := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, r.Persister().CreateAccessTokenSession(s.t1, accessSignature, request))
+			require.NoError(t, r.Persister().CreateRefreshTokenSession(s.t1, refreshSignature, request))
+			require.NoError(t, r.Persister().CreateOpenIDConnectSession(s.t1, uuid.Must(uuid.NewV4()).String(), request))
+
+			t.Run("case=unknown new challenge", func(t *testing.T) {
+				_, err := r.Persister().RelinkSessionsConsentChallenge(s.t1, oldChallenge, uuid.Must(uuid.NewV4()).String())
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t1, t1f1, &flow.OAuth2ConsentRequest{
-				ID:             t1f1.ID,
-				LoginChallenge: sqlxx.NullString(t1f1.ID),
-				Skip:           false,
-				Verifier:       t1f1.ConsentVerifier.String(),
-				CSRF:           "csrf",
-			}))
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f1, &flow.OAuth2ConsentRequest{
-				ID:             t2f1.ID,
-				LoginChallenge: sqlxx.NullString(t2f1.ID),
-				Skip:           false,
-				Verifier:       t2f1.ConsentVerifier.String(),
-				CSRF:           "csrf",
-			}))
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f2, &flow.OAuth2ConsentRequest{
-				ID:             t2f2.ID,
-				LoginChallenge: sqlxx.NullString(t2f2.ID),
-				Skip:           false,
-				Verifier:       t2f2.ConsentVerifier.String(),
-				CSRF:           "csrf",
-			}))
+			t.Run("case=new challenge of another network", func(t *testing.T) {
+				_, err := r.Persister().RelinkSessionsConsentChallenge(s.t2, oldChallenge, newChallenge)
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 
-			_, err := r.Persister().HandleConsentRequest(s.t1, t1f1, &flow.AcceptOAuth2ConsentRequest{
-				ID:        t1f1.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
+			t.Run("case=relinks all token tables", func(t *testing.T) {
+				relinked, err := r.Persister().RelinkSessionsConsentChallenge(s.t1, oldChallenge, newChallenge)
+				require.NoError(t, err)
+				assert.Equal(t, 3, relinked)
+
+				actual, err := r.Persister().GetAccessTokenSession(s.t1, accessSignature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, newChallenge, actual.GetSession().(*oauth2.Session).ConsentChallenge)
+
+				relinked, err = r.Persister().RelinkSessionsConsentChallenge(s.t1, oldChallenge, newChallenge)
+				require.NoError(t, err)
+				assert.Zero(t, relinked)
 			})
-			require.NoError(t, err)
-			_, err = r.Persister().HandleConsentRequest(s.t2, t2f1, &flow.AcceptOAuth2ConsentRequest{
-				ID:        t2f1.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
+
+			t.Run("case=revocation follows the new challenge", func(t *testing.T) {
+				// Removing the superseded consent no longer affects the tokens.
+				require.NoError(t, r.Persister().Connection(context.Background()).
+					RawQuery("DELETE FROM hydra_oauth2_flow WHERE consent_challenge_id = ?", oldChallenge).
+					Exec())
+				_, err := r.Persister().GetAccessTokenSession(s.t1, accessSignature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				_, err = r.Persister().GetRefreshTokenSession(s.t1, refreshSignature, oauth2.NewSession(""))
+				require.NoError(t, err)
+
+				require.NoError(t, r.Persister().RevokeSubjectClientConsentSession(s.t1, "relinked-subject", cl.ID))
+				_, err = r.Persister().GetAccessTokenSession(s.t1, accessSignature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+				_, err = r.Persister().GetRefreshTokenSession(s.t1, refreshSignature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
 			})
-			require.NoError(t, err)
-			_, err = r.Persister().HandleConsentRequest(s.t2, t2f2, &flow.AcceptOAuth2ConsentRequest{
-				ID:        t2f2.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestInspectSession() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+
+			request := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "inspected-subject")
+			sig := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+			require.NoError(t, p.CreateRefreshTokenSession(s.t1, sig, request))
+			require.NoError(t, p.RevokeRefreshToken(s.t1, request.ID))
+
+			storedLength := func(t *testing.T, table, signature string) (n int) {
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery(fmt.Sprintf("SELECT LENGTH(session_data) FROM %s WHERE signature = ?", table), signature).
+					First(&n))
+				return n
+			}
+
+			t.Run("case=access token", func(t *testing.T) {
+				row, err := p.InspectSession(s.t1, "access", sig)
+				require.NoError(t, err)
+				assert.True(t, row.Active)
+				assert.Equal(t, "inspected-subject", row.Subject)
+				assert.Equal(t, persistencesql.SignatureHash(sig), row.ID)
+				assert.Len(t, row.Session, storedLength(t, "hydra_oauth2_access", persistencesql.SignatureHash(sig)))
 			})
-			require.NoError(t, err)
 
-			cs, err := r.Persister().ListUserAuthenticatedClientsWithBackChannelLogout(s.t1, "sub", t1f1.SessionID.String())
-			require.NoError(t, err)
-			require.Equal(t, 1, len(cs))
+			t.Run("case=revoked refresh token", func(t *testing.T) {
+				row, err := p.InspectSession(s.t1, "refresh", sig)
+				require.NoError(t, err)
+				assert.False(t, row.Active)
+				assert.Equal(t, "inspected-subject", row.Subject)
+				assert.Len(t, row.Session, storedLength(t, "hydra_oauth2_refresh", sig))
+			})
 
-			cs, err = r.Persister().ListUserAuthenticatedClientsWithBackChannelLogout(s.t2, "sub", t1f1.SessionID.String())
-			require.NoError(t, err)
-			require.Equal(t, 2, len(cs))
+			t.Run("case=other network", func(t *testing.T) {
+				_, err := p.InspectSession(s.t2, "access", sig)
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
+
+			t.Run("case=unknown table", func(t *testing.T) {
+				_, err := p.InspectSession(s.t1, "client", sig)
+				assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestListUserAuthenticatedClientsWithFrontChannelLogout() {
+func (s *PersisterTestSuite) TestGetDeviceCodeSessionStates() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			c1 := &client.Client{ID: "client-1", FrontChannelLogoutURI: "not-null"}
-			c2 := &client.Client{ID: "client-2", FrontChannelLogoutURI: "not-null"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, c2))
+			p := r.Persister()
+			cl := createClient(s.t1, t, p, "client-id")
+
+			create := func(t *testing.T, requestedAt time.Time, completed bool) (signature, requestID string) {
+				signature, requestID = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+				session := oauth2.NewSession("sub")
+				session.SetBrowserFlowCompleted(completed)
+				request := fosite.NewRequest()
+				request.ID = requestID
+				request.RequestedAt = requestedAt
+				request.Client = cl
+				request.Session = session
+				require.NoError(t, p.CreateDeviceCodeSession(s.t1, signature, request))
+				return signature, requestID
+			}
+			now := time.Now().UTC().Round(time.Second)
 
-			t1f1 := newFlow(s.t1NID, c1.ID, "sub", sqlxx.NullString(uuid.Must(uuid.NewV4()).String()))
-			t1f1.ConsentChallengeID = "t1f1-consent-challenge"
-			t1f1.LoginVerifier = "t1f1-login-verifier"
-			t1f1.ConsentVerifier = "t1f1-consent-verifier"
+			t.Run("case=approved", func(t *testing.T) {
+				signature, requestID := create(t, now, true)
+				actual, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, requestID, actual.GetID())
 
-			t2f1 := newFlow(s.t2NID, c1.ID, "sub", t1f1.SessionID)
-			t2f1.ConsentChallengeID = "t2f1-consent-challenge"
-			t2f1.LoginVerifier = "t2f1-login-verifier"
-			t2f1.ConsentVerifier = "t2f1-consent-verifier"
+				_, err = p.GetDeviceCodeSession(s.t2, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 
-			t2f2 := newFlow(s.t2NID, c2.ID, "sub", t1f1.SessionID)
-			t2f2.ConsentChallengeID = "t2f2-consent-challenge"
-			t2f2.LoginVerifier = "t2f2-login-verifier"
-			t2f2.ConsentVerifier = "t2f2-consent-verifier"
+			t.Run("case=pending", func(t *testing.T) {
+				signature, _ := create(t, now, false)
+				_, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrAuthorizationPending)
+				assert.ErrorIs(t, err, x.ErrDeviceFlowNotHandled)
+			})
 
-			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: t1f1.SessionID.String()})
+			linkFlow := func(t *testing.T, requestID string, state int16) {
+				f := newFlow(s.t1NID, cl.ID, "sub", sqlxx.NullString(""))
+				f.ConsentChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceChallengeID = sqlxx.NullString(uuid.Must(uuid.NewV4()).String())
+				f.DeviceWasUsed = sqlxx.NullBool{Bool: state != flow.DeviceFlowStateInitialized, Valid: true}
+				f.DeviceCodeRequestID = sqlxx.NullString(requestID)
+				f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+				f.ConsentRememberFor = pointerx.Ptr(0)
+				f.SessionAccessToken = map[string]interface{}{}
+				f.SessionIDToken = map[string]interface{}{}
+				f.State = state
+				require.NoError(t, p.Connection(s.t1).Create(f))
+			}
 
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(t1f1))
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f1))
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f2))
+			t.Run("case=pending during login", func(t *testing.T) {
+				signature, requestID := create(t, now, false)
+				linkFlow(t, requestID, flow.FlowStateLoginUnused)
 
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t1, t1f1, &flow.OAuth2ConsentRequest{
-				ID:             t1f1.ID,
-				LoginChallenge: sqlxx.NullString(t1f1.ID),
-				Skip:           false,
-				Verifier:       t1f1.ConsentVerifier.String(),
-				CSRF:           "csrf",
-			}))
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f1, &flow.OAuth2ConsentRequest{
-				ID:             t2f1.ID,
-				LoginChallenge: sqlxx.NullString(t2f1.ID),
-				Skip:           false,
-				Verifier:       t2f1.ConsentVerifier.String(),
-				CSRF:           "csrf",
-			}))
-			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f2, &flow.OAuth2ConsentRequest{
-				ID:             t2f2.ID,
-				LoginChallenge: sqlxx.NullString(t2f2.ID),
-				Skip:           false,
-				Verifier:       t2f2.ConsentVerifier.String(),
-				CSRF:           "csrf",
-			}))
+				_, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrAuthorizationPending)
+				assert.NotErrorIs(t, err, x.ErrDeviceFlowNotHandled)
+			})
 
-			_, err := r.Persister().HandleConsentRequest(s.t1, t1f1, &flow.AcceptOAuth2ConsentRequest{
-				ID:        t1f1.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
+			t.Run("case=pending responses do not reveal progress", func(t *testing.T) {
+				// Device flows in DeviceFlowStateInitialized or DeviceFlowStateUnused
+				// are not linked to the device code yet.
+				initialized, _ := create(t, now, false)
+				_, notHandled := p.GetDeviceCodeSession(s.t1, initialized, oauth2.NewSession(""))
+				require.ErrorIs(t, notHandled, x.ErrDeviceFlowNotHandled)
+
+				loggingIn, requestID := create(t, now, false)
+				linkFlow(t, requestID, flow.FlowStateLoginUnused)
+				_, handled := p.GetDeviceCodeSession(s.t1, loggingIn, oauth2.NewSession(""))
+				require.NotErrorIs(t, handled, x.ErrDeviceFlowNotHandled)
+
+				var notHandledResponse, handledResponse *fosite.RFC6749Error
+				require.ErrorAs(t, notHandled, &notHandledResponse)
+				require.ErrorAs(t, handled, &handledResponse)
+				assert.Equal(t, handledResponse.ToValues(), notHandledResponse.ToValues())
+				assert.Equal(t, handledResponse.StatusCode(), notHandledResponse.StatusCode())
 			})
-			require.NoError(t, err)
-			_, err = r.Persister().HandleConsentRequest(s.t2, t2f1, &flow.AcceptOAuth2ConsentRequest{
-				ID:        t2f1.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
+
+			t.Run("case=completed", func(t *testing.T) {
+				signature, requestID := create(t, now, true)
+				linkFlow(t, requestID, flow.FlowStateConsentUsed)
+
+				actual, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, requestID, actual.GetID())
 			})
-			require.NoError(t, err)
-			_, err = r.Persister().HandleConsentRequest(s.t2, t2f2, &flow.AcceptOAuth2ConsentRequest{
-				ID:        t2f2.ID,
-				HandledAt: sqlxx.NullTime(time.Now()),
-				Remember:  true,
+
+			t.Run("case=expired", func(t *testing.T) {
+				lifespan := r.Config().GetDeviceAndUserCodeLifespan(s.t1)
+				signature, _ := create(t, now.Add(-lifespan-time.Minute), false)
+				_, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrDeviceExpiredToken)
 			})
-			require.NoError(t, err)
 
-			cs, err := r.Persister().ListUserAuthenticatedClientsWithFrontChannelLogout(s.t1, "sub", t1f1.SessionID.String())
-			require.NoError(t, err)
-			require.Equal(t, 1, len(cs))
+			t.Run("case=denied", func(t *testing.T) {
+				signature, requestID := create(t, now, false)
+				f := newFlow(s.t1NID, cl.ID, "sub", sqlxx.NullString(""))
+				f.DeviceCodeRequestID = sqlxx.NullString(requestID)
+				f.State = flow.FlowStateConsentError
+				require.NoError(t, p.Connection(s.t1).Create(f))
 
-			cs, err = r.Persister().ListUserAuthenticatedClientsWithFrontChannelLogout(s.t2, "sub", t1f1.SessionID.String())
-			require.NoError(t, err)
-			require.Equal(t, 2, len(cs))
+				_, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrAccessDenied)
+				assert.NotErrorIs(t, err, x.ErrDeviceFlowNotHandled)
+			})
+
+			t.Run("case=exchanged", func(t *testing.T) {
+				signature, requestID := create(t, now, true)
+				require.NoError(t, p.InvalidateDeviceCodeSession(s.t1, signature))
+
+				actual, err := p.GetDeviceCodeSession(s.t1, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrInvalidatedDeviceCode)
+				require.NotNil(t, actual)
+				assert.Equal(t, requestID, actual.GetID())
+			})
+
+			t.Run("case=missing", func(t *testing.T) {
+				_, err := p.GetDeviceCodeSession(s.t1, uuid.Must(uuid.NewV4()).String(), oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestMarkJWTUsedForTime() {
+func (s *PersisterTestSuite) TestWhichTables() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			r.Persister().SetClientAssertionJWT(s.t1, "a", time.Now().Add(-24*time.Hour))
-			r.Persister().SetClientAssertionJWT(s.t2, "a", time.Now().Add(-24*time.Hour))
-			r.Persister().SetClientAssertionJWT(s.t2, "b", time.Now().Add(-24*time.Hour))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+
+			create := func(t *testing.T, create func(context.Context, string, fosite.Requester) error) string {
+				sig := uuid.Must(uuid.NewV4()).String()
+				request := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+				require.NoError(t, create(s.t1, sig, request))
+				return sig
+			}
 
-			require.NoError(t, r.Persister().MarkJWTUsedForTime(s.t2, "a", time.Now().Add(48*time.Hour)))
+			t.Run("case=access token", func(t *testing.T) {
+				sig := create(t, p.CreateAccessTokenSession)
+				tables, err := p.WhichTables(s.t1, sig)
+				require.NoError(t, err)
+				assert.Equal(t, []persistencesql.TableName{persistencesql.SQLTableAccess}, tables)
 
-			store, ok := r.OAuth2Storage().(oauth2.AssertionJWTReader)
-			if !ok {
-				t.Fatal("type assertion failed")
-			}
+				tables, err = p.WhichTables(s.t2, sig)
+				require.NoError(t, err)
+				assert.Empty(t, tables)
+			})
 
-			_, err := store.GetClientAssertionJWT(s.t1, "a")
-			require.NoError(t, err)
-			_, err = store.GetClientAssertionJWT(s.t2, "a")
-			require.NoError(t, err)
-			_, err = store.GetClientAssertionJWT(s.t2, "b")
-			require.Error(t, err)
+			t.Run("case=refresh token", func(t *testing.T) {
+				sig := create(t, p.CreateRefreshTokenSession)
+				tables, err := p.WhichTables(s.t1, sig)
+				require.NoError(t, err)
+				assert.Equal(t, []persistencesql.TableName{persistencesql.SQLTableRefresh}, tables)
+			})
+
+			t.Run("case=double write", func(t *testing.T) {
+				sig := create(t, p.CreateOpenIDConnectSession)
+				request := fosite.NewRequest()
+				request.Client = cl
+				request.Session = oauth2.NewSession("sub")
+				require.NoError(t, p.CreatePKCERequestSession(s.t1, sig, request))
+
+				tables, err := p.WhichTables(s.t1, sig)
+				require.NoError(t, err)
+				assert.Equal(t, []persistencesql.TableName{persistencesql.SQLTableOpenID, persistencesql.SQLTablePKCE}, tables)
+			})
+
+			t.Run("case=unknown signature", func(t *testing.T) {
+				tables, err := p.WhichTables(s.t1, uuid.Must(uuid.NewV4()).String())
+				require.NoError(t, err)
+				assert.Empty(t, tables)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestQueryWithNetwork() {
+func (s *PersisterTestSuite) TestClientSnapshot() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			r.Persister().CreateClient(s.t1, &client.Client{ID: "client-1", FrontChannelLogoutURI: "not-null"})
-
-			store, ok := r.Persister().(*persistencesql.Persister)
-			if !ok {
-				t.Fatal("type assertion failed")
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := &client.Client{ID: "client-id", Name: "Original", Scope: "openid offline", RedirectURIs: []string{"https://original.example/cb"}}
+			require.NoError(t, p.CreateClient(s.t1, cl))
+
+			create := func(t *testing.T) string {
+				sig := uuid.Must(uuid.NewV4()).String()
+				request := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+				require.NoError(t, p.CreateRefreshTokenSession(s.t1, sig, request))
+				return sig
 			}
 
-			var actual []client.Client
-			store.QueryWithNetwork(s.t2).All(&actual)
-			require.Equal(t, 0, len(actual))
-			store.QueryWithNetwork(s.t1).All(&actual)
-			require.Equal(t, 1, len(actual))
+			t.Run("case=disabled", func(t *testing.T) {
+				row, err := p.InspectSession(s.t1, persistencesql.SQLTableRefresh, create(t))
+				require.NoError(t, err)
+				snapshot, err := row.GetClientSnapshot()
+				require.NoError(t, err)
+				assert.Nil(t, snapshot)
+			})
+
+			t.Run("case=snapshot survives client changes", func(t *testing.T) {
+				r.Config().MustSet(s.t1, config.KeyClientSnapshotEnabled, true)
+				t.Cleanup(func() { r.Config().MustSet(s.t1, config.KeyClientSnapshotEnabled, false) })
+				sig := create(t)
+
+				updated := *cl
+				updated.Name = "Changed"
+				updated.Scope = "openid"
+				updated.RedirectURIs = []string{"https://changed.example/cb"}
+				require.NoError(t, p.UpdateClient(s.t1, &updated))
+
+				row, err := p.InspectSession(s.t1, persistencesql.SQLTableRefresh, sig)
+				require.NoError(t, err)
+				snapshot, err := row.GetClientSnapshot()
+				require.NoError(t, err)
+				assert.Equal(t, &persistencesql.ClientSnapshot{
+					Name:         "Original",
+					Scope:        "openid offline",
+					RedirectURIs: []string{"https://original.example/cb"},
+				}, snapshot)
+
+				actual, err := p.GetRefreshTokenSession(s.t1, sig, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, "Changed", actual.GetClient().(*client.Client).Name)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestRejectLogoutRequest() {
+func (s *PersisterTestSuite) TestGetAccessTokenExpiry() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			lr := newLogoutRequest()
-			require.NoError(t, r.ConsentManager().CreateLogoutRequest(s.t1, lr))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+			lifespan := r.Config().GetAccessTokenLifespan(s.t1)
+
+			create := func(t *testing.T) string {
+				sig := uuid.Must(uuid.NewV4()).String()
+				request := fosite.NewRequest()
+				request.Client = cl
+				request.RequestedAt = time.Now().UTC().Add(-time.Minute).Round(time.Second)
+				request.Session = oauth2.NewSession("sub")
+				request.Session.SetExpiresAt(fosite.AccessToken, request.RequestedAt.Add(lifespan))
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+				return sig
+			}
+			assertMatchesFullGetter := func(t *testing.T, sig string) {
+				issuedAt, expiresAt, active, err := p.GetAccessTokenExpiry(s.t1, sig)
+				require.NoError(t, err)
+				assert.True(t, active)
+
+				full, err := p.GetAccessTokenSession(s.t1, sig, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.WithinDuration(t, full.GetRequestedAt(), issuedAt, time.Second)
+				assert.WithinDuration(t, full.GetSession().GetExpiresAt(fosite.AccessToken), expiresAt, time.Second)
+			}
 
-			require.Error(t, r.ConsentManager().RejectLogoutRequest(s.t2, lr.ID))
-			actual, err := r.ConsentManager().GetLogoutRequest(s.t1, lr.ID)
-			require.NoError(t, err)
-			require.Equal(t, lr, actual)
+			t.Run("case=hashed", func(t *testing.T) {
+				sig := create(t)
+				assertMatchesFullGetter(t, sig)
 
-			require.NoError(t, r.ConsentManager().RejectLogoutRequest(s.t1, lr.ID))
-			actual, err = r.ConsentManager().GetLogoutRequest(s.t1, lr.ID)
-			require.Error(t, err)
-			require.Equal(t, &flow.LogoutRequest{}, actual)
+				_, _, _, err := p.GetAccessTokenExpiry(s.t2, sig)
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
+
+			t.Run("case=legacy", func(t *testing.T) {
+				sig := create(t)
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", sig, persistencesql.SignatureHash(sig)).
+					Exec())
+				assertMatchesFullGetter(t, sig)
+			})
+
+			t.Run("case=inactive", func(t *testing.T) {
+				sig := create(t)
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET active = false WHERE signature = ?", persistencesql.SignatureHash(sig)).
+					Exec())
+
+				_, _, active, err := p.GetAccessTokenExpiry(s.t1, sig)
+				require.NoError(t, err)
+				assert.False(t, active)
+			})
+
+			t.Run("case=not found", func(t *testing.T) {
+				_, _, _, err := p.GetAccessTokenExpiry(s.t1, uuid.Must(uuid.NewV4()).String())
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestRevokeAccessToken() {
+func (s *PersisterTestSuite) TestExtendAccessTokenLifespan() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			client := &client.Client{ID: "client-id"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, client))
-			sig := uuid.Must(uuid.NewV4()).String()
-			fr := fosite.NewRequest()
-			fr.Client = &fosite.DefaultClient{ID: client.ID}
-			require.NoError(t, r.Persister().CreateAccessTokenSession(s.t1, sig, fr))
-			require.NoError(t, r.Persister().RevokeAccessToken(s.t2, fr.ID))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+			lifespan := r.Config().GetAccessTokenLifespan(s.t1)
+
+			create := func(t *testing.T, requestedAt time.Time) string {
+				sig := uuid.Must(uuid.NewV4()).String()
+				request := fosite.NewRequest()
+				request.Client = cl
+				request.RequestedAt = requestedAt
+				request.Session = oauth2.NewSession("sub")
+				request.Session.SetExpiresAt(fosite.AccessToken, requestedAt.Add(lifespan))
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+				return sig
+			}
+			expiry := func(t *testing.T, sig string) time.Time {
+				r, err := p.GetAccessTokenSession(s.t1, sig, oauth2.NewSession(""))
+				require.NoError(t, err)
+				return r.GetSession().GetExpiresAt(fosite.AccessToken)
+			}
 
-			actual := persistencesql.OAuth2RequestSQL{Table: "access"}
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, persistencesql.SignatureHash(sig)))
-			require.Equal(t, s.t1NID, actual.NID)
+			t.Run("case=within the cap", func(t *testing.T) {
+				requestedAt := time.Now().UTC().Round(time.Second)
+				sig := create(t, requestedAt)
+				newExpiry := requestedAt.Add(lifespan + 2*time.Hour)
+				require.NoError(t, p.ExtendAccessTokenLifespan(s.t1, sig, newExpiry))
 
-			require.NoError(t, r.Persister().RevokeAccessToken(s.t1, fr.ID))
-			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, persistencesql.SignatureHash(sig)))
-		})
-	}
-}
+				assert.WithinDuration(t, newExpiry, expiry(t, sig), time.Second)
+				_, expiresAt, _, err := p.GetAccessTokenExpiry(s.t1, sig)
+				require.NoError(t, err)
+				assert.WithinDuration(t, newExpiry, expiresAt, time.Second)
 
-func (s *PersisterTestSuite) TestRevokeRefreshToken() {
-	t := s.T()
-	for k, r := range s.registries {
-		t.Run(k, func(t *testing.T) {
-			client := &client.Client{ID: "client-id"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+				assert.ErrorIs(t, p.ExtendAccessTokenLifespan(s.t2, sig, newExpiry), fosite.ErrNotFound)
+			})
 
-			request := fosite.NewRequest()
-			request.Client = &fosite.DefaultClient{ID: "client-id"}
+			t.Run("case=beyond the cap", func(t *testing.T) {
+				r.Config().MustSet(s.t1, config.KeyAccessTokenMaxExtendedLifespan, 3*time.Hour)
+				t.Cleanup(func() { r.Config().MustSet(s.t1, config.KeyAccessTokenMaxExtendedLifespan, 24*time.Hour) })
 
-			signature := uuid.Must(uuid.NewV4()).String()
-			require.NoError(t, r.Persister().CreateRefreshTokenSession(s.t1, signature, request))
+				requestedAt := time.Now().UTC().Round(time.Second)
+				sig := create(t, requestedAt)
+				assert.ErrorIs(t, p.ExtendAccessTokenLifespan(s.t1, sig, requestedAt.Add(4*time.Hour)), fosite.ErrInvalidRequest)
+				assert.WithinDuration(t, requestedAt.Add(lifespan), expiry(t, sig), time.Second)
 
-			actual := persistencesql.OAuth2RequestSQL{Table: "refresh"}
+				require.NoError(t, p.ExtendAccessTokenLifespan(s.t1, sig, requestedAt.Add(3*time.Hour)))
+				assert.WithinDuration(t, requestedAt.Add(3*time.Hour), expiry(t, sig), time.Second)
+			})
 
-			require.NoError(t, r.Persister().RevokeRefreshToken(s.t2, request.ID))
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
-			require.Equal(t, true, actual.Active)
-			require.NoError(t, r.Persister().RevokeRefreshToken(s.t1, request.ID))
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
-			require.Equal(t, false, actual.Active)
+			t.Run("case=expiry in the past", func(t *testing.T) {
+				sig := create(t, time.Now().UTC().Round(time.Second))
+				assert.ErrorIs(t, p.ExtendAccessTokenLifespan(s.t1, sig, time.Now().Add(-time.Minute)), fosite.ErrInvalidRequest)
+			})
+
+			t.Run("case=inactive", func(t *testing.T) {
+				sig := create(t, time.Now().UTC().Round(time.Second))
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET active = false WHERE signature = ?", persistencesql.SignatureHash(sig)).
+					Exec())
+				assert.ErrorIs(t, p.ExtendAccessTokenLifespan(s.t1, sig, time.Now().Add(time.Hour)), fosite.ErrInactiveToken)
+			})
+
+			t.Run("case=not found", func(t *testing.T) {
+				assert.ErrorIs(t, p.ExtendAccessTokenLifespan(s.t1, uuid.Must(uuid.NewV4()).String(), time.Now().Add(time.Hour)), fosite.ErrNotFound)
+			})
+
+			t.Run("case=extended tokens are not flushed", func(t *testing.T) {
+				requestedAt := time.Now().UTC().Add(-lifespan - time.Hour).Round(time.Second)
+				extended, expired := create(t, requestedAt), create(t, requestedAt)
+				require.NoError(t, p.ExtendAccessTokenLifespan(s.t1, extended, time.Now().Add(time.Hour)))
+
+				_, err := p.FlushInactiveAccessTokens(s.t1, time.Now(), 100, 10)
+				require.NoError(t, err)
+
+				_, err = p.GetAccessTokenSession(s.t1, extended, oauth2.NewSession(""))
+				assert.NoError(t, err)
+				_, err = p.GetAccessTokenSession(s.t1, expired, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestRevokeRefreshTokenMaybeGracePeriod() {
+func (s *PersisterTestSuite) TestGetAccessTokenMetadata() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			client := &client.Client{ID: "client-id"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, "client-id")
+
+			create := func(t *testing.T) string {
+				sig := uuid.Must(uuid.NewV4()).String()
+				request := fosite.NewRequest()
+				request.Client = cl
+				request.RequestedAt = time.Now().UTC().Round(time.Second)
+				request.RequestedScope = fosite.Arguments{"openid", "offline"}
+				request.GrantedScope = fosite.Arguments{"openid"}
+				request.RequestedAudience = fosite.Arguments{"https://api.example.com"}
+				request.GrantedAudience = fosite.Arguments{"https://api.example.com"}
+				request.Form = url.Values{"grant_type": {"authorization_code"}}
+				request.Session = oauth2.NewSession("sub")
+				require.NoError(t, p.CreateAccessTokenSession(s.t1, sig, request))
+				return sig
+			}
+			assertMatchesFullGetter := func(t *testing.T, sig string) {
+				shallow, err := p.GetAccessTokenMetadata(s.t1, sig)
+				require.NoError(t, err)
+				assert.Nil(t, shallow.GetSession())
+
+				full, err := p.GetAccessTokenSession(s.t1, sig, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, full.GetID(), shallow.GetID())
+				assert.Equal(t, full.GetClient().GetID(), shallow.GetClient().GetID())
+				assert.WithinDuration(t, full.GetRequestedAt(), shallow.GetRequestedAt(), time.Second)
+				assert.Equal(t, full.GetRequestedScopes(), shallow.GetRequestedScopes())
+				assert.Equal(t, full.GetGrantedScopes(), shallow.GetGrantedScopes())
+				assert.Equal(t, full.GetRequestedAudience(), shallow.GetRequestedAudience())
+				assert.Equal(t, full.GetGrantedAudience(), shallow.GetGrantedAudience())
+				assert.Equal(t, full.GetRequestForm(), shallow.GetRequestForm())
+			}
 
-			request := fosite.NewRequest()
-			request.Client = &fosite.DefaultClient{ID: "client-id"}
+			t.Run("case=hashed", func(t *testing.T) {
+				sig := create(t)
+				assertMatchesFullGetter(t, sig)
 
-			signature := uuid.Must(uuid.NewV4()).String()
-			require.NoError(t, r.Persister().CreateRefreshTokenSession(s.t1, signature, request))
+				_, err := p.GetAccessTokenMetadata(s.t2, sig)
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 
-			actual := persistencesql.OAuth2RequestSQL{Table: "refresh"}
+			t.Run("case=legacy", func(t *testing.T) {
+				sig := create(t)
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", sig, persistencesql.SignatureHash(sig)).
+					Exec())
+				assertMatchesFullGetter(t, sig)
+			})
 
-			store, ok := r.Persister().(*persistencesql.Persister)
-			if !ok {
-				t.Fatal("type assertion failed")
-			}
+			t.Run("case=session is not decrypted", func(t *testing.T) {
+				sig := create(t)
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET session_data = 'not-decryptable' WHERE signature = ?", persistencesql.SignatureHash(sig)).
+					Exec())
 
-			require.NoError(t, store.RevokeRefreshTokenMaybeGracePeriod(s.t2, request.ID, signature))
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
-			require.Equal(t, true, actual.Active)
-			require.NoError(t, store.RevokeRefreshTokenMaybeGracePeriod(s.t1, request.ID, signature))
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
-			require.Equal(t, false, actual.Active)
+				_, err := p.GetAccessTokenSession(s.t1, sig, oauth2.NewSession(""))
+				require.Error(t, err)
+
+				shallow, err := p.GetAccessTokenMetadata(s.t1, sig)
+				require.NoError(t, err)
+				assert.Equal(t, cl.GetID(), shallow.GetClient().GetID())
+			})
+
+			t.Run("case=inactive", func(t *testing.T) {
+				sig := create(t)
+				require.NoError(t, p.Connection(context.Background()).
+					RawQuery("UPDATE hydra_oauth2_access SET active = false WHERE signature = ?", persistencesql.SignatureHash(sig)).
+					Exec())
+
+				shallow, err := p.GetAccessTokenMetadata(s.t1, sig)
+				assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+				require.NotNil(t, shallow)
+				assert.Equal(t, cl.GetID(), shallow.GetClient().GetID())
+			})
+
+			t.Run("case=not found", func(t *testing.T) {
+				_, err := p.GetAccessTokenMetadata(s.t1, uuid.Must(uuid.NewV4()).String())
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestRevokeSubjectClientConsentSession() {
+func (s *PersisterTestSuite) TestReconcileTokenConsistency() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			sessionID := uuid.Must(uuid.NewV4()).String()
-			client := &client.Client{ID: "client-id"}
-			f := newFlow(s.t1NID, client.ID, "sub", sqlxx.NullString(sessionID))
-			f.RequestedAt = time.Now().Add(-24 * time.Hour)
-			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
-			require.NoError(t, r.Persister().CreateClient(s.t1, client))
-			require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := &client.Client{ID: uuid.Must(uuid.NewV4()).String()}
+			other := &client.Client{ID: uuid.Must(uuid.NewV4()).String()}
+			require.NoError(t, p.CreateClient(s.t1, cl))
+			require.NoError(t, p.CreateClient(s.t1, other))
+
+			seed := func(t *testing.T, cl *client.Client, withAccess, withRefresh bool) string {
+				request := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+				if withAccess {
+					require.NoError(t, p.CreateAccessTokenSession(s.t1, uuid.Must(uuid.NewV4()).String(), request))
+				}
+				if withRefresh {
+					require.NoError(t, p.CreateRefreshTokenSession(s.t1, uuid.Must(uuid.NewV4()).String(), request))
+				}
+				return request.ID
+			}
 
-			actual := flow.Flow{}
+			report, err := p.ReconcileTokenConsistency(s.t1, cl.GetID())
+			require.NoError(t, err)
+			assert.True(t, report.Consistent())
 
-			require.Error(t, r.Persister().RevokeSubjectClientConsentSession(s.t2, "sub", client.ID))
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, f.ID))
-			require.NoError(t, r.Persister().RevokeSubjectClientConsentSession(s.t1, "sub", client.ID))
-			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, f.ID))
+			seed(t, cl, true, true)
+			seed(t, cl, true, false)
+			report, err = p.ReconcileTokenConsistency(s.t1, cl.GetID())
+			require.NoError(t, err)
+			assert.True(t, report.Consistent(), "%+v", report)
+
+			orphan := seed(t, cl, false, true)
+			revoked := seed(t, cl, true, true)
+			require.NoError(t, p.Connection(context.Background()).
+				RawQuery("UPDATE hydra_oauth2_refresh SET active = false WHERE request_id = ?", revoked).
+				Exec())
+			seed(t, other, false, true)
+
+			report, err = p.ReconcileTokenConsistency(s.t1, cl.GetID())
+			require.NoError(t, err)
+			assert.False(t, report.Consistent())
+			assert.Equal(t, cl.GetID(), report.ClientID)
+			assert.Equal(t, []string{orphan}, report.RefreshWithoutAccess)
+			assert.Equal(t, []string{revoked}, report.AccessWithRevokedRefresh)
+
+			report, err = p.ReconcileTokenConsistency(s.t2, cl.GetID())
+			require.NoError(t, err)
+			assert.True(t, report.Consistent(), "%+v", report)
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestSetClientAssertionJWT() {
+func (s *PersisterTestSuite) TestRefreshTokenGraceState() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			jti := oauth2.NewBlacklistedJTI(uuid.Must(uuid.NewV4()).String(), time.Now().Add(24*time.Hour))
-			require.NoError(t, r.Persister().SetClientAssertionJWT(s.t1, jti.JTI, jti.Expiry))
+			p, ok := r.Persister().(*persistencesql.Persister)
+			require.True(t, ok)
+			cl := createClient(s.t1, t, p, uuid.Must(uuid.NewV4()).String())
+
+			create := func(t *testing.T) (*fosite.Request, string) {
+				request := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+				signature := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, p.CreateRefreshTokenSession(s.t1, signature, request))
+				return request, signature
+			}
 
-			actual := &oauth2.BlacklistedJTI{}
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, jti.ID))
-			require.Equal(t, s.t1NID, actual.NID)
+			t.Run("state=active", func(t *testing.T) {
+				_, signature := create(t)
+				state, err := p.RefreshTokenGraceState(s.t1, signature)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateActive, state)
+
+				// Tokens of other networks are unknown.
+				state, err = p.RefreshTokenGraceState(s.t2, signature)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateNotFound, state)
+			})
+
+			t.Run("state=revoked", func(t *testing.T) {
+				request, signature := create(t)
+				require.NoError(t, p.RevokeRefreshToken(s.t1, request.ID))
+				state, err := p.RefreshTokenGraceState(s.t1, signature)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateRevoked, state)
+			})
+
+			t.Run("state=revoked by rotation", func(t *testing.T) {
+				request, signature := create(t)
+				rotated := uuid.Must(uuid.NewV4()).String()
+				_, err := p.RotateRefreshToken(s.t1, signature, rotated, request)
+				require.NoError(t, err)
+
+				state, err := p.RefreshTokenGraceState(s.t1, signature)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateRevoked, state)
+				state, err = p.RefreshTokenGraceState(s.t1, rotated)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateActive, state)
+			})
+
+			t.Run("state=graced", func(t *testing.T) {
+				request, signature := create(t)
+				require.NoError(t, p.RevokeRefreshToken(s.t1, request.ID))
+				graceUntil := func(t *testing.T, until time.Time) {
+					require.NoError(t, p.Connection(context.Background()).
+						RawQuery("UPDATE hydra_oauth2_refresh SET graced_until = ? WHERE signature = ?", until.UTC(), signature).
+						Exec())
+				}
+
+				graceUntil(t, time.Now().Add(time.Hour))
+				state, err := p.RefreshTokenGraceState(s.t1, signature)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateGraced, state)
+
+				graceUntil(t, time.Now().Add(-time.Hour))
+				state, err = p.RefreshTokenGraceState(s.t1, signature)
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateRevoked, state)
+			})
+
+			t.Run("state=not found", func(t *testing.T) {
+				state, err := p.RefreshTokenGraceState(s.t1, uuid.Must(uuid.NewV4()).String())
+				require.NoError(t, err)
+				assert.Equal(t, persistencesql.GraceStateNotFound, state)
+			})
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestSetClientAssertionJWTRaw() {
+func (s *PersisterTestSuite) TestGetRememberedLoginSession() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			store, ok := r.Persister().(*persistencesql.Persister)
-			if !ok {
-				t.Fatal("type assertion failed")
-			}
+			ls := flow.LoginSession{ID: uuid.Must(uuid.NewV4()).String(), Remember: true}
+			require.NoError(t, r.Persister().CreateLoginSession(s.t1, &ls))
 
-			jti := oauth2.NewBlacklistedJTI(uuid.Must(uuid.NewV4()).String(), time.Now().Add(24*time.Hour))
-			require.NoError(t, store.SetClientAssertionJWTRaw(s.t1, jti))
+			actual, err := r.Persister().GetRememberedLoginSession(s.t2, &ls, ls.ID)
+			require.Error(t, err)
+			require.Nil(t, actual)
 
-			actual := &oauth2.BlacklistedJTI{}
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, jti.ID))
-			require.Equal(t, s.t1NID, actual.NID)
+			actual, err = r.Persister().GetRememberedLoginSession(s.t1, &ls, ls.ID)
+			require.NoError(t, err)
+			require.NotNil(t, actual)
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestUpdateClient() {
+func (s *PersisterTestSuite) TestHandleConsentRequest() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			t1c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret"}
-			t2c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, t1c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, t2c1))
-			t1Hash, t2Hash := t1c1.Secret, t2c1.Secret
-
-			u1 := *t1c1
-			u1.Name = "updated"
-			u1.Secret = ""
-			require.NoError(t, r.Persister().UpdateClient(s.t2, &u1))
-
-			actual, err := r.Persister().GetConcreteClient(s.t1, t1c1.ID)
-			require.NoError(t, err)
-			require.Equal(t, "original", actual.Name)
-			require.Equal(t, t1Hash, actual.Secret)
-
-			actual, err = r.Persister().GetConcreteClient(s.t2, t1c1.ID)
-			require.NoError(t, err)
-			require.Equal(t, "updated", actual.Name)
-			require.Equal(t, t2Hash, actual.Secret)
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			c1 := &client.Client{ID: uuidx.NewV4().String()}
+			f := newFlow(s.t1NID, c1.ID, "sub", sqlxx.NullString(sessionID))
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
+			require.NoError(t, r.Persister().CreateClient(s.t1, c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, c1))
 
-			u2 := *t1c1
-			u2.Name = "updated"
-			u2.Secret = ""
-			require.NoError(t, r.Persister().UpdateClient(s.t1, &u2))
+			req := &flow.OAuth2ConsentRequest{
+				ID:             "consent-request-id",
+				LoginChallenge: sqlxx.NullString(f.ID),
+				Skip:           false,
+				Verifier:       "verifier",
+				CSRF:           "csrf",
+			}
 
-			actual, err = r.Persister().GetConcreteClient(s.t1, t1c1.ID)
-			require.NoError(t, err)
-			require.Equal(t, "updated", actual.Name)
-			require.Equal(t, t1Hash, actual.Secret)
+			hcr := &flow.AcceptOAuth2ConsentRequest{
+				ID:        req.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			}
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t1, f, req))
 
-			u3 := *t1c1
-			u3.Name = "updated"
-			u3.Secret = "updated-secret"
-			require.NoError(t, r.Persister().UpdateClient(s.t1, &u3))
+			actualCR, err := r.Persister().HandleConsentRequest(s.t2, f, hcr)
+			require.Error(t, err)
+			require.Nil(t, actualCR)
+			actual, err := r.Persister().FindGrantedAndRememberedConsentRequests(s.t1, c1.ID, f.Subject)
+			require.Error(t, err)
+			require.Equal(t, 0, len(actual))
 
-			actual, err = r.Persister().GetConcreteClient(s.t1, t1c1.ID)
+			actualCR, err = r.Persister().HandleConsentRequest(s.t1, f, hcr)
 			require.NoError(t, err)
-			require.Equal(t, "updated", actual.Name)
-			require.NotEqual(t, t1Hash, actual.Secret)
-
-			actual, err = r.Persister().GetConcreteClient(s.t2, t2c1.ID)
+			require.NotNil(t, actualCR)
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
+			actual, err = r.Persister().FindGrantedAndRememberedConsentRequests(s.t1, c1.ID, f.Subject)
 			require.NoError(t, err)
-			require.Equal(t, "updated", actual.Name)
-			require.Equal(t, t2Hash, actual.Secret)
+			require.Equal(t, 1, len(actual))
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestUpdateKey() {
+func (s *PersisterTestSuite) TestInvalidateAuthorizeCodeSession() {
 	t := s.T()
 	for k, r := range s.registries {
-		t.Run("dialect="+k, func(*testing.T) {
-			k1 := newKey("test-ks", "test")
-			ks := "key-set"
-			require.NoError(t, r.Persister().AddKey(s.t1, ks, &k1))
-			actual, err := r.Persister().GetKey(s.t1, ks, k1.KeyID)
-			require.NoError(t, err)
-			assertx.EqualAsJSON(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k1}}, actual)
+		t.Run(k, func(t *testing.T) {
+			cl := createClient(s.t1, t, r.Persister(), uuidx.NewV4().String())
+			require.NoError(t, r.Persister().CreateClient(s.t2, cl))
+			sig := uuid.Must(uuid.NewV4()).String()
+			fr := fosite.NewRequest()
+			fr.Client = &fosite.DefaultClient{ID: cl.ID}
+			require.NoError(t, r.Persister().CreateAuthorizeCodeSession(s.t1, sig, fr))
 
-			k2 := newKey("test-ks", "test")
-			r.Persister().UpdateKey(s.t2, ks, &k2)
-			actual, err = r.Persister().GetKey(s.t1, ks, k1.KeyID)
-			require.NoError(t, err)
-			assertx.EqualAsJSON(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k1}}, actual)
+			require.NoError(t, r.Persister().InvalidateAuthorizeCodeSession(s.t2, sig))
+			actual := persistencesql.OAuth2RequestSQL{Table: "code"}
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, sig))
+			require.Equal(t, true, actual.Active)
 
-			r.Persister().UpdateKey(s.t1, ks, &k2)
-			actual, err = r.Persister().GetKey(s.t1, ks, k2.KeyID)
-			require.NoError(t, err)
-			require.NotEqual(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k1}}, actual)
+			require.NoError(t, r.Persister().InvalidateAuthorizeCodeSession(s.t1, sig))
+			actual = persistencesql.OAuth2RequestSQL{Table: "code"}
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, sig))
+			require.Equal(t, false, actual.Active)
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestUpdateKeySet() {
+func (s *PersisterTestSuite) TestIsJWTUsed() {
 	t := s.T()
 	for k, r := range s.registries {
-		t.Run("dialect="+k, func(*testing.T) {
-			ks := "key-set"
-			ks1 := newKeySet(ks, "test")
-			require.NoError(t, r.Persister().AddKeySet(s.t1, ks, ks1))
-			actual, err := r.Persister().GetKeySet(s.t1, ks)
-			require.NoError(t, err)
-			requireKeySetEqual(t, ks1, actual)
+		t.Run(k, func(t *testing.T) {
+			jti := oauth2.NewBlacklistedJTI(uuid.Must(uuid.NewV4()).String(), time.Now().Add(24*time.Hour))
+			require.NoError(t, r.Persister().SetClientAssertionJWT(s.t1, jti.JTI, jti.Expiry))
 
-			ks2 := newKeySet(ks, "test")
-			r.Persister().UpdateKeySet(s.t2, ks, ks2)
-			actual, err = r.Persister().GetKeySet(s.t1, ks)
+			actual, err := r.Persister().IsJWTUsed(s.t2, jti.JTI)
 			require.NoError(t, err)
-			requireKeySetEqual(t, ks1, actual)
+			require.False(t, actual)
 
-			r.Persister().UpdateKeySet(s.t1, ks, ks2)
-			actual, err = r.Persister().GetKeySet(s.t1, ks)
+			actual, err = r.Persister().IsJWTUsed(s.t1, jti.JTI)
 			require.NoError(t, err)
-			requireKeySetEqual(t, ks2, actual)
+			require.True(t, actual)
 		})
 	}
 }
 
-func (s *PersisterTestSuite) TestUpdateWithNetwork() {
+func (s *PersisterTestSuite) TestListUserAuthenticatedClientsWithBackChannelLogout() {
 	t := s.T()
 	for k, r := range s.registries {
 		t.Run(k, func(t *testing.T) {
-			t1c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret"}
-			t2c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret", Owner: "erase-me"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, t1c1))
-			require.NoError(t, r.Persister().CreateClient(s.t2, t2c1))
+			c1 := &client.Client{ID: "client-1", BackChannelLogoutURI: "not-null"}
+			c2 := &client.Client{ID: "client-2", BackChannelLogoutURI: "not-null"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, c2))
 
-			store, ok := r.Persister().(*persistencesql.Persister)
-			if !ok {
-				t.Fatal("type assertion failed")
+			t1f1 := newFlow(s.t1NID, c1.ID, "sub", sqlxx.NullString(uuid.Must(uuid.NewV4()).String()))
+			t1f1.ConsentChallengeID = "t1f1-consent-challenge"
+			t1f1.LoginVerifier = "t1f1-login-verifier"
+			t1f1.ConsentVerifier = "t1f1-consent-verifier"
+
+			t2f1 := newFlow(s.t2NID, c1.ID, "sub", t1f1.SessionID)
+			t2f1.ConsentChallengeID = "t2f1-consent-challenge"
+			t2f1.LoginVerifier = "t2f1-login-verifier"
+			t2f1.ConsentVerifier = "t2f1-consent-verifier"
+
+			t2f2 := newFlow(s.t2NID, c2.ID, "sub", t1f1.SessionID)
+			t2f2.ConsentChallengeID = "t2f2-consent-challenge"
+			t2f2.LoginVerifier = "t2f2-login-verifier"
+			t2f2.ConsentVerifier = "t2f2-consent-verifier"
+
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: t1f1.SessionID.String()})
+
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(t1f1))
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f1))
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f2))
+
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t1, t1f1, &flow.OAuth2ConsentRequest{
+				ID:             t1f1.ID,
+				LoginChallenge: sqlxx.NullString(t1f1.ID),
+				Skip:           false,
+				Verifier:       t1f1.ConsentVerifier.String(),
+				CSRF:           "csrf",
+			}))
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f1, &flow.OAuth2ConsentRequest{
+				ID:             t2f1.ID,
+				LoginChallenge: sqlxx.NullString(t2f1.ID),
+				Skip:           false,
+				Verifier:       t2f1.ConsentVerifier.String(),
+				CSRF:           "csrf",
+			}))
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f2, &flow.OAuth2ConsentRequest{
+				ID:             t2f2.ID,
+				LoginChallenge: sqlxx.NullString(t2f2.ID),
+				Skip:           false,
+				Verifier:       t2f2.ConsentVerifier.String(),
+				CSRF:           "csrf",
+			}))
+
+			_, err := r.Persister().HandleConsentRequest(s.t1, t1f1, &flow.AcceptOAuth2ConsentRequest{
+				ID:        t1f1.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			})
+			require.NoError(t, err)
+			_, err = r.Persister().HandleConsentRequest(s.t2, t2f1, &flow.AcceptOAuth2ConsentRequest{
+				ID:        t2f1.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			})
+			require.NoError(t, err)
+			_, err = r.Persister().HandleConsentRequest(s.t2, t2f2, &flow.AcceptOAuth2ConsentRequest{
+				ID:        t2f2.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			})
+			require.NoError(t, err)
+
+			cs, err := r.Persister().ListUserAuthenticatedClientsWithBackChannelLogout(s.t1, "sub", t1f1.SessionID.String())
+			require.NoError(t, err)
+			require.Equal(t, 1, len(cs))
+
+			cs, err = r.Persister().ListUserAuthenticatedClientsWithBackChannelLogout(s.t2, "sub", t1f1.SessionID.String())
+			require.NoError(t, err)
+			require.Equal(t, 2, len(cs))
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestListUserAuthenticatedClientsWithFrontChannelLogout() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			c1 := &client.Client{ID: "client-1", FrontChannelLogoutURI: "not-null"}
+			c2 := &client.Client{ID: "client-2", FrontChannelLogoutURI: "not-null"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, c2))
+
+			t1f1 := newFlow(s.t1NID, c1.ID, "sub", sqlxx.NullString(uuid.Must(uuid.NewV4()).String()))
+			t1f1.ConsentChallengeID = "t1f1-consent-challenge"
+			t1f1.LoginVerifier = "t1f1-login-verifier"
+			t1f1.ConsentVerifier = "t1f1-consent-verifier"
+
+			t2f1 := newFlow(s.t2NID, c1.ID, "sub", t1f1.SessionID)
+			t2f1.ConsentChallengeID = "t2f1-consent-challenge"
+			t2f1.LoginVerifier = "t2f1-login-verifier"
+			t2f1.ConsentVerifier = "t2f1-consent-verifier"
+
+			t2f2 := newFlow(s.t2NID, c2.ID, "sub", t1f1.SessionID)
+			t2f2.ConsentChallengeID = "t2f2-consent-challenge"
+			t2f2.LoginVerifier = "t2f2-login-verifier"
+			t2f2.ConsentVerifier = "t2f2-consent-verifier"
+
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: t1f1.SessionID.String()})
+
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(t1f1))
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f1))
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(t2f2))
+
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t1, t1f1, &flow.OAuth2ConsentRequest{
+				ID:             t1f1.ID,
+				LoginChallenge: sqlxx.NullString(t1f1.ID),
+				Skip:           false,
+				Verifier:       t1f1.ConsentVerifier.String(),
+				CSRF:           "csrf",
+			}))
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f1, &flow.OAuth2ConsentRequest{
+				ID:             t2f1.ID,
+				LoginChallenge: sqlxx.NullString(t2f1.ID),
+				Skip:           false,
+				Verifier:       t2f1.ConsentVerifier.String(),
+				CSRF:           "csrf",
+			}))
+			require.NoError(t, r.Persister().CreateConsentRequest(s.t2, t2f2, &flow.OAuth2ConsentRequest{
+				ID:             t2f2.ID,
+				LoginChallenge: sqlxx.NullString(t2f2.ID),
+				Skip:           false,
+				Verifier:       t2f2.ConsentVerifier.String(),
+				CSRF:           "csrf",
+			}))
+
+			_, err := r.Persister().HandleConsentRequest(s.t1, t1f1, &flow.AcceptOAuth2ConsentRequest{
+				ID:        t1f1.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			})
+			require.NoError(t, err)
+			_, err = r.Persister().HandleConsentRequest(s.t2, t2f1, &flow.AcceptOAuth2ConsentRequest{
+				ID:        t2f1.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			})
+			require.NoError(t, err)
+			_, err = r.Persister().HandleConsentRequest(s.t2, t2f2, &flow.AcceptOAuth2ConsentRequest{
+				ID:        t2f2.ID,
+				HandledAt: sqlxx.NullTime(time.Now()),
+				Remember:  true,
+			})
+			require.NoError(t, err)
+
+			cs, err := r.Persister().ListUserAuthenticatedClientsWithFrontChannelLogout(s.t1, "sub", t1f1.SessionID.String())
+			require.NoError(t, err)
+			require.Equal(t, 1, len(cs))
+
+			cs, err = r.Persister().ListUserAuthenticatedClientsWithFrontChannelLogout(s.t2, "sub", t1f1.SessionID.String())
+			require.NoError(t, err)
+			require.Equal(t, 2, len(cs))
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestMarkJWTUsedForTime() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			r.Persister().SetClientAssertionJWT(s.t1, "a", time.Now().Add(-24*time.Hour))
+			r.Persister().SetClientAssertionJWT(s.t2, "a", time.Now().Add(-24*time.Hour))
+			r.Persister().SetClientAssertionJWT(s.t2, "b", time.Now().Add(-24*time.Hour))
+
+			require.NoError(t, r.Persister().MarkJWTUsedForTime(s.t2, "a", time.Now().Add(48*time.Hour)))
+
+			store, ok := r.OAuth2Storage().(oauth2.AssertionJWTReader)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+
+			_, err := store.GetClientAssertionJWT(s.t1, "a")
+			require.NoError(t, err)
+			_, err = store.GetClientAssertionJWT(s.t2, "a")
+			require.NoError(t, err)
+			_, err = store.GetClientAssertionJWT(s.t2, "b")
+			require.Error(t, err)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestQueryWithNetwork() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			r.Persister().CreateClient(s.t1, &client.Client{ID: "client-1", FrontChannelLogoutURI: "not-null"})
+
+			store, ok := r.Persister().(*persistencesql.Persister)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+
+			var actual []client.Client
+			store.QueryWithNetwork(s.t2).All(&actual)
+			require.Equal(t, 0, len(actual))
+			store.QueryWithNetwork(s.t1).All(&actual)
+			require.Equal(t, 1, len(actual))
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestRejectLogoutRequest() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			lr := newLogoutRequest()
+			require.NoError(t, r.ConsentManager().CreateLogoutRequest(s.t1, lr))
+
+			require.Error(t, r.ConsentManager().RejectLogoutRequest(s.t2, lr.ID))
+			actual, err := r.ConsentManager().GetLogoutRequest(s.t1, lr.ID)
+			require.NoError(t, err)
+			require.Equal(t, lr, actual)
+
+			require.NoError(t, r.ConsentManager().RejectLogoutRequest(s.t1, lr.ID))
+			actual, err = r.ConsentManager().GetLogoutRequest(s.t1, lr.ID)
+			require.Error(t, err)
+			require.Equal(t, &flow.LogoutRequest{}, actual)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestRevokeAccessToken() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			sig := uuid.Must(uuid.NewV4()).String()
+			fr := fosite.NewRequest()
+			fr.Client = &fosite.DefaultClient{ID: client.ID}
+			require.NoError(t, r.Persister().CreateAccessTokenSession(s.t1, sig, fr))
+			require.NoError(t, r.Persister().RevokeAccessToken(s.t2, fr.ID))
+
+			actual := persistencesql.OAuth2RequestSQL{Table: "access"}
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, persistencesql.SignatureHash(sig)))
+			require.Equal(t, s.t1NID, actual.NID)
+
+			require.NoError(t, r.Persister().RevokeAccessToken(s.t1, fr.ID))
+			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, persistencesql.SignatureHash(sig)))
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestRevokeRefreshToken() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+
+			request := fosite.NewRequest()
+			request.Client = &fosite.DefaultClient{ID: "client-id"}
+
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, r.Persister().CreateRefreshTokenSession(s.t1, signature, request))
+
+			actual := persistencesql.OAuth2RequestSQL{Table: "refresh"}
+
+			require.NoError(t, r.Persister().RevokeRefreshToken(s.t2, request.ID))
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
+			require.Equal(t, true, actual.Active)
+			require.NoError(t, r.Persister().RevokeRefreshToken(s.t1, request.ID))
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
+			require.Equal(t, false, actual.Active)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestRevokeRefreshTokenMaybeGracePeriod() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+
+			request := fosite.NewRequest()
+			request.Client = &fosite.DefaultClient{ID: "client-id"}
+
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, r.Persister().CreateRefreshTokenSession(s.t1, signature, request))
+
+			actual := persistencesql.OAuth2RequestSQL{Table: "refresh"}
+
+			store, ok := r.Persister().(*persistencesql.Persister)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+
+			require.NoError(t, store.RevokeRefreshTokenMaybeGracePeriod(s.t2, request.ID, signature))
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
+			require.Equal(t, true, actual.Active)
+			require.NoError(t, store.RevokeRefreshTokenMaybeGracePeriod(s.t1, request.ID, signature))
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, signature))
+			require.Equal(t, false, actual.Active)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestRevokeSubjectClientConsentSession() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			client := &client.Client{ID: "client-id"}
+			f := newFlow(s.t1NID, client.ID, "sub", sqlxx.NullString(sessionID))
+			f.RequestedAt = time.Now().Add(-24 * time.Hour)
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			require.NoError(t, r.Persister().Connection(context.Background()).Create(f))
+
+			actual := flow.Flow{}
+
+			require.Error(t, r.Persister().RevokeSubjectClientConsentSession(s.t2, "sub", client.ID))
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(&actual, f.ID))
+			require.NoError(t, r.Persister().RevokeSubjectClientConsentSession(s.t1, "sub", client.ID))
+			require.Error(t, r.Persister().Connection(context.Background()).Find(&actual, f.ID))
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestSetClientAssertionJWT() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			jti := oauth2.NewBlacklistedJTI(uuid.Must(uuid.NewV4()).String(), time.Now().Add(24*time.Hour))
+			require.NoError(t, r.Persister().SetClientAssertionJWT(s.t1, jti.JTI, jti.Expiry))
+
+			actual := &oauth2.BlacklistedJTI{}
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, jti.ID))
+			require.Equal(t, s.t1NID, actual.NID)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestSetClientAssertionJWTRaw() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			store, ok := r.Persister().(*persistencesql.Persister)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+
+			jti := oauth2.NewBlacklistedJTI(uuid.Must(uuid.NewV4()).String(), time.Now().Add(24*time.Hour))
+			require.NoError(t, store.SetClientAssertionJWTRaw(s.t1, jti))
+
+			actual := &oauth2.BlacklistedJTI{}
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, jti.ID))
+			require.Equal(t, s.t1NID, actual.NID)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestUpdateClient() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			t1c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret"}
+			t2c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, t1c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, t2c1))
+			t1Hash, t2Hash := t1c1.Secret, t2c1.Secret
+
+			u1 := *t1c1
+			u1.Name = "updated"
+			u1.Secret = ""
+			require.NoError(t, r.Persister().UpdateClient(s.t2, &u1))
+
+			actual, err := r.Persister().GetConcreteClient(s.t1, t1c1.ID)
+			require.NoError(t, err)
+			require.Equal(t, "original", actual.Name)
+			require.Equal(t, t1Hash, actual.Secret)
+
+			actual, err = r.Persister().GetConcreteClient(s.t2, t1c1.ID)
+			require.NoError(t, err)
+			require.Equal(t, "updated", actual.Name)
+			require.Equal(t, t2Hash, actual.Secret)
+
+			u2 := *t1c1
+			u2.Name = "updated"
+			u2.Secret = ""
+			require.NoError(t, r.Persister().UpdateClient(s.t1, &u2))
+
+			actual, err = r.Persister().GetConcreteClient(s.t1, t1c1.ID)
+			require.NoError(t, err)
+			require.Equal(t, "updated", actual.Name)
+			require.Equal(t, t1Hash, actual.Secret)
+
+			u3 := *t1c1
+			u3.Name = "updated"
+			u3.Secret = "updated-secret"
+			require.NoError(t, r.Persister().UpdateClient(s.t1, &u3))
+
+			actual, err = r.Persister().GetConcreteClient(s.t1, t1c1.ID)
+			require.NoError(t, err)
+			require.Equal(t, "updated", actual.Name)
+			require.NotEqual(t, t1Hash, actual.Secret)
+
+			actual, err = r.Persister().GetConcreteClient(s.t2, t2c1.ID)
+			require.NoError(t, err)
+			require.Equal(t, "updated", actual.Name)
+			require.Equal(t, t2Hash, actual.Secret)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestUpdateKey() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run("dialect="+k, func(*testing.T) {
+			k1 := newKey("test-ks", "test")
+			ks := "key-set"
+			require.NoError(t, r.Persister().AddKey(s.t1, ks, &k1))
+			actual, err := r.Persister().GetKey(s.t1, ks, k1.KeyID)
+			require.NoError(t, err)
+			assertx.EqualAsJSON(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k1}}, actual)
+
+			k2 := newKey("test-ks", "test")
+			r.Persister().UpdateKey(s.t2, ks, &k2)
+			actual, err = r.Persister().GetKey(s.t1, ks, k1.KeyID)
+			require.NoError(t, err)
+			assertx.EqualAsJSON(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k1}}, actual)
+
+			r.Persister().UpdateKey(s.t1, ks, &k2)
+			actual, err = r.Persister().GetKey(s.t1, ks, k2.KeyID)
+			require.NoError(t, err)
+			require.NotEqual(t, &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{k1}}, actual)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestUpdateKeySet() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run("dialect="+k, func(*testing.T) {
+			ks := "key-set"
+			ks1 := newKeySet(ks, "test")
+			require.NoError(t, r.Persister().AddKeySet(s.t1, ks, ks1))
+			actual, err := r.Persister().GetKeySet(s.t1, ks)
+			require.NoError(t, err)
+			requireKeySetEqual(t, ks1, actual)
+
+			ks2 := newKeySet(ks, "test")
+			r.Persister().UpdateKeySet(s.t2, ks, ks2)
+			actual, err = r.Persister().GetKeySet(s.t1, ks)
+			require.NoError(t, err)
+			requireKeySetEqual(t, ks1, actual)
+
+			r.Persister().UpdateKeySet(s.t1, ks, ks2)
+			actual, err = r.Persister().GetKeySet(s.t1, ks)
+			require.NoError(t, err)
+			requireKeySetEqual(t, ks2, actual)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestUpdateWithNetwork() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			t1c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret"}
+			t2c1 := &client.Client{ID: "client-id", Name: "original", Secret: "original-secret", Owner: "erase-me"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, t1c1))
+			require.NoError(t, r.Persister().CreateClient(s.t2, t2c1))
+
+			store, ok := r.Persister().(*persistencesql.Persister)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+
+			count, err := store.UpdateWithNetwork(s.t1, &client.Client{ID: "client-id", Name: "updated", Secret: "original-secret"})
+			require.NoError(t, err)
+			require.Equal(t, int64(1), count)
+			actualt1, err := store.GetConcreteClient(s.t1, "client-id")
+			require.NoError(t, err)
+			require.Equal(t, "updated", actualt1.Name)
+			require.Equal(t, "", actualt1.Owner)
+			actualt2, err := store.GetConcreteClient(s.t2, "client-id")
+			require.NoError(t, err)
+			require.Equal(t, "original", actualt2.Name)
+			require.Equal(t, "erase-me", actualt2.Owner)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestVerifyAndInvalidateConsentRequest() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			sub := uuid.Must(uuid.NewV4()).String()
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			f := newFlow(s.t1NID, client.ID, sub, sqlxx.NullString(sessionID))
+			f.ConsentSkip = false
+			f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+			f.ConsentRemember = false
+			crf := 86400
+			f.ConsentRememberFor = &crf
+			f.ConsentError = &flow.RequestDeniedError{}
+			f.SessionAccessToken = map[string]interface{}{}
+			f.SessionIDToken = map[string]interface{}{}
+			f.ConsentWasHandled = false
+			f.State = flow.FlowStateConsentUnused
+
+			consentVerifier := x.Must(f.ToConsentVerifier(s.t1, r))
+
+			_, err := r.ConsentManager().VerifyAndInvalidateConsentRequest(s.t2, consentVerifier)
+			require.Error(t, err)
+			require.Equal(t, flow.FlowStateConsentUnused, f.State)
+			require.Equal(t, false, f.ConsentWasHandled)
+			_, err = r.ConsentManager().VerifyAndInvalidateConsentRequest(s.t1, consentVerifier)
+			require.NoError(t, err)
+			require.Equal(t, flow.FlowStateConsentUnused, f.State) // TODO: Delegate reuse detection to external service.
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestDeviceSecretsEncryptedAtRest() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		cl := createClient(ctx, t, p, "device-secrets")
+
+		storeFlow := func(t *testing.T) (*flow.Flow, string, string) {
+			verifier, err := flow.NewDeviceVerifier()
+			require.NoError(t, err)
+			csrf, err := flow.NewDeviceVerifier()
+			require.NoError(t, err)
+
+			f := newFlow(p.NetworkID(ctx), cl.ID, "sub", "")
+			f.GrantedScope = sqlxx.StringSliceJSONFormat{}
+			rememberFor := 0
+			f.ConsentRememberFor = &rememberFor
+			f.SessionAccessToken = map[string]interface{}{}
+			f.SessionIDToken = map[string]interface{}{}
+			f.DeviceVerifier = sqlxx.NullString(verifier)
+			f.DeviceCSRF = sqlxx.NullString(csrf)
+			_, err = p.VerifyAndInvalidateConsentRequest(ctx, x.Must(f.ToConsentVerifier(ctx, reg)))
+			require.NoError(t, err)
+			return f, verifier, csrf
+		}
+
+		storedSecrets := func(t *testing.T, f *flow.Flow) (verifier, csrf string) {
+			var row struct {
+				Verifier string `db:"device_verifier"`
+				CSRF     string `db:"device_csrf"`
+			}
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT device_verifier, device_csrf FROM hydra_oauth2_flow WHERE login_challenge = ?", f.ID).First(&row))
+			return row.Verifier, row.CSRF
+		}
+
+		t.Run("case=plaintext by default", func(t *testing.T) {
+			f, verifier, csrf := storeFlow(t)
+
+			storedVerifier, storedCSRF := storedSecrets(t, f)
+			assert.Equal(t, verifier, storedVerifier)
+			assert.Equal(t, csrf, storedCSRF)
+		})
+
+		reg.Config().MustSet(ctx, config.KeyDeviceAuthEncryptSecretsAtRest, true)
+		t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyDeviceAuthEncryptSecretsAtRest, false) })
+
+		t.Run("case=encrypted values round-trip", func(t *testing.T) {
+			f, verifier, csrf := storeFlow(t)
+
+			// The encrypted values are longer than the plaintext ones, which
+			// must not be truncated or rejected by the database.
+			storedVerifier, storedCSRF := storedSecrets(t, f)
+			assert.NotContains(t, storedVerifier, verifier)
+			assert.NotContains(t, storedCSRF, csrf)
+			assert.Greater(t, len(storedVerifier), 40)
+			assert.Greater(t, len(storedCSRF), 40)
+
+			actual, err := p.GetFlow(ctx, f.ID)
+			require.NoError(t, err)
+			assert.Equal(t, verifier, actual.DeviceVerifier.String())
+			assert.Equal(t, csrf, actual.DeviceCSRF.String())
+		})
+
+		t.Run("case=legacy plaintext values are read as-is", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyDeviceAuthEncryptSecretsAtRest, false)
+			f, verifier, csrf := storeFlow(t)
+			reg.Config().MustSet(ctx, config.KeyDeviceAuthEncryptSecretsAtRest, true)
+
+			actual, err := p.GetFlow(ctx, f.ID)
+			require.NoError(t, err)
+			assert.Equal(t, verifier, actual.DeviceVerifier.String())
+			assert.Equal(t, csrf, actual.DeviceCSRF.String())
+		})
+
+		t.Run("case=encrypted values are read after disabling encryption", func(t *testing.T) {
+			f, verifier, csrf := storeFlow(t)
+			reg.Config().MustSet(ctx, config.KeyDeviceAuthEncryptSecretsAtRest, false)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyDeviceAuthEncryptSecretsAtRest, true) })
+
+			actual, err := p.GetFlow(ctx, f.ID)
+			require.NoError(t, err)
+			assert.Equal(t, verifier, actual.DeviceVerifier.String())
+			assert.Equal(t, csrf, actual.DeviceCSRF.String())
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestVerifyAndInvalidateLoginRequest() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			sub := uuid.Must(uuid.NewV4()).String()
+			sessionID := uuid.Must(uuid.NewV4()).String()
+			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
+			client := &client.Client{ID: "client-id"}
+			require.NoError(t, r.Persister().CreateClient(s.t1, client))
+			f := newFlow(s.t1NID, client.ID, sub, sqlxx.NullString(sessionID))
+			f.State = flow.FlowStateLoginUnused
+
+			loginVerifier := x.Must(f.ToLoginVerifier(s.t1, r))
+			_, err := r.ConsentManager().VerifyAndInvalidateLoginRequest(s.t2, loginVerifier)
+			require.Error(t, err)
+			require.Equal(t, flow.FlowStateLoginUnused, f.State)
+			require.Equal(t, false, f.LoginWasUsed)
+			_, err = r.ConsentManager().VerifyAndInvalidateLoginRequest(s.t1, loginVerifier)
+			require.NoError(t, err)
+			require.Equal(t, flow.FlowStateLoginUnused, f.State) // TODO: Delegate reuse detection to external service.
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestVerifyAndInvalidateLogoutRequest() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			lr := newLogoutRequest()
+			lr.Verifier = uuid.Must(uuid.NewV4()).String()
+			lr.Accepted = true
+			lr.Rejected = false
+			require.NoError(t, r.ConsentManager().CreateLogoutRequest(s.t1, lr))
+
+			expected, err := r.ConsentManager().GetLogoutRequest(s.t1, lr.ID)
+			require.NoError(t, err)
+
+			lrInvalidated, err := r.ConsentManager().VerifyAndInvalidateLogoutRequest(s.t2, lr.Verifier)
+			require.Error(t, err)
+			require.Nil(t, lrInvalidated)
+			actual := &flow.LogoutRequest{}
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, lr.ID))
+			require.Equal(t, expected, actual)
+
+			lrInvalidated, err = r.ConsentManager().VerifyAndInvalidateLogoutRequest(s.t1, lr.Verifier)
+			require.NoError(t, err)
+			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, lr.ID))
+			require.Equal(t, lrInvalidated, actual)
+			require.Equal(t, true, actual.WasHandled)
+		})
+	}
+}
+
+func (s *PersisterTestSuite) TestWithFallbackNetworkID() {
+	t := s.T()
+	for k, r := range s.registries {
+		t.Run(k, func(t *testing.T) {
+			r.WithContextualizer(&contextx.Default{})
+			store, ok := r.Persister().(*persistencesql.Persister)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+			original := store.NetworkID(context.Background())
+			expected := uuid.Must(uuid.NewV4())
+			store, ok = store.WithFallbackNetworkID(expected).(*persistencesql.Persister)
+			if !ok {
+				t.Fatal("type assertion failed")
+			}
+
+			require.NotEqual(t, original, expected)
+			require.Equal(t, expected, store.NetworkID(context.Background()))
+		})
+	}
+}
+
+func TestPersisterTestSuite(t *testing.T) {
+	suite.Run(t, new(PersisterTestSuite))
+}
+
+func newClient() *client.Client {
+	return &client.Client{
+		ID: uuid.Must(uuid.NewV4()).String(),
+	}
+}
+
+// createClient stores a client with the given ID in the network of ctx.
+func createClient(ctx context.Context, t *testing.T, m client.Storage, id string) *client.Client {
+	cl := &client.Client{ID: id}
+	require.NoError(t, m.CreateClient(ctx, cl))
+	return cl
+}
+
+// newTokenRequest returns a request of the client for the subject, requested
+// now.
+func newTokenRequest(id string, cl fosite.Client, subject string) *fosite.Request {
+	return &fosite.Request{
+		ID:          id,
+		RequestedAt: time.Now().UTC().Round(time.Second),
+		Client:      cl,
+		Session:     oauth2.NewSession(subject),
+	}
+}
+
+func newFlow(nid uuid.UUID, clientID string, subject string, sessionID sqlxx.NullString) *flow.Flow {
+	return &flow.Flow{
+		NID:                nid,
+		ID:                 uuid.Must(uuid.NewV4()).String(),
+		ClientID:           clientID,
+		Subject:            subject,
+		ConsentError:       &flow.RequestDeniedError{},
+		State:              flow.FlowStateConsentUnused,
+		LoginError:         &flow.RequestDeniedError{},
+		Context:            sqlxx.JSONRawMessage{},
+		AMR:                sqlxx.StringSliceJSONFormat{},
+		ConsentChallengeID: sqlxx.NullString("not-null"),
+		ConsentVerifier:    sqlxx.NullString("not-null"),
+		ConsentCSRF:        sqlxx.NullString("not-null"),
+		SessionID:          sessionID,
+		RequestedAt:        time.Now(),
+	}
+}
+
+func newGrant(keySet string, keyID string) trust.Grant {
+	return trust.Grant{
+		ID:        uuid.Must(uuid.NewV4()).String(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		PublicKey: trust.PublicKey{
+			Set:   keySet,
+			KeyID: keyID,
+		},
+	}
+}
+
+func newLogoutRequest() *flow.LogoutRequest {
+	return &flow.LogoutRequest{
+		ID: uuid.Must(uuid.NewV4()).String(),
+	}
+}
+
+func newKey(ksID string, use string) jose.JSONWebKey {
+	ks, err := jwk.GenerateJWK(context.Background(), jose.RS256, ksID, use)
+	if err != nil {
+		panic(err)
+	}
+	return ks.Keys[0]
+}
+
+func newKeySet(id string, use string) *jose.JSONWebKeySet {
+	return x.Must(jwk.GenerateJWK(context.Background(), jose.RS256, id, use))
+}
+
+func newLoginSession() *flow.LoginSession {
+	return &flow.LoginSession{
+		ID:              uuid.Must(uuid.NewV4()).String(),
+		AuthenticatedAt: sqlxx.NullTime(time.Time{}),
+		Subject:         uuid.Must(uuid.NewV4()).String(),
+		Remember:        false,
+	}
+}
+
+func requireKeySetEqual(t *testing.T, expected *jose.JSONWebKeySet, actual *jose.JSONWebKeySet) {
+	assertx.EqualAsJSON(t, expected, actual)
+}
+
+func persistLoginSession(ctx context.Context, t *testing.T, p persistence.Persister, session *flow.LoginSession) {
+	t.Helper()
+	require.NoError(t, p.CreateLoginSession(ctx, session))
+	require.NoError(t, p.Connection(ctx).Create(session))
+}
+
+func (s *PersisterTestSuite) TestFlushInactiveAccessTokensParallel() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, reg.ClientManager(), "flush-parallel-client")
+
+		const tokens = 40
+		create := func(t *testing.T) {
+			for i := 0; i < tokens; i++ {
+				require.NoError(t, p.CreateAccessTokenSession(ctx, fmt.Sprintf("flush-parallel-%d", i), &fosite.Request{
+					ID:          fmt.Sprintf("flush-parallel-request-%d", i),
+					RequestedAt: time.Now().UTC().Add(-24 * time.Hour).Round(time.Second),
+					Client:      cl,
+					Session:     oauth2.NewSession("sub"),
+				}))
+			}
+			// Simulate legacy signatures which do not start with a hex character.
+			for i, prefix := range []string{"Z", "A", "-", "_"} {
+				require.NoError(t, p.Connection(ctx).RawQuery(
+					"UPDATE hydra_oauth2_access SET signature = ? WHERE request_id = ?",
+					prefix+"legacy", fmt.Sprintf("flush-parallel-request-%d", i),
+				).Exec())
+			}
+		}
+		count := func(t *testing.T, condition string) (n int) {
+			require.NoError(t, p.Connection(ctx).RawQuery(
+				fmt.Sprintf("SELECT COUNT(*) FROM hydra_oauth2_access WHERE nid = ? AND (%s)", condition), p.NetworkID(ctx),
+			).First(&n))
+			return n
+		}
+
+		t.Run("case=shards cover every signature exactly once", func(t *testing.T) {
+			create(t)
+			t.Cleanup(func() {
+				_, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 1000, 100)
+				require.NoError(t, err)
+			})
+
+			for _, shards := range []int{1, 2, 3, 5, persistencesql.MaxSignatureShards} {
+				total := 0
+				for shard := 0; shard < shards; shard++ {
+					total += count(t, persistencesql.SignatureShardCondition(shard, shards))
+				}
+				assert.Equal(t, tokens, total, "shards=%d", shards)
+			}
+		})
+
+		t.Run("case=flushes all shards", func(t *testing.T) {
+			create(t)
+
+			deleted, err := p.FlushInactiveAccessTokensParallel(ctx, time.Now(), 100, 3, 5, 2)
+			require.NoError(t, err)
+			assert.Equal(t, tokens, deleted)
+			assert.Zero(t, count(t, "1=1"))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestAccessTokenCache() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyAccessTokenCacheSize, 2)
+		reg.Config().MustSet(ctx, config.KeyAccessTokenCacheTTL, time.Minute)
+
+		cl := createClient(ctx, t, p, "access-token-cache-client")
+
+		// create stores an access token and caches it by reading it once.
+		create := func(t *testing.T) (signature, requestID string) {
+			signature, requestID = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(requestID, cl, "sub")))
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			return signature, requestID
+		}
+		// deleteRow deletes the access token behind the back of the persister, so
+		// that only a cache hit can still return it.
+		deleteRow := func(t *testing.T, signature string) {
+			require.NoError(t, p.Connection(ctx).RawQuery("DELETE FROM hydra_oauth2_access WHERE signature = ?", persistencesql.SignatureHash(signature)).Exec())
+		}
+		get := func(signature string) error {
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			return err
+		}
+
+		t.Run("case=cache hit", func(t *testing.T) {
+			signature, _ := create(t)
+			deleteRow(t, signature)
+			assert.NoError(t, get(signature))
+		})
+
+		t.Run("case=evicts the least recently used tokens", func(t *testing.T) {
+			first, _ := create(t)
+			create(t)
+			create(t)
+			deleteRow(t, first)
+			assert.ErrorIs(t, get(first), fosite.ErrNotFound)
+		})
+
+		t.Run("case=ttl expiry", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyAccessTokenCacheTTL, 50*time.Millisecond)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAccessTokenCacheTTL, time.Minute) })
+
+			signature, _ := create(t)
+			deleteRow(t, signature)
+			time.Sleep(100 * time.Millisecond)
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+
+		t.Run("case=invalidated on revoke", func(t *testing.T) {
+			signature, requestID := create(t)
+			require.NoError(t, p.RevokeAccessToken(ctx, requestID))
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+
+		t.Run("case=invalidated after reads during a bulk revocation", func(t *testing.T) {
+			challenge := uuid.Must(uuid.NewV4()).String()
+			signatures := make([]string, 2)
+			for i := range signatures {
+				signatures[i] = uuid.Must(uuid.NewV4()).String()
+				request := newTokenRequest(fmt.Sprintf("%s-%d", challenge, i), cl, "sub")
+				request.Session.(*oauth2.Session).DeviceChallenge = challenge
+				require.NoError(t, p.CreateAccessTokenSession(ctx, signatures[i], request))
+			}
+
+			// The requests are revoked in order within a single transaction.
+			// Once the second one is revoked, the first token is read on
+			// another connection, which still finds it active as the
+			// transaction was not committed yet. Databases which lock the
+			// row instead reject the read, or delay it until the commit.
+			var revoked int
+			reg.WithTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(&spanStartHook{
+				SpanRecorder: tracetest.NewSpanRecorder(),
+				name:         "persistence.sql.RevokeRefreshToken",
+				f: func() {
+					if revoked++; revoked != 2 {
+						return
+					}
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						_ = get(signatures[0])
+					}()
+					select {
+					case <-done:
+					case <-time.After(time.Second):
+					}
+				},
+			})).Tracer(""))
+
+			require.NoError(t, p.RevokeTokensByDeviceChallenge(ctx, challenge))
+			assert.Equal(t, 2, revoked)
+			for _, signature := range signatures {
+				assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+			}
+		})
+
+		t.Run("case=invalidated on delete", func(t *testing.T) {
+			signature, _ := create(t)
+			require.NoError(t, p.DeleteAccessTokenSession(ctx, signature))
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+
+		t.Run("case=invalidated on client token delete", func(t *testing.T) {
+			signature, _ := create(t)
+			require.NoError(t, p.DeleteAccessTokens(ctx, cl.ID))
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+
+		t.Run("case=invalidated on delete by signatures", func(t *testing.T) {
+			signature, _ := create(t)
+			_, err := p.DeleteSessionsBySignatures(ctx, "access", []string{persistencesql.SignatureHash(signature)})
+			require.NoError(t, err)
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+
+		t.Run("case=invalidated on client delete", func(t *testing.T) {
+			other := &client.Client{ID: "access-token-cache-deleted-client"}
+			require.NoError(t, p.CreateClient(ctx, other))
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), other, "sub")))
+			require.NoError(t, get(signature))
+
+			require.NoError(t, p.DeleteClient(ctx, other.ID))
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+
+		t.Run("case=negatives are not cached", func(t *testing.T) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")))
+			assert.NoError(t, get(signature))
+		})
+
+		t.Run("case=disabled", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyAccessTokenCacheSize, 0)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAccessTokenCacheSize, 2) })
+
+			signature, _ := create(t)
+			deleteRow(t, signature)
+			assert.ErrorIs(t, get(signature), fosite.ErrNotFound)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestMaxRequestedAudience() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyMaxRequestedAudience, 2)
+
+		cl := createClient(ctx, t, p, "max-audience-client")
+		newRequest := func(audience ...string) *fosite.Request {
+			return &fosite.Request{
+				ID:                uuid.Must(uuid.NewV4()).String(),
+				RequestedAt:       time.Now().UTC().Round(time.Second),
+				Client:            cl,
+				RequestedAudience: audience,
+				Session:           oauth2.NewSession("sub"),
+			}
+		}
+
+		t.Run("case=within limit", func(t *testing.T) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newRequest("aud-1", "aud-2")))
+
+			actual, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.EqualValues(t, fosite.Arguments{"aud-1", "aud-2"}, actual.GetRequestedAudience())
+		})
+
+		t.Run("case=over limit", func(t *testing.T) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			err := p.CreateAccessTokenSession(ctx, signature, newRequest("aud-1", "aud-2", "aud-3"))
+
+			var tooMany *x.TooManyAudiencesError
+			require.ErrorAs(t, err, &tooMany)
+			assert.Equal(t, 3, tooMany.Count)
+			assert.Equal(t, 2, tooMany.Limit)
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+
+			_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=unbounded by default", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyMaxRequestedAudience, 0)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyMaxRequestedAudience, 2) })
+
+			audience := make([]string, 50)
+			for i := range audience {
+				audience[i] = fmt.Sprintf("aud-%d", i)
+			}
+			assert.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), newRequest(audience...)))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestOutbox() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyOutboxEnabled, true)
+		conn := p.Connection(ctx)
+
+		cl := createClient(ctx, t, p, "outbox-client")
+		newRequest := func() *fosite.Request {
+			return newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+		}
+		outbox := func(t *testing.T, requestID string) []persistencesql.OutboxEvent {
+			var events []persistencesql.OutboxEvent
+			require.NoError(t, conn.Where("request_id = ?", requestID).All(&events))
+			return events
+		}
+
+		t.Run("case=issuance", func(t *testing.T) {
+			r := newRequest()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), r))
+
+			events := outbox(t, r.ID)
+			require.Len(t, events, 1)
+			assert.Equal(t, persistencesql.OutboxEventTokenIssued, events[0].Event)
+			assert.Equal(t, "access", events[0].TokenType)
+			assert.Equal(t, cl.ID, events[0].ClientID)
+			assert.Equal(t, p.NetworkID(ctx), events[0].NID)
+		})
+
+		t.Run("case=revocation", func(t *testing.T) {
+			r := newRequest()
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), r))
+			require.NoError(t, p.RevokeRefreshToken(ctx, r.ID))
+
+			var kinds []string
+			for _, e := range outbox(t, r.ID) {
+				assert.Equal(t, "refresh", e.TokenType)
+				kinds = append(kinds, e.Event)
+			}
+			assert.ElementsMatch(t, []string{persistencesql.OutboxEventTokenIssued, persistencesql.OutboxEventTokenRevoked}, kinds)
+		})
+
+		t.Run("case=written in the same transaction", func(t *testing.T) {
+			r, signature := newRequest(), uuid.Must(uuid.NewV4()).String()
+			abort := errors.New("abort")
+			err := p.Transaction(ctx, func(ctx context.Context, _ *pop.Connection) error {
+				require.NoError(t, p.CreateAccessTokenSession(ctx, signature, r))
+				return abort
+			})
+			require.ErrorIs(t, err, abort)
+
+			assert.Empty(t, outbox(t, r.ID))
+			_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=rolled back if the token write fails", func(t *testing.T) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newRequest()))
+
+			r := newRequest()
+			require.Error(t, p.CreateAccessTokenSession(ctx, signature, r))
+			assert.Empty(t, outbox(t, r.ID))
+		})
+
+		t.Run("case=token write rolled back if the outbox write fails", func(t *testing.T) {
+			require.NoError(t, conn.RawQuery("ALTER TABLE hydra_oauth2_outbox RENAME TO hydra_oauth2_outbox_moved").Exec())
+			t.Cleanup(func() {
+				require.NoError(t, conn.RawQuery("ALTER TABLE hydra_oauth2_outbox_moved RENAME TO hydra_oauth2_outbox").Exec())
+			})
+
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.Error(t, p.CreateAccessTokenSession(ctx, signature, newRequest()))
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=disabled", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyOutboxEnabled, false)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyOutboxEnabled, true) })
+
+			r := newRequest()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), r))
+			require.NoError(t, p.RevokeAccessToken(ctx, r.ID))
+			assert.Empty(t, outbox(t, r.ID))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestSchemaInfo() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, reg.ClientManager(), "schema-info-client")
+		req := &fosite.Request{ID: "schema-info-request", RequestedAt: time.Now().UTC(), Client: cl, Session: oauth2.NewSession("sub")}
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "schema-info-access", req))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, "schema-info-refresh", req))
+
+		info, err := p.SchemaInfo(ctx)
+		require.NoError(t, err)
+
+		status, err := p.MigrationStatus(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{
+			"latest_applied": status[len(status)-1].Version,
+			"pending":        0,
+		}, info["migrations"])
+		assert.Equal(t, reg.Config().EncryptSessionData(ctx), info["encrypt_session_data"])
+
+		tables, ok := info["tables"].(map[string]any)
+		require.True(t, ok)
+		assert.Len(t, tables, 7)
+		assert.Equal(t, map[string]any{
+			"rows":    1,
+			"columns": map[string]bool{"auth_time": true, "client_snapshot": true, "introspection_audience": true, "grant_type": true, "expires_at": true, "device_challenge": true, "amr": true, "sid": true, "issuer": true, "flagged_at": true, "flagged_reason": true},
+		}, tables["hydra_oauth2_access"])
+		assert.Equal(t, map[string]any{
+			"rows":    0,
+			"columns": map[string]bool{"auth_time": true, "nonce_hash": true},
+		}, tables["hydra_oauth2_code"])
+		assert.Equal(t, map[string]any{
+			"rows":    0,
+			"columns": map[string]bool{"auth_time": true, "last_polled_at": true, "device_challenge": true},
+		}, tables["hydra_oauth2_device_code"])
+		assert.Equal(t, map[string]any{
+			"rows":    1,
+			"columns": map[string]bool{"auth_time": true, "client_snapshot": true, "grant_type": true, "expires_at": true, "device_challenge": true, "amr": true, "sid": true, "issuer": true, "flagged_at": true, "flagged_reason": true, "sliding_expires_at": true, "absolute_expires_at": true, "chain_length": true, "revocation_reason": true, "revoked_at": true, "graced_until": true},
+		}, tables["hydra_oauth2_refresh"])
+	})
+}
+
+// memorySessionBackend is an in-memory SessionBackend standing in for an
+// ephemeral store such as Redis.
+type memorySessionBackend struct {
+	sessions map[string]*memorySession
+}
+
+type memorySession struct {
+	requester fosite.Requester
+	active    bool
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{sessions: make(map[string]*memorySession)}
+}
+
+func (b *memorySessionBackend) CreateSession(_ context.Context, signature string, requester fosite.Requester) error {
+	b.sessions[signature] = &memorySession{requester: requester, active: true}
+	return nil
+}
+
+func (b *memorySessionBackend) GetSession(_ context.Context, signature string, _ fosite.Session) (fosite.Requester, bool, error) {
+	s, ok := b.sessions[signature]
+	if !ok {
+		return nil, false, fosite.ErrNotFound
+	}
+	return s.requester, s.active, nil
+}
+
+func (b *memorySessionBackend) GetSessionByRequestID(_ context.Context, requestID string, _ fosite.Session) (fosite.Requester, bool, error) {
+	for _, s := range b.sessions {
+		if s.requester.GetID() == requestID {
+			return s.requester, s.active, nil
+		}
+	}
+	return nil, false, fosite.ErrNotFound
+}
+
+func (b *memorySessionBackend) DeleteSession(_ context.Context, signature string) error {
+	if _, ok := b.sessions[signature]; !ok {
+		return fosite.ErrNotFound
+	}
+	delete(b.sessions, signature)
+	return nil
+}
+
+func (b *memorySessionBackend) DeleteSessionsByRequestID(_ context.Context, requestID string) error {
+	deleted := 0
+	for signature, s := range b.sessions {
+		if s.requester.GetID() == requestID {
+			delete(b.sessions, signature)
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return fosite.ErrNotFound
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) DeactivateSession(_ context.Context, signature string) error {
+	if s, ok := b.sessions[signature]; ok {
+		s.active = false
+	}
+	return nil
+}
+
+func (b *memorySessionBackend) DeactivateSessionsByRequestID(_ context.Context, requestID string) error {
+	for _, s := range b.sessions {
+		if s.requester.GetID() == requestID {
+			s.active = false
+		}
+	}
+	return nil
+}
+
+func (s *PersisterTestSuite) TestSessionBackend() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(ctx)
+
+		codes, pkce := newMemorySessionBackend(), newMemorySessionBackend()
+		require.NoError(t, p.SetSessionBackend("code", codes))
+		require.NoError(t, p.SetSessionBackend("pkce", pkce))
+		t.Cleanup(func() {
+			require.NoError(t, p.SetSessionBackend("code", nil))
+			require.NoError(t, p.SetSessionBackend("pkce", nil))
+		})
+
+		cl := createClient(ctx, t, p, "session-backend-client")
+		newRequest := func() *fosite.Request {
+			return newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+		}
+		countRows := func(t *testing.T, table, requestID string) int {
+			n, err := conn.RawQuery(fmt.Sprintf("SELECT * FROM %s WHERE request_id = ?", table), requestID).Count(&persistencesql.OAuth2RequestSQL{})
+			require.NoError(t, err)
+			return n
+		}
+
+		t.Run("case=unknown table", func(t *testing.T) {
+			assert.Error(t, p.SetSessionBackend("client", codes))
+		})
+
+		t.Run("case=tables with SQL-only flows stay in SQL", func(t *testing.T) {
+			for _, table := range []persistencesql.TableName{"access", "refresh", "oidc", "device_code", "user_code"} {
+				assert.Error(t, p.SetSessionBackend(table, codes), table)
+			}
+		})
+
+		t.Run("case=SQL-only operations reject tables of other backends", func(t *testing.T) {
+			_, err := p.ErasureBySubject(ctx, "sub")
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+			_, err = p.IsNonceUsed(ctx, cl.ID, "nonce")
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+			_, err = p.DeduplicateActiveAuthorizeCodes(ctx)
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+			_, err = p.ExportActiveSessions(ctx, "pkce", io.Discard)
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+
+			// Tables stored in SQL are not affected.
+			_, err = p.ExportActiveSessions(ctx, "refresh", io.Discard)
+			assert.NoError(t, err)
+		})
+
+		t.Run("case=authorization codes are stored in the configured backend", func(t *testing.T) {
+			r := newRequest()
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAuthorizeCodeSession(ctx, signature, r))
+
+			assert.Contains(t, codes.sessions, signature)
+			assert.Zero(t, countRows(t, "hydra_oauth2_code", r.ID))
+
+			got, err := p.GetAuthorizeCodeSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, r.ID, got.GetID())
+
+			require.NoError(t, p.InvalidateAuthorizeCodeSession(ctx, signature))
+			got, err = p.GetAuthorizeCodeSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInvalidatedAuthorizeCode)
+			require.NotNil(t, got)
+			assert.Equal(t, r.ID, got.GetID())
+		})
+
+		t.Run("case=PKCE sessions are stored in the configured backend", func(t *testing.T) {
+			r := newRequest()
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreatePKCERequestSession(ctx, signature, r))
+			assert.Contains(t, pkce.sessions, signature)
+			assert.Zero(t, countRows(t, "hydra_oauth2_pkce", r.ID))
+
+			require.NoError(t, p.DeletePKCERequestSession(ctx, signature))
+			assert.NotContains(t, pkce.sessions, signature)
+			_, err := p.GetPKCERequestSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=refresh tokens are stored in SQL", func(t *testing.T) {
+			r := newRequest()
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAuthorizeCodeSession(ctx, signature, r))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, signature, r))
+			assert.Equal(t, 1, countRows(t, "hydra_oauth2_refresh", r.ID))
+
+			require.NoError(t, p.RevokeRefreshToken(ctx, r.ID))
+			_, err := p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+			// The code with the same signature lives in the other backend.
+			_, err = p.GetAuthorizeCodeSession(ctx, signature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestFlushPreviewByClient() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		lifespan := reg.Config().GetAccessTokenLifespan(ctx)
+		clients := map[string]struct{ old, recent int }{
+			"flush-preview-a": {old: 3, recent: 1},
+			"flush-preview-b": {old: 1, recent: 2},
+			"flush-preview-c": {old: 0, recent: 2},
+		}
+		for id, n := range clients {
+			cl := createClient(ctx, t, p, id)
+			for i := 0; i < n.old+n.recent; i++ {
+				requestedAt := time.Now().UTC().Add(-lifespan - time.Hour)
+				if i >= n.old {
+					requestedAt = time.Now().UTC()
+				}
+				require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: requestedAt,
+					Client:      cl,
+					Session:     oauth2.NewSession("sub"),
+				}))
+			}
+		}
+
+		t.Run("case=unsupported table", func(t *testing.T) {
+			_, err := p.FlushPreviewByClient(ctx, "code", time.Now())
+			assert.Error(t, err)
+		})
+
+		t.Run("case=notAfter before all tokens", func(t *testing.T) {
+			counts, err := p.FlushPreviewByClient(ctx, "access", time.Now().Add(-lifespan-2*time.Hour))
+			require.NoError(t, err)
+			assert.Empty(t, counts)
+		})
+
+		t.Run("case=counts match the flushed rows", func(t *testing.T) {
+			counts, err := p.FlushPreviewByClient(ctx, "access", time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, map[string]int{"flush-preview-a": 3, "flush-preview-b": 1}, counts)
+
+			// Previewing deletes nothing.
+			again, err := p.FlushPreviewByClient(ctx, "access", time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, counts, again)
+
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 4, res.Deleted)
+
+			counts, err = p.FlushPreviewByClient(ctx, "access", time.Now())
+			require.NoError(t, err)
+			assert.Empty(t, counts)
+		})
+	})
+}
+
+type flushArchiveSinkFunc func(ctx context.Context, table string, records []persistencesql.FlushArchiveRecord) error
+
+func (f flushArchiveSinkFunc) Archive(ctx context.Context, table string, records []persistencesql.FlushArchiveRecord) error {
+	return f(ctx, table, records)
+}
+
+func (s *PersisterTestSuite) TestFlushArchiveSink() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		t.Cleanup(func() { p.SetFlushArchiveSink(nil) })
+
+		cl := createClient(ctx, t, p, "flush-archive")
+		lifespan := reg.Config().GetAccessTokenLifespan(ctx)
+
+		createTokens := func(t *testing.T, n int) map[string]bool {
+			requestIDs := make(map[string]bool, n)
+			for i := 0; i < n; i++ {
+				id := uuid.Must(uuid.NewV4()).String()
+				require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+					ID:             id,
+					RequestedAt:    time.Now().UTC().Add(-lifespan - time.Hour).Round(time.Second),
+					Client:         cl,
+					RequestedScope: fosite.Arguments{"openid", "offline"},
+					Session:        oauth2.NewSession("archived-subject"),
+				}))
+				requestIDs[id] = true
+			}
+			return requestIDs
+		}
+		countTokens := func(t *testing.T) int {
+			var row struct {
+				N int `db:"n"`
+			}
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT COUNT(*) AS n FROM hydra_oauth2_access WHERE client_id = ?", cl.ID).First(&row))
+			return row.N
+		}
+
+		t.Run("case=rows are archived before they are deleted", func(t *testing.T) {
+			requestIDs := createTokens(t, 5)
+
+			var batches int
+			p.SetFlushArchiveSink(flushArchiveSinkFunc(func(ctx context.Context, table string, records []persistencesql.FlushArchiveRecord) error {
+				assert.Equal(t, "access", table)
+				assert.Equal(t, 5-2*batches, countTokens(t), "the batch must not be deleted yet")
+				for _, r := range records {
+					assert.True(t, requestIDs[r.RequestID], "%s", r.RequestID)
+					delete(requestIDs, r.RequestID)
+					assert.Equal(t, cl.ID, r.ClientID)
+					assert.Equal(t, "archived-subject", r.Subject)
+					assert.Equal(t, []string{"openid", "offline"}, r.RequestedScope)
+					assert.True(t, r.Active)
+				}
+				batches++
+				return nil
+			}))
+
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 2)
+			require.NoError(t, err)
+			assert.Equal(t, 5, res.Deleted)
+			assert.Equal(t, 3, batches)
+			assert.Empty(t, requestIDs)
+			assert.Zero(t, countTokens(t))
+		})
+
+		t.Run("case=sink failure aborts the flush", func(t *testing.T) {
+			createTokens(t, 3)
+
+			sinkErr := errors.New("cold storage unavailable")
+			p.SetFlushArchiveSink(flushArchiveSinkFunc(func(context.Context, string, []persistencesql.FlushArchiveRecord) error {
+				return sinkErr
+			}))
+
+			_, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 2)
+			assert.ErrorIs(t, err, sinkErr)
+			assert.Equal(t, 3, countTokens(t))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestPerClientSessionEncryption() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		plain := &client.Client{ID: "plain-sessions", Metadata: []byte(`{"encrypt_session_data":false}`)}
+		encrypted := &client.Client{ID: "encrypted-sessions", Metadata: []byte(`{"encrypt_session_data":true}`)}
+		global := &client.Client{ID: "global-sessions"}
+		for _, cl := range []*client.Client{plain, encrypted, global} {
+			require.NoError(t, p.CreateClient(ctx, cl))
+		}
+
+		for _, tc := range []struct {
+			globalEncrypt bool
+			client        *client.Client
+			encrypted     bool
+		}{
+			{globalEncrypt: true, client: plain, encrypted: false},
+			{globalEncrypt: true, client: encrypted, encrypted: true},
+			{globalEncrypt: true, client: global, encrypted: true},
+			{globalEncrypt: false, client: plain, encrypted: false},
+			{globalEncrypt: false, client: encrypted, encrypted: true},
+			{globalEncrypt: false, client: global, encrypted: false},
+		} {
+			t.Run(fmt.Sprintf("global=%t/client=%s", tc.globalEncrypt, tc.client.ID), func(t *testing.T) {
+				reg.Config().MustSet(ctx, config.KeyEncryptSessionData, tc.globalEncrypt)
+				t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyEncryptSessionData, true) })
+
+				signature := uuid.Must(uuid.NewV4()).String()
+				session := oauth2.NewSession("sub-" + tc.client.ID)
+				require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: time.Now().UTC().Round(time.Second),
+					Client:      tc.client,
+					Session:     session,
+				}))
+
+				row, err := p.InspectSession(ctx, "access", signature)
+				require.NoError(t, err)
+				assert.Equal(t, !tc.encrypted, gjson.ValidBytes(row.Session), "%s", row.Session)
+
+				// Reads detect the encryption, regardless of the current setting.
+				reg.Config().MustSet(ctx, config.KeyEncryptSessionData, !tc.globalEncrypt)
+				r, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, session.GetSubject(), r.GetSession().GetSubject())
+				assert.Equal(t, tc.client.ID, r.GetClient().GetID())
+			})
+		}
+	})
+}
+
+func (s *PersisterTestSuite) TestSessionSerializationFormat() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		encrypted := &client.Client{ID: "format-encrypted"}
+		plain := &client.Client{ID: "format-plain", Metadata: []byte(`{"encrypt_session_data":false}`)}
+		for _, cl := range []*client.Client{encrypted, plain} {
+			require.NoError(t, p.CreateClient(ctx, cl))
+		}
+
+		createSession := func(t *testing.T, format string, cl *client.Client) (string, *oauth2.Session) {
+			reg.Config().MustSet(ctx, config.KeySessionSerializationFormat, format)
+			t.Cleanup(func() {
+				reg.Config().MustSet(ctx, config.KeySessionSerializationFormat, config.SessionSerializationFormatJSON)
+			})
+
+			signature := uuid.Must(uuid.NewV4()).String()
+			session := oauth2.NewSession("sub-" + format)
+			session.Extra = map[string]interface{}{"number": 42.0, "list": []interface{}{"a", "b"}}
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Round(time.Second),
+				Client:      cl,
+				Session:     session,
+			}))
+			return signature, session
+		}
+
+		readSession := func(t *testing.T, signature string, expected *oauth2.Session) {
+			r, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			actual := r.GetSession().(*oauth2.Session)
+			assert.Equal(t, expected.GetSubject(), actual.GetSubject())
+			assert.Equal(t, expected.Extra, actual.Extra)
+		}
+
+		plaintext := func(t *testing.T, signature string) []byte {
+			row, err := p.InspectSession(ctx, "access", signature)
+			require.NoError(t, err)
+			data, err := reg.KeyCipher().Decrypt(ctx, string(row.Session), nil)
+			require.NoError(t, err)
+			return data
+		}
+
+		for _, format := range []string{config.SessionSerializationFormatJSON, config.SessionSerializationFormatMsgpack} {
+			t.Run("format="+format, func(t *testing.T) {
+				signature, session := createSession(t, format, encrypted)
+				assert.Equal(t, format == config.SessionSerializationFormatJSON, gjson.ValidBytes(plaintext(t, signature)))
+				readSession(t, signature, session)
+			})
+		}
+
+		t.Run("case=reads legacy JSON sessions under the msgpack format", func(t *testing.T) {
+			signature, session := createSession(t, config.SessionSerializationFormatJSON, encrypted)
+			reg.Config().MustSet(ctx, config.KeySessionSerializationFormat, config.SessionSerializationFormatMsgpack)
+			readSession(t, signature, session)
+		})
+
+		t.Run("case=reads msgpack sessions under the JSON format", func(t *testing.T) {
+			signature, session := createSession(t, config.SessionSerializationFormatMsgpack, encrypted)
+			reg.Config().MustSet(ctx, config.KeySessionSerializationFormat, config.SessionSerializationFormatJSON)
+			readSession(t, signature, session)
+		})
+
+		t.Run("case=stores unencrypted sessions as JSON", func(t *testing.T) {
+			signature, session := createSession(t, config.SessionSerializationFormatMsgpack, plain)
+			row, err := p.InspectSession(ctx, "access", signature)
+			require.NoError(t, err)
+			assert.True(t, gjson.ValidBytes(row.Session), "%s", row.Session)
+			readSession(t, signature, session)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestAssumePlaintextSessionData() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		plain := &client.Client{ID: "assume-plaintext-plain"}
+		encrypted := &client.Client{ID: "assume-plaintext-encrypted", Metadata: []byte(`{"encrypt_session_data":true}`)}
+		for _, cl := range []*client.Client{plain, encrypted} {
+			require.NoError(t, p.CreateClient(ctx, cl))
+		}
+		reg.Config().MustSet(ctx, config.KeyEncryptSessionData, false)
+
+		createSession := func(t *testing.T, cl *client.Client) (string, *oauth2.Session) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			session := oauth2.NewSession("sub-" + cl.GetID())
+			session.Extra = map[string]interface{}{"foo": "bar"}
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Round(time.Second),
+				Client:      cl,
+				Session:     session,
+			}))
+			return signature, session
+		}
+
+		plainSignature, plainSession := createSession(t, plain)
+		encryptedSignature, encryptedSession := createSession(t, encrypted)
+
+		for _, assume := range []bool{false, true} {
+			t.Run(fmt.Sprintf("assume_plaintext=%t", assume), func(t *testing.T) {
+				reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, assume)
+				t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, false) })
+				assert.Equal(t, assume, reg.Config().AssumePlaintextSessionData(ctx))
+
+				for _, tc := range []struct {
+					signature string
+					expected  *oauth2.Session
+				}{
+					{signature: plainSignature, expected: plainSession},
+					// Sessions encrypted despite the setting are still read.
+					{signature: encryptedSignature, expected: encryptedSession},
+				} {
+					r, err := p.GetAccessTokenSession(ctx, tc.signature, oauth2.NewSession(""))
+					require.NoError(t, err)
+					actual := r.GetSession().(*oauth2.Session)
+					assert.Equal(t, tc.expected.GetSubject(), actual.GetSubject())
+					assert.Equal(t, tc.expected.Extra, actual.Extra)
+				}
+			})
+		}
+
+		t.Run("case=ignored while encryption is enabled", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, true)
+			reg.Config().MustSet(ctx, config.KeyEncryptSessionData, true)
+			t.Cleanup(func() {
+				reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, false)
+				reg.Config().MustSet(ctx, config.KeyEncryptSessionData, false)
+			})
+			assert.False(t, reg.Config().AssumePlaintextSessionData(ctx))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestFindUndecryptableSessions() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(ctx)
+
+		encrypted := &client.Client{ID: "undecryptable-encrypted"}
+		plain := &client.Client{ID: "undecryptable-plain", Metadata: []byte(`{"encrypt_session_data":false}`)}
+		require.NoError(t, p.CreateClient(ctx, encrypted))
+		require.NoError(t, p.CreateClient(ctx, plain))
+
+		var healthy, corrupted []string
+		for i := 0; i < 7; i++ {
+			cl := encrypted
+			if i%3 == 0 {
+				cl = plain
+			}
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")))
+
+			if i%2 == 1 {
+				require.NoError(t, conn.RawQuery("UPDATE hydra_oauth2_refresh SET session_data = ? WHERE signature = ?", "corrupted-"+signature, signature).Exec())
+				corrupted = append(corrupted, signature)
+			} else {
+				healthy = append(healthy, signature)
+			}
+		}
+
+		_, err := p.FindUndecryptableSessions(ctx, "refresh", 0)
+		assert.Error(t, err)
+
+		for _, batchSize := range []int{1, 2, 7, 100} {
+			t.Run(fmt.Sprintf("batch=%d", batchSize), func(t *testing.T) {
+				found, err := p.FindUndecryptableSessions(ctx, "refresh", batchSize)
+				require.NoError(t, err)
+				assert.ElementsMatch(t, corrupted, found)
+			})
+		}
+
+		found, err := p.FindUndecryptableSessions(ctx, "access", 10)
+		require.NoError(t, err)
+		assert.Empty(t, found)
+
+		deleted, err := p.DeleteSessionsBySignatures(ctx, "refresh", append(corrupted, "unknown"))
+		require.NoError(t, err)
+		assert.Equal(t, len(corrupted), deleted)
+
+		found, err = p.FindUndecryptableSessions(ctx, "refresh", 2)
+		require.NoError(t, err)
+		assert.Empty(t, found)
+		for _, signature := range healthy {
+			_, err := p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+		}
+		for _, signature := range corrupted {
+			_, err := p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		}
+
+		deleted, err = p.DeleteSessionsBySignatures(ctx, "refresh", nil)
+		require.NoError(t, err)
+		assert.Zero(t, deleted)
+	})
+}
+
+func (s *PersisterTestSuite) TestSessionUnmarshalErrorStrategy() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(ctx)
+
+		cl := createClient(ctx, t, p, "unmarshal-strategy")
+
+		var healthyID, corruptID, corruptSignature string
+		for _, corrupt := range []bool{false, true} {
+			signature, id := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, signature, &fosite.Request{
+				ID:           id,
+				RequestedAt:  time.Now().UTC().Round(time.Second),
+				Client:       cl,
+				GrantedScope: fosite.Arguments{"listed"},
+				Session:      oauth2.NewSession("sub"),
+			}))
+			if corrupt {
+				require.NoError(t, conn.RawQuery("UPDATE hydra_oauth2_refresh SET session_data = ? WHERE signature = ?", "corrupted-"+signature, signature).Exec())
+				corruptID, corruptSignature = id, signature
+			} else {
+				healthyID = id
+			}
+		}
+
+		t.Cleanup(func() {
+			reg.Config().MustSet(ctx, config.KeySessionUnmarshalErrorStrategy, config.SessionUnmarshalErrorStrategySkip)
+		})
+
+		t.Run("strategy=fail", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionUnmarshalErrorStrategy, config.SessionUnmarshalErrorStrategyFail)
+			_, err := p.GetActiveTokensByGrantedScope(ctx, cl.GetID(), "listed")
+			assert.Error(t, err)
+		})
+
+		t.Run("strategy=skip", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionUnmarshalErrorStrategy, config.SessionUnmarshalErrorStrategySkip)
+			requests, err := p.GetActiveTokensByGrantedScope(ctx, cl.GetID(), "listed")
+			require.NoError(t, err)
+			require.Len(t, requests, 1)
+			assert.Equal(t, healthyID, requests[0].GetID())
+			assert.Equal(t, "sub", requests[0].GetSession().GetSubject())
+		})
+
+		t.Run("strategy=partial", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionUnmarshalErrorStrategy, config.SessionUnmarshalErrorStrategyPartial)
+			requests, err := p.GetActiveTokensByGrantedScope(ctx, cl.GetID(), "listed")
+			require.NoError(t, err)
+			require.Len(t, requests, 2)
+
+			sessions := make(map[string]fosite.Session, len(requests))
+			for _, r := range requests {
+				assert.Equal(t, cl.GetID(), r.GetClient().GetID())
+				sessions[r.GetID()] = r.GetSession()
+			}
+			assert.Equal(t, "sub", sessions[healthyID].GetSubject())
+			assert.Nil(t, sessions[corruptID])
+		})
+
+		t.Run("case=single lookups always fail", func(t *testing.T) {
+			for _, strategy := range []string{config.SessionUnmarshalErrorStrategySkip, config.SessionUnmarshalErrorStrategyPartial} {
+				reg.Config().MustSet(ctx, config.KeySessionUnmarshalErrorStrategy, strategy)
+				_, err := p.GetRefreshTokenSession(ctx, corruptSignature, oauth2.NewSession(""))
+				assert.Error(t, err, strategy)
+			}
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestSessionSkipFormData() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "skip-form-data")
+
+		form := url.Values{"grant_type": {"authorization_code"}, "foo": {"bar"}}
+		for _, skip := range []bool{false, true} {
+			t.Run(fmt.Sprintf("skip=%t", skip), func(t *testing.T) {
+				tables := []string{}
+				if skip {
+					tables = []string{"access"}
+				}
+				reg.Config().MustSet(ctx, config.KeySessionSkipFormData, tables)
+				t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeySessionSkipFormData, []string{}) })
+
+				accessSignature, refreshSignature := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+				request := &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: time.Now().UTC().Round(time.Second),
+					Client:      cl,
+					Form:        form,
+					Session:     oauth2.NewSession("sub"),
+				}
+				require.NoError(t, p.CreateAccessTokenSession(ctx, accessSignature, request))
+				require.NoError(t, p.CreateRefreshTokenSession(ctx, refreshSignature, request))
+
+				access, err := p.GetAccessTokenSession(ctx, accessSignature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				if skip {
+					assert.NotNil(t, access.GetRequestForm())
+					assert.Empty(t, access.GetRequestForm())
+				} else {
+					assert.Equal(t, form, access.GetRequestForm())
+				}
+				assert.Equal(t, "sub", access.GetSession().GetSubject())
+
+				// The refresh table is not configured and keeps its form.
+				refresh, err := p.GetRefreshTokenSession(ctx, refreshSignature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, form, refresh.GetRequestForm())
+			})
+		}
+	})
+}
+
+func (s *PersisterTestSuite) TestSessionSkipFormDataRefresh() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeySessionSkipFormData, []string{"refresh"})
+
+		cl := createClient(ctx, t, p, "skip-refresh-form-data")
+
+		form := url.Values{"grant_type": {"authorization_code"}, "code": {"secret"}}
+		request := func(form url.Values) *fosite.Request {
+			return &fosite.Request{
+				ID:             "skip-refresh-form-data",
+				RequestedAt:    time.Now().UTC().Round(time.Second),
+				Client:         cl,
+				Form:           form,
+				RequestedScope: fosite.Arguments{"offline"},
+				GrantedScope:   fosite.Arguments{"offline"},
+				Session:        oauth2.NewSession("sub"),
+			}
+		}
+
+		// Authorization codes keep their form, which aids debugging.
+		require.NoError(t, p.CreateAuthorizeCodeSession(ctx, "code", request(url.Values{"response_type": {"code"}})))
+		code, err := p.GetAuthorizeCodeSession(ctx, "code", oauth2.NewSession(""))
+		require.NoError(t, err)
+		assert.Equal(t, url.Values{"response_type": {"code"}}, code.GetRequestForm())
+
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access", request(form)))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, "refresh", request(form)))
+
+		access, err := p.GetAccessTokenSession(ctx, "access", oauth2.NewSession(""))
+		require.NoError(t, err)
+		assert.Equal(t, form, access.GetRequestForm())
+
+		refresh, err := p.GetRefreshTokenSession(ctx, "refresh", oauth2.NewSession(""))
+		require.NoError(t, err)
+		assert.NotNil(t, refresh.GetRequestForm())
+		assert.Empty(t, refresh.GetRequestForm())
+		assert.Equal(t, "sub", refresh.GetSession().GetSubject())
+		assert.Equal(t, fosite.Arguments{"offline"}, refresh.GetGrantedScopes())
+
+		// Refreshing works without the form, and the tokens keep the grant they
+		// originate from, which is stored in its own column.
+		refreshed := request(url.Values{"grant_type": {"refresh_token"}})
+		refreshed.Session = refresh.GetSession()
+		_, err = p.RotateRefreshToken(ctx, "refresh", "refresh-2", refreshed)
+		require.NoError(t, err)
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access-2", refreshed))
+
+		refresh, err = p.GetRefreshTokenSession(ctx, "refresh-2", oauth2.NewSession(""))
+		require.NoError(t, err)
+		assert.Empty(t, refresh.GetRequestForm())
+
+		var grantTypes []string
+		require.NoError(t, p.Connection(ctx).RawQuery("SELECT grant_type FROM hydra_oauth2_access WHERE request_id = ? ORDER BY signature", "skip-refresh-form-data").All(&grantTypes))
+		assert.Equal(t, []string{"authorization_code", "authorization_code"}, grantTypes)
+	})
+}
+
+func (s *PersisterTestSuite) TestDeviceAuthMaxActiveFlowsPerClient() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "device-flow-limit")
+		reg.Config().MustSet(ctx, config.KeyDeviceAuthMaxActiveFlowsPerClient, 2)
+
+		create := func() (string, error) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			return signature, p.CreateDeviceCodeSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub"))
+		}
+
+		first, err := create()
+		require.NoError(t, err)
+		_, err = create()
+		require.NoError(t, err)
+
+		_, err = create()
+		var limitErr *x.DeviceFlowLimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, cl.GetID(), limitErr.ClientID)
+		assert.Equal(t, 2, limitErr.Limit)
+		assert.ErrorIs(t, err, fosite.ErrPollingRateLimited)
+
+		// Exchanged device codes are no longer pending.
+		require.NoError(t, p.InvalidateDeviceCodeSession(ctx, first))
+		_, err = create()
+		require.NoError(t, err)
+
+		reg.Config().MustSet(ctx, config.KeyDeviceAuthMaxActiveFlowsPerClient, 0)
+		_, err = create()
+		require.NoError(t, err)
+	})
+}
+
+func (s *PersisterTestSuite) TestCleanupOrphanedGrantSessions() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "orphaned-grants")
+
+		old, recent := time.Now().UTC().Add(-2*time.Hour).Round(time.Second), time.Now().UTC().Round(time.Second)
+		createSessions := func(t *testing.T, requestedAt time.Time, grantType string, scopes []string, withRefresh bool) (accessSignature string) {
+			request := &fosite.Request{
+				ID:           uuid.Must(uuid.NewV4()).String(),
+				RequestedAt:  requestedAt,
+				Client:       cl,
+				GrantedScope: scopes,
+				Form:         url.Values{"grant_type": {grantType}},
+				Session:      oauth2.NewSession("sub"),
+			}
+			accessSignature = uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, accessSignature, request))
+			if withRefresh {
+				require.NoError(t, p.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+			}
+			return accessSignature
+		}
+
+		authorizationCode := string(fosite.GrantTypeAuthorizationCode)
+		orphaned := []string{
+			createSessions(t, old, authorizationCode, []string{"openid", "offline"}, false),
+			createSessions(t, old, string(fosite.GrantTypeDeviceCode), []string{"offline_access"}, false),
+		}
+		kept := []string{
+			// The refresh token was stored.
+			createSessions(t, old, authorizationCode, []string{"offline"}, true),
+			// The refresh token may still be stored.
+			createSessions(t, recent, authorizationCode, []string{"offline"}, false),
+			// No refresh token was requested.
+			createSessions(t, old, authorizationCode, []string{"openid", "offline.read"}, false),
+			// The grant never issues refresh tokens.
+			createSessions(t, old, string(fosite.GrantTypeClientCredentials), []string{"offline"}, false),
+		}
+
+		deleted, err := p.CleanupOrphanedGrantSessions(ctx, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, len(orphaned), deleted)
+
+		for _, signature := range orphaned {
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		}
+		for _, signature := range kept {
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+		}
+
+		deleted, err = p.CleanupOrphanedGrantSessions(ctx, time.Hour)
+		require.NoError(t, err)
+		assert.Zero(t, deleted)
+	})
+}
+
+func (s *PersisterTestSuite) TestSessionMaxDecryptConcurrency() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		// decrypt returns the highest number of concurrent calls of the callback,
+		// and the order in which the calls started.
+		decrypt := func(t *testing.T, ctx context.Context) (int, []int) {
+			var mu sync.Mutex
+			var active, highest int
+			var order []int
+			require.NoError(t, p.DecryptConcurrently(ctx, 20, func(_ context.Context, i int) error {
+				mu.Lock()
+				order = append(order, i)
+				active++
+				highest = max(highest, active)
+				mu.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+
+				mu.Lock()
+				active--
+				mu.Unlock()
+				return nil
+			}))
+			return highest, order
+		}
+
+		for _, limit := range []int{2, 5} {
+			t.Run(fmt.Sprintf("case=limit=%d", limit), func(t *testing.T) {
+				reg.Config().MustSet(ctx, config.KeySessionMaxDecryptConcurrency, limit)
+				highest, order := decrypt(t, ctx)
+				assert.LessOrEqual(t, highest, limit)
+				assert.Greater(t, highest, 1)
+				assert.Len(t, order, 20)
+			})
+		}
+
+		t.Run("case=limit=1", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionMaxDecryptConcurrency, 1)
+			highest, order := decrypt(t, ctx)
+			assert.EqualValues(t, 1, highest)
+			for i := range order {
+				assert.Equal(t, i, order[i])
+			}
+		})
+
+		t.Run("case=transactions are decrypted serially", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionMaxDecryptConcurrency, 5)
+			require.NoError(t, p.Transaction(ctx, func(ctx context.Context, _ *pop.Connection) error {
+				highest, _ := decrypt(t, ctx)
+				assert.EqualValues(t, 1, highest)
+				return nil
+			}))
+		})
+
+		t.Run("case=errors abort", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionMaxDecryptConcurrency, 5)
+			err := p.DecryptConcurrently(ctx, 20, func(_ context.Context, i int) error {
+				if i == 3 {
+					return errors.New("decryption failed")
+				}
+				return nil
+			})
+			assert.EqualError(t, err, "decryption failed")
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestRefreshTokenRequireOfflineAccess() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "offline-access")
+
+		createRefreshToken := func(scopes ...string) (string, error) {
+			signature := uuid.Must(uuid.NewV4()).String()
+			return signature, p.CreateRefreshTokenSession(ctx, signature, &fosite.Request{
+				ID:           uuid.Must(uuid.NewV4()).String(),
+				RequestedAt:  time.Now().UTC().Round(time.Second),
+				Client:       cl,
+				GrantedScope: scopes,
+				Session:      oauth2.NewSession("sub"),
+			})
+		}
+
+		t.Run("case=not enforced", func(t *testing.T) {
+			for _, scopes := range [][]string{{"openid", "offline_access"}, {"openid", "offline"}, {"openid"}} {
+				signature, err := createRefreshToken(scopes...)
+				require.NoError(t, err, "%v", scopes)
+				_, err = p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+				assert.NoError(t, err, "%v", scopes)
+			}
+		})
+
+		t.Run("case=enforced", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyRefreshTokenRequireOfflineAccess, true)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyRefreshTokenRequireOfflineAccess, false) })
+
+			signature, err := createRefreshToken("openid", "offline_access")
+			require.NoError(t, err)
+			_, err = p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+
+			for _, scopes := range [][]string{{"openid", "offline"}, {"openid"}} {
+				signature, err := createRefreshToken(scopes...)
+				assert.ErrorIs(t, err, fosite.ErrInvalidScope, "%v", scopes)
+				_, err = p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound, "%v", scopes)
+			}
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestTokenIssuer() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "token-issuer")
+
+		newRequest := func() *fosite.Request {
+			return newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+		}
+
+		reg.Config().MustSet(ctx, config.KeyIssuerURL, "https://old-issuer.example.com/")
+		accessSignature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, accessSignature, newRequest()))
+		refreshSignature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, refreshSignature, newRequest()))
+
+		reg.Config().MustSet(ctx, config.KeyIssuerURL, "https://new-issuer.example.com/")
+		newSignature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, newSignature, newRequest()))
+
+		issuer, err := p.GetTokenIssuer(ctx, persistencesql.SQLTableAccess, accessSignature)
+		require.NoError(t, err)
+		assert.Equal(t, "https://old-issuer.example.com/", issuer)
+
+		issuer, err = p.GetTokenIssuer(ctx, persistencesql.SQLTableRefresh, refreshSignature)
+		require.NoError(t, err)
+		assert.Equal(t, "https://old-issuer.example.com/", issuer)
+
+		issuer, err = p.GetTokenIssuer(ctx, persistencesql.SQLTableAccess, newSignature)
+		require.NoError(t, err)
+		assert.Equal(t, "https://new-issuer.example.com/", issuer)
+
+		_, err = p.GetTokenIssuer(ctx, persistencesql.SQLTableAccess, "unknown")
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+		_, err = p.GetTokenIssuer(ctx, persistencesql.SQLTableOpenID, accessSignature)
+		assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+	})
+}
+
+func (s *PersisterTestSuite) TestObserveSession() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "observe-session")
+
+		newRequest := func(expiresAt time.Time) *fosite.Request {
+			session := oauth2.NewSession("sub")
+			session.SetExpiresAt(fosite.AccessToken, expiresAt)
+			session.SetExpiresAt(fosite.RefreshToken, expiresAt)
+			return &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Round(time.Second),
+				Client:      cl,
+				Session:     session,
+			}
+		}
+
+		activeSignature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, activeSignature, newRequest(time.Now().UTC().Add(time.Hour))))
+
+		expiredSignature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, expiredSignature, newRequest(time.Now().UTC().Add(-time.Hour))))
+
+		revokedSignature := uuid.Must(uuid.NewV4()).String()
+		revoked := newRequest(time.Now().UTC().Add(time.Hour))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, revokedSignature, revoked))
+		require.NoError(t, p.RevokeRefreshToken(ctx, revoked.ID))
+
+		t.Run("case=default mode errors on inactive tokens", func(t *testing.T) {
+			_, err := p.GetRefreshTokenSession(ctx, revokedSignature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+		})
+
+		t.Run("case=observability mode returns inactive tokens", func(t *testing.T) {
+			r, active, err := p.ObserveSession(ctx, persistencesql.SQLTableAccess, activeSignature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.True(t, active)
+			assert.Equal(t, cl.ID, r.GetClient().GetID())
+
+			r, active, err = p.ObserveSession(ctx, persistencesql.SQLTableAccess, expiredSignature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.False(t, active)
+			assert.Equal(t, cl.ID, r.GetClient().GetID())
+
+			r, active, err = p.ObserveSession(ctx, persistencesql.SQLTableRefresh, revokedSignature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.False(t, active)
+			assert.Equal(t, revoked.ID, r.GetID())
+
+			_, _, err = p.ObserveSession(ctx, persistencesql.SQLTableAccess, "unknown", oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestExchangeDeviceCode() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "exchange-device-code")
+
+		newRequest := func() *fosite.Request {
+			return newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+		}
+		createDeviceCode := func(t *testing.T) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateDeviceCodeSession(ctx, signature, newRequest()))
+			return signature
+		}
+
+		t.Run("case=success", func(t *testing.T) {
+			deviceSignature := createDeviceCode(t)
+			accessSignature, refreshSignature := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.ExchangeDeviceCode(ctx, deviceSignature, accessSignature, newRequest(), refreshSignature, newRequest()))
+
+			_, err := p.GetDeviceCodeSession(ctx, deviceSignature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInvalidatedDeviceCode)
+			_, err = p.GetAccessTokenSession(ctx, accessSignature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+			_, err = p.GetRefreshTokenSession(ctx, refreshSignature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+
+			err = p.ExchangeDeviceCode(ctx, deviceSignature, uuid.Must(uuid.NewV4()).String(), newRequest(), "", nil)
+			assert.ErrorIs(t, err, fosite.ErrInvalidatedDeviceCode)
+		})
+
+		t.Run("case=rolls back if a token cannot be stored", func(t *testing.T) {
+			taken := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, taken, newRequest()))
+
+			deviceSignature := createDeviceCode(t)
+			accessSignature := uuid.Must(uuid.NewV4()).String()
+			require.Error(t, p.ExchangeDeviceCode(ctx, deviceSignature, accessSignature, newRequest(), taken, newRequest()))
+
+			_, active, err := p.ObserveSession(ctx, persistencesql.SQLTableDeviceCode, deviceSignature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.True(t, active)
+			_, err = p.GetAccessTokenSession(ctx, accessSignature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=unknown device code", func(t *testing.T) {
+			err := p.ExchangeDeviceCode(ctx, uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String(), newRequest(), "", nil)
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=concurrent exchanges", func(t *testing.T) {
+			deviceSignature := createDeviceCode(t)
+			accessSignatures := []string{uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(accessSignatures))
+			for i := range accessSignatures {
+				i := i
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[i] = p.ExchangeDeviceCode(ctx, deviceSignature, accessSignatures[i], newRequest(), "", nil)
+				}()
+			}
+			wg.Wait()
+
+			issued := 0
+			for i, signature := range accessSignatures {
+				_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+				if errs[i] == nil {
+					issued++
+					assert.NoError(t, err)
+				} else {
+					assert.ErrorIs(t, err, fosite.ErrNotFound)
+				}
+			}
+			assert.Equal(t, 1, issued, "%v", errs)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestAccessTokenReadRepair() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "read-repair")
+
+		// createLegacy stores an access token under its unhashed signature, like
+		// older versions did.
+		createLegacy := func(t *testing.T) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")))
+			require.NoError(t, p.Connection(ctx).
+				RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", signature, persistencesql.SignatureHash(signature)).
+				Exec())
+			return signature
+		}
+		stored := func(t *testing.T, signature string) bool {
+			var n int
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT COUNT(*) FROM hydra_oauth2_access WHERE signature = ?", signature).First(&n))
+			return n == 1
+		}
+
+		t.Run("case=disabled", func(t *testing.T) {
+			signature := createLegacy(t)
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+
+			assert.True(t, stored(t, signature))
+			assert.False(t, stored(t, persistencesql.SignatureHash(signature)))
+		})
+
+		t.Run("case=enabled", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyAccessTokenReadRepairEnabled, true)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAccessTokenReadRepairEnabled, false) })
+
+			signature := createLegacy(t)
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+
+			assert.False(t, stored(t, signature))
+			assert.True(t, stored(t, persistencesql.SignatureHash(signature)))
+
+			r, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, cl.ID, r.GetClient().GetID())
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestInvalidateAllTokensForClient() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyOutboxEnabled, true)
+
+		compromised, other := &client.Client{ID: "compromised"}, &client.Client{ID: "unaffected"}
+		require.NoError(t, p.CreateClient(ctx, compromised))
+		require.NoError(t, p.CreateClient(ctx, other))
+
+		type tokens struct {
+			request         *fosite.Request
+			access, refresh string
+		}
+		issue := func(t *testing.T, cl fosite.Client) tokens {
+			tk := tokens{
+				request: newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub"),
+				access:  uuid.Must(uuid.NewV4()).String(),
+				refresh: uuid.Must(uuid.NewV4()).String(),
+			}
+			require.NoError(t, p.CreateAccessTokenSession(ctx, tk.access, tk.request))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, tk.refresh, tk.request))
+			return tk
+		}
+
+		revoked := []tokens{issue(t, compromised), issue(t, compromised)}
+		unaffected := issue(t, other)
+
+		require.NoError(t, p.InvalidateAllTokensForClient(ctx, compromised.ID))
+
+		for _, tk := range revoked {
+			_, err := p.GetAccessTokenSession(ctx, tk.access, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+			_, err = p.GetRefreshTokenSession(ctx, tk.refresh, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+
+			var events []persistencesql.OutboxEvent
+			require.NoError(t, p.Connection(ctx).Where("request_id = ? AND event = ?", tk.request.ID, persistencesql.OutboxEventTokenRevoked).All(&events))
+			var types []string
+			for _, e := range events {
+				assert.Equal(t, compromised.ID, e.ClientID)
+				types = append(types, e.TokenType)
+			}
+			assert.ElementsMatch(t, []string{"access", "refresh"}, types)
+		}
+
+		_, err := p.GetAccessTokenSession(ctx, unaffected.access, oauth2.NewSession(""))
+		assert.NoError(t, err)
+		_, err = p.GetRefreshTokenSession(ctx, unaffected.refresh, oauth2.NewSession(""))
+		assert.NoError(t, err)
+
+		var n int
+		require.NoError(t, p.Connection(ctx).RawQuery("SELECT COUNT(*) FROM hydra_oauth2_outbox WHERE request_id = ? AND event = ?", unaffected.request.ID, persistencesql.OutboxEventTokenRevoked).First(&n))
+		assert.Zero(t, n)
+	})
+}
+
+func (s *PersisterTestSuite) TestFlushBatchTimeBudget() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "flush-batch-budget-client")
+		old := time.Now().UTC().Add(-24 * time.Hour).Round(time.Second)
+		for i := 0; i < 20; i++ {
+			require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: old,
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+		}
+
+		// The archive sink runs within every batch, so sleeping in it simulates
+		// slow batches, and the records it receives reveal the batch sizes.
+		var sizes []int
+		p.SetFlushArchiveSink(flushArchiveSinkFunc(func(_ context.Context, _ string, records []persistencesql.FlushArchiveRecord) error {
+			sizes = append(sizes, len(records))
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		}))
+		t.Cleanup(func() { p.SetFlushArchiveSink(nil) })
+		reg.Config().MustSet(ctx, config.KeyDBFlushBatchTimeBudget, "20ms")
+
+		res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 8)
+		require.NoError(t, err)
+		assert.Equal(t, 20, res.Deleted)
+
+		require.Greater(t, len(sizes), 2)
+		assert.Equal(t, 8, sizes[0])
+		assert.Less(t, sizes[1], sizes[0])
+		for i := 1; i < len(sizes); i++ {
+			assert.LessOrEqual(t, sizes[i], sizes[i-1], "%v", sizes)
+		}
+	})
+}
+
+func (s *PersisterTestSuite) TestFlushMaxBatchSize() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyDBFlushMaxBatchSize, 6)
+
+		cl := createClient(ctx, t, p, "flush-max-batch-size")
+		createExpired := func(t *testing.T, n int) {
+			old := time.Now().UTC().Add(-24 * time.Hour).Round(time.Second)
+			for i := 0; i < n; i++ {
+				require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: old,
+					Client:      cl,
+					Session:     oauth2.NewSession("sub"),
+				}))
+			}
+		}
+		count := func(t *testing.T) (n int) {
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT COUNT(*) FROM hydra_oauth2_access").First(&n))
+			return n
+		}
+
+		t.Run("case=delete", func(t *testing.T) {
+			createExpired(t, 20)
+
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 100)
+			require.NoError(t, err)
+			assert.Equal(t, 20, res.Deleted)
+			assert.Equal(t, 4, res.Batches, "batches of 6, 6, 6 and 2 tokens")
+			assert.Zero(t, count(t))
+		})
+
+		t.Run("case=archive", func(t *testing.T) {
+			createExpired(t, 20)
+
+			var sizes []int
+			p.SetFlushArchiveSink(flushArchiveSinkFunc(func(_ context.Context, _ string, records []persistencesql.FlushArchiveRecord) error {
+				sizes = append(sizes, len(records))
+				return nil
+			}))
+			t.Cleanup(func() { p.SetFlushArchiveSink(nil) })
+
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 100)
+			require.NoError(t, err)
+			assert.Equal(t, 20, res.Deleted)
+			assert.Equal(t, []int{6, 6, 6, 2}, sizes)
+			assert.Zero(t, count(t))
+		})
+
+		t.Run("case=smaller batches are kept", func(t *testing.T) {
+			createExpired(t, 5)
+
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 2)
+			require.NoError(t, err)
+			assert.Equal(t, 5, res.Deleted)
+			assert.Equal(t, 3, res.Batches)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestCredentialsRotatedAt() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyAccessTokenCacheSize, 10)
+
+		rotated, other := &client.Client{ID: "rotated"}, &client.Client{ID: "unrotated"}
+		require.NoError(t, p.CreateClient(ctx, rotated))
+		require.NoError(t, p.CreateClient(ctx, other))
+
+		now := time.Now().UTC().Round(time.Second)
+		issue := func(t *testing.T, cl fosite.Client, requestedAt time.Time) (access, refresh string) {
+			r := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: requestedAt,
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}
+			access, refresh = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, access, r))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, refresh, r))
+			return access, refresh
+		}
+
+		beforeAccess, beforeRefresh := issue(t, rotated, now.Add(-time.Hour))
+		afterAccess, afterRefresh := issue(t, rotated, now)
+		otherAccess, otherRefresh := issue(t, other, now.Add(-time.Hour))
+
+		// Without a rotation timestamp, all tokens are accepted. This also caches
+		// the access token issued before the rotation.
+		_, err := p.GetAccessTokenSession(ctx, beforeAccess, oauth2.NewSession(""))
+		require.NoError(t, err)
+		_, err = p.GetRefreshTokenSession(ctx, beforeRefresh, oauth2.NewSession(""))
+		require.NoError(t, err)
+
+		rotated.CredentialsRotatedAt = pointerx.Ptr(now.Add(-30 * time.Minute))
+		require.NoError(t, p.UpdateClient(ctx, rotated))
+
+		t.Run("case=issued before the rotation", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, beforeAccess, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			assert.ErrorIs(t, err, x.ErrClientCredentialsRotated)
+			_, err = p.GetRefreshTokenSession(ctx, beforeRefresh, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			assert.ErrorIs(t, err, x.ErrClientCredentialsRotated)
+		})
+
+		t.Run("case=issued after the rotation", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, afterAccess, oauth2.NewSession(""))
+			assert.NoError(t, err)
+			_, err = p.GetRefreshTokenSession(ctx, afterRefresh, oauth2.NewSession(""))
+			assert.NoError(t, err)
+		})
+
+		t.Run("case=client without rotation", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, otherAccess, oauth2.NewSession(""))
+			assert.NoError(t, err)
+			_, err = p.GetRefreshTokenSession(ctx, otherRefresh, oauth2.NewSession(""))
+			assert.NoError(t, err)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestFrozenTokenLifespans() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, time.Hour)
+		reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, 2*time.Hour)
+
+		cl := createClient(ctx, t, p, "frozen-lifespans")
+
+		now := time.Now().UTC().Round(time.Second)
+		issue := func(t *testing.T, frozen bool, requestedAt time.Time) (access, refresh string) {
+			reg.Config().MustSet(ctx, config.KeyFrozenTokenLifespansEnabled, frozen)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyFrozenTokenLifespansEnabled, false) })
+
+			r := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: requestedAt,
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
 			}
+			access, refresh = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, access, r))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, refresh, r))
+			return access, refresh
+		}
+		exists := func(t *testing.T, table, signature string) bool {
+			var n int
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT COUNT(*) FROM hydra_oauth2_"+table+" WHERE signature = ?", signature).First(&n))
+			return n == 1
+		}
+		flush := func(t *testing.T) {
+			_, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+			require.NoError(t, err)
+			_, err = p.FlushInactiveRefreshTokens(ctx, time.Now(), 100, 10)
+			require.NoError(t, err)
+		}
 
-			count, err := store.UpdateWithNetwork(s.t1, &client.Client{ID: "client-id", Name: "updated", Secret: "original-secret"})
+		t.Run("case=shortened lifespan does not expire frozen tokens early", func(t *testing.T) {
+			frozenAccess, frozenRefresh := issue(t, true, now.Add(-30*time.Minute))
+			access, refresh := issue(t, false, now.Add(-30*time.Minute))
+
+			reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, 10*time.Minute)
+			reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, 10*time.Minute)
+			t.Cleanup(func() {
+				reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, time.Hour)
+				reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, 2*time.Hour)
+			})
+
+			_, expiresAt, _, err := p.GetAccessTokenExpiry(ctx, frozenAccess)
 			require.NoError(t, err)
-			require.Equal(t, int64(1), count)
-			actualt1, err := store.GetConcreteClient(s.t1, "client-id")
+			assert.Equal(t, now.Add(30*time.Minute), expiresAt.UTC())
+
+			r, err := p.GetRefreshTokenSession(ctx, frozenRefresh, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, now.Add(90*time.Minute), r.GetSession().GetExpiresAt(fosite.RefreshToken).UTC())
+
+			flush(t)
+			assert.True(t, exists(t, "access", persistencesql.SignatureHash(frozenAccess)))
+			assert.True(t, exists(t, "refresh", frozenRefresh))
+			assert.False(t, exists(t, "access", persistencesql.SignatureHash(access)))
+			assert.False(t, exists(t, "refresh", refresh))
+		})
+
+		t.Run("case=extended lifespan does not keep frozen tokens", func(t *testing.T) {
+			frozenAccess, frozenRefresh := issue(t, true, now.Add(-3*time.Hour))
+			access, refresh := issue(t, false, now.Add(-3*time.Hour))
+
+			reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, 24*time.Hour)
+			reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, 24*time.Hour)
+			t.Cleanup(func() {
+				reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, time.Hour)
+				reg.Config().MustSet(ctx, config.KeyRefreshTokenLifespan, 2*time.Hour)
+			})
+
+			_, expiresAt, _, err := p.GetAccessTokenExpiry(ctx, frozenAccess)
+			require.NoError(t, err)
+			assert.Equal(t, now.Add(-2*time.Hour), expiresAt.UTC())
+
+			flush(t)
+			assert.False(t, exists(t, "access", persistencesql.SignatureHash(frozenAccess)))
+			assert.False(t, exists(t, "refresh", frozenRefresh))
+			assert.True(t, exists(t, "access", persistencesql.SignatureHash(access)))
+			assert.True(t, exists(t, "refresh", refresh))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestAccessTokenSignatureStrategies() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "signature-strategies")
+
+		create := func(t *testing.T) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")))
+			return signature
+		}
+		stored := func(t *testing.T, signature string) bool {
+			var n int
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT COUNT(*) FROM hydra_oauth2_access WHERE signature = ?", signature).First(&n))
+			return n == 1
+		}
+
+		// The token is stored under the default, hashed strategy before the
+		// signature scheme is migrated.
+		old := create(t)
+		require.True(t, stored(t, persistencesql.SignatureHash(old)))
+
+		sha256Strategy := persistencesql.SignatureStrategy{Name: "sha256", Derive: func(signature string) string {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte(signature)))
+		}}
+		p.SetAccessTokenSignatureStrategies(sha256Strategy, persistencesql.HashedSignatureStrategy, persistencesql.LegacySignatureStrategy)
+		t.Cleanup(func() { p.SetAccessTokenSignatureStrategies() })
+
+		t.Run("case=new tokens use the primary strategy", func(t *testing.T) {
+			signature := create(t)
+			assert.True(t, stored(t, sha256Strategy.Derive(signature)))
+			assert.False(t, stored(t, persistencesql.SignatureHash(signature)))
+
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			exists, current, err := p.VerifyAccessTokenSignature(ctx, signature)
+			require.NoError(t, err)
+			assert.True(t, exists)
+			assert.True(t, current)
+		})
+
+		t.Run("case=tokens of the previous strategy still resolve", func(t *testing.T) {
+			r, err := p.GetAccessTokenSession(ctx, old, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, cl.ID, r.GetClient().GetID())
+
+			_, err = p.GetAccessTokenMetadata(ctx, old)
+			require.NoError(t, err)
+			_, _, _, err = p.GetAccessTokenExpiry(ctx, old)
+			require.NoError(t, err)
+
+			exists, current, err := p.VerifyAccessTokenSignature(ctx, old)
+			require.NoError(t, err)
+			assert.True(t, exists)
+			assert.False(t, current)
+		})
+
+		t.Run("case=read repair rewrites to the primary strategy", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyAccessTokenReadRepairEnabled, true)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAccessTokenReadRepairEnabled, false) })
+
+			_, err := p.GetAccessTokenSession(ctx, old, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.True(t, stored(t, sha256Strategy.Derive(old)))
+			assert.False(t, stored(t, persistencesql.SignatureHash(old)))
+		})
+
+		t.Run("case=tokens of the previous strategy are deleted", func(t *testing.T) {
+			p.SetAccessTokenSignatureStrategies()
+			signature := create(t)
+			p.SetAccessTokenSignatureStrategies(sha256Strategy, persistencesql.HashedSignatureStrategy)
+
+			require.NoError(t, p.DeleteAccessTokenSession(ctx, signature))
+			assert.False(t, stored(t, persistencesql.SignatureHash(signature)))
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestCountTokensByGrantType() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "count-grant-types")
+
+		issue := func(t *testing.T, grantType string) (access, refresh string) {
+			r := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Form:        url.Values{"grant_type": {grantType}},
+				Session:     oauth2.NewSession("sub"),
+			}
+			access, refresh = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, access, r))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, refresh, r))
+			return access, refresh
+		}
+
+		issue(t, "authorization_code")
+		issue(t, "authorization_code")
+		issue(t, "client_credentials")
+		issue(t, "urn:ietf:params:oauth:grant-type:device_code")
+		issue(t, "")
+		legacyAccess, legacyRefresh := issue(t, "refresh_token")
+		// Legacy tokens predate the grant_type column.
+		require.NoError(t, p.Connection(ctx).RawQuery("UPDATE hydra_oauth2_access SET grant_type = NULL WHERE signature = ?", persistencesql.SignatureHash(legacyAccess)).Exec())
+		require.NoError(t, p.Connection(ctx).RawQuery("UPDATE hydra_oauth2_refresh SET grant_type = NULL WHERE signature = ?", legacyRefresh).Exec())
+
+		expected := map[string]int{
+			"authorization_code":                           2,
+			"client_credentials":                           1,
+			"urn:ietf:params:oauth:grant-type:device_code": 1,
+			"refresh_token":                                1,
+			"":                                             1,
+		}
+		for _, table := range []persistencesql.TableName{persistencesql.SQLTableAccess, persistencesql.SQLTableRefresh} {
+			counts, err := p.CountTokensByGrantType(ctx, table)
+			require.NoError(t, err)
+			assert.Equal(t, expected, counts, "%s", table)
+		}
+
+		_, err := p.CountTokensByGrantType(ctx, persistencesql.SQLTableOpenID)
+		assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+	})
+}
+
+func (s *PersisterTestSuite) TestGetAccessTokenIssuedAt() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "issued-at")
+
+		issuedAt := time.Now().UTC().Add(-time.Hour).Round(time.Second)
+		create := func(t *testing.T) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: issuedAt,
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+			return signature
+		}
+
+		t.Run("case=hashed signature", func(t *testing.T) {
+			actual, err := p.GetAccessTokenIssuedAt(ctx, create(t))
+			require.NoError(t, err)
+			assert.Equal(t, issuedAt, actual.UTC())
+		})
+
+		t.Run("case=legacy signature", func(t *testing.T) {
+			signature := create(t)
+			require.NoError(t, p.Connection(ctx).
+				RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", signature, persistencesql.SignatureHash(signature)).
+				Exec())
+
+			actual, err := p.GetAccessTokenIssuedAt(ctx, signature)
+			require.NoError(t, err)
+			assert.Equal(t, issuedAt, actual.UTC())
+		})
+
+		t.Run("case=inactive token", func(t *testing.T) {
+			signature := create(t)
+			require.NoError(t, p.Connection(ctx).
+				RawQuery("UPDATE hydra_oauth2_access SET active = false WHERE signature = ?", persistencesql.SignatureHash(signature)).
+				Exec())
+
+			actual, err := p.GetAccessTokenIssuedAt(ctx, signature)
+			require.NoError(t, err)
+			assert.Equal(t, issuedAt, actual.UTC())
+		})
+
+		t.Run("case=unknown signature", func(t *testing.T) {
+			_, err := p.GetAccessTokenIssuedAt(ctx, uuid.Must(uuid.NewV4()).String())
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestFlagSession() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "flag-session")
+
+		issue := func(t *testing.T) (access, refresh string) {
+			r := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}
+			access, refresh = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, access, r))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, refresh, r))
+			return access, refresh
+		}
+
+		flaggedAccess, flaggedRefresh := issue(t)
+		unflaggedAccess, _ := issue(t)
+		require.NoError(t, p.FlagSession(ctx, persistencesql.SQLTableAccess, flaggedAccess, "impossible travel"))
+		require.NoError(t, p.FlagSession(ctx, persistencesql.SQLTableRefresh, flaggedRefresh, "impossible travel"))
+
+		t.Run("case=lists flagged sessions", func(t *testing.T) {
+			sessions, err := p.ListFlaggedSessions(ctx, persistencesql.SQLTableAccess)
+			require.NoError(t, err)
+			require.Len(t, sessions, 1)
+			assert.Equal(t, persistencesql.SignatureHash(flaggedAccess), sessions[0].Signature)
+			assert.Equal(t, cl.ID, sessions[0].ClientID)
+			assert.Equal(t, "sub", sessions[0].Subject)
+			assert.True(t, sessions[0].Active)
+			assert.Equal(t, "impossible travel", sessions[0].Reason)
+			assert.WithinDuration(t, time.Now(), sessions[0].FlaggedAt, time.Minute)
+
+			sessions, err = p.ListFlaggedSessions(ctx, persistencesql.SQLTableRefresh)
+			require.NoError(t, err)
+			require.Len(t, sessions, 1)
+			assert.Equal(t, flaggedRefresh, sessions[0].Signature)
+		})
+
+		t.Run("case=flagged sessions remain valid", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, flaggedAccess, oauth2.NewSession(""))
+			require.NoError(t, err)
+			_, err = p.GetRefreshTokenSession(ctx, flaggedRefresh, oauth2.NewSession(""))
+			require.NoError(t, err)
+			_, err = p.GetAccessTokenSession(ctx, unflaggedAccess, oauth2.NewSession(""))
+			require.NoError(t, err)
+		})
+
+		t.Run("case=flagging again replaces the reason", func(t *testing.T) {
+			require.NoError(t, p.FlagSession(ctx, persistencesql.SQLTableAccess, flaggedAccess, "confirmed by analyst"))
+
+			sessions, err := p.ListFlaggedSessions(ctx, persistencesql.SQLTableAccess)
+			require.NoError(t, err)
+			require.Len(t, sessions, 1)
+			assert.Equal(t, "confirmed by analyst", sessions[0].Reason)
+		})
+
+		t.Run("case=legacy signature", func(t *testing.T) {
+			legacy, _ := issue(t)
+			require.NoError(t, p.Connection(ctx).
+				RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", legacy, persistencesql.SignatureHash(legacy)).
+				Exec())
+			require.NoError(t, p.FlagSession(ctx, persistencesql.SQLTableAccess, legacy, "legacy"))
+
+			sessions, err := p.ListFlaggedSessions(ctx, persistencesql.SQLTableAccess)
+			require.NoError(t, err)
+			assert.Len(t, sessions, 2)
+		})
+
+		t.Run("case=unknown signature", func(t *testing.T) {
+			err := p.FlagSession(ctx, persistencesql.SQLTableAccess, uuid.Must(uuid.NewV4()).String(), "unknown")
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=unknown table", func(t *testing.T) {
+			err := p.FlagSession(ctx, persistencesql.TableName("unknown"), flaggedAccess, "unknown")
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+			_, err = p.ListFlaggedSessions(ctx, persistencesql.TableName("unknown"))
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		})
+
+		t.Run("case=table without flags", func(t *testing.T) {
+			err := p.FlagSession(ctx, persistencesql.SQLTableOpenID, flaggedAccess, "oidc")
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+			_, err = p.ListFlaggedSessions(ctx, persistencesql.SQLTableOpenID)
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestDeleteAccessTokenSessionEvent() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		spans := tracetest.NewSpanRecorder()
+		reg.WithTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer(""))
+
+		cl := createClient(ctx, t, p, "delete-event")
+
+		// deletionEvent deletes a new access token and returns the event emitted
+		// by the deletion.
+		deletionEvent := func(t *testing.T) sdktrace.Event {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+			require.NoError(t, p.DeleteAccessTokenSession(ctx, signature))
+
+			ended := spans.Ended()
+			for i := len(ended) - 1; i >= 0; i-- {
+				if ended[i].Name() != "persistence.sql.DeleteAccessTokenSession" {
+					continue
+				}
+				for _, event := range ended[i].Events() {
+					if event.Name == string(events.AccessTokenDeleted) {
+						return event
+					}
+				}
+			}
+			require.FailNow(t, "no deletion event was emitted")
+			return sdktrace.Event{}
+		}
+		clientID := func(event sdktrace.Event) (string, bool) {
+			for _, attr := range event.Attributes {
+				if attr.Key == "OAuth2ClientID" {
+					return attr.Value.AsString(), true
+				}
+			}
+			return "", false
+		}
+
+		t.Run("case=disabled", func(t *testing.T) {
+			_, found := clientID(deletionEvent(t))
+			assert.False(t, found)
+		})
+
+		t.Run("case=enabled", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyAccessTokenDeletionIncludeClientID, true)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyAccessTokenDeletionIncludeClientID, false) })
+
+			id, found := clientID(deletionEvent(t))
+			assert.True(t, found)
+			assert.Equal(t, cl.ID, id)
+
+			err := p.DeleteAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String())
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestHasActiveTokens() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "has-active-tokens")
+
+		request := func(subject string) *fosite.Request {
+			return newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, subject)
+		}
+		require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), request("access-subject")))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), request("refresh-subject")))
+
+		revoked := request("revoked-subject")
+		require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), revoked))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), revoked))
+		require.NoError(t, p.Connection(ctx).RawQuery("UPDATE hydra_oauth2_access SET active = false WHERE request_id = ?", revoked.ID).Exec())
+		require.NoError(t, p.Connection(ctx).RawQuery("UPDATE hydra_oauth2_refresh SET active = false WHERE request_id = ?", revoked.ID).Exec())
+
+		for subject, expected := range map[string]bool{
+			"access-subject":  true,
+			"refresh-subject": true,
+			"revoked-subject": false,
+			"unknown-subject": false,
+		} {
+			t.Run("subject="+subject, func(t *testing.T) {
+				actual, err := p.HasActiveTokens(ctx, subject)
+				require.NoError(t, err)
+				assert.Equal(t, expected, actual)
+			})
+		}
+	})
+}
+
+func (s *PersisterTestSuite) TestDeduplicateActiveAuthorizeCodes() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "duplicate-codes")
+
+		now := time.Now().UTC().Round(time.Second)
+		createCode := func(t *testing.T, requestID string, requestedAt time.Time) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAuthorizeCodeSession(ctx, signature, &fosite.Request{
+				ID:          requestID,
+				RequestedAt: requestedAt,
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+			return signature
+		}
+
+		duplicated := uuid.Must(uuid.NewV4()).String()
+		earliest := createCode(t, duplicated, now.Add(-time.Minute))
+		createCode(t, duplicated, now)
+		createCode(t, duplicated, now.Add(time.Minute))
+
+		// Only one of the codes of this request is active.
+		deactivated := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.InvalidateAuthorizeCodeSession(ctx, createCode(t, deactivated, now.Add(-time.Minute))))
+		active := createCode(t, deactivated, now)
+
+		single := uuid.Must(uuid.NewV4()).String()
+		createCode(t, single, now)
+
+		activeCodes := func(t *testing.T, requestID string) []string {
+			var signatures []string
+			require.NoError(t, p.Connection(ctx).
+				RawQuery("SELECT signature FROM hydra_oauth2_code WHERE request_id = ? AND active = ?", requestID, true).
+				All(&signatures))
+			return signatures
+		}
+
+		fixed, err := p.DeduplicateActiveAuthorizeCodes(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 2, fixed)
+
+		assert.Equal(t, []string{earliest}, activeCodes(t, duplicated))
+		assert.Equal(t, []string{active}, activeCodes(t, deactivated))
+		assert.Len(t, activeCodes(t, single), 1)
+
+		fixed, err = p.DeduplicateActiveAuthorizeCodes(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, fixed)
+	})
+}
+
+func (s *PersisterTestSuite) TestReplayIssuanceEvents() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		spans := tracetest.NewSpanRecorder()
+		reg.WithTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer(""))
+
+		cl := createClient(ctx, t, p, "replay-events")
+
+		since := time.Now().UTC().Add(-time.Hour).Round(time.Second)
+		create := func(t *testing.T, requestedAt time.Time, subject string) {
+			request := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: requestedAt,
+				Client:      cl,
+				Form:        url.Values{"grant_type": {"authorization_code"}, "code": {"secret"}},
+				Session:     oauth2.NewSession(subject),
+			}
+			require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+			require.NoError(t, p.CreateOpenIDConnectSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+		}
+		// Issued before the replay window.
+		create(t, since.Add(-time.Minute), "before")
+		issuedBefore := len(spans.Ended())
+		create(t, since.Add(time.Minute), "alice")
+		create(t, since.Add(2*time.Minute), "bob")
+
+		emitted := map[string][]sdktrace.Event{}
+		for _, span := range spans.Ended()[issuedBefore:] {
+			for _, event := range span.Events() {
+				emitted[event.Name] = append(emitted[event.Name], event)
+			}
+		}
+
+		for table, name := range map[persistencesql.TableName]string{
+			persistencesql.SQLTableAccess:  string(events.AccessTokenIssued),
+			persistencesql.SQLTableRefresh: string(events.RefreshTokenIssued),
+			persistencesql.SQLTableOpenID:  string(events.IdentityTokenIssued),
+		} {
+			t.Run("table="+string(table), func(t *testing.T) {
+				var replayed []persistencesql.IssuanceEvent
+				require.NoError(t, p.ReplayIssuanceEvents(ctx, table, since, func(event persistencesql.IssuanceEvent) error {
+					replayed = append(replayed, event)
+					return nil
+				}))
+
+				require.Len(t, emitted[name], 2)
+				require.Len(t, replayed, 2)
+				for i, event := range replayed {
+					assert.Equal(t, name, string(event.Name))
+					assert.Equal(t, emitted[name][i].Attributes, event.Attributes)
+				}
+				assert.True(t, replayed[0].IssuedAt.Before(replayed[1].IssuedAt), "events are replayed in the order of issuance")
+			})
+		}
+
+		t.Run("case=callback error", func(t *testing.T) {
+			calls := 0
+			err := p.ReplayIssuanceEvents(ctx, persistencesql.SQLTableAccess, since, func(persistencesql.IssuanceEvent) error {
+				calls++
+				return errors.New("sink unavailable")
+			})
+			assert.EqualError(t, err, "sink unavailable")
+			assert.Equal(t, 1, calls)
+		})
+
+		t.Run("case=table without issuance events", func(t *testing.T) {
+			err := p.ReplayIssuanceEvents(ctx, persistencesql.SQLTablePKCE, since, func(persistencesql.IssuanceEvent) error { return nil })
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestPreviousOpenIDConnectGrant() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "previous-grant")
+
+		requestID := uuid.Must(uuid.NewV4()).String()
+		request := func(scopes, audience []string) *fosite.Request {
+			return &fosite.Request{
+				ID:              requestID,
+				RequestedAt:     time.Now().UTC().Round(time.Second),
+				Client:          cl,
+				GrantedScope:    scopes,
+				GrantedAudience: audience,
+				Session:         oauth2.NewSession("sub"),
+			}
+		}
+		require.NoError(t, p.CreateOpenIDConnectSession(ctx, uuid.Must(uuid.NewV4()).String(), request([]string{"openid", "email"}, []string{"aud-1"})))
+
+		change, err := p.GetPreviousOpenIDConnectGrant(ctx, requestID)
+		require.NoError(t, err)
+		assert.Nil(t, change, "the session was never updated")
+
+		require.NoError(t, p.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, request([]string{"openid", "profile"}, []string{"aud-2"})))
+
+		change, err = p.GetPreviousOpenIDConnectGrant(ctx, requestID)
+		require.NoError(t, err)
+		require.NotNil(t, change)
+		assert.Equal(t, []string{"openid", "email"}, change.PreviousGrantedScope)
+		assert.Equal(t, []string{"aud-1"}, change.PreviousGrantedAudience)
+		assert.WithinDuration(t, time.Now(), change.UpdatedAt, time.Minute)
+
+		actual, err := p.GetOpenIDConnectSessionByRequestID(ctx, requestID, oauth2.NewSession(""))
+		require.NoError(t, err)
+		assert.Equal(t, fosite.Arguments{"openid", "profile"}, actual.GetGrantedScopes())
+		assert.Equal(t, fosite.Arguments{"aud-2"}, actual.GetGrantedAudience())
+
+		t.Run("case=only the last change is kept", func(t *testing.T) {
+			require.NoError(t, p.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, request([]string{"openid"}, nil)))
+
+			change, err := p.GetPreviousOpenIDConnectGrant(ctx, requestID)
+			require.NoError(t, err)
+			require.NotNil(t, change)
+			assert.Equal(t, []string{"openid", "profile"}, change.PreviousGrantedScope)
+			assert.Equal(t, []string{"aud-2"}, change.PreviousGrantedAudience)
+		})
+
+		t.Run("case=unknown request", func(t *testing.T) {
+			_, err := p.GetPreviousOpenIDConnectGrant(ctx, uuid.Must(uuid.NewV4()).String())
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestGetSession() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "get-session")
+
+		request := func() *fosite.Request {
+			session := oauth2.NewSession("sub")
+			session.SetBrowserFlowCompleted(true)
+			return &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Round(time.Second),
+				Client:      cl,
+				Session:     session,
+			}
+		}
+
+		for tokenType, create := range map[fosite.TokenType]func(ctx context.Context, signature string, r fosite.Requester) error{
+			fosite.AccessToken:   p.CreateAccessTokenSession,
+			fosite.RefreshToken:  p.CreateRefreshTokenSession,
+			fosite.AuthorizeCode: p.CreateAuthorizeCodeSession,
+			fosite.IDToken:       p.CreateOpenIDConnectSession,
+			fosite.DeviceCode:    p.CreateDeviceCodeSession,
+			fosite.UserCode:      p.CreateUserCodeSession,
+		} {
+			t.Run("type="+string(tokenType), func(t *testing.T) {
+				signature, r := uuid.Must(uuid.NewV4()).String(), request()
+				require.NoError(t, create(ctx, signature, r))
+
+				actual, err := p.GetSession(ctx, tokenType, signature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, r.ID, actual.GetID())
+				assert.Equal(t, "sub", actual.GetSession().GetSubject())
+
+				_, err = p.GetSession(ctx, tokenType, uuid.Must(uuid.NewV4()).String(), oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrNotFound)
+			})
+		}
+
+		t.Run("case=used authorize code", func(t *testing.T) {
+			signature, r := uuid.Must(uuid.NewV4()).String(), request()
+			require.NoError(t, p.CreateAuthorizeCodeSession(ctx, signature, r))
+			require.NoError(t, p.InvalidateAuthorizeCodeSession(ctx, signature))
+
+			actual, err := p.GetSession(ctx, fosite.AuthorizeCode, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInvalidatedAuthorizeCode)
+			require.NotNil(t, actual)
+			assert.Equal(t, r.ID, actual.GetID())
+		})
+
+		t.Run("case=unknown token type", func(t *testing.T) {
+			_, err := p.GetSession(ctx, fosite.PushedAuthorizeRequestContext, uuid.Must(uuid.NewV4()).String(), oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestRevocationReason() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "revocation-reason")
+
+		issue := func(t *testing.T) (requestID, signature string) {
+			requestID, signature = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, signature, &fosite.Request{
+				ID:          requestID,
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+			return requestID, signature
+		}
+
+		stolen, stolenSignature := issue(t)
+		loggedOut, loggedOutSignature := issue(t)
+		removed, removedSignature := issue(t)
+		unspecified, _ := issue(t)
+
+		require.NoError(t, p.RevokeRefreshTokenWithReason(ctx, stolen, persistencesql.RevocationReasonTokenTheft))
+		require.NoError(t, p.RevokeRefreshToken(persistencesql.WithRevocationReason(ctx, persistencesql.RevocationReasonLogout), loggedOut))
+		require.NoError(t, p.RevokeRefreshTokenMaybeGracePeriod(persistencesql.WithRevocationReason(ctx, persistencesql.RevocationReasonAdmin), removed, removedSignature))
+		require.NoError(t, p.RevokeRefreshToken(ctx, unspecified))
+
+		t.Run("case=revoked tokens are inactive", func(t *testing.T) {
+			for _, signature := range []string{stolenSignature, loggedOutSignature, removedSignature} {
+				_, err := p.GetRefreshTokenSession(ctx, signature, oauth2.NewSession(""))
+				assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+			}
+		})
+
+		t.Run("case=lists revocations by reason", func(t *testing.T) {
+			for reason, expected := range map[string][2]string{
+				persistencesql.RevocationReasonTokenTheft: {stolen, stolenSignature},
+				persistencesql.RevocationReasonLogout:     {loggedOut, loggedOutSignature},
+				persistencesql.RevocationReasonAdmin:      {removed, removedSignature},
+			} {
+				tokens, err := p.ListRevokedRefreshTokens(ctx, reason)
+				require.NoError(t, err)
+				require.Len(t, tokens, 1, reason)
+				assert.Equal(t, expected[0], tokens[0].RequestID)
+				assert.Equal(t, expected[1], tokens[0].Signature)
+				assert.Equal(t, cl.ID, tokens[0].ClientID)
+				assert.Equal(t, "sub", tokens[0].Subject)
+				assert.Equal(t, reason, tokens[0].Reason)
+				assert.WithinDuration(t, time.Now(), tokens[0].RevokedAt, time.Minute)
+			}
+
+			tokens, err := p.ListRevokedRefreshTokens(ctx, "unknown")
+			require.NoError(t, err)
+			assert.Empty(t, tokens)
+		})
+
+		t.Run("case=revoking again keeps the first reason", func(t *testing.T) {
+			require.NoError(t, p.RevokeRefreshTokenWithReason(ctx, stolen, persistencesql.RevocationReasonAdmin))
+
+			tokens, err := p.ListRevokedRefreshTokens(ctx, persistencesql.RevocationReasonTokenTheft)
+			require.NoError(t, err)
+			require.Len(t, tokens, 1)
+			assert.Equal(t, stolen, tokens[0].RequestID)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestSubjectRequiredGrantTypes() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "subject-required")
+
+		issue := func(grantType fosite.GrantType, subject string) error {
+			return p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Form:        url.Values{"grant_type": {string(grantType)}},
+				Session:     oauth2.NewSession(subject),
+			})
+		}
+
+		t.Run("case=permissive by default", func(t *testing.T) {
+			assert.NoError(t, issue(fosite.GrantTypeAuthorizationCode, ""))
+			assert.NoError(t, issue(fosite.GrantTypeClientCredentials, ""))
+		})
+
+		t.Run("case=policy", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySubjectRequiredGrantTypes, []string{string(fosite.GrantTypeAuthorizationCode)})
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeySubjectRequiredGrantTypes, []string{}) })
+
+			err := issue(fosite.GrantTypeAuthorizationCode, "")
+			var subjectErr *x.EmptySubjectError
+			require.ErrorAs(t, err, &subjectErr)
+			assert.Equal(t, string(fosite.GrantTypeAuthorizationCode), subjectErr.GrantType)
+			assert.ErrorIs(t, err, fosite.ErrServerError)
+
+			assert.NoError(t, issue(fosite.GrantTypeAuthorizationCode, "sub"))
+			assert.NoError(t, issue(fosite.GrantTypeClientCredentials, ""), "client credentials tokens have no subject")
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestBuildTokenGraphBySubject() {
+	s.forEachPersister(s.T(), func(t *testing.T, _ driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "token-graph")
+
+		start := time.Now().UTC().Add(-time.Hour).Round(time.Second)
+		request := func(id, subject string, requestedAt time.Time) *fosite.Request {
+			return &fosite.Request{
+				ID:          id,
+				RequestedAt: requestedAt,
+				Client:      cl,
+				Session:     oauth2.NewSession(subject),
+			}
+		}
+
+		// The authorization code flow: the code is exchanged for an access and a
+		// refresh token, which is then rotated once.
+		codeFlow := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAuthorizeCodeSession(ctx, "code", request(codeFlow, "alice", start)))
+		require.NoError(t, p.CreateOpenIDConnectSession(ctx, codeFlow, request(codeFlow, "alice", start)))
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access-1", request(codeFlow, "alice", start.Add(time.Minute))))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, "refresh-1", request(codeFlow, "alice", start.Add(time.Minute))))
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access-2", request(codeFlow, "alice", start.Add(2*time.Minute))))
+		_, err := p.RotateRefreshToken(ctx, "refresh-1", "refresh-2", request(codeFlow, "alice", start.Add(2*time.Minute)))
+		require.NoError(t, err)
+		// An access token without its refresh token, e.g. because the row was
+		// tampered with.
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access-3", request(codeFlow, "alice", start.Add(3*time.Minute))))
+
+		// A grant which issues no refresh token.
+		accessOnly := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access-4", request(accessOnly, "alice", start.Add(4*time.Minute))))
+
+		// Tokens of other subjects are not part of the graph.
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "access-5", request(uuid.Must(uuid.NewV4()).String(), "bob", start)))
+
+		graph, err := p.BuildTokenGraphBySubject(ctx, "alice")
+		require.NoError(t, err)
+		assert.Equal(t, "alice", graph.Subject)
+		require.Len(t, graph.Families, 2)
+
+		family := graph.Families[0]
+		assert.Equal(t, codeFlow, family.RequestID)
+		assert.Equal(t, cl.ID, family.ClientID)
+		require.Len(t, family.AuthorizeCodes, 1)
+		assert.Equal(t, "code", family.AuthorizeCodes[0].Signature)
+		assert.True(t, family.AuthorizeCodes[0].Active)
+		require.Len(t, family.OpenIDConnectSessions, 1)
+		assert.Equal(t, codeFlow, family.OpenIDConnectSessions[0].Signature)
+
+		require.Len(t, family.RefreshTokens, 2)
+		assert.Equal(t, "refresh-1", family.RefreshTokens[0].Signature)
+		assert.False(t, family.RefreshTokens[0].Active)
+		assert.Zero(t, family.RefreshTokens[0].ChainLength)
+		require.Len(t, family.RefreshTokens[0].AccessTokens, 1)
+		assert.Equal(t, persistencesql.SignatureHash("access-1"), family.RefreshTokens[0].AccessTokens[0].Signature)
+
+		assert.Equal(t, "refresh-2", family.RefreshTokens[1].Signature)
+		assert.True(t, family.RefreshTokens[1].Active)
+		assert.Equal(t, 1, family.RefreshTokens[1].ChainLength)
+		require.Len(t, family.RefreshTokens[1].AccessTokens, 1)
+		assert.Equal(t, persistencesql.SignatureHash("access-2"), family.RefreshTokens[1].AccessTokens[0].Signature)
+		assert.True(t, family.RefreshTokens[1].AccessTokens[0].Active)
+
+		require.Len(t, family.UnlinkedAccessTokens, 1)
+		assert.Equal(t, persistencesql.SignatureHash("access-3"), family.UnlinkedAccessTokens[0].Signature)
+
+		family = graph.Families[1]
+		assert.Equal(t, accessOnly, family.RequestID)
+		assert.Empty(t, family.AuthorizeCodes)
+		assert.Empty(t, family.RefreshTokens)
+		require.Len(t, family.UnlinkedAccessTokens, 1)
+		assert.Equal(t, persistencesql.SignatureHash("access-4"), family.UnlinkedAccessTokens[0].Signature)
+
+		graph, err = p.BuildTokenGraphBySubject(ctx, "unknown")
+		require.NoError(t, err)
+		assert.Empty(t, graph.Families)
+	})
+}
+
+func (s *PersisterTestSuite) TestRawSessionBlob() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyAccessTokenCacheSize, 10)
+
+		cl := createClient(ctx, t, p, "raw-session-blob")
+
+		issue := func(t *testing.T, subject string) (access, refresh string) {
+			r := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Session:     oauth2.NewSession(subject),
+			}
+			access, refresh = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, access, r))
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, refresh, r))
+			return access, refresh
+		}
+
+		aliceAccess, aliceRefresh := issue(t, "alice")
+		bobAccess, bobRefresh := issue(t, "bob")
+
+		t.Run("case=blob is returned as stored", func(t *testing.T) {
+			blob, err := p.GetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, aliceRefresh)
+			require.NoError(t, err)
+
+			var stored []byte
+			require.NoError(t, p.Connection(ctx).RawQuery("SELECT session_data FROM hydra_oauth2_refresh WHERE signature = ?", aliceRefresh).First(&stored))
+			assert.Equal(t, stored, blob)
+			assert.NotContains(t, string(blob), "alice", "the session is encrypted at rest")
+		})
+
+		t.Run("case=round-trip", func(t *testing.T) {
+			blob, err := p.GetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, aliceRefresh)
+			require.NoError(t, err)
+			require.NoError(t, p.SetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, aliceRefresh, blob))
+
+			actual, err := p.GetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, aliceRefresh)
+			require.NoError(t, err)
+			assert.Equal(t, blob, actual)
+
+			r, err := p.GetRefreshTokenSession(ctx, aliceRefresh, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, "alice", r.GetSession().GetSubject())
+		})
+
+		t.Run("case=written blob is read by hydra", func(t *testing.T) {
+			// Reading the access token caches it, which the write must invalidate.
+			r, err := p.GetAccessTokenSession(ctx, aliceAccess, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, "alice", r.GetSession().GetSubject())
+
+			blob, err := p.GetRawSessionBlob(ctx, persistencesql.SQLTableAccess, bobAccess)
+			require.NoError(t, err)
+			require.NoError(t, p.SetRawSessionBlob(ctx, persistencesql.SQLTableAccess, aliceAccess, blob))
+
+			r, err = p.GetAccessTokenSession(ctx, aliceAccess, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, "bob", r.GetSession().GetSubject())
+		})
+
+		t.Run("case=unencrypted blob", func(t *testing.T) {
+			blob := []byte(`{"id_token":{"id_token_claims":{"sub":"carol"}},"subject":"carol"}`)
+			require.NoError(t, p.SetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, bobRefresh, blob))
+
+			actual, err := p.GetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, bobRefresh)
+			require.NoError(t, err)
+			assert.Equal(t, blob, actual)
+		})
+
+		t.Run("case=not found", func(t *testing.T) {
+			_, err := p.GetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, "unknown")
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			assert.ErrorIs(t, p.SetRawSessionBlob(ctx, persistencesql.SQLTableRefresh, "unknown", []byte("{}")), fosite.ErrNotFound)
+			_, err = p.GetRawSessionBlob(ctx, "unknown", aliceRefresh)
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestAccessTokenLegacyFallbackCutoff() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "legacy-fallback-cutoff")
+
+		create := func(t *testing.T) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+			return signature
+		}
+		hashed, legacy := create(t), create(t)
+		require.NoError(t, p.Connection(ctx).
+			RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", legacy, persistencesql.SignatureHash(legacy)).
+			Exec())
+
+		now := time.Now().UTC()
+		for _, tc := range []struct {
+			name        string
+			cutoff      time.Time
+			maxLifespan string
+			lifespan    string
+			found       bool
+		}{
+			{name: "no cutoff", found: true},
+			{name: "within max lifespan", cutoff: now.Add(-30 * time.Minute), maxLifespan: "1h", found: true},
+			{name: "just before the fallback is disabled", cutoff: now.Add(-time.Hour + time.Minute), maxLifespan: "1h", found: true},
+			{name: "just after the fallback is disabled", cutoff: now.Add(-time.Hour - time.Minute), maxLifespan: "1h", found: false},
+			{name: "cutoff in the future", cutoff: now.Add(time.Hour), maxLifespan: "1h", found: true},
+			{name: "defaults to the access token lifespan", cutoff: now.Add(-2 * time.Hour), lifespan: "3h", found: true},
+			{name: "access token lifespan passed", cutoff: now.Add(-2 * time.Hour), lifespan: "1h", found: false},
+		} {
+			t.Run("case="+tc.name, func(t *testing.T) {
+				t.Cleanup(func() {
+					reg.Config().MustSet(ctx, config.KeyAccessTokenLegacyFallbackCutoff, "")
+					reg.Config().MustSet(ctx, config.KeyAccessTokenLegacyFallbackMaxLifespan, nil)
+					reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, "1h")
+				})
+				if !tc.cutoff.IsZero() {
+					reg.Config().MustSet(ctx, config.KeyAccessTokenLegacyFallbackCutoff, tc.cutoff.Format(time.RFC3339))
+				}
+				if tc.maxLifespan != "" {
+					reg.Config().MustSet(ctx, config.KeyAccessTokenLegacyFallbackMaxLifespan, tc.maxLifespan)
+				}
+				if tc.lifespan != "" {
+					reg.Config().MustSet(ctx, config.KeyAccessTokenLifespan, tc.lifespan)
+				}
+
+				_, err := p.GetAccessTokenSession(ctx, legacy, oauth2.NewSession(""))
+				if tc.found {
+					assert.NoError(t, err)
+				} else {
+					assert.ErrorIs(t, err, fosite.ErrNotFound)
+				}
+
+				_, err = p.GetAccessTokenSession(ctx, hashed, oauth2.NewSession(""))
+				assert.NoError(t, err, "hashed signatures are always found")
+			})
+		}
+	})
+}
+
+func (s *PersisterTestSuite) TestCompatReport() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+
+		cl := createClient(ctx, t, p, "compat-report")
+
+		create := func(t *testing.T, ctx context.Context) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC(),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+			return signature
+		}
+
+		modern := create(t, ctx)
+		legacy := create(t, ctx)
+		require.NoError(t, p.Connection(ctx).
+			RawQuery("UPDATE hydra_oauth2_access SET signature = ? WHERE signature = ?", legacy, persistencesql.SignatureHash(legacy)).
+			Exec())
+
+		t.Run("case=no report", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, modern, oauth2.NewSession(""))
+			require.NoError(t, err)
+		})
+
+		t.Run("case=encrypted modern token", func(t *testing.T) {
+			ctx, report := persistencesql.WithCompatReport(ctx)
+			_, err := p.GetAccessTokenSession(ctx, modern, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, map[persistencesql.CompatPath]int{
+				persistencesql.CompatPathHashedSignature: 1,
+				persistencesql.CompatPathDecryptedRead:   1,
+			}, report.Counts())
+		})
+
+		t.Run("case=encrypted legacy token", func(t *testing.T) {
+			ctx, report := persistencesql.WithCompatReport(ctx)
+			_, err := p.GetAccessTokenSession(ctx, legacy, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, map[persistencesql.CompatPath]int{
+				persistencesql.CompatPathLegacySignature: 1,
+				persistencesql.CompatPathDecryptedRead:   1,
+			}, report.Counts())
+			assert.True(t, report.Took(persistencesql.CompatPathLegacySignature))
+			assert.False(t, report.Took(persistencesql.CompatPathHashedSignature))
+		})
+
+		t.Run("case=writes", func(t *testing.T) {
+			ctx, report := persistencesql.WithCompatReport(ctx)
+			create(t, ctx)
+			assert.Equal(t, map[persistencesql.CompatPath]int{persistencesql.CompatPathEncryptedWrite: 1}, report.Counts())
+
+			reg.Config().MustSet(ctx, config.KeyEncryptSessionData, false)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyEncryptSessionData, true) })
+
+			ctx, report = persistencesql.WithCompatReport(ctx)
+			plaintext := create(t, ctx)
+			assert.Equal(t, map[persistencesql.CompatPath]int{persistencesql.CompatPathPlaintextWrite: 1}, report.Counts())
+
+			ctx, report = persistencesql.WithCompatReport(ctx)
+			_, err := p.GetAccessTokenSession(ctx, plaintext, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, map[persistencesql.CompatPath]int{
+				persistencesql.CompatPathHashedSignature: 1,
+				persistencesql.CompatPathPlaintextRead:   1,
+			}, report.Counts())
+		})
+
+		t.Run("case=plaintext assumption fallback", func(t *testing.T) {
+			// The session of the modern token was encrypted before encryption
+			// was disabled.
+			reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, true)
+			reg.Config().MustSet(ctx, config.KeyEncryptSessionData, false)
+			t.Cleanup(func() {
+				reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, false)
+				reg.Config().MustSet(ctx, config.KeyEncryptSessionData, true)
+			})
+
+			ctx, report := persistencesql.WithCompatReport(ctx)
+			_, err := p.GetAccessTokenSession(ctx, modern, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.True(t, report.Took(persistencesql.CompatPathPlaintextAssumptionFallback))
+			assert.True(t, report.Took(persistencesql.CompatPathDecryptedRead))
+		})
+	})
+}
+
+func (s *PersisterTestSuite) TestFlushConnection() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		// The dedicated flush pool is a closed pool on the same database, which
+		// makes it observable which pool a flush was executed on.
+		flushReg := internal.NewRegistrySQLFromURL(t, reg.Config().DSN(), false, &contextx.TestContextualizer{})
+		fp := p.WithFlushConnection(flushReg.Persister().Connection(context.Background()))
+		require.NoError(t, flushReg.Persister().Connection(context.Background()).Close())
+
+		cl := createClient(ctx, t, reg.ClientManager(), "flush-connection-client")
+		req := &fosite.Request{
+			ID:          "flush-connection-request",
+			RequestedAt: time.Now().UTC().Add(-24 * time.Hour).Round(time.Second),
+			Client:      cl,
+			Session:     oauth2.NewSession("sub"),
+		}
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "flush-connection-signature", req))
+
+		t.Run("case=flushes run on the dedicated connection", func(t *testing.T) {
+			_, err := fp.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+			require.Error(t, err)
+			_, err = p.GetAccessTokenSession(ctx, "flush-connection-signature", oauth2.NewSession(""))
 			require.NoError(t, err)
-			require.Equal(t, "updated", actualt1.Name)
-			require.Equal(t, "", actualt1.Owner)
-			actualt2, err := store.GetConcreteClient(s.t2, "client-id")
+		})
+
+		t.Run("case=flushes default to the regular connection", func(t *testing.T) {
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
 			require.NoError(t, err)
-			require.Equal(t, "original", actualt2.Name)
-			require.Equal(t, "erase-me", actualt2.Owner)
+			assert.Equal(t, 1, res.Deleted)
+			assert.Equal(t, 1, res.Batches)
+			assert.Equal(t, x.FlushStoppedDrained, res.StoppedReason)
+			assert.Positive(t, res.Duration)
+
+			_, err = p.GetAccessTokenSession(ctx, "flush-connection-signature", oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
 		})
+
+		t.Run("case=prefers the transaction in the context", func(t *testing.T) {
+			require.NoError(t, fp.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+				assert.Same(t, c.TX, fp.FlushConnection(ctx).TX)
+				return nil
+			}))
+		})
+	})
+}
+
+// tenantContextualizer uses a dedicated configuration for the tenant network.
+type tenantContextualizer struct {
+	contextx.TestContextualizer
+	tenant       uuid.UUID
+	tenantConfig *configx.Provider
+}
+
+func (c *tenantContextualizer) Config(ctx context.Context, config *configx.Provider) *configx.Provider {
+	if c.tenantConfig != nil && c.Network(ctx, uuid.Nil) == c.tenant {
+		return c.tenantConfig
 	}
+	return config
 }
 
-func (s *PersisterTestSuite) TestVerifyAndInvalidateConsentRequest() {
-	t := s.T()
-	for k, r := range s.registries {
-		t.Run(k, func(t *testing.T) {
-			sub := uuid.Must(uuid.NewV4()).String()
-			sessionID := uuid.Must(uuid.NewV4()).String()
-			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
-			client := &client.Client{ID: "client-id"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, client))
-			f := newFlow(s.t1NID, client.ID, sub, sqlxx.NullString(sessionID))
-			f.ConsentSkip = false
-			f.GrantedScope = sqlxx.StringSliceJSONFormat{}
-			f.ConsentRemember = false
-			crf := 86400
-			f.ConsentRememberFor = &crf
-			f.ConsentError = &flow.RequestDeniedError{}
-			f.SessionAccessToken = map[string]interface{}{}
-			f.SessionIDToken = map[string]interface{}{}
-			f.ConsentWasHandled = false
-			f.State = flow.FlowStateConsentUnused
+func (s *PersisterTestSuite) TestTokenTableNames() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(context.Background())
+
+		assert.Error(t, p.SetTokenTableNames(ctx, map[string]string{"unknown": "tokens"}))
+		assert.Error(t, p.SetTokenTableNames(ctx, map[string]string{"access": "tokens; DROP TABLE hydra_oauth2_access"}))
+
+		// Remapped tables must exist with all columns of the default table.
+		assert.Error(t, p.SetTokenTableNames(ctx, map[string]string{"access": "missing_access"}))
+		require.NoError(t, conn.RawQuery("CREATE TABLE hydra_oauth2_partial_access (signature VARCHAR(255), nid CHAR(36))").Exec())
+		t.Cleanup(func() { require.NoError(t, conn.RawQuery("DROP TABLE hydra_oauth2_partial_access").Exec()) })
+		assert.Error(t, p.SetTokenTableNames(ctx, map[string]string{"access": "partial_access"}))
+
+		// Create the remapped table with the columns of the default table. SQLite
+		// does not keep the declared column types when creating a table from a
+		// query, so its table is created from the statement of the default one.
+		create := "CREATE TABLE hydra_oauth2_custom_access AS SELECT * FROM hydra_oauth2_access WHERE 1 = 0"
+		if conn.Dialect.Name() == "sqlite3" {
+			require.NoError(t, conn.RawQuery("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", "hydra_oauth2_access").First(&create))
+			create = strings.Replace(create, "hydra_oauth2_access", "hydra_oauth2_custom_access", 1)
+		}
+		require.NoError(t, conn.RawQuery(create).Exec())
+		t.Cleanup(func() { require.NoError(t, conn.RawQuery("DROP TABLE hydra_oauth2_custom_access").Exec()) })
+		require.NoError(t, p.SetTokenTableNames(ctx, map[string]string{"access": "custom_access"}))
+
+		count := func(t *testing.T, table string) (n int) {
+			require.NoError(t, conn.RawQuery(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).First(&n))
+			return n
+		}
+
+		cl := createClient(ctx, t, p, "table-names-client")
+		req := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+		signature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, signature, req))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, signature, req))
+
+		assert.Equal(t, 1, count(t, "hydra_oauth2_custom_access"))
+		assert.Zero(t, count(t, "hydra_oauth2_access"))
+		// Tables which are not remapped keep their default name.
+		assert.Equal(t, 1, count(t, "hydra_oauth2_refresh"))
+
+		got, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+		require.NoError(t, err)
+		assert.Equal(t, req.ID, got.GetID())
+		assert.Equal(t, "sub", got.GetSession().GetSubject())
+
+		require.NoError(t, p.DeleteAccessTokenSession(ctx, signature))
+		assert.Zero(t, count(t, "hydra_oauth2_custom_access"))
+		_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+	})
+}
 
-			consentVerifier := x.Must(f.ToConsentVerifier(s.t1, r))
+func (s *PersisterTestSuite) TestClientLookupErrors() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(context.Background())
 
-			_, err := r.ConsentManager().VerifyAndInvalidateConsentRequest(s.t2, consentVerifier)
+		cl := createClient(ctx, t, p, "client-lookup-client")
+		require.NoError(t, p.CreateAccessTokenSession(ctx, "client-lookup-signature", newTokenRequest("client-lookup-request", cl, "sub")))
+
+		// Moving the client table aside keeps the token rows, which would
+		// otherwise be deleted together with their client.
+		require.NoError(t, conn.RawQuery("ALTER TABLE hydra_client RENAME TO hydra_client_moved").Exec())
+		t.Cleanup(func() {
+			require.NoError(t, conn.RawQuery("DROP TABLE IF EXISTS hydra_client").Exec())
+			require.NoError(t, conn.RawQuery("ALTER TABLE hydra_client_moved RENAME TO hydra_client").Exec())
+		})
+
+		t.Run("case=transient errors are returned as-is", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, "client-lookup-signature", oauth2.NewSession(""))
 			require.Error(t, err)
-			require.Equal(t, flow.FlowStateConsentUnused, f.State)
-			require.Equal(t, false, f.ConsentWasHandled)
-			_, err = r.ConsentManager().VerifyAndInvalidateConsentRequest(s.t1, consentVerifier)
-			require.NoError(t, err)
-			require.Equal(t, flow.FlowStateConsentUnused, f.State) // TODO: Delegate reuse detection to external service.
+			assert.NotErrorIs(t, err, fosite.ErrNotFound)
+			assert.NotErrorIs(t, err, x.ErrClientDeleted)
+		})
+
+		t.Run("case=missing clients are reported as deleted", func(t *testing.T) {
+			require.NoError(t, conn.RawQuery("CREATE TABLE hydra_client AS SELECT * FROM hydra_client_moved WHERE 1 = 0").Exec())
+
+			_, err := p.GetAccessTokenSession(ctx, "client-lookup-signature", oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+			assert.ErrorIs(t, err, x.ErrClientDeleted)
 		})
+	})
+}
+
+// spanStartHook calls f whenever a span with the name is started.
+type spanStartHook struct {
+	*tracetest.SpanRecorder
+	name string
+	f    func()
+}
+
+func (h *spanStartHook) OnStart(ctx context.Context, s sdktrace.ReadWriteSpan) {
+	if s.Name() == h.name {
+		h.f()
 	}
+	h.SpanRecorder.OnStart(ctx, s)
 }
 
-func (s *PersisterTestSuite) TestVerifyAndInvalidateLoginRequest() {
-	t := s.T()
-	for k, r := range s.registries {
-		t.Run(k, func(t *testing.T) {
-			sub := uuid.Must(uuid.NewV4()).String()
-			sessionID := uuid.Must(uuid.NewV4()).String()
-			persistLoginSession(s.t1, t, r.Persister(), &flow.LoginSession{ID: sessionID})
-			client := &client.Client{ID: "client-id"}
-			require.NoError(t, r.Persister().CreateClient(s.t1, client))
-			f := newFlow(s.t1NID, client.ID, sub, sqlxx.NullString(sessionID))
-			f.State = flow.FlowStateLoginUnused
+// tracerRegistry overrides the tracer of the registry it wraps.
+type tracerRegistry struct {
+	driver.Registry
+	tracer *otelx.Tracer
+}
 
-			loginVerifier := x.Must(f.ToLoginVerifier(s.t1, r))
-			_, err := r.ConsentManager().VerifyAndInvalidateLoginRequest(s.t2, loginVerifier)
-			require.Error(t, err)
-			require.Equal(t, flow.FlowStateLoginUnused, f.State)
-			require.Equal(t, false, f.LoginWasUsed)
-			_, err = r.ConsentManager().VerifyAndInvalidateLoginRequest(s.t1, loginVerifier)
-			require.NoError(t, err)
-			require.Equal(t, flow.FlowStateLoginUnused, f.State) // TODO: Delegate reuse detection to external service.
+func (r tracerRegistry) Tracer(context.Context) *otelx.Tracer {
+	return r.tracer
+}
+
+func (s *PersisterTestSuite) TestIssuanceWithoutTracer() {
+	s.forEachPersister(s.T(), func(t *testing.T, r driver.Registry, _ *persistencesql.Persister) {
+		ctx := context.Background()
+		conf := internal.NewConfigurationWithDefaults()
+		conf.MustSet(ctx, config.KeyDSN, r.Config().DSN())
+		reg, err := driver.New(ctx, servicelocatorx.NewOptions(), []driver.OptionsModifier{
+			driver.WithConfig(conf),
+			driver.DisableValidation(),
+			// Discarding the tracer leaves the registry without one, as if
+			// tracing failed to initialize.
+			driver.WithTracerWrapper(func(*otelx.Tracer) *otelx.Tracer { return nil }),
 		})
-	}
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = reg.Persister().Connection(ctx).Close() })
+
+		cl := createClient(ctx, t, reg.Persister(), "no-tracer-client")
+
+		for k, tc := range []struct {
+			d string
+			p func(t *testing.T) persistence.Persister
+		}{
+			{
+				d: "registry without tracer",
+				p: func(*testing.T) persistence.Persister { return reg.Persister() },
+			},
+			{
+				d: "nil tracer",
+				p: func(t *testing.T) persistence.Persister {
+					p, err := persistencesql.NewPersister(ctx, reg.Persister().Connection(ctx), tracerRegistry{Registry: reg}, conf, nil, nil)
+					require.NoError(t, err)
+					return p.WithFallbackNetworkID(reg.Persister().NetworkID(ctx))
+				},
+			},
+			{
+				d: "uninitialized tracer",
+				p: func(t *testing.T) persistence.Persister {
+					p, err := persistencesql.NewPersister(ctx, reg.Persister().Connection(ctx), tracerRegistry{Registry: reg, tracer: new(otelx.Tracer)}, conf, nil, nil)
+					require.NoError(t, err)
+					return p.WithFallbackNetworkID(reg.Persister().NetworkID(ctx))
+				},
+			},
+		} {
+			t.Run("case="+tc.d, func(t *testing.T) {
+				p := tc.p(t)
+				req := newTokenRequest(fmt.Sprintf("no-tracer-request-%d", k), cl, "sub")
+
+				access, refresh, openID := fmt.Sprintf("no-tracer-access-%d", k), fmt.Sprintf("no-tracer-refresh-%d", k), fmt.Sprintf("no-tracer-openid-%d", k)
+				require.NoError(t, p.CreateAccessTokenSession(ctx, access, req))
+				require.NoError(t, p.CreateRefreshTokenSession(ctx, refresh, req))
+				require.NoError(t, p.CreateOpenIDConnectSession(ctx, openID, req))
+
+				_, err := p.GetAccessTokenSession(ctx, access, oauth2.NewSession(""))
+				assert.NoError(t, err)
+			})
+		}
+	})
 }
 
-func (s *PersisterTestSuite) TestVerifyAndInvalidateLogoutRequest() {
-	t := s.T()
-	for k, r := range s.registries {
-		t.Run(k, func(t *testing.T) {
-			lr := newLogoutRequest()
-			lr.Verifier = uuid.Must(uuid.NewV4()).String()
-			lr.Accepted = true
-			lr.Rejected = false
-			require.NoError(t, r.ConsentManager().CreateLogoutRequest(s.t1, lr))
+func (s *PersisterTestSuite) TestSessionWriteTimeout() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(context.Background())
+
+		cl := createClient(ctx, t, p, "write-timeout-client")
+		newRequest := func() *fosite.Request {
+			return newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")
+		}
+
+		t.Run("case=slow write is aborted", func(t *testing.T) {
+			// A trigger makes every insert into the access token table take far
+			// longer than the timeout.
+			var create, drop []string
+			switch conn.Dialect.Name() {
+			case "sqlite3":
+				// Scan a cross join of 1024 rows with itself three times.
+				create = []string{
+					"CREATE TABLE slow_write_rows (n INTEGER)",
+					"INSERT INTO slow_write_rows (n) VALUES (1)",
+				}
+				for i := 0; i < 10; i++ {
+					create = append(create, "INSERT INTO slow_write_rows (n) SELECT n FROM slow_write_rows")
+				}
+				create = append(create, `CREATE TRIGGER slow_write BEFORE INSERT ON hydra_oauth2_access
+BEGIN
+	SELECT count(*) FROM slow_write_rows a, slow_write_rows b, slow_write_rows c;
+END`)
+				drop = []string{"DROP TRIGGER slow_write", "DROP TABLE slow_write_rows"}
+			case "postgres":
+				create = []string{
+					"CREATE FUNCTION slow_write() RETURNS trigger AS $$ BEGIN PERFORM pg_sleep(3); RETURN NEW; END; $$ LANGUAGE plpgsql",
+					"CREATE TRIGGER slow_write BEFORE INSERT ON hydra_oauth2_access FOR EACH ROW EXECUTE FUNCTION slow_write()",
+				}
+				drop = []string{"DROP TRIGGER slow_write ON hydra_oauth2_access", "DROP FUNCTION slow_write()"}
+			case "mysql":
+				create = []string{"CREATE TRIGGER slow_write BEFORE INSERT ON hydra_oauth2_access FOR EACH ROW SET @slow_write = SLEEP(3)"}
+				drop = []string{"DROP TRIGGER slow_write"}
+			default:
+				t.Skipf("%s does not support triggers", conn.Dialect.Name())
+			}
+			for _, stmt := range create {
+				require.NoError(t, conn.RawQuery(stmt).Exec())
+			}
+			t.Cleanup(func() {
+				for _, stmt := range drop {
+					require.NoError(t, conn.RawQuery(stmt).Exec())
+				}
+			})
 
-			expected, err := r.ConsentManager().GetLogoutRequest(s.t1, lr.ID)
-			require.NoError(t, err)
+			reg.Config().MustSet(ctx, config.KeySessionWriteTimeout, "100ms")
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeySessionWriteTimeout, "0s") })
 
-			lrInvalidated, err := r.ConsentManager().VerifyAndInvalidateLogoutRequest(s.t2, lr.Verifier)
+			signature := uuid.Must(uuid.NewV4()).String()
+			start := time.Now()
+			err := p.CreateAccessTokenSession(ctx, signature, newRequest())
 			require.Error(t, err)
-			require.Nil(t, lrInvalidated)
-			actual := &flow.LogoutRequest{}
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, lr.ID))
-			require.Equal(t, expected, actual)
+			assert.Less(t, time.Since(start), 2*time.Second)
+			assert.ErrorIs(t, err, fosite.ErrTemporarilyUnavailable)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
 
-			lrInvalidated, err = r.ConsentManager().VerifyAndInvalidateLogoutRequest(s.t1, lr.Verifier)
-			require.NoError(t, err)
-			require.NoError(t, r.Persister().Connection(context.Background()).Find(actual, lr.ID))
-			require.Equal(t, lrInvalidated, actual)
-			require.Equal(t, true, actual.WasHandled)
+			_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
 		})
-	}
+
+		t.Run("case=fast write succeeds", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionWriteTimeout, "10s")
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeySessionWriteTimeout, "0s") })
+
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newRequest()))
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+		})
+	})
 }
 
-func (s *PersisterTestSuite) TestWithFallbackNetworkID() {
-	t := s.T()
-	for k, r := range s.registries {
-		t.Run(k, func(t *testing.T) {
-			r.WithContextualizer(&contextx.Default{})
-			store, ok := r.Persister().(*persistencesql.Persister)
-			if !ok {
-				t.Fatal("type assertion failed")
-			}
-			original := store.NetworkID(context.Background())
-			expected := uuid.Must(uuid.NewV4())
-			store, ok = store.WithFallbackNetworkID(expected).(*persistencesql.Persister)
-			if !ok {
-				t.Fatal("type assertion failed")
-			}
+func (s *PersisterTestSuite) TestDeleteSessionErrors() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		cl := createClient(ctx, t, p, "delete-session-client")
+		create := func(t *testing.T) (signature, requestID string) {
+			signature, requestID = uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateRefreshTokenSession(ctx, signature, newTokenRequest(requestID, cl, "sub")))
+			return signature, requestID
+		}
+
+		t.Run("case=by signature", func(t *testing.T) {
+			signature, _ := create(t)
+			require.NoError(t, p.DeleteSessionBySignature(ctx, signature, persistencesql.SQLTableRefresh))
+			assert.ErrorIs(t, p.DeleteSessionBySignature(ctx, signature, persistencesql.SQLTableRefresh), fosite.ErrNotFound)
+		})
 
-			require.NotEqual(t, original, expected)
-			require.Equal(t, expected, store.NetworkID(context.Background()))
+		t.Run("case=by request ID", func(t *testing.T) {
+			_, requestID := create(t)
+			require.NoError(t, p.DeleteSessionByRequestID(ctx, requestID, persistencesql.SQLTableRefresh))
+			assert.ErrorIs(t, p.DeleteSessionByRequestID(ctx, requestID, persistencesql.SQLTableRefresh), fosite.ErrNotFound)
 		})
-	}
+
+		t.Run("case=other networks are not found", func(t *testing.T) {
+			signature, requestID := create(t)
+			assert.ErrorIs(t, p.DeleteSessionBySignature(s.t2, signature, persistencesql.SQLTableRefresh), fosite.ErrNotFound)
+			assert.ErrorIs(t, p.DeleteSessionByRequestID(s.t2, requestID, persistencesql.SQLTableRefresh), fosite.ErrNotFound)
+		})
+
+		t.Run("case=revoking a request without access tokens succeeds", func(t *testing.T) {
+			assert.NoError(t, p.RevokeAccessToken(ctx, uuid.Must(uuid.NewV4()).String()))
+		})
+	})
 }
 
-func TestPersisterTestSuite(t *testing.T) {
-	suite.Run(t, new(PersisterTestSuite))
+func (s *PersisterTestSuite) TestPerNetworkSessionEncryption() {
+	s.forEachPersister(s.T(), func(t *testing.T, r driver.Registry, _ *persistencesql.Persister) {
+		ctx := context.Background()
+		ctxer := &tenantContextualizer{tenant: s.t2NID}
+		conf := config.NewCustom(logrusx.New("", ""), internal.NewConfigurationWithDefaults().Source(ctx), ctxer)
+		conf.MustSet(ctx, config.KeyDSN, r.Config().DSN())
+		reg, err := driver.NewRegistryFromDSN(ctx, conf, logrusx.New("test_hydra", "master"), false, false, ctxer)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = reg.Persister().Connection(ctx).Close() })
+		p, ok := reg.Persister().(*persistencesql.Persister)
+		require.True(t, ok)
+
+		// The network of t2 is the tenant with its own configuration.
+		conf.MustSet(ctx, config.KeyEncryptSessionData, true)
+		plainConfig := internal.NewConfigurationWithDefaults()
+		plainConfig.MustSet(ctx, config.KeyEncryptSessionData, false)
+		ctxer.tenantConfig = plainConfig.Source(ctx)
+
+		for _, tc := range []struct {
+			name      string
+			ctx       context.Context
+			encrypted bool
+		}{
+			{name: "encrypted network", ctx: s.t1, encrypted: true},
+			{name: "plain network", ctx: s.t2, encrypted: false},
+		} {
+			t.Run("case="+tc.name, func(t *testing.T) {
+				cl := createClient(tc.ctx, t, p, "network-client")
+
+				signature := uuid.Must(uuid.NewV4()).String()
+				session := oauth2.NewSession("sub")
+				require.NoError(t, p.CreateAccessTokenSession(tc.ctx, signature, &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: time.Now().UTC().Round(time.Second),
+					Client:      cl,
+					Session:     session,
+				}))
+
+				row, err := p.InspectSession(tc.ctx, "access", signature)
+				require.NoError(t, err)
+				assert.Equal(t, !tc.encrypted, gjson.ValidBytes(row.Session), "%s", row.Session)
+
+				got, err := p.GetAccessTokenSession(tc.ctx, signature, oauth2.NewSession(""))
+				require.NoError(t, err)
+				assert.Equal(t, session.GetSubject(), got.GetSession().GetSubject())
+				assert.Equal(t, cl.GetID(), got.GetClient().GetID())
+			})
+		}
+	})
 }
 
-func newClient() *client.Client {
-	return &client.Client{
-		ID: uuid.Must(uuid.NewV4()).String(),
-	}
+func (s *PersisterTestSuite) TestRevokeSessionForLogoutIsAtomic() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		conn := p.Connection(context.Background())
+
+		cl := createClient(ctx, t, p, "logout-atomic")
+
+		request := &fosite.Request{
+			ID:          uuid.Must(uuid.NewV4()).String(),
+			RequestedAt: time.Now().UTC().Round(time.Second),
+			Client:      cl,
+			Session: &oauth2.Session{DefaultSession: &openid.DefaultSession{
+				Subject: "sub",
+				Claims:  &jwt.IDTokenClaims{Extra: map[string]interface{}{"sid": "login-session"}},
+			}},
+		}
+		accessSignature, refreshSignature := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, accessSignature, request))
+		require.NoError(t, p.CreateRefreshTokenSession(ctx, refreshSignature, request))
+		require.NoError(t, p.CreateOpenIDConnectSession(ctx, uuid.Must(uuid.NewV4()).String(), request))
+
+		// Deleting the OpenID Connect session, which happens last, fails.
+		var fail, restore []string
+		switch conn.Dialect.Name() {
+		case "sqlite3":
+			fail = []string{"CREATE TRIGGER fail_oidc_delete BEFORE DELETE ON hydra_oauth2_oidc BEGIN SELECT RAISE(ABORT, 'forced failure'); END"}
+			restore = []string{"DROP TRIGGER fail_oidc_delete"}
+		case "postgres":
+			fail = []string{
+				"CREATE FUNCTION fail_oidc_delete() RETURNS trigger AS $$ BEGIN RAISE EXCEPTION 'forced failure'; END; $$ LANGUAGE plpgsql",
+				"CREATE TRIGGER fail_oidc_delete BEFORE DELETE ON hydra_oauth2_oidc FOR EACH ROW EXECUTE FUNCTION fail_oidc_delete()",
+			}
+			restore = []string{"DROP TRIGGER fail_oidc_delete ON hydra_oauth2_oidc", "DROP FUNCTION fail_oidc_delete()"}
+		case "mysql":
+			fail = []string{"CREATE TRIGGER fail_oidc_delete BEFORE DELETE ON hydra_oauth2_oidc FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'forced failure'"}
+			restore = []string{"DROP TRIGGER fail_oidc_delete"}
+		default:
+			// Without triggers, the OpenID Connect table is moved aside.
+			fail = []string{"ALTER TABLE hydra_oauth2_oidc RENAME TO hydra_oauth2_oidc_moved"}
+			restore = []string{"ALTER TABLE hydra_oauth2_oidc_moved RENAME TO hydra_oauth2_oidc"}
+		}
+		for _, stmt := range fail {
+			require.NoError(t, conn.RawQuery(stmt).Exec())
+		}
+
+		require.Error(t, p.RevokeSessionForLogout(ctx, "sub", cl.GetID(), "login-session"))
+
+		for _, stmt := range restore {
+			require.NoError(t, conn.RawQuery(stmt).Exec())
+		}
+
+		// Nothing was revoked.
+		_, err := p.GetAccessTokenSession(ctx, accessSignature, oauth2.NewSession(""))
+		assert.NoError(t, err)
+		_, err = p.GetRefreshTokenSession(ctx, refreshSignature, oauth2.NewSession(""))
+		assert.NoError(t, err)
+		_, err = p.GetOpenIDConnectSessionByRequestID(ctx, request.ID, oauth2.NewSession(""))
+		assert.NoError(t, err)
+
+		require.NoError(t, p.RevokeSessionForLogout(ctx, "sub", cl.GetID(), "login-session"))
+
+		_, err = p.GetAccessTokenSession(ctx, accessSignature, oauth2.NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+		_, err = p.GetRefreshTokenSession(ctx, refreshSignature, oauth2.NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrInactiveToken)
+		_, err = p.GetOpenIDConnectSessionByRequestID(ctx, request.ID, oauth2.NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+	})
 }
 
-func newFlow(nid uuid.UUID, clientID string, subject string, sessionID sqlxx.NullString) *flow.Flow {
-	return &flow.Flow{
-		NID:                nid,
-		ID:                 uuid.Must(uuid.NewV4()).String(),
-		ClientID:           clientID,
-		Subject:            subject,
-		ConsentError:       &flow.RequestDeniedError{},
-		State:              flow.FlowStateConsentUnused,
-		LoginError:         &flow.RequestDeniedError{},
-		Context:            sqlxx.JSONRawMessage{},
-		AMR:                sqlxx.StringSliceJSONFormat{},
-		ConsentChallengeID: sqlxx.NullString("not-null"),
-		ConsentVerifier:    sqlxx.NullString("not-null"),
-		ConsentCSRF:        sqlxx.NullString("not-null"),
-		SessionID:          sessionID,
-		RequestedAt:        time.Now(),
-	}
+func (s *PersisterTestSuite) TestClientIDCaseInsensitive() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		cl := createClient(ctx, t, p, "MixedCase-Client")
+
+		createAccessToken := func(t *testing.T) string {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")))
+			return signature
+		}
+
+		t.Run("case=strict", func(t *testing.T) {
+			if p.Connection(ctx).Dialect.Name() == "mysql" {
+				t.Skip("the default collation of MySQL compares client IDs ignoring case")
+			}
+			reg.Config().MustSet(ctx, config.KeyClientIDCaseInsensitive, false)
+			signature := createAccessToken(t)
+
+			_, err := p.GetLatestAccessTokenSession(ctx, "sub", "mixedcase-client")
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+			require.NoError(t, p.DeleteAccessTokens(ctx, "mixedcase-client"))
+			_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.NoError(t, err)
+
+			require.NoError(t, p.DeleteAccessTokens(ctx, "MixedCase-Client"))
+			_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=insensitive", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeyClientIDCaseInsensitive, true)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyClientIDCaseInsensitive, false) })
+			signature := createAccessToken(t)
+
+			latest, err := p.GetLatestAccessTokenSession(ctx, "sub", "MIXEDCASE-CLIENT")
+			require.NoError(t, err)
+			assert.Equal(t, cl.ID, latest.GetClient().GetID())
+
+			require.NoError(t, p.DeleteAccessTokens(ctx, "mixedcase-client"))
+			_, err = p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+
+		t.Run("case=client lookup ignoring case", func(t *testing.T) {
+			c, err := p.GetClientIgnoringCase(ctx, "mixedcase-CLIENT")
+			require.NoError(t, err)
+			assert.Equal(t, cl.ID, c.GetID())
+
+			_, err = p.GetClientIgnoringCase(ctx, "other-client")
+			assert.ErrorIs(t, err, sqlcon.ErrNoRows)
+		})
+	})
 }
 
-func newGrant(keySet string, keyID string) trust.Grant {
-	return trust.Grant{
-		ID:        uuid.Must(uuid.NewV4()).String(),
-		ExpiresAt: time.Now().Add(time.Hour),
-		PublicKey: trust.PublicKey{
-			Set:   keySet,
-			KeyID: keyID,
-		},
-	}
+func (s *PersisterTestSuite) TestFlushMaintenance() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyDBFlushMaintenanceThreshold, 3)
+		c := p.Connection(context.Background())
+
+		cl := createClient(ctx, t, p, "flush-maintenance-client")
+		createTokens := func(t *testing.T, n int, requestedAt time.Time) {
+			for i := 0; i < n; i++ {
+				require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+					ID:          uuid.Must(uuid.NewV4()).String(),
+					RequestedAt: requestedAt,
+					Client:      cl,
+					Session:     oauth2.NewSession("sub"),
+				}))
+			}
+		}
+
+		// maintenanceRuns returns how often the table was maintained, if the
+		// dialect records it.
+		var maintenanceRuns func(t *testing.T) int
+		switch c.Dialect.Name() {
+		case "sqlite3":
+			// ANALYZE records the statistics of the table in sqlite_stat1, which
+			// only exists once ANALYZE ran.
+			maintenanceRuns = func(t *testing.T) (n int) {
+				if err := c.RawQuery("SELECT COUNT(*) FROM sqlite_stat1 WHERE tbl = ?", "hydra_oauth2_access").First(&n); err != nil {
+					require.ErrorContains(t, err, "no such table")
+					return 0
+				}
+				return n
+			}
+		case "postgres":
+			maintenanceRuns = func(t *testing.T) (n int) {
+				require.NoError(t, c.RawQuery("SELECT vacuum_count FROM pg_stat_user_tables WHERE relname = ?", "hydra_oauth2_access").First(&n))
+				return n
+			}
+		}
+
+		var before int
+		if maintenanceRuns != nil {
+			before = maintenanceRuns(t)
+		}
+
+		old := time.Now().UTC().Add(-24 * time.Hour).Round(time.Second)
+		createTokens(t, 5, time.Now().UTC().Round(time.Second))
+
+		createTokens(t, 2, old)
+		res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+		require.NoError(t, err)
+		require.Equal(t, 2, res.Deleted)
+		if maintenanceRuns != nil {
+			assert.Equal(t, before, maintenanceRuns(t), "flushes below the threshold must not maintain the table")
+		}
+
+		createTokens(t, 3, old)
+		res, err = p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+		require.NoError(t, err)
+		require.Equal(t, 3, res.Deleted)
+		if maintenanceRuns != nil {
+			// PostgreSQL reports its statistics asynchronously.
+			assert.Eventually(t, func() bool { return maintenanceRuns(t) > before }, 5*time.Second, 100*time.Millisecond,
+				"flushes reaching the threshold must maintain the table")
+		}
+	})
 }
 
-func newLogoutRequest() *flow.LogoutRequest {
-	return &flow.LogoutRequest{
-		ID: uuid.Must(uuid.NewV4()).String(),
-	}
+func (s *PersisterTestSuite) TestCheckSignatureColumns() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		require.NoError(t, p.CheckSignatureColumns(ctx))
+
+		// Simulate a migration which left the signature column too narrow.
+		c := p.Connection(context.Background())
+		require.NoError(t, c.RawQuery("ALTER TABLE hydra_oauth2_access RENAME TO hydra_oauth2_access_backup").Exec())
+		require.NoError(t, c.RawQuery("CREATE TABLE hydra_oauth2_access (signature VARCHAR(64) NOT NULL PRIMARY KEY)").Exec())
+		t.Cleanup(func() {
+			require.NoError(t, c.RawQuery("DROP TABLE hydra_oauth2_access").Exec())
+			require.NoError(t, c.RawQuery("ALTER TABLE hydra_oauth2_access_backup RENAME TO hydra_oauth2_access").Exec())
+		})
+
+		err := p.CheckSignatureColumns(ctx)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "hydra_oauth2_access (64)")
+		assert.NotContains(t, err.Error(), "hydra_oauth2_refresh")
+	})
 }
 
-func newKey(ksID string, use string) jose.JSONWebKey {
-	ks, err := jwk.GenerateJWK(context.Background(), jose.RS256, ksID, use)
-	if err != nil {
-		panic(err)
-	}
-	return ks.Keys[0]
+func (s *PersisterTestSuite) TestExportImportSessions() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		// Sessions are exported from the first network and imported into the
+		// second one. Signatures are unique across networks, so the exported
+		// rows are deleted before they are imported.
+		source, target := s.t1, s.t2
+		require.NoError(t, p.CreateClient(source, &client.Client{ID: "export-client"}))
+		require.NoError(t, p.CreateClient(target, &client.Client{ID: "export-client"}))
+		deleteExported := func(t *testing.T, table persistencesql.TableName) {
+			/* #nosec G201 table is static */
+			require.NoError(t, p.Connection(context.Background()).RawQuery(fmt.Sprintf("DELETE FROM hydra_oauth2_%s WHERE nid = ?", table), s.t1NID).Exec())
+		}
+
+		cl, err := p.GetClient(source, "export-client")
+		require.NoError(t, err)
+		var active []string
+		for i := 0; i < 3; i++ {
+			signature := uuid.Must(uuid.NewV4()).String()
+			require.NoError(t, p.CreateAccessTokenSession(source, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, fmt.Sprintf("sub-%d", i))))
+			active = append(active, signature)
+		}
+		revokedRequest := newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "revoked")
+		revoked := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(source, revoked, revokedRequest))
+		require.NoError(t, p.RevokeAccessToken(source, revokedRequest.ID))
+
+		var buf bytes.Buffer
+		n, err := p.ExportActiveSessions(source, persistencesql.SQLTableAccess, &buf)
+		require.NoError(t, err)
+		assert.Equal(t, len(active), n)
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, len(active))
+		for _, line := range lines {
+			var exported persistencesql.ExportedSession
+			require.NoError(t, json.Unmarshal([]byte(line), &exported))
+			assert.NotContains(t, string(exported.SessionData), exported.Subject, "sessions must be exported encrypted")
+		}
+
+		expected := make([]fosite.Requester, len(active))
+		for i, signature := range active {
+			expected[i], err = p.GetAccessTokenSession(source, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+		}
+		deleteExported(t, persistencesql.SQLTableAccess)
+
+		n, err = p.ImportSessions(target, persistencesql.SQLTableAccess, &buf)
+		require.NoError(t, err)
+		assert.Equal(t, len(active), n)
+
+		for i, signature := range active {
+			actual, err := p.GetAccessTokenSession(target, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			assert.Equal(t, expected[i].GetID(), actual.GetID())
+			assert.Equal(t, expected[i].GetRequestedAt().UTC(), actual.GetRequestedAt().UTC())
+			assert.Equal(t, fmt.Sprintf("sub-%d", i), actual.GetSession().GetSubject())
+		}
+		_, err = p.GetAccessTokenSession(target, revoked, oauth2.NewSession(""))
+		assert.ErrorIs(t, err, fosite.ErrNotFound)
+
+		t.Run("case=table-specific columns", func(t *testing.T) {
+			at := time.Now().UTC().Add(time.Hour).Round(time.Second)
+
+			for _, tc := range []struct {
+				table   persistencesql.TableName
+				create  func(context.Context, string, fosite.Requester) error
+				columns map[string]interface{}
+			}{
+				{
+					table:   persistencesql.SQLTableRefresh,
+					create:  p.CreateRefreshTokenSession,
+					columns: map[string]interface{}{"sliding_expires_at": at, "absolute_expires_at": at.Add(time.Hour), "chain_length": int64(3), "graced_until": at},
+				},
+				{
+					table:   persistencesql.SQLTableDeviceCode,
+					create:  p.CreateDeviceCodeSession,
+					columns: map[string]interface{}{"last_polled_at": at},
+				},
+				{
+					table:   persistencesql.SQLTableOpenID,
+					create:  p.CreateOpenIDConnectSession,
+					columns: map[string]interface{}{"previous_granted_scope": "openid offline", "previous_granted_audience": "audience", "grant_updated_at": at},
+				},
+			} {
+				t.Run("table="+string(tc.table), func(t *testing.T) {
+					requestID := uuid.Must(uuid.NewV4()).String()
+					require.NoError(t, tc.create(source, uuid.Must(uuid.NewV4()).String(), newTokenRequest(requestID, cl, "sub")))
+					tableName := "hydra_oauth2_" + string(tc.table)
+					for column, value := range tc.columns {
+						require.NoError(t, p.Connection(source).RawQuery(
+							fmt.Sprintf("UPDATE %s SET %s = ? WHERE request_id = ?", tableName, column), value, requestID,
+						).Exec())
+					}
+
+					var buf bytes.Buffer
+					n, err := p.ExportActiveSessions(source, tc.table, &buf)
+					require.NoError(t, err)
+					require.Equal(t, 1, n)
+					deleteExported(t, tc.table)
+					n, err = p.ImportSessions(target, tc.table, &buf)
+					require.NoError(t, err)
+					require.Equal(t, 1, n)
+
+					for column, expected := range tc.columns {
+						query := fmt.Sprintf("SELECT %s FROM %s WHERE request_id = ? AND nid = ?", column, tableName)
+						switch expected := expected.(type) {
+						case time.Time:
+							var actual sql.NullTime
+							require.NoError(t, p.Connection(target).RawQuery(query, requestID, s.t2NID).First(&actual))
+							require.True(t, actual.Valid, column)
+							assert.True(t, expected.Equal(actual.Time), "%s: expected %s, got %s", column, expected, actual.Time)
+						case int64:
+							var actual sql.NullInt64
+							require.NoError(t, p.Connection(target).RawQuery(query, requestID, s.t2NID).First(&actual))
+							assert.Equal(t, sql.NullInt64{Int64: expected, Valid: true}, actual, column)
+						case string:
+							var actual sql.NullString
+							require.NoError(t, p.Connection(target).RawQuery(query, requestID, s.t2NID).First(&actual))
+							assert.Equal(t, sql.NullString{String: expected, Valid: true}, actual, column)
+						}
+					}
+				})
+			}
+		})
+
+		t.Run("case=malformed input is not imported", func(t *testing.T) {
+			_, err := p.ImportSessions(s.t1, persistencesql.SQLTableRefresh, strings.NewReader(`{"signature":"a","request_id":"r","client_id":"export-client","session_data":"e30="}`+"\n{"))
+			assert.ErrorIs(t, err, fosite.ErrInvalidRequest)
+
+			var buf bytes.Buffer
+			n, err := p.ExportActiveSessions(s.t1, persistencesql.SQLTableRefresh, &buf)
+			require.NoError(t, err)
+			assert.Zero(t, n)
+		})
+	})
 }
 
-func newKeySet(id string, use string) *jose.JSONWebKeySet {
-	return x.Must(jwk.GenerateJWK(context.Background(), jose.RS256, id, use))
+func (s *PersisterTestSuite) TestTokenSubjectIndex() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		cl := createClient(ctx, t, p, "subject-index")
+		subjects := seedSubjectTokens(ctx, t, p, cl, 20, 3)
+
+		t.Run("case=subject lookups use the index", func(t *testing.T) {
+			for _, table := range []string{"access", "refresh", "oidc"} {
+				query := fmt.Sprintf("SELECT request_id FROM hydra_oauth2_%s WHERE subject = :subject AND nid = :nid", table)
+				plan := queryPlan(t, p, query, map[string]any{"subject": subjects[0], "nid": p.NetworkID(ctx)})
+				assert.Contains(t, plan, fmt.Sprintf("hydra_oauth2_%s_nid_subject_idx", table))
+			}
+		})
+
+		t.Run("case=subject scoped results are unchanged", func(t *testing.T) {
+			latest, err := p.GetLatestAccessTokenSession(ctx, subjects[1], cl.ID)
+			require.NoError(t, err)
+			assert.Equal(t, subjects[1], latest.GetSession().GetSubject())
+
+			report, err := p.ErasureBySubject(ctx, subjects[0])
+			require.NoError(t, err)
+			assert.EqualValues(t, 3, report["hydra_oauth2_access"])
+			assert.EqualValues(t, 3, report["hydra_oauth2_refresh"])
+			assert.EqualValues(t, 3, report["hydra_oauth2_oidc"])
+
+			for _, table := range []string{"access", "refresh", "oidc"} {
+				var n int
+				require.NoError(t, p.Connection(ctx).RawQuery(fmt.Sprintf("SELECT COUNT(*) FROM hydra_oauth2_%s", table)).First(&n))
+				assert.Equal(t, 19*3, n, "tokens of other subjects are kept in %s", table)
+			}
+
+			_, err = p.GetLatestAccessTokenSession(ctx, subjects[0], cl.ID)
+			assert.ErrorIs(t, err, fosite.ErrNotFound)
+		})
+	})
 }
 
-func newLoginSession() *flow.LoginSession {
-	return &flow.LoginSession{
-		ID:              uuid.Must(uuid.NewV4()).String(),
-		AuthenticatedAt: sqlxx.NullTime(time.Time{}),
-		Subject:         uuid.Must(uuid.NewV4()).String(),
-		Remember:        false,
-	}
+// queryPlan returns the plan of the query with named parameters as the
+// database explains it, with the columns of all rows joined by spaces. PostgreSQL is kept from scanning
+// the table sequentially, which it prefers for the few rows of a test.
+func queryPlan(t *testing.T, p *persistencesql.Persister, query string, arg map[string]any) string {
+	var plan []string
+	require.NoError(t, p.Transaction(context.Background(), func(ctx context.Context, c *pop.Connection) error {
+		explain := "EXPLAIN "
+		switch c.Dialect.Name() {
+		case "sqlite3":
+			explain = "EXPLAIN QUERY PLAN "
+		case "postgres":
+			if err := c.RawQuery("SET LOCAL enable_seqscan = off").Exec(); err != nil {
+				return err
+			}
+		}
+
+		rows, err := c.Store.NamedQueryContext(ctx, explain+query, arg)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			columns, err := rows.SliceScan()
+			if err != nil {
+				return err
+			}
+			for _, column := range columns {
+				if b, ok := column.([]byte); ok {
+					column = string(b)
+				}
+				plan = append(plan, fmt.Sprint(column))
+			}
+		}
+		return rows.Err()
+	}))
+	return strings.Join(plan, " ")
 }
 
-func requireKeySetEqual(t *testing.T, expected *jose.JSONWebKeySet, actual *jose.JSONWebKeySet) {
-	assertx.EqualAsJSON(t, expected, actual)
+func (s *PersisterTestSuite) TestSessionUnmarshalMode() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyEncryptSessionData, false)
+		cl := createClient(ctx, t, p, "unmarshal-mode")
+
+		signature := uuid.Must(uuid.NewV4()).String()
+		require.NoError(t, p.CreateAccessTokenSession(ctx, signature, newTokenRequest(uuid.Must(uuid.NewV4()).String(), cl, "sub")))
+
+		// An older shape of the session stored the extra claims as a list and the
+		// key ID as a number.
+		var stored map[string]any
+		var row struct {
+			Session []byte `db:"session_data"`
+		}
+		require.NoError(t, p.Connection(ctx).RawQuery("SELECT session_data FROM hydra_oauth2_access WHERE signature = ?", persistencesql.SignatureHash(signature)).First(&row))
+		require.NoError(t, json.Unmarshal(row.Session, &stored))
+		stored["extra"] = []string{"legacy"}
+		stored["kid"] = 1
+		stored["client_id"] = cl.ID
+		legacy, err := json.Marshal(stored)
+		require.NoError(t, err)
+		require.NoError(t, p.Connection(ctx).RawQuery("UPDATE hydra_oauth2_access SET session_data = ? WHERE signature = ?", string(legacy), persistencesql.SignatureHash(signature)).Exec())
+
+		t.Run("case=strict", func(t *testing.T) {
+			_, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.Error(t, err)
+		})
+
+		t.Run("case=tolerant", func(t *testing.T) {
+			reg.Config().MustSet(ctx, config.KeySessionUnmarshalMode, config.SessionUnmarshalModeTolerant)
+			t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeySessionUnmarshalMode, config.SessionUnmarshalModeStrict) })
+
+			req, err := p.GetAccessTokenSession(ctx, signature, oauth2.NewSession(""))
+			require.NoError(t, err)
+			session, ok := req.GetSession().(*oauth2.Session)
+			require.True(t, ok)
+			assert.Equal(t, "sub", session.GetSubject(), "matching fields are decoded")
+			assert.Equal(t, cl.ID, session.ClientID)
+			assert.Empty(t, session.Extra, "mismatched fields are left empty")
+			assert.Empty(t, session.KID)
+		})
+	})
 }
 
-func persistLoginSession(ctx context.Context, t *testing.T, p persistence.Persister, session *flow.LoginSession) {
-	t.Helper()
-	require.NoError(t, p.CreateLoginSession(ctx, session))
-	require.NoError(t, p.Connection(ctx).Create(session))
+func (s *PersisterTestSuite) TestFlushMissingIndex() {
+	s.forEachPersister(s.T(), func(t *testing.T, reg driver.Registry, p *persistencesql.Persister) {
+		ctx := s.t1
+		reg.Config().MustSet(ctx, config.KeyDBFlushMissingIndex, config.DbFlushMissingIndexRefuse)
+		cl := createClient(ctx, t, p, "flush-missing-index")
+		createExpired := func(t *testing.T) {
+			require.NoError(t, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Add(-48 * time.Hour).Round(time.Second),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+		}
+
+		t.Run("case=index present", func(t *testing.T) {
+			createExpired(t)
+			res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 1, res.Deleted)
+		})
+
+		// Simulate a failed migration by replacing the table with a copy which
+		// has none of its indexes.
+		c := p.Connection(context.Background())
+		require.NoError(t, c.RawQuery("ALTER TABLE hydra_oauth2_access RENAME TO hydra_oauth2_access_indexed").Exec())
+		require.NoError(t, c.RawQuery("CREATE TABLE hydra_oauth2_access AS SELECT * FROM hydra_oauth2_access_indexed WHERE 1 = 0").Exec())
+		t.Cleanup(func() {
+			require.NoError(t, c.RawQuery("DROP TABLE hydra_oauth2_access").Exec())
+			require.NoError(t, c.RawQuery("ALTER TABLE hydra_oauth2_access_indexed RENAME TO hydra_oauth2_access").Exec())
+		})
+
+		t.Run("case=refuse", func(t *testing.T) {
+			createExpired(t)
+			_, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+			assert.ErrorIs(t, err, x.ErrFlushIndexMissing)
+
+			// Other tables are not affected.
+			_, err = p.FlushInactiveRefreshTokens(ctx, time.Now(), 100, 10)
+			assert.NoError(t, err)
+		})
+
+		for _, mode := range []string{config.DbFlushMissingIndexWarn, config.DbFlushMissingIndexIgnore} {
+			t.Run("case="+mode, func(t *testing.T) {
+				reg.Config().MustSet(ctx, config.KeyDBFlushMissingIndex, mode)
+				t.Cleanup(func() { reg.Config().MustSet(ctx, config.KeyDBFlushMissingIndex, config.DbFlushMissingIndexRefuse) })
+
+				createExpired(t)
+				res, err := p.FlushInactiveAccessTokens(ctx, time.Now(), 100, 10)
+				require.NoError(t, err)
+				assert.NotZero(t, res.Deleted)
+			})
+		}
+	})
 }
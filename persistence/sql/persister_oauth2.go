@@ -12,22 +12,33 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/pop/v6/columns"
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	"github.com/tidwall/gjson"
 
 	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/rfc8628"
 	"github.com/ory/fosite/storage"
+	"github.com/ory/hydra/v2/client"
+	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/hydra/v2/flow"
 	"github.com/ory/hydra/v2/oauth2"
+	"github.com/ory/hydra/v2/x"
 	"github.com/ory/hydra/v2/x/events"
 	"github.com/ory/x/errorsx"
 	"github.com/ory/x/otelx"
 	"github.com/ory/x/sqlcon"
+	"github.com/ory/x/sqlxx"
 	"github.com/ory/x/stringsx"
 )
 
@@ -51,7 +62,54 @@ type (
 		Subject           string         `db:"subject"`
 		Active            bool           `db:"active"`
 		Session           []byte         `db:"session_data"`
-		Table             tableName      `db:"-"`
+		AuthTime          sql.NullTime   `db:"auth_time"`
+		// ClientSnapshot holds the client of access and refresh tokens as it
+		// was at issuance, see GetClientSnapshot. Only those tables have the
+		// column, see tableOnlyColumns.
+		ClientSnapshot sql.NullString `db:"client_snapshot" rw:"w"`
+		// NonceHash is the hash of the nonce of OpenID Connect and authorize
+		// code sessions, see IsNonceUsed. Only those tables have the column,
+		// see tableOnlyColumns.
+		NonceHash sql.NullString `db:"nonce_hash" rw:"w"`
+		// IntrospectionAudience restricts which resource servers may
+		// introspect the access token, see CheckIntrospectionAudience. Only
+		// the access token table has the column, see tableOnlyColumns.
+		IntrospectionAudience sql.NullString `db:"introspection_audience" rw:"w"`
+		// GrantType is the grant the access or refresh token originates from,
+		// see RevokeDeviceGrantedTokens. Only those tables have the column,
+		// see tableOnlyColumns.
+		GrantType sql.NullString `db:"grant_type" rw:"w"`
+		// ExpiresAt overrides the expiry of access and refresh tokens, which
+		// is otherwise stored in the session, see ExtendAccessTokenLifespan.
+		// Only those tables have the column, see tableOnlyColumns.
+		ExpiresAt sql.NullTime `db:"expires_at" rw:"w"`
+		// DeviceChallenge is the device challenge through which the device
+		// code, access or refresh token was granted, see
+		// GetTokensByDeviceChallenge. Only those tables have the column, see
+		// tableOnlyColumns.
+		DeviceChallenge sql.NullString `db:"device_challenge" rw:"w"`
+		// AMR is the JSON array of the authentication methods references of
+		// the session of access and refresh tokens, see RevokeTokensByAMR.
+		// Only those tables have the column, see tableOnlyColumns.
+		AMR sql.NullString `db:"amr" rw:"w"`
+		// SID is the login session identifier of the session of access and
+		// refresh tokens and OpenID Connect sessions, see
+		// RevokeSessionForLogout. Only those tables have the column, see
+		// tableOnlyColumns.
+		SID sql.NullString `db:"sid" rw:"w"`
+		// Issuer is the issuer URL configured when the access or refresh
+		// token was issued, see GetTokenIssuer. Only those tables have the
+		// column, see tableOnlyColumns.
+		Issuer sql.NullString `db:"issuer" rw:"w"`
+		// FlaggedAt and FlaggedReason record when and why the access or
+		// refresh token was flagged for review, see FlagSession. Only those
+		// tables have the columns, see tableOnlyColumns.
+		FlaggedAt     sql.NullTime   `db:"flagged_at" rw:"w"`
+		FlaggedReason sql.NullString `db:"flagged_reason" rw:"w"`
+		Table         tableName      `db:"-"`
+		// TableSuffix overrides the table name following "hydra_oauth2_",
+		// which defaults to Table, see SetTokenTableNames.
+		TableSuffix string `db:"-" json:"-"`
 	}
 )
 
@@ -65,8 +123,97 @@ const (
 	sqlTableUserCode   tableName = "user_code"
 )
 
+// tokenTables lists all token tables.
+var tokenTables = []tableName{sqlTableOpenID, sqlTableAccess, sqlTableRefresh, sqlTableCode, sqlTablePKCE, sqlTableDeviceCode, sqlTableUserCode}
+
 func (r OAuth2RequestSQL) TableName() string {
-	return "hydra_oauth2_" + string(r.Table)
+	suffix := r.TableSuffix
+	if suffix == "" {
+		suffix = string(r.Table)
+	}
+	return "hydra_oauth2_" + suffix
+}
+
+// tokenTable returns the model of the token table, using the table name set
+// by SetTokenTableNames.
+func (p *Persister) tokenTable(ctx context.Context, table tableName) *OAuth2RequestSQL {
+	return &OAuth2RequestSQL{Table: table, TableSuffix: p.tokenTableName(table)}
+}
+
+// tableOnlyColumns are the columns of OAuth2RequestSQL which not all token
+// tables have, see optionalTokenTableColumns. Their fields are only written by
+// pop, so rows are read with tokenColumns to include them.
+var tableOnlyColumns = []string{"client_snapshot", "nonce_hash", "introspection_audience", "grant_type", "device_challenge", "amr", "sid", "issuer", "expires_at", "flagged_at", "flagged_reason"}
+
+// tokenTableColumns are the readable columns of OAuth2RequestSQL, which all
+// token tables have.
+var tokenTableColumns = strings.Split(columns.ForStruct(&OAuth2RequestSQL{}, "", "signature").Readable().SelectString(), ", ")
+
+// tokenColumns returns the columns of OAuth2RequestSQL which the table has, to
+// read its rows with.
+func tokenColumns(table tableName) []string {
+	selected := slices.Clone(tokenTableColumns)
+	for _, column := range tableOnlyColumns {
+		if slices.Contains(optionalTokenTableColumns[table], column) {
+			selected = append(selected, column)
+		}
+	}
+	return selected
+}
+
+// tokenQuery returns a query in the current network which reads rows of the
+// token table with the columns the table has.
+func (p *Persister) tokenQuery(ctx context.Context, table tableName) *pop.Query {
+	return p.QueryWithNetwork(ctx).Select(tokenColumns(table)...)
+}
+
+// excludedColumns returns the columns of OAuth2RequestSQL which the table of
+// the row does not have.
+func (r *OAuth2RequestSQL) excludedColumns() (excluded []string) {
+	for _, column := range tableOnlyColumns {
+		if !slices.Contains(optionalTokenTableColumns[r.Table], column) {
+			excluded = append(excluded, column)
+		}
+	}
+	return excluded
+}
+
+// createTokenRow stores the row in its token table in the current network,
+// leaving out the columns the table does not have.
+func (p *Persister) createTokenRow(ctx context.Context, r *OAuth2RequestSQL) error {
+	return p.Connection(ctx).Create(p.mustSetNetwork(p.NetworkID(ctx), r), r.excludedColumns()...)
+}
+
+// ClientSnapshot holds the attributes of a client at the time a token was
+// issued, so that audits reflect the client as it was then.
+type ClientSnapshot struct {
+	Name         string   `json:"client_name"`
+	Scope        string   `json:"scope"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+func newClientSnapshot(c fosite.Client) *ClientSnapshot {
+	snapshot := &ClientSnapshot{
+		Scope:        strings.Join(c.GetScopes(), " "),
+		RedirectURIs: c.GetRedirectURIs(),
+	}
+	if cl, ok := c.(*client.Client); ok {
+		snapshot.Name = cl.Name
+	}
+	return snapshot
+}
+
+// GetClientSnapshot returns the attributes of the client at the time the token
+// was issued, or nil if no snapshot was recorded.
+func (r *OAuth2RequestSQL) GetClientSnapshot() (*ClientSnapshot, error) {
+	if !r.ClientSnapshot.Valid {
+		return nil, nil
+	}
+	var snapshot ClientSnapshot
+	if err := json.Unmarshal([]byte(r.ClientSnapshot.String), &snapshot); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
+	return &snapshot, nil
 }
 
 func (p *Persister) sqlSchemaFromRequest(ctx context.Context, signature string, r fosite.Requester, table tableName) (*OAuth2RequestSQL, error) {
@@ -76,21 +223,39 @@ func (p *Persister) sqlSchemaFromRequest(ctx context.Context, signature string,
 	} else {
 		subject = r.GetSession().GetSubject()
 	}
+	// Tokens issued by the refresh grant are checked against the refresh grant,
+	// not against the grant they originate from.
+	if grantType := r.GetRequestForm().Get("grant_type"); subject == "" && grantType != "" && slices.Contains(p.config.SubjectRequiredGrantTypes(ctx), grantType) {
+		return nil, errorsx.WithStack(&x.EmptySubjectError{GrantType: grantType})
+	}
 
-	session, err := json.Marshal(r.GetSession())
+	if limit := p.config.GetMaxRequestedAudience(ctx); limit > 0 && len(r.GetRequestedAudience()) > limit {
+		return nil, errorsx.WithStack(&x.TooManyAudiencesError{Count: len(r.GetRequestedAudience()), Limit: limit})
+	}
+
+	// The origin grant type is recorded in the session before it is
+	// serialized, so that tokens refreshed from it inherit it.
+	grantType := grantTypeOrigin(r, table)
+
+	encrypt := p.encryptSessionData(ctx, r.GetClient())
+	session, err := p.marshalSession(ctx, r.GetSession(), encrypt)
 	if err != nil {
-		return nil, errorsx.WithStack(err)
+		return nil, err
 	}
 
-	if p.config.EncryptSessionData(ctx) {
+	if encrypt {
 		ciphertext, err := p.r.KeyCipher().Encrypt(ctx, session, nil)
 		if err != nil {
 			return nil, errorsx.WithStack(err)
 		}
 		session = []byte(ciphertext)
+		recordCompatPath(ctx, CompatPathEncryptedWrite)
+	} else {
+		recordCompatPath(ctx, CompatPathPlaintextWrite)
 	}
 
-	var challenge sql.NullString
+	var challenge, deviceChallenge, amr, sid sql.NullString
+	var authTime sql.NullTime
 	rr, ok := r.GetSession().(*oauth2.Session)
 	if !ok && r.GetSession() != nil {
 		return nil, errors.Errorf("Expected request to be of type *Session, but got: %T", r.GetSession())
@@ -98,52 +263,359 @@ func (p *Persister) sqlSchemaFromRequest(ctx context.Context, signature string,
 		if len(rr.ConsentChallenge) > 0 {
 			challenge = sql.NullString{Valid: true, String: rr.ConsentChallenge}
 		}
+		if len(rr.DeviceChallenge) > 0 && (table == sqlTableAccess || table == sqlTableRefresh || table == sqlTableDeviceCode) {
+			deviceChallenge = sql.NullString{Valid: true, String: rr.DeviceChallenge}
+		}
+		if rr.DefaultSession != nil && rr.Claims != nil && !rr.Claims.AuthTime.IsZero() {
+			authTime = sql.NullTime{Valid: true, Time: rr.Claims.AuthTime.UTC()}
+		}
+		if rr.DefaultSession != nil && rr.Claims != nil && len(rr.Claims.AuthenticationMethodsReferences) > 0 && (table == sqlTableAccess || table == sqlTableRefresh) {
+			methods, err := json.Marshal(rr.Claims.AuthenticationMethodsReferences)
+			if err != nil {
+				return nil, errorsx.WithStack(err)
+			}
+			amr = sql.NullString{Valid: true, String: string(methods)}
+		}
+		if rr.DefaultSession != nil && rr.Claims != nil && (table == sqlTableAccess || table == sqlTableRefresh || table == sqlTableOpenID) {
+			if v, ok := rr.Claims.Extra["sid"].(string); ok && v != "" {
+				sid = sql.NullString{Valid: true, String: v}
+			}
+		}
+	}
+
+	var clientSnapshot sql.NullString
+	if p.config.ClientSnapshotEnabled(ctx) && r.GetClient() != nil && (table == sqlTableAccess || table == sqlTableRefresh) {
+		snapshot, err := json.Marshal(newClientSnapshot(r.GetClient()))
+		if err != nil {
+			return nil, errorsx.WithStack(err)
+		}
+		clientSnapshot = sql.NullString{Valid: true, String: string(snapshot)}
+	}
+
+	// The nonce is indexed for OpenID Connect and authorize code sessions to
+	// detect replays, see IsNonceUsed. Nonces are chosen by the client and
+	// may be of any length, so only their hash is stored.
+	var nonce sql.NullString
+	if n := r.GetRequestForm().Get("nonce"); n != "" && (table == sqlTableOpenID || table == sqlTableCode) {
+		nonce = sql.NullString{Valid: true, String: nonceHash(n)}
+	}
+
+	// Access tokens can be bound to the resource servers which may introspect
+	// them, see CheckIntrospectionAudience.
+	var introspectionAudience sql.NullString
+	if aud := strings.Fields(r.GetRequestForm().Get("introspection_audience")); len(aud) > 0 && table == sqlTableAccess {
+		introspectionAudience = sql.NullString{Valid: true, String: strings.Join(aud, "|")}
+	}
+
+	form := r.GetRequestForm().Encode()
+	if slices.Contains(p.config.SessionSkipFormDataTables(ctx), string(table)) {
+		form = ""
+	}
+
+	// Access and refresh tokens are validated against the issuer they were
+	// issued by, see GetTokenIssuer.
+	var issuer sql.NullString
+	if table == sqlTableAccess || table == sqlTableRefresh {
+		issuer = sql.NullString{Valid: true, String: p.config.IssuerURL(ctx).String()}
+	}
+
+	var expiresAt sql.NullTime
+	if p.config.FrozenTokenLifespansEnabled(ctx) {
+		expiresAt = p.issuanceExpiry(ctx, r, table)
 	}
 
 	return &OAuth2RequestSQL{
-		Request:           r.GetID(),
-		ConsentChallenge:  challenge,
-		ID:                signature,
-		RequestedAt:       r.GetRequestedAt(),
-		Client:            r.GetClient().GetID(),
-		Scopes:            strings.Join(r.GetRequestedScopes(), "|"),
-		GrantedScope:      strings.Join(r.GetGrantedScopes(), "|"),
-		GrantedAudience:   strings.Join(r.GetGrantedAudience(), "|"),
-		RequestedAudience: strings.Join(r.GetRequestedAudience(), "|"),
-		Form:              r.GetRequestForm().Encode(),
-		Session:           session,
-		Subject:           subject,
-		Active:            true,
-		Table:             table,
+		Request:               r.GetID(),
+		ConsentChallenge:      challenge,
+		ID:                    signature,
+		RequestedAt:           r.GetRequestedAt(),
+		Client:                r.GetClient().GetID(),
+		Scopes:                strings.Join(r.GetRequestedScopes(), "|"),
+		GrantedScope:          strings.Join(r.GetGrantedScopes(), "|"),
+		GrantedAudience:       strings.Join(r.GetGrantedAudience(), "|"),
+		RequestedAudience:     strings.Join(r.GetRequestedAudience(), "|"),
+		Form:                  form,
+		Session:               session,
+		Subject:               subject,
+		Active:                true,
+		AuthTime:              authTime,
+		ClientSnapshot:        clientSnapshot,
+		NonceHash:             nonce,
+		IntrospectionAudience: introspectionAudience,
+		GrantType:             grantType,
+		ExpiresAt:             expiresAt,
+		DeviceChallenge:       deviceChallenge,
+		AMR:                   amr,
+		SID:                   sid,
+		Issuer:                issuer,
+		Table:                 table,
+		TableSuffix:           p.tokenTableName(table),
 	}, nil
 }
 
+// frozenLifespanTokenTypes are the token types whose expiry is stored at
+// issuance if FrozenTokenLifespansEnabled, keyed by their table.
+var frozenLifespanTokenTypes = map[tableName]fosite.TokenType{
+	sqlTableAccess:  fosite.AccessToken,
+	sqlTableRefresh: fosite.RefreshToken,
+}
+
+// issuanceExpiry returns the expiry of the access or refresh token being
+// issued. It is taken from the session, which holds the lifespan that applied
+// to the client, and falls back to the configured lifespan. Tokens of other
+// tables and refresh tokens which never expire have no expiry.
+func (p *Persister) issuanceExpiry(ctx context.Context, r fosite.Requester, table tableName) sql.NullTime {
+	tokenType, ok := frozenLifespanTokenTypes[table]
+	if !ok {
+		return sql.NullTime{}
+	}
+	if s := r.GetSession(); s != nil {
+		if exp := s.GetExpiresAt(tokenType); !exp.IsZero() {
+			return sql.NullTime{Valid: true, Time: exp.UTC()}
+		}
+	}
+
+	lifespan := p.config.GetAccessTokenLifespan(ctx)
+	if tokenType == fosite.RefreshToken {
+		lifespan = p.config.GetRefreshTokenLifespan(ctx)
+	}
+	if lifespan < 0 {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Valid: true, Time: r.GetRequestedAt().Add(lifespan).UTC()}
+}
+
+// clientIDCondition returns the SQL condition comparing the client ID column
+// to a client ID argument. If ClientIDCaseInsensitive is enabled, the case is
+// ignored, which prevents the database from using indexes on the column.
+func (p *Persister) clientIDCondition(ctx context.Context, column string) string {
+	if p.config.ClientIDCaseInsensitive(ctx) {
+		return "LOWER(" + column + ") = LOWER(?)"
+	}
+	return column + " = ?"
+}
+
+// grantTypeOrigin returns the grant which access and refresh tokens originate
+// from. It is carried on the session: the token endpoint records the grant of
+// its request there, as fosite stores tokens without the form of the request,
+// and otherwise the first token issued from a session records the grant found
+// in the form. Tokens issued by the refresh grant inherit it from the session
+// of the refresh token they were refreshed with. This keeps e.g. device
+// granted tokens recognizable across refresh token rotation. Refresh tokens
+// whose session predates the origin grant type have none.
+func grantTypeOrigin(r fosite.Requester, table tableName) sql.NullString {
+	if table != sqlTableAccess && table != sqlTableRefresh {
+		return sql.NullString{}
+	}
+	session, ok := r.GetSession().(*oauth2.Session)
+	if !ok {
+		return sql.NullString{}
+	}
+	if session.OriginGrantType == "" {
+		grantType := r.GetRequestForm().Get("grant_type")
+		if grantType == "" || fosite.GrantType(grantType) == fosite.GrantTypeRefreshToken {
+			return sql.NullString{}
+		}
+		session.OriginGrantType = grantType
+	}
+	return sql.NullString{Valid: true, String: session.OriginGrantType}
+}
+
+// encryptSessionData returns whether sessions of the client are encrypted at
+// rest. Clients can override the setting of their network in their metadata,
+// see client.Client.GetEncryptSessionData. Reading detects whether a session is
+// encrypted, so the setting can differ between networks and clients and change
+// over time.
+func (p *Persister) encryptSessionData(ctx context.Context, c fosite.Client) bool {
+	if c, ok := c.(interface{ GetEncryptSessionData() (bool, bool) }); ok {
+		if encrypt, ok := c.GetEncryptSessionData(); ok {
+			return encrypt
+		}
+	}
+	return p.config.EncryptSessionData(ctx)
+}
+
 func (r *OAuth2RequestSQL) toRequest(ctx context.Context, session fosite.Session, p *Persister) (_ *fosite.Request, err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.toRequest")
 	defer otelx.End(span, &err)
 
+	if err := r.decodeSession(ctx, session, p); err != nil {
+		return nil, err
+	}
+
+	req, err := r.toRequestShallow(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	req.Session = session
+	return req, nil
+}
+
+// toListedRequest is toRequest for methods listing several tokens, so that a
+// single corrupt row does not break the whole listing: sessions which cannot be
+// decrypted or decoded are handled according to the configured
+// SessionUnmarshalErrorStrategy. It returns nil if the row is skipped.
+func (r *OAuth2RequestSQL) toListedRequest(ctx context.Context, session fosite.Session, p *Persister) (*fosite.Request, error) {
+	strategy := p.config.SessionUnmarshalErrorStrategy(ctx)
+	if strategy == config.SessionUnmarshalErrorStrategyFail {
+		return r.toRequest(ctx, session, p)
+	}
+
+	if err := r.decodeSession(ctx, session, p); err != nil {
+		l := p.l.WithError(err).WithField("request_id", r.Request).WithField("client_id", r.Client)
+		if strategy == config.SessionUnmarshalErrorStrategyPartial {
+			l.Warn("Unable to decode the session of a listed token, returning the token without its session.")
+			return r.toRequestShallow(ctx, p)
+		}
+		l.Warn("Unable to decode the session of a listed token, skipping it.")
+		return nil, nil
+	}
+
+	req, err := r.toRequestShallow(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	req.Session = session
+	return req, nil
+}
+
+// toListedRequests calls toListedRequest for all rows of a token table,
+// decoding at most SessionMaxDecryptConcurrency sessions at the same time. The
+// order of the rows is kept, and skipped rows are omitted.
+func (p *Persister) toListedRequests(ctx context.Context, rows []OAuth2RequestSQL) ([]fosite.Requester, error) {
+	decoded := make([]*fosite.Request, len(rows))
+	if err := p.decryptConcurrently(ctx, len(rows), func(ctx context.Context, i int) (err error) {
+		decoded[i], err = rows[i].toListedRequest(ctx, oauth2.NewSession(""), p)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	requests := make([]fosite.Requester, 0, len(decoded))
+	for _, r := range decoded {
+		if r != nil {
+			requests = append(requests, r)
+		}
+	}
+	return requests, nil
+}
+
+// decryptConcurrently calls decrypt for every index below n, with at most
+// SessionMaxDecryptConcurrency calls running at the same time, and returns the
+// first error. With a limit of 1, or within a transaction, whose connection
+// must not be shared between goroutines, the calls run one after another.
+func (p *Persister) decryptConcurrently(ctx context.Context, n int, decrypt func(ctx context.Context, i int) error) error {
+	limit := p.config.SessionMaxDecryptConcurrency(ctx)
+	if limit == 1 || n <= 1 || p.Connection(ctx).TX != nil {
+		for i := 0; i < n; i++ {
+			if err := decrypt(ctx, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(limit)
+	for i := 0; i < n; i++ {
+		i := i
+		eg.Go(func() error { return decrypt(ctx, i) })
+	}
+	return eg.Wait()
+}
+
+// decodeSession decrypts and decodes session_data into the session, and
+// applies the columns which take precedence over the stored session, see
+// applyColumnsToSession.
+func (r *OAuth2RequestSQL) decodeSession(ctx context.Context, session fosite.Session, p *Persister) error {
+	// Plaintext sessions can skip detecting whether they are encrypted. Should
+	// the session be encrypted nevertheless, decoding it fails and it is read
+	// the safe way below.
+	assumePlaintext := session != nil && p.config.AssumePlaintextSessionData(ctx)
+	if assumePlaintext && unmarshalSession(r.Session, session) == nil {
+		recordCompatPath(ctx, CompatPathPlaintextRead)
+		r.applyColumnsToSession(session)
+		return nil
+	}
+
 	sess := r.Session
 	if !gjson.ValidBytes(sess) {
 		var err error
 		sess, err = p.r.KeyCipher().Decrypt(ctx, string(sess), nil)
 		if err != nil {
-			return nil, errorsx.WithStack(err)
+			return errorsx.WithStack(err)
+		}
+		if assumePlaintext {
+			recordCompatPath(ctx, CompatPathPlaintextAssumptionFallback)
 		}
+		recordCompatPath(ctx, CompatPathDecryptedRead)
+	} else {
+		recordCompatPath(ctx, CompatPathPlaintextRead)
 	}
 
-	if session != nil {
-		if err := json.Unmarshal(sess, session); err != nil {
-			return nil, errorsx.WithStack(err)
+	if session != nil && p.config.SessionUnmarshalMode(ctx) == config.SessionUnmarshalModeTolerant {
+		mismatched, err := unmarshalSessionTolerantly(sess, session)
+		if err != nil {
+			return err
+		} else if len(mismatched) > 0 {
+			p.l.WithField("request_id", r.Request).WithField("client_id", r.Client).WithField("fields", mismatched).
+				Warn("The stored session does not match the session type, leaving the mismatched fields empty.")
+		}
+	} else if session != nil {
+		if err := unmarshalSession(sess, session); err != nil {
+			return err
 		}
 	} else {
 		p.l.Debugf("Got an empty session in toRequest")
 	}
 
-	c, err := p.GetClient(ctx, r.Client)
-	if err != nil {
+	r.applyColumnsToSession(session)
+	return nil
+}
+
+// applyColumnsToSession overrides the decoded session with the columns which
+// take precedence over it.
+func (r *OAuth2RequestSQL) applyColumnsToSession(session fosite.Session) {
+	// The consent challenge is stored in its own column, which is the source of
+	// truth for which consent the token was issued from.
+	if s, ok := session.(*oauth2.Session); ok && r.ConsentChallenge.Valid {
+		s.ConsentChallenge = r.ConsentChallenge.String
+	}
+	// The device challenge and origin grant type are not part of the session
+	// data, see oauth2.Session.
+	if s, ok := session.(*oauth2.Session); ok {
+		if r.DeviceChallenge.Valid {
+			s.DeviceChallenge = r.DeviceChallenge.String
+		}
+		if r.GrantType.Valid {
+			s.OriginGrantType = r.GrantType.String
+		}
+	}
+	// The stored expiry was extended or frozen at issuance.
+	if tokenType, ok := frozenLifespanTokenTypes[r.Table]; ok && session != nil && r.ExpiresAt.Valid {
+		session.SetExpiresAt(tokenType, r.ExpiresAt.Time)
+	}
+}
+
+// toRequestShallow builds the request from the plain columns and loads its
+// client, but neither decrypts nor decodes session_data. The session of the
+// returned request is nil.
+func (r *OAuth2RequestSQL) toRequestShallow(ctx context.Context, p *Persister) (*fosite.Request, error) {
+	// A missing client means that the client was deleted, which invalidates the
+	// request. Any other error, e.g. a transient database error, is returned
+	// as-is so that callers can retry.
+	c, err := p.getCachedClient(ctx, r.Client)
+	if errors.Is(err, sqlcon.ErrNoRows) && p.config.ClientIDCaseInsensitive(ctx) {
+		c, err = p.getClientIgnoringCase(ctx, r.Client)
+	}
+	if errors.Is(err, sqlcon.ErrNoRows) {
+		return nil, errorsx.WithStack(fosite.ErrNotFound.WithWrap(x.ErrClientDeleted).WithDebugf("The client %q of the stored request no longer exists.", r.Client))
+	} else if err != nil {
 		return nil, err
 	}
 
+	// The form is empty for tables which skip persisting it, which parses
+	// into an empty, non-nil form.
 	val, err := url.ParseQuery(r.Form)
 	if err != nil {
 		return nil, errorsx.WithStack(err)
@@ -158,7 +630,6 @@ func (r *OAuth2RequestSQL) toRequest(ctx context.Context, session fosite.Session
 		RequestedAudience: stringsx.Splitx(r.RequestedAudience, "|"),
 		GrantedAudience:   stringsx.Splitx(r.GrantedAudience, "|"),
 		Form:              val,
-		Session:           session,
 	}, nil
 }
 
@@ -186,11 +657,15 @@ func (p *Persister) SetClientAssertionJWT(ctx context.Context, jti string, exp t
 	defer otelx.End(span, &err)
 
 	// delete expired; this cleanup spares us the need for a background worker
-	if err := p.QueryWithNetwork(ctx).Where("expires_at < CURRENT_TIMESTAMP").Delete(&oauth2.BlacklistedJTI{}); err != nil {
-		return sqlcon.HandleError(err)
+	if p.config.DbInlineJTICleanup(ctx) {
+		if err := p.QueryWithNetwork(ctx).Where("expires_at < CURRENT_TIMESTAMP").Delete(&oauth2.BlacklistedJTI{}); err != nil {
+			return sqlcon.HandleError(err)
+		}
 	}
 
-	if err := p.SetClientAssertionJWTRaw(ctx, oauth2.NewBlacklistedJTI(jti, exp)); errors.Is(err, sqlcon.ErrUniqueViolation) {
+	j := oauth2.NewBlacklistedJTI(jti, exp)
+	j.ClientID = sqlxx.NullString(x.ClientAssertionClientID(ctx))
+	if err := p.SetClientAssertionJWTRaw(ctx, j); errors.Is(err, sqlcon.ErrUniqueViolation) {
 		// found a jti
 		return errorsx.WithStack(fosite.ErrJTIKnown)
 	} else if err != nil {
@@ -216,182 +691,461 @@ func (p *Persister) SetClientAssertionJWTRaw(ctx context.Context, jti *oauth2.Bl
 	return sqlcon.HandleError(p.CreateWithNetwork(ctx, jti))
 }
 
+// DeleteClientAssertionJWTsByClient deletes the JTIs of the client's assertions
+// in the current network, e.g. when the client is decommissioned, and returns
+// how many it deleted. JTIs are only attributed to a client if they were
+// stored within a context carrying x.WithClientAssertionClientID, which is the
+// case for assertions sent to the token endpoint.
+func (p *Persister) DeleteClientAssertionJWTsByClient(ctx context.Context, clientID string) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteClientAssertionJWTsByClient")
+	defer otelx.End(span, &err)
+
+	/* #nosec G201 table is static */
+	n, err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("DELETE FROM %s WHERE client_id = ? AND nid = ?", oauth2.BlacklistedJTI{}.TableName()),
+		clientID,
+		p.NetworkID(ctx),
+	).ExecWithCount()
+	return n, sqlcon.HandleError(err)
+}
+
 func (p *Persister) createSession(ctx context.Context, signature string, requester fosite.Requester, table tableName) error {
-	req, err := p.sqlSchemaFromRequest(ctx, signature, requester, table)
-	if err != nil {
-		return err
+	return p.sessionBackend(table).CreateSession(ctx, signature, requester)
+}
+
+// insertSession stores the row, aborting the write if it does not complete
+// within the configured session write timeout.
+func (p *Persister) insertSession(ctx context.Context, req *OAuth2RequestSQL) error {
+	timeout := p.config.GetSessionWriteTimeout(ctx)
+	if timeout <= 0 {
+		return sqlcon.HandleError(p.createTokenRow(ctx, req))
 	}
 
-	if err = sqlcon.HandleError(p.CreateWithNetwork(ctx, req)); errors.Is(err, sqlcon.ErrConcurrentUpdate) {
-		return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
-	} else if err != nil {
-		return err
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := p.createTokenRow(ctx, req)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errorsx.WithStack(fosite.ErrTemporarilyUnavailable.
+			WithHintf("Storing the token did not complete within %s.", timeout).
+			WithWrap(err).WithDebug(err.Error()))
 	}
-	return nil
+	return sqlcon.HandleError(err)
 }
 
 func (p *Persister) findSessionBySignature(ctx context.Context, signature string, session fosite.Session, table tableName) (fosite.Requester, error) {
-	r := OAuth2RequestSQL{Table: table}
-	err := p.QueryWithNetwork(ctx).Where("signature = ?", signature).First(&r)
-	if errors.Is(err, sql.ErrNoRows) {
-		return nil, errorsx.WithStack(fosite.ErrNotFound)
-	}
+	r, active, err := p.sessionBackend(table).GetSession(ctx, signature, session)
+	return inactiveSessionError(r, active, err, table)
+}
+
+// inactiveSessionError returns the error fosite expects for a deactivated
+// session of the table alongside the request.
+func inactiveSessionError(r fosite.Requester, active bool, err error, table tableName) (fosite.Requester, error) {
 	if err != nil {
-		return nil, sqlcon.HandleError(err)
+		return nil, err
 	}
-	if !r.Active {
-		fr, err := r.toRequest(ctx, session, p)
-		if err != nil {
-			return nil, err
-		}
+	if !active {
 		if table == sqlTableCode {
-			return fr, errorsx.WithStack(fosite.ErrInvalidatedAuthorizeCode)
+			return r, errorsx.WithStack(fosite.ErrInvalidatedAuthorizeCode)
 		}
-		return fr, errorsx.WithStack(fosite.ErrInactiveToken)
+		return r, errorsx.WithStack(fosite.ErrInactiveToken)
 	}
-
-	return r.toRequest(ctx, session, p)
+	return r, nil
 }
 
-func (p *Persister) findSessionByRequestID(ctx context.Context, requestID string, session fosite.Session, table tableName) (fosite.Requester, error) {
-	r := OAuth2RequestSQL{Table: table}
-	err := p.QueryWithNetwork(ctx).Where("request_id = ?", requestID).First(&r)
-	if errors.Is(err, sql.ErrNoRows) {
-		return nil, errorsx.WithStack(fosite.ErrNotFound)
+// InspectSession returns the row stored in the token table under the given
+// signature without interpreting it, for debugging purposes such as encryption
+// or round-trip issues. Beware that it exposes raw data: Session holds the
+// stored, possibly encrypted, bytes, and nothing is redacted. Access token
+// signatures are looked up hashed first, like GetAccessTokenSession does.
+func (p *Persister) InspectSession(ctx context.Context, table tableName, signature string) (_ *OAuth2RequestSQL, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InspectSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	if !slices.Contains(tokenTables, table) {
+		return nil, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
+	} else if err := p.requireSQLSessionBackend(table); err != nil {
+		return nil, err
 	}
-	if err != nil {
-		return nil, sqlcon.HandleError(err)
+
+	candidates := []string{signature}
+	if table == sqlTableAccess {
+		candidates = p.accessTokenSignatureCandidates(signature)
 	}
-	if !r.Active {
-		fr, err := r.toRequest(ctx, session, p)
-		if err != nil {
-			return nil, err
-		}
-		if table == sqlTableCode {
-			return fr, errorsx.WithStack(fosite.ErrInvalidatedAuthorizeCode)
+
+	r := p.tokenTable(ctx, table)
+	for _, candidate := range candidates {
+		err = p.tokenQuery(ctx, table).Where("signature = ?", candidate).First(r)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, sqlcon.HandleError(err)
 		}
-		return fr, errorsx.WithStack(fosite.ErrInactiveToken)
+		return r, nil
 	}
-
-	return r.toRequest(ctx, session, p)
+	return nil, errorsx.WithStack(fosite.ErrNotFound)
 }
 
-func (p *Persister) deleteSessionBySignature(ctx context.Context, signature string, table tableName) error {
-	err := sqlcon.HandleError(
-		p.QueryWithNetwork(ctx).
-			Where("signature = ?", signature).
-			Delete(&OAuth2RequestSQL{Table: table}))
-	if errors.Is(err, sqlcon.ErrNoRows) {
-		return errorsx.WithStack(fosite.ErrNotFound)
+// GetTokenIssuer returns the issuer URL which was configured when the access
+// or refresh token stored in the table under the given signature was issued,
+// so that the original issuer can be validated even after the configured
+// issuer changed. It returns an empty string for tokens issued before the
+// issuer was recorded.
+func (p *Persister) GetTokenIssuer(ctx context.Context, table tableName, signature string) (_ string, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetTokenIssuer")
+	defer otelx.End(span, &err)
+
+	if table != sqlTableAccess && table != sqlTableRefresh {
+		return "", errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Tokens of table %q have no issuer.", table))
 	}
-	if errors.Is(err, sqlcon.ErrConcurrentUpdate) {
-		return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+
+	r, err := p.InspectSession(ctx, table, signature)
+	if err != nil {
+		return "", err
 	}
-	return err
+	return r.Issuer.String, nil
 }
 
-func (p *Persister) deleteSessionByRequestID(ctx context.Context, id string, table tableName) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.deleteSessionByRequestID")
+// observedTokenTypes are the token types whose expiry ObserveSession checks.
+var observedTokenTypes = map[tableName]fosite.TokenType{
+	sqlTableAccess:  fosite.AccessToken,
+	sqlTableRefresh: fosite.RefreshToken,
+	sqlTableCode:    fosite.AuthorizeCode,
+}
+
+// ObserveSession returns the session stored in the table under the given
+// signature, and whether it is active, i.e. neither deactivated nor expired.
+// Unlike the Get*Session methods, inactive and expired sessions are returned
+// without an error. It is meant for trusted internal callers such as
+// observability endpoints only, and must never be used to validate tokens.
+func (p *Persister) ObserveSession(ctx context.Context, table tableName, signature string, session fosite.Session) (_ fosite.Requester, active bool, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ObserveSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 
-	err = p.QueryWithNetwork(ctx).
-		Where("request_id=?", id).
-		Delete(&OAuth2RequestSQL{Table: table})
-	if errors.Is(err, sql.ErrNoRows) {
-		return errorsx.WithStack(fosite.ErrNotFound)
+	if !slices.Contains(tokenTables, table) {
+		return nil, false, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
 	}
-	if err := sqlcon.HandleError(err); err != nil {
-		if errors.Is(err, sqlcon.ErrConcurrentUpdate) {
-			return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+
+	candidates := []string{signature}
+	if table == sqlTableAccess {
+		candidates = p.accessTokenSignatureCandidates(signature)
+	}
+
+	for _, candidate := range candidates {
+		r, active, err := p.sessionBackend(table).GetSession(ctx, candidate, session)
+		if errors.Is(err, fosite.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, false, err
 		}
-		if strings.Contains(err.Error(), "Error 1213") { // InnoDB Deadlock?
-			return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+
+		if tokenType, ok := observedTokenTypes[table]; ok && r.GetSession() != nil {
+			if exp := r.GetSession().GetExpiresAt(tokenType); !exp.IsZero() && exp.Before(time.Now().UTC()) {
+				active = false
+			}
 		}
-		return err
+		return r, active, nil
 	}
-	return nil
+	return nil, false, errorsx.WithStack(fosite.ErrNotFound)
 }
 
-func (p *Persister) deactivateSessionByRequestID(ctx context.Context, id string, table tableName) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.deactivateSessionByRequestID")
+// FindUndecryptableSessions scans the sessions of the table in the current
+// network, batchSize rows at a time, and returns the stored signatures of those
+// whose session data cannot be decrypted, e.g. after a botched key rotation.
+// Unencrypted sessions are never reported. The returned signatures can be
+// passed to DeleteSessionsBySignatures.
+func (p *Persister) FindUndecryptableSessions(ctx context.Context, table tableName, batchSize int) (_ []string, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FindUndecryptableSessions")
 	defer otelx.End(span, &err)
 
-	/* #nosec G201 table is static */
-	return sqlcon.HandleError(
-		p.Connection(ctx).
-			RawQuery(
-				fmt.Sprintf("UPDATE %s SET active=false WHERE request_id=? AND nid = ? AND active=true", OAuth2RequestSQL{Table: table}.TableName()),
-				id,
-				p.NetworkID(ctx),
-			).
-			Exec(),
-	)
-}
+	if err := p.requireSQLSessionBackend(table); err != nil {
+		return nil, err
+	}
 
-func (p *Persister) CreateAuthorizeCodeSession(ctx context.Context, signature string, requester fosite.Requester) error {
-	return otelx.WithSpan(ctx, "persistence.sql.CreateAuthorizeCodeSession", func(ctx context.Context) error {
-		return p.createSession(ctx, signature, requester, sqlTableCode)
-	})
-}
+	if batchSize <= 0 {
+		return nil, errors.Errorf("batch size must be positive, got %d", batchSize)
+	}
 
-func (p *Persister) GetAuthorizeCodeSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetAuthorizeCodeSession")
-	defer otelx.End(span, &err)
+	var undecryptable []string
+	for after := ""; ; {
+		var rows []struct {
+			ID      string `db:"signature"`
+			Session []byte `db:"session_data"`
+		}
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("SELECT signature, session_data FROM %s WHERE nid = ? AND signature > ? ORDER BY signature LIMIT %d", p.tokenTable(ctx, table).TableName(), batchSize),
+			p.NetworkID(ctx),
+			after,
+		).All(&rows); err != nil {
+			return nil, sqlcon.HandleError(err)
+		}
+
+		failed := make([]bool, len(rows))
+		if err := p.decryptConcurrently(ctx, len(rows), func(ctx context.Context, i int) error {
+			if !gjson.ValidBytes(rows[i].Session) {
+				_, err := p.r.KeyCipher().Decrypt(ctx, string(rows[i].Session), nil)
+				failed[i] = err != nil
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			if failed[i] {
+				undecryptable = append(undecryptable, row.ID)
+			}
+		}
 
-	return p.findSessionBySignature(ctx, signature, session, sqlTableCode)
+		if len(rows) < batchSize {
+			return undecryptable, nil
+		}
+		after = rows[len(rows)-1].ID
+	}
 }
 
-func (p *Persister) InvalidateAuthorizeCodeSession(ctx context.Context, signature string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateAuthorizeCodeSession")
+// DeleteSessionsBySignatures deletes the sessions of the table in the current
+// network which are stored under the given signatures, and returns how many
+// were deleted. The signatures are used as stored, e.g. as returned by
+// FindUndecryptableSessions, so access token signatures must already be hashed.
+func (p *Persister) DeleteSessionsBySignatures(ctx context.Context, table tableName, signatures []string) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteSessionsBySignatures")
 	defer otelx.End(span, &err)
 
-	/* #nosec G201 table is static */
-	return sqlcon.HandleError(
-		p.Connection(ctx).
-			RawQuery(
-				fmt.Sprintf("UPDATE %s SET active = false WHERE signature = ? AND nid = ?", OAuth2RequestSQL{Table: sqlTableCode}.TableName()),
-				signature,
-				p.NetworkID(ctx),
-			).
-			Exec(),
-	)
-}
+	if err := p.requireSQLSessionBackend(table); err != nil {
+		return 0, err
+	}
+	if table == sqlTableAccess {
+		defer p.accessTokenCache.removeNetwork(p.NetworkID(ctx))
+	}
 
-// SignatureHash hashes the signature to prevent errors where the signature is
-// longer than 128 characters (and thus doesn't fit into the pk).
-func SignatureHash(signature string) string {
-	return fmt.Sprintf("%x", sha512.Sum384([]byte(signature)))
+	const chunkSize = 500
+	deleted := 0
+	for i := 0; i < len(signatures); i += chunkSize {
+		chunk := signatures[i:min(i+chunkSize, len(signatures))]
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		n, err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("DELETE FROM %s WHERE signature IN (?) AND nid = ?", p.tokenTable(ctx, table).TableName()),
+			chunk,
+			p.NetworkID(ctx),
+		).ExecWithCount()
+		deleted += n
+		if err != nil {
+			return deleted, sqlcon.HandleError(err)
+		}
+	}
+	return deleted, nil
+}
+
+// WhichTables returns the token tables in which the signature is stored in the
+// current network, to diagnose migration or double-write bugs. Access token
+// signatures are probed both hashed and in their legacy, unhashed form.
+func (p *Persister) WhichTables(ctx context.Context, signature string) (_ []tableName, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.WhichTables")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	if err := p.requireSQLSessionBackend(tokenTables...); err != nil {
+		return nil, err
+	}
+
+	var tables []tableName
+	for _, table := range tokenTables {
+		candidates := []string{signature}
+		if table == sqlTableAccess {
+			candidates = p.accessTokenSignatureCandidates(signature)
+		}
+
+		exists, err := p.QueryWithNetwork(ctx).Where("signature IN (?)", candidates).Exists(p.tokenTable(ctx, table))
+		if err != nil {
+			return nil, sqlcon.HandleError(err)
+		}
+		if exists {
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
+
+func (p *Persister) findSessionByRequestID(ctx context.Context, requestID string, session fosite.Session, table tableName) (fosite.Requester, error) {
+	r, active, err := p.sessionBackend(table).GetSessionByRequestID(ctx, requestID, session)
+	return inactiveSessionError(r, active, err, table)
+}
+
+// GetSessionsByRequestID returns the access token, refresh token, OpenID Connect
+// and PKCE sessions issued for the given request ID, keyed by their table.
+// Tables without a session for the request ID are omitted. Inactive sessions
+// are included.
+func (p *Persister) GetSessionsByRequestID(ctx context.Context, requestID string, session fosite.Session) (_ map[tableName]fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetSessionsByRequestID")
+	defer otelx.End(span, &err)
+
+	sessions := make(map[tableName]fosite.Requester)
+	for _, table := range []tableName{sqlTableAccess, sqlTableRefresh, sqlTableOpenID, sqlTablePKCE} {
+		var s fosite.Session
+		if session != nil {
+			s = session.Clone()
+		}
+
+		r, err := p.findSessionByRequestID(ctx, requestID, s, table)
+		if errors.Is(err, fosite.ErrNotFound) {
+			continue
+		} else if err != nil && !errors.Is(err, fosite.ErrInactiveToken) {
+			return nil, err
+		}
+		sessions[table] = r
+	}
+
+	return sessions, nil
+}
+
+func (p *Persister) deleteSessionBySignature(ctx context.Context, signature string, table tableName) error {
+	return p.sessionBackend(table).DeleteSession(ctx, signature)
+}
+
+func (p *Persister) deleteSessionByRequestID(ctx context.Context, id string, table tableName) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.deleteSessionByRequestID")
+	defer otelx.End(span, &err)
+
+	return p.sessionBackend(table).DeleteSessionsByRequestID(ctx, id)
+}
+
+func (p *Persister) deactivateSessionByRequestID(ctx context.Context, id string, table tableName) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.deactivateSessionByRequestID")
+	defer otelx.End(span, &err)
+
+	return p.sessionBackend(table).DeactivateSessionsByRequestID(ctx, id)
+}
+
+func (p *Persister) CreateAuthorizeCodeSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	return otelx.WithSpan(ctx, "persistence.sql.CreateAuthorizeCodeSession", func(ctx context.Context) error {
+		return p.createSession(ctx, normalizeSignature(signature), requester, sqlTableCode)
+	})
+}
+
+// GetAuthorizeCodeSession reads the authorization code from the primary
+// connection configured by dsn, never from the flush connection, so that an
+// invalidated code is seen as such right away. Deployments with read replicas
+// must not point dsn at a replica, as replication lag would allow exchanging
+// a code twice.
+func (p *Persister) GetAuthorizeCodeSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetAuthorizeCodeSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	request, err = p.findSessionBySignature(ctx, signature, session, sqlTableCode)
+	if errors.Is(err, fosite.ErrInvalidatedAuthorizeCode) && request != nil {
+		x.AuthorizeCodeReuseDetections.Inc()
+		p.l.WithField("client_id", request.GetClient().GetID()).
+			WithField("request_id", request.GetID()).
+			Warn("An invalidated authorization code was presented again.")
+	}
+	return request, err
+}
+
+func (p *Persister) InvalidateAuthorizeCodeSession(ctx context.Context, signature string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateAuthorizeCodeSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	if !p.hasSQLSessionBackend(sqlTableCode) {
+		return p.sessionBackend(sqlTableCode).DeactivateSession(ctx, signature)
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	return sqlcon.HandleError(
+		p.Connection(ctx).
+			RawQuery(
+				fmt.Sprintf("UPDATE %s SET active = false WHERE signature = ? AND nid = ? AND active = true", p.tokenTable(ctx, sqlTableCode).TableName()),
+				signature,
+				p.NetworkID(ctx),
+			).
+			Exec(),
+	)
+}
+
+// InvalidateAuthorizeCodeSessionsByRequestIDs deactivates the active
+// authorization codes of the given requests in a single statement, e.g. after
+// detecting compromised authorization sessions, and returns how many codes were
+// deactivated.
+func (p *Persister) InvalidateAuthorizeCodeSessionsByRequestIDs(ctx context.Context, ids []string) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateAuthorizeCodeSessionsByRequestIDs")
+	defer otelx.End(span, &err)
+
+	if !p.hasSQLSessionBackend(sqlTableCode) {
+		return 0, errors.Errorf("the session backend of token table %q does not support batch invalidation", sqlTableCode)
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	invalidated, err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("UPDATE %s SET active = false WHERE request_id IN (?) AND nid = ? AND active = true", p.tokenTable(ctx, sqlTableCode).TableName()),
+			ids,
+			p.NetworkID(ctx),
+		).
+		ExecWithCount()
+	if err != nil {
+		return 0, sqlcon.HandleError(err)
+	}
+	return invalidated, nil
+}
+
+// normalizeSignature returns the canonical form of a token signature, which is
+// unpadded base64url as produced by fosite. Standard base64 characters are
+// mapped to their URL-safe counterparts and padding is removed, so that
+// re-encoded signatures resolve to the same row. Signatures are case-sensitive
+// and are therefore never case-folded: signatures differing in case encode
+// different bytes.
+func normalizeSignature(signature string) string {
+	return strings.TrimRight(signatureReplacer.Replace(signature), "=")
+}
+
+var signatureReplacer = strings.NewReplacer("+", "-", "/", "_")
+
+// SignatureHash hashes the signature to prevent errors where the signature is
+// longer than 128 characters (and thus doesn't fit into the pk).
+func SignatureHash(signature string) string {
+	return fmt.Sprintf("%x", sha512.Sum384([]byte(signature)))
 }
 
 func (p *Persister) CreateAccessTokenSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateAccessTokenSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 
 	events.Trace(ctx, events.AccessTokenIssued,
 		append(toEventOptions(requester), events.WithGrantType(requester.GetRequestForm().Get("grant_type")))...,
 	)
 
-	return p.createSession(ctx, SignatureHash(signature), requester, sqlTableAccess)
+	return p.createSession(ctx, p.storedAccessTokenSignature(signature), requester, sqlTableAccess)
 }
 
 func (p *Persister) GetAccessTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetAccessTokenSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 
-	r := OAuth2RequestSQL{Table: sqlTableAccess}
-	err = p.QueryWithNetwork(ctx).Where("signature = ?", SignatureHash(signature)).First(&r)
-	if errors.Is(err, sql.ErrNoRows) {
-		// Backwards compatibility: we previously did not always hash the
-		// signature before inserting. In case there are still very old (but
-		// valid) access tokens in the database, this should get them.
-		err = p.QueryWithNetwork(ctx).Where("signature = ?", signature).First(&r)
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errorsx.WithStack(fosite.ErrNotFound)
-		}
+	if r, ok := p.cachedAccessToken(ctx, signature); ok {
+		return rejectIssuedBeforeCredentialRotation(r.toRequest(ctx, session, p))
 	}
+
+	// Tokens stored under a previous signature strategy, e.g. the unhashed
+	// signatures of older versions, are still found until the configured
+	// legacy fallback period has passed.
+	r := p.tokenTable(ctx, sqlTableAccess)
+	strategy, err := p.findAccessToken(ctx, r, signature)
 	if err != nil {
-		return nil, sqlcon.HandleError(err)
+		return nil, err
+	}
+	if strategy > 0 && p.config.AccessTokenReadRepairEnabled(ctx) {
+		p.repairLegacyAccessTokenSignature(ctx, r, p.storedAccessTokenSignature(signature))
 	}
+	p.cacheAccessToken(ctx, signature, r)
 	if !r.Active {
 		fr, err := r.toRequest(ctx, session, p)
 		if err != nil {
@@ -400,207 +1154,1912 @@ func (p *Persister) GetAccessTokenSession(ctx context.Context, signature string,
 		return fr, errorsx.WithStack(fosite.ErrInactiveToken)
 	}
 
-	return r.toRequest(ctx, session, p)
+	return rejectIssuedBeforeCredentialRotation(r.toRequest(ctx, session, p))
+}
+
+// rejectIssuedBeforeCredentialRotation passes through the request of an active
+// token, unless the token was requested before the credentials of its client
+// were last rotated, in which case it is reported as not found. It checks the
+// client which toRequest loaded for the request anyway, so it does not read the
+// client again, and a rotation applies to the next read of every token.
+func rejectIssuedBeforeCredentialRotation(r fosite.Requester, err error) (fosite.Requester, error) {
+	if err != nil {
+		return nil, err
+	}
+	c, ok := r.GetClient().(*client.Client)
+	if !ok || c.CredentialsRotatedAt == nil || !r.GetRequestedAt().Before(*c.CredentialsRotatedAt) {
+		return r, nil
+	}
+	return nil, errorsx.WithStack(fosite.ErrNotFound.WithWrap(x.ErrClientCredentialsRotated).
+		WithDebugf("The token was requested at %s, before the credentials of client %q were rotated at %s.", r.GetRequestedAt().UTC(), c.GetID(), c.CredentialsRotatedAt.UTC()))
+}
+
+// repairLegacyAccessTokenSignature rewrites the signature of the access token
+// row, which was stored under a previous signature strategy such as the legacy,
+// unhashed form, to the signature of the current strategy, so that tokens
+// which are still in use are migrated gradually. It is best-effort: failures
+// are only logged, and nothing is done within a transaction, which a failed
+// write would abort.
+func (p *Persister) repairLegacyAccessTokenSignature(ctx context.Context, r *OAuth2RequestSQL, current string) {
+	if p.Connection(ctx).TX != nil {
+		return
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("UPDATE %s SET signature = ? WHERE signature = ? AND nid = ?", r.TableName()),
+		current,
+		r.ID,
+		p.NetworkID(ctx),
+	).Exec(); err != nil {
+		p.l.WithError(sqlcon.HandleError(err)).Warn("Unable to rewrite the signature of an access token to the current signature strategy.")
+		return
+	}
+	r.ID = current
+}
+
+// tokenMetadataColumns are all columns of the access token table but
+// session_data.
+var tokenMetadataColumns = []string{
+	"signature", "nid", "request_id", "challenge_id", "requested_at", "client_id",
+	"scope", "granted_scope", "requested_audience", "granted_audience", "form_data",
+	"subject", "active", "auth_time", "client_snapshot", "introspection_audience",
+	"grant_type", "expires_at", "device_challenge", "amr", "sid", "issuer",
+}
+
+// GetAccessTokenMetadata returns the request of the access token with the given
+// signature without loading and decrypting its session, e.g. for listing or
+// auditing tokens. The session of the returned request is nil. Like
+// GetAccessTokenSession, it returns the request alongside
+// fosite.ErrInactiveToken if the token is no longer active.
+func (p *Persister) GetAccessTokenMetadata(ctx context.Context, signature string) (_ fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetAccessTokenMetadata")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	r := p.tokenTable(ctx, sqlTableAccess)
+	if _, err := p.findAccessToken(ctx, r, signature, tokenMetadataColumns...); err != nil {
+		return nil, err
+	}
+
+	fr, err := r.toRequestShallow(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Active {
+		return fr, errorsx.WithStack(fosite.ErrInactiveToken)
+	}
+	return fr, nil
+}
+
+// GetAccessTokenExpiry returns when the access token with the given signature
+// was issued, when it expires, and whether it is active, without loading and
+// decrypting its session. Unless the lifespan of the token was extended, the
+// expiry is computed from the configured access token lifespan, so per-client
+// lifespans are not taken into account.
+func (p *Persister) GetAccessTokenExpiry(ctx context.Context, signature string) (issuedAt time.Time, expiresAt time.Time, active bool, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetAccessTokenExpiry")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	row := p.tokenTable(ctx, sqlTableAccess)
+	if _, err := p.findAccessToken(ctx, row, signature, "requested_at", "active", "expires_at"); err != nil {
+		return time.Time{}, time.Time{}, false, err
+	}
+
+	if row.ExpiresAt.Valid {
+		return row.RequestedAt, row.ExpiresAt.Time, row.Active, nil
+	}
+	return row.RequestedAt, row.RequestedAt.Add(p.config.GetAccessTokenLifespan(ctx)), row.Active, nil
+}
+
+// GetAccessTokenIssuedAt returns when the access token with the given signature
+// was issued. Only requested_at is selected, so neither the session nor the
+// client are loaded. Inactive tokens are reported as well.
+func (p *Persister) GetAccessTokenIssuedAt(ctx context.Context, signature string) (_ time.Time, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetAccessTokenIssuedAt")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	row := p.tokenTable(ctx, sqlTableAccess)
+	if _, err := p.findAccessToken(ctx, row, signature, "requested_at"); err != nil {
+		return time.Time{}, err
+	}
+	return row.RequestedAt, nil
+}
+
+// ExtendAccessTokenLifespan changes the expiry of the active access token with
+// the given signature to newExpiry without reissuing it, e.g. for long-running
+// operations. The new expiry overrides the one stored in the session on every
+// read. It may not be in the past, nor exceed the configured maximum lifespan
+// measured from when the token was issued.
+func (p *Persister) ExtendAccessTokenLifespan(ctx context.Context, signature string, newExpiry time.Time) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ExtendAccessTokenLifespan")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	defer p.accessTokenCache.remove(accessTokenCacheKey(p.NetworkID(ctx), signature))
+
+	if newExpiry.Before(time.Now()) {
+		return errorsx.WithStack(fosite.ErrInvalidRequest.WithHint("The new expiry of the access token must not be in the past."))
+	}
+
+	table := p.tokenTable(ctx, sqlTableAccess).TableName()
+	var row struct {
+		Signature   string    `db:"signature"`
+		RequestedAt time.Time `db:"requested_at"`
+		Active      bool      `db:"active"`
+	}
+	// Tokens stored under a previous signature strategy are extended, too.
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err = p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT signature, requested_at, active FROM %s WHERE signature IN (?) AND nid = ?", table),
+		p.accessTokenSignatureCandidates(signature),
+		p.NetworkID(ctx),
+	).First(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errorsx.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return sqlcon.HandleError(err)
+	}
+	if !row.Active {
+		return errorsx.WithStack(fosite.ErrInactiveToken)
+	}
+	if maxLifespan := p.config.GetAccessTokenMaxExtendedLifespan(ctx); newExpiry.Sub(row.RequestedAt) > maxLifespan {
+		return errorsx.WithStack(fosite.ErrInvalidRequest.WithHintf("The lifespan of the access token may not be extended beyond %s.", maxLifespan))
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	return sqlcon.HandleError(p.Connection(ctx).RawQuery(
+		fmt.Sprintf("UPDATE %s SET expires_at = ? WHERE signature = ? AND nid = ?", table),
+		newExpiry.UTC(),
+		row.Signature,
+		p.NetworkID(ctx),
+	).Exec())
+}
+
+// GetLatestAccessTokenSession returns the most recently issued access token of
+// the subject and client, e.g. to show when the subject last signed in to the
+// client. It returns fosite.ErrNotFound if there is none. Access tokens which
+// were revoked or flushed are no longer known.
+func (p *Persister) GetLatestAccessTokenSession(ctx context.Context, subject, clientID string) (_ fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetLatestAccessTokenSession")
+	defer otelx.End(span, &err)
+
+	r := p.tokenTable(ctx, sqlTableAccess)
+	err = p.tokenQuery(ctx, sqlTableAccess).
+		Where("subject = ? AND "+p.clientIDCondition(ctx, "client_id"), subject, clientID).
+		Order("requested_at DESC").
+		First(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorsx.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	return r.toRequest(ctx, oauth2.NewSession(""), p)
 }
 
+// DeleteAccessTokenSession deletes the access token with the given signature and
+// emits an events.AccessTokenDeleted event. The requester is not loaded, so the
+// event only includes the client ID if the configuration asks to read it
+// beforehand.
 func (p *Persister) DeleteAccessTokenSession(ctx context.Context, signature string) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteAccessTokenSession")
 	defer otelx.End(span, &err)
-
-	err = sqlcon.HandleError(
-		p.QueryWithNetwork(ctx).
-			Where("signature = ?", SignatureHash(signature)).
-			Delete(&OAuth2RequestSQL{Table: sqlTableAccess}))
-	if errors.Is(err, sqlcon.ErrNoRows) {
-		// Backwards compatibility: we previously did not always hash the
-		// signature before inserting. In case there are still very old (but
-		// valid) access tokens in the database, this should get them.
-		err = sqlcon.HandleError(
-			p.QueryWithNetwork(ctx).
-				Where("signature = ?", signature).
-				Delete(&OAuth2RequestSQL{Table: sqlTableAccess}))
-		if errors.Is(err, sqlcon.ErrNoRows) {
-			return errorsx.WithStack(fosite.ErrNotFound)
+	signature = normalizeSignature(signature)
+	defer p.accessTokenCache.remove(accessTokenCacheKey(p.NetworkID(ctx), signature))
+
+	var eventOptions []trace.EventOption
+	if p.config.AccessTokenDeletionIncludeClientID(ctx) {
+		row := p.tokenTable(ctx, sqlTableAccess)
+		// Tokens which do not exist are reported as not found by the deletion.
+		if _, err := p.findAccessToken(ctx, row, signature, "client_id"); err == nil {
+			eventOptions = append(eventOptions, events.WithClientID(row.Client))
+		} else if !errors.Is(err, fosite.ErrNotFound) {
+			return err
 		}
 	}
-	if errors.Is(err, sqlcon.ErrConcurrentUpdate) {
-		return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+
+	deleteBySignature := func(signature string) error {
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		return handleDeleteError(
+			p.Connection(ctx).
+				RawQuery(
+					fmt.Sprintf("DELETE FROM %s WHERE signature = ? AND nid = ?", p.tokenTable(ctx, sqlTableAccess).TableName()),
+					signature,
+					p.NetworkID(ctx),
+				).
+				ExecWithCount(),
+		)
+	}
+
+	// Tokens stored under a previous signature strategy, e.g. the unhashed
+	// signatures of older versions, are deleted, too.
+	for _, strategy := range p.accessTokenSignatureStrategies() {
+		err = deleteBySignature(strategy.Derive(signature))
+		if errors.Is(err, fosite.ErrNotFound) {
+			continue
+		} else if err == nil {
+			x.AccessTokenDeletions.WithLabelValues(strategy.Name).Inc()
+			events.Trace(ctx, events.AccessTokenDeleted, eventOptions...)
+		}
+		return err
 	}
 	return err
 }
 
+// VerifyAccessTokenSignature reports whether an access token with the given raw
+// signature is stored, and whether it was found under the current signature
+// strategy, which hashes signatures by default, or under a previous one such as
+// the legacy, unhashed form. It is meant as a diagnostic aid.
+func (p *Persister) VerifyAccessTokenSignature(ctx context.Context, rawSignature string) (exists bool, hashed bool, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.VerifyAccessTokenSignature")
+	defer otelx.End(span, &err)
+	rawSignature = normalizeSignature(rawSignature)
+
+	for i, candidate := range p.accessTokenSignatureCandidates(rawSignature) {
+		exists, err = p.QueryWithNetwork(ctx).Where("signature = ?", candidate).Exists(p.tokenTable(ctx, sqlTableAccess))
+		if err != nil {
+			return false, false, sqlcon.HandleError(err)
+		} else if exists {
+			return true, i == 0, nil
+		}
+	}
+	return false, false, nil
+}
+
 func toEventOptions(requester fosite.Requester) []trace.EventOption {
 	sub := ""
 	if requester.GetSession() != nil {
 		hash := sha256.Sum256([]byte(requester.GetSession().GetSubject()))
 		sub = hex.EncodeToString(hash[:])
 	}
-	return []trace.EventOption{
+	opts := []trace.EventOption{
 		events.WithGrantType(requester.GetRequestForm().Get("grant_type")),
 		events.WithSubject(sub),
 		events.WithRequest(requester),
-		events.WithClientID(requester.GetClient().GetID()),
 	}
+	if client := requester.GetClient(); client != nil {
+		opts = append(opts, events.WithClientID(client.GetID()))
+	}
+	return opts
 }
 
 func (p *Persister) CreateRefreshTokenSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateRefreshTokenSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	if p.config.RefreshTokenRequireOfflineAccess(ctx) && !slices.Contains(requester.GetGrantedScopes(), "offline_access") {
+		return errorsx.WithStack(fosite.ErrInvalidScope.WithHint("Refresh tokens may only be issued if the 'offline_access' scope was granted."))
+	}
+	chainLength, err := p.nextRefreshTokenChainLength(ctx, requester.GetID())
+	if err != nil {
+		return err
+	}
 	events.Trace(ctx, events.RefreshTokenIssued, toEventOptions(requester)...)
-	return p.createSession(ctx, signature, requester, sqlTableRefresh)
+	if err := p.createSession(ctx, signature, requester, sqlTableRefresh); err != nil {
+		return err
+	}
+	if chainLength > 0 {
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("UPDATE %s SET chain_length = ? WHERE signature = ? AND nid = ?", p.tokenTable(ctx, sqlTableRefresh).TableName()),
+			chainLength,
+			signature,
+			p.NetworkID(ctx),
+		).Exec(); err != nil {
+			return sqlcon.HandleError(err)
+		}
+	}
+	return p.setRefreshTokenExpiry(ctx, signature, requester.GetID())
+}
+
+// nextRefreshTokenChainLength returns the chain length of a new refresh token
+// for requestID. Refreshing issues a new refresh token for the same request ID,
+// so the new token is one rotation further down the chain than the earlier
+// tokens of the request. It fails with *x.RefreshTokenChainLengthError if the
+// chain would grow beyond the configured maximum chain length.
+func (p *Persister) nextRefreshTokenChainLength(ctx context.Context, requestID string) (int, error) {
+	var row struct {
+		ChainLength int `db:"chain_length"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("SELECT chain_length FROM %s WHERE request_id = ? AND nid = ? ORDER BY chain_length DESC LIMIT 1", p.tokenTable(ctx, sqlTableRefresh).TableName()),
+			requestID,
+			p.NetworkID(ctx),
+		).
+		First(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, sqlcon.HandleError(err)
+	}
+	if limit := p.config.GetRefreshTokenMaxChainLength(ctx); limit > 0 && row.ChainLength >= limit {
+		return 0, errorsx.WithStack(&x.RefreshTokenChainLengthError{Limit: limit})
+	}
+	return row.ChainLength + 1, nil
+}
+
+// RotateRefreshToken atomically deactivates the refresh token oldSignature and
+// stores requester under newSignature, returning the requester of the old
+// refresh token for audit logging. The new refresh token is linked to the old
+// one through the request ID of requester, which also carries over its absolute
+// expiry. It fails with fosite.ErrNotFound or fosite.ErrInactiveToken if the
+// old refresh token does not exist or was already used, in which case nothing
+// is changed.
+//
+// The new refresh token is one rotation further down the chain than the old
+// one. If the chain would grow beyond the configured maximum chain length,
+// rotation fails with *x.RefreshTokenChainLengthError and nothing is changed.
+func (p *Persister) RotateRefreshToken(ctx context.Context, oldSignature, newSignature string, requester fosite.Requester) (old fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RotateRefreshToken")
+	defer otelx.End(span, &err)
+	oldSignature, newSignature = normalizeSignature(oldSignature), normalizeSignature(newSignature)
+
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		var err error
+		old, err = p.findSessionBySignature(ctx, oldSignature, oauth2.NewSession(""), sqlTableRefresh)
+		if err != nil {
+			return err
+		}
+		table := p.tokenTable(ctx, sqlTableRefresh).TableName()
+
+		// Guard on active to fail if a concurrent rotation won the race.
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		updated, err := c.RawQuery(
+			fmt.Sprintf("UPDATE %s SET active = false WHERE signature = ? AND nid = ? AND active = true", table),
+			oldSignature,
+			p.NetworkID(ctx),
+		).ExecWithCount()
+		if err != nil {
+			return sqlcon.HandleError(err)
+		} else if updated == 0 {
+			return errorsx.WithStack(fosite.ErrInactiveToken)
+		}
+
+		return p.CreateRefreshTokenSession(ctx, newSignature, requester)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+// setRefreshTokenExpiry stores the sliding and absolute expiry of a newly
+// created refresh token. Refreshing issues a new refresh token for the same
+// request ID, so the sliding expiry is extended on every use while the
+// absolute expiry is carried over from the earlier tokens of the chain.
+func (p *Persister) setRefreshTokenExpiry(ctx context.Context, signature, requestID string) error {
+	sliding := p.config.GetRefreshTokenSlidingLifespan(ctx)
+	absolute := p.config.GetRefreshTokenAbsoluteLifespan(ctx)
+	if sliding <= 0 && absolute <= 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	table := p.tokenTable(ctx, sqlTableRefresh).TableName()
+
+	var row struct {
+		AbsoluteExpiresAt sql.NullTime `db:"absolute_expires_at"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("SELECT absolute_expires_at FROM %s WHERE request_id = ? AND nid = ? AND signature <> ? AND absolute_expires_at IS NOT NULL ORDER BY absolute_expires_at LIMIT 1", table),
+			requestID,
+			p.NetworkID(ctx),
+			signature,
+		).
+		First(&row)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return sqlcon.HandleError(err)
+	}
+
+	absoluteExpiresAt := row.AbsoluteExpiresAt
+	if !absoluteExpiresAt.Valid && absolute > 0 {
+		absoluteExpiresAt = sql.NullTime{Time: now.Add(absolute), Valid: true}
+	}
+
+	var slidingExpiresAt sql.NullTime
+	if sliding > 0 {
+		slidingExpiresAt = sql.NullTime{Time: now.Add(sliding), Valid: true}
+		if absoluteExpiresAt.Valid && absoluteExpiresAt.Time.Before(slidingExpiresAt.Time) {
+			slidingExpiresAt.Time = absoluteExpiresAt.Time
+		}
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	return sqlcon.HandleError(
+		p.Connection(ctx).
+			RawQuery(
+				fmt.Sprintf("UPDATE %s SET sliding_expires_at = ?, absolute_expires_at = ? WHERE signature = ? AND nid = ?", table),
+				slidingExpiresAt,
+				absoluteExpiresAt,
+				signature,
+				p.NetworkID(ctx),
+			).
+			Exec(),
+	)
+}
+
+func (p *Persister) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetRefreshTokenSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	request, err = p.findSessionBySignature(ctx, signature, session, sqlTableRefresh)
+	if err != nil {
+		return request, err
+	}
+	if request, err = rejectIssuedBeforeCredentialRotation(request, nil); err != nil {
+		return nil, err
+	}
+
+	// Like setRefreshTokenExpiry, the expiry is only looked up while a
+	// lifespan is configured, so that refresh lookups do not pay for a
+	// second query when neither lifespan is in use.
+	if p.config.GetRefreshTokenSlidingLifespan(ctx) <= 0 && p.config.GetRefreshTokenAbsoluteLifespan(ctx) <= 0 {
+		return request, nil
+	}
+
+	var row struct {
+		SlidingExpiresAt  sql.NullTime `db:"sliding_expires_at"`
+		AbsoluteExpiresAt sql.NullTime `db:"absolute_expires_at"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err = p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("SELECT sliding_expires_at, absolute_expires_at FROM %s WHERE signature = ? AND nid = ?", p.tokenTable(ctx, sqlTableRefresh).TableName()),
+			signature,
+			p.NetworkID(ctx),
+		).
+		First(&row)
+	if err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	now := time.Now().UTC()
+	if (row.SlidingExpiresAt.Valid && now.After(row.SlidingExpiresAt.Time)) ||
+		(row.AbsoluteExpiresAt.Valid && now.After(row.AbsoluteExpiresAt.Time)) {
+		// Expired refresh tokens are reported as not found, which fosite turns into an invalid_grant error.
+		return nil, errorsx.WithStack(fosite.ErrNotFound.WithWrap(fosite.ErrTokenExpired).WithDebug("The refresh token has expired."))
+	}
+	return request, nil
+}
+
+func (p *Persister) DeleteRefreshTokenSession(ctx context.Context, signature string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteRefreshTokenSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	return p.deleteSessionBySignature(ctx, signature, sqlTableRefresh)
+}
+
+// GetActiveTokensByGrantedScope returns the active access and refresh tokens of
+// the client which were granted the given scope, e.g. to find all tokens
+// granting "admin" during incident response. Scopes are matched exactly, so
+// "admin" does not match a token which was only granted "admin:read".
+func (p *Persister) GetActiveTokensByGrantedScope(ctx context.Context, clientID, scope string) (_ []fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetActiveTokensByGrantedScope")
+	defer otelx.End(span, &err)
+
+	var requests []fosite.Requester
+	for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+		var rows []OAuth2RequestSQL
+		// The LIKE only narrows down the candidates, as the scope may be part
+		// of another scope or contain wildcards. Exact matching happens below.
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("SELECT %s FROM %s WHERE %s AND nid = ? AND active = true AND granted_scope LIKE ?", strings.Join(tokenColumns(table), ", "), p.tokenTable(ctx, table).TableName(), p.clientIDCondition(ctx, "client_id")),
+			clientID,
+			p.NetworkID(ctx),
+			"%"+scope+"%",
+		).All(&rows); err != nil {
+			return nil, sqlcon.HandleError(err)
+		}
+
+		rows = slices.DeleteFunc(rows, func(row OAuth2RequestSQL) bool {
+			return !slices.Contains(stringsx.Splitx(row.GrantedScope, "|"), scope)
+		})
+		listed, err := p.toListedRequests(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, listed...)
+	}
+	return requests, nil
+}
+
+// IsNonceUsed reports whether an OpenID Connect or authorize code session was
+// already stored for the client with the given nonce, e.g. to detect replays.
+// An empty nonce is never considered used.
+func (p *Persister) IsNonceUsed(ctx context.Context, clientID, nonce string) (_ bool, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.IsNonceUsed")
+	defer otelx.End(span, &err)
+
+	if err := p.requireSQLSessionBackend(sqlTableOpenID, sqlTableCode); err != nil {
+		return false, err
+	}
+
+	if nonce == "" {
+		return false, nil
+	}
+
+	for _, table := range []tableName{sqlTableOpenID, sqlTableCode} {
+		exists, err := p.QueryWithNetwork(ctx).
+			Where("client_id = ? AND nonce_hash = ?", clientID, nonceHash(nonce)).
+			Exists(p.tokenTable(ctx, table))
+		if err != nil {
+			return false, sqlcon.HandleError(err)
+		} else if exists {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// nonceHash hashes the nonce, which is stored and looked up by its hash only.
+func nonceHash(nonce string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(nonce)))
+}
+
+// GraceState is the state of a refresh token reported by
+// RefreshTokenGraceState.
+type GraceState string
+
+const (
+	// GraceStateActive is a refresh token which can be used.
+	GraceStateActive GraceState = "active"
+	// GraceStateGraced is a refresh token which was deactivated, e.g. by a
+	// rotation, but is still tolerated until its graced_until.
+	GraceStateGraced GraceState = "graced"
+	// GraceStateRevoked is a refresh token which was revoked or rotated, and
+	// whose grace period, if any, has passed.
+	GraceStateRevoked GraceState = "revoked"
+	// GraceStateNotFound is a refresh token which does not exist, e.g.
+	// because it was flushed.
+	GraceStateNotFound GraceState = "not_found"
+)
+
+// RefreshTokenGraceState returns the state of the refresh token with the given
+// signature, e.g. to tell a presented refresh token which was revoked apart
+// from one which is unknown when detecting refresh token theft. Inactive
+// refresh tokens are reported as graced as long as their graced_until lies in
+// the future.
+func (p *Persister) RefreshTokenGraceState(ctx context.Context, signature string) (_ GraceState, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RefreshTokenGraceState")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	var row struct {
+		Active      bool         `db:"active"`
+		GracedUntil sql.NullTime `db:"graced_until"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err = p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("SELECT active, graced_until FROM %s WHERE signature = ? AND nid = ?", p.tokenTable(ctx, sqlTableRefresh).TableName()),
+			signature,
+			p.NetworkID(ctx),
+		).
+		First(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GraceStateNotFound, nil
+	} else if err != nil {
+		return "", sqlcon.HandleError(err)
+	}
+
+	if row.Active {
+		return GraceStateActive, nil
+	} else if row.GracedUntil.Valid && time.Now().Before(row.GracedUntil.Time) {
+		return GraceStateGraced, nil
+	}
+	return GraceStateRevoked, nil
+}
+
+// InvalidateRefreshTokenBySignature deactivates the refresh token with the given
+// signature while keeping it for audit. Invalidating an already inactive refresh
+// token is a no-op. It returns fosite.ErrNotFound if there is no refresh token
+// with the given signature.
+func (p *Persister) InvalidateRefreshTokenBySignature(ctx context.Context, signature string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateRefreshTokenBySignature")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	table := p.tokenTable(ctx, sqlTableRefresh).TableName()
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	updated, err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("UPDATE %s SET active = false WHERE signature = ? AND nid = ? AND active = true", table),
+			signature,
+			p.NetworkID(ctx),
+		).
+		ExecWithCount()
+	if err != nil {
+		return sqlcon.HandleError(err)
+	} else if updated > 0 {
+		return nil
+	}
+
+	// Nothing was updated, either because the refresh token is already
+	// inactive or because it does not exist.
+	exists, err := p.QueryWithNetwork(ctx).Where("signature = ?", signature).Exists(p.tokenTable(ctx, sqlTableRefresh))
+	if err != nil {
+		return sqlcon.HandleError(err)
+	} else if !exists {
+		return errorsx.WithStack(fosite.ErrNotFound)
+	}
+	return nil
+}
+
+// IsAuthTimeWithin reports whether the end-user authentication behind the
+// refresh token with the given signature happened no longer than maxAge ago.
+// Tokens without a recorded auth_time are never considered to be within maxAge.
+func (p *Persister) IsAuthTimeWithin(ctx context.Context, signature string, maxAge time.Duration) (_ bool, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.IsAuthTimeWithin")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	r := p.tokenTable(ctx, sqlTableRefresh)
+	err = p.tokenQuery(ctx, sqlTableRefresh).Where("signature = ?", signature).First(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errorsx.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return false, sqlcon.HandleError(err)
+	}
+
+	if !r.AuthTime.Valid {
+		return false, nil
+	}
+	return time.Since(r.AuthTime.Time) <= maxAge, nil
+}
+
+// CheckIntrospectionAudience returns nil if the resource server may introspect
+// the access token with the given signature, which is the case if the token was
+// not bound to an introspection audience, or if the resource server is part of
+// it. Otherwise, it returns a *x.IntrospectionAudienceError.
+func (p *Persister) CheckIntrospectionAudience(ctx context.Context, signature, resourceServer string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CheckIntrospectionAudience")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	r := p.tokenTable(ctx, sqlTableAccess)
+	if _, err := p.findAccessToken(ctx, r, signature, "introspection_audience"); err != nil {
+		return err
+	}
+
+	if !r.IntrospectionAudience.Valid {
+		return nil
+	}
+	for _, aud := range stringsx.Splitx(r.IntrospectionAudience.String, "|") {
+		if aud == resourceServer {
+			return nil
+		}
+	}
+	return errorsx.WithStack(&x.IntrospectionAudienceError{ResourceServer: resourceServer})
+}
+
+func (p *Persister) CreateOpenIDConnectSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateOpenIDConnectSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	events.Trace(ctx, events.IdentityTokenIssued, toEventOptions(requester)...)
+	return p.createSession(ctx, signature, requester, sqlTableOpenID)
+}
+
+// UpdateOpenIDConnectSessionByRequestID updates an OpenID session by requestID.
+// It returns fosite.ErrNotFound if there is no OpenID session for requestID.
+// Updates erasing all previously granted scopes are rejected with an error
+// wrapping x.ErrGrantedScopeErasure, unless allowed by the configuration.
+func (p *Persister) UpdateOpenIDConnectSessionByRequestID(ctx context.Context, requestID string, requester fosite.Requester) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.UpdateOpenIDConnectSessionByRequestID")
+	defer otelx.End(span, &err)
+
+	req, err := p.sqlSchemaFromRequest(ctx, requestID, requester, sqlTableOpenID)
+	if err != nil {
+		return err
+	}
+
+	// Unless allowed, an update must not erase a non-empty grant. The guard is
+	// part of the statement, so that it holds under concurrent updates.
+	guard := req.GrantedScope == "" && !p.config.AllowGrantedScopeErasure(ctx)
+	condition := ""
+	if guard {
+		condition = " AND granted_scope = ''"
+	} else if req.GrantedScope == "" {
+		granted, err := p.QueryWithNetwork(ctx).Where("request_id = ? AND granted_scope <> ''", requestID).Exists(p.tokenTable(ctx, sqlTableOpenID))
+		if err != nil {
+			return sqlcon.HandleError(err)
+		}
+		if granted {
+			p.l.WithField("request_id", requestID).Warn("Erasing the granted scopes of an OpenID Connect session.")
+		}
+	}
+	// The previous grant is recorded for auditing, see GetPreviousOpenIDConnectGrant.
+	// MySQL applies assignments from left to right, so it has to be copied
+	// before the grant is overwritten.
+	stmt := fmt.Sprintf(
+		"UPDATE %s SET previous_granted_scope=granted_scope, previous_granted_audience=granted_audience, grant_updated_at=?, granted_scope=?, granted_audience=?, session_data=? WHERE request_id=? AND nid = ?%s",
+		p.tokenTable(ctx, sqlTableOpenID).TableName(),
+		condition,
+	)
+
+	/* #nosec G201 table and condition are static */
+	updated, err := p.Connection(ctx).RawQuery(stmt, time.Now().UTC().Round(time.Second), req.GrantedScope, req.GrantedAudience, req.Session, requestID, p.NetworkID(ctx)).ExecWithCount()
+	if err != nil {
+		return sqlcon.HandleError(err)
+	}
+	if updated == 0 {
+		// MySQL reports rows which already had the new values as unaffected,
+		// so check whether the session exists at all.
+		exists, err := p.QueryWithNetwork(ctx).Where("request_id = ?", requestID).Exists(p.tokenTable(ctx, sqlTableOpenID))
+		if err != nil {
+			return sqlcon.HandleError(err)
+		}
+		if !exists {
+			return errorsx.WithStack(fosite.ErrNotFound)
+		}
+		if guard {
+			granted, err := p.QueryWithNetwork(ctx).Where("request_id = ? AND granted_scope <> ''", requestID).Exists(p.tokenTable(ctx, sqlTableOpenID))
+			if err != nil {
+				return sqlcon.HandleError(err)
+			}
+			if granted {
+				return errorsx.WithStack(fosite.ErrServerError.WithWrap(x.ErrGrantedScopeErasure).WithDebugf("Refusing to erase the granted scopes of the OpenID Connect session of request %q.", requestID))
+			}
+		}
+	}
+
+	return nil
+}
+
+// UpsertOpenIDConnectSession updates the OpenID session of requestID like
+// UpdateOpenIDConnectSessionByRequestID, or creates it if there is none yet.
+// A created session is stored under requestID as its signature, so it can be
+// retrieved with GetOpenIDConnectSessionByRequestID.
+func (p *Persister) UpsertOpenIDConnectSession(ctx context.Context, requestID string, requester fosite.Requester) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.UpsertOpenIDConnectSession")
+	defer otelx.End(span, &err)
+
+	return p.Transaction(ctx, func(ctx context.Context, _ *pop.Connection) error {
+		err := p.UpdateOpenIDConnectSessionByRequestID(ctx, requestID, requester)
+		if !errors.Is(err, fosite.ErrNotFound) {
+			return err
+		}
+
+		err = p.createSession(ctx, normalizeSignature(requestID), requester, sqlTableOpenID)
+		var duplicate *x.DuplicateSignatureError
+		if errors.As(err, &duplicate) {
+			// A concurrent upsert created the session first. The failed insert
+			// aborts the transaction on PostgreSQL, so the caller has to retry.
+			return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+		}
+		return err
+	})
+}
+
+// OpenIDConnectGrantChange is the grant of an OpenID Connect session before it
+// was last replaced by UpdateOpenIDConnectSessionByRequestID.
+type OpenIDConnectGrantChange struct {
+	PreviousGrantedScope    []string
+	PreviousGrantedAudience []string
+	UpdatedAt               time.Time
+}
+
+// GetPreviousOpenIDConnectGrant returns the grant the OpenID Connect session of
+// the request had before its last update, e.g. to audit what changed on
+// re-consent. Only the last change is kept. It returns nil if the session was
+// never updated, and fosite.ErrNotFound if there is no session for requestID.
+func (p *Persister) GetPreviousOpenIDConnectGrant(ctx context.Context, requestID string) (_ *OpenIDConnectGrantChange, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetPreviousOpenIDConnectGrant")
+	defer otelx.End(span, &err)
+
+	var row struct {
+		GrantedScope    sql.NullString `db:"previous_granted_scope"`
+		GrantedAudience sql.NullString `db:"previous_granted_audience"`
+		UpdatedAt       sql.NullTime   `db:"grant_updated_at"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT previous_granted_scope, previous_granted_audience, grant_updated_at FROM %s WHERE request_id = ? AND nid = ?", p.tokenTable(ctx, sqlTableOpenID).TableName()),
+		requestID,
+		p.NetworkID(ctx),
+	).First(&row); errors.Is(err, sql.ErrNoRows) {
+		return nil, errorsx.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	if !row.UpdatedAt.Valid {
+		return nil, nil
+	}
+	return &OpenIDConnectGrantChange{
+		PreviousGrantedScope:    stringsx.Splitx(row.GrantedScope.String, "|"),
+		PreviousGrantedAudience: stringsx.Splitx(row.GrantedAudience.String, "|"),
+		UpdatedAt:               row.UpdatedAt.Time,
+	}, nil
+}
+
+// GetOpenIDConnectSessionByRequestID returns the OpenID session stored for
+// requestID, e.g. to verify the grant persisted by
+// UpdateOpenIDConnectSessionByRequestID.
+func (p *Persister) GetOpenIDConnectSessionByRequestID(ctx context.Context, requestID string, session fosite.Session) (_ fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetOpenIDConnectSessionByRequestID")
+	defer otelx.End(span, &err)
+	return p.findSessionByRequestID(ctx, requestID, session, sqlTableOpenID)
+}
+
+func (p *Persister) GetOpenIDConnectSession(ctx context.Context, signature string, requester fosite.Requester) (_ fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetOpenIDConnectSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	return p.findSessionBySignature(ctx, signature, requester.GetSession(), sqlTableOpenID)
+}
+
+func (p *Persister) DeleteOpenIDConnectSession(ctx context.Context, signature string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteOpenIDConnectSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	return p.deleteSessionBySignature(ctx, signature, sqlTableOpenID)
+}
+
+func (p *Persister) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (_ fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetPKCERequestSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	return p.findSessionBySignature(ctx, signature, session, sqlTablePKCE)
+}
+
+func (p *Persister) CreatePKCERequestSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreatePKCERequestSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	return p.createSession(ctx, signature, requester, sqlTablePKCE)
+}
+
+func (p *Persister) DeletePKCERequestSession(ctx context.Context, signature string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeletePKCERequestSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+	return p.deleteSessionBySignature(ctx, signature, sqlTablePKCE)
+}
+
+func (p *Persister) RevokeRefreshToken(ctx context.Context, id string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeRefreshToken")
+	defer otelx.End(span, &err)
+	return p.withOutbox(ctx, func(ctx context.Context) error {
+		if err := p.deactivateRefreshTokensByRequestID(ctx, id); err != nil {
+			return err
+		}
+		return p.writeOutboxEvent(ctx, OutboxEventTokenRevoked, sqlTableRefresh, id, "")
+	})
+}
+
+// ReduceRefreshTokenScope removes the given scopes from the granted scope of the
+// active refresh token issued for requestID, so that subsequent refreshes issue
+// access tokens with the reduced scope. If no granted scope would remain, the
+// refresh token is revoked instead. It returns fosite.ErrNotFound if there is no
+// active refresh token for requestID.
+func (p *Persister) ReduceRefreshTokenScope(ctx context.Context, requestID string, removeScopes []string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ReduceRefreshTokenScope")
+	defer otelx.End(span, &err)
+
+	table := p.tokenTable(ctx, sqlTableRefresh).TableName()
+	return p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		var rows []struct {
+			Signature    string `db:"signature"`
+			GrantedScope string `db:"granted_scope"`
+		}
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := c.RawQuery(
+			fmt.Sprintf("SELECT signature, granted_scope FROM %s WHERE request_id = ? AND nid = ? AND active = true", table),
+			requestID,
+			p.NetworkID(ctx),
+		).All(&rows); err != nil {
+			return sqlcon.HandleError(err)
+		}
+		if len(rows) == 0 {
+			return errorsx.WithStack(fosite.ErrNotFound)
+		}
+
+		for _, row := range rows {
+			var remaining []string
+			for _, scope := range stringsx.Splitx(row.GrantedScope, "|") {
+				if !slices.Contains(removeScopes, scope) {
+					remaining = append(remaining, scope)
+				}
+			}
+			if len(remaining) == 0 {
+				return p.deactivateSessionByRequestID(ctx, requestID, sqlTableRefresh)
+			}
+
+			/* #nosec G201 table name is validated by SetTokenTableNames */
+			if err := c.RawQuery(
+				fmt.Sprintf("UPDATE %s SET granted_scope = ? WHERE signature = ? AND nid = ?", table),
+				strings.Join(remaining, "|"),
+				row.Signature,
+				p.NetworkID(ctx),
+			).Exec(); err != nil {
+				return sqlcon.HandleError(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (p *Persister) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, id string, _ string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeRefreshTokenMaybeGracePeriod")
+	defer otelx.End(span, &err)
+	return p.withOutbox(ctx, func(ctx context.Context) error {
+		if err := p.deactivateRefreshTokensByRequestID(ctx, id); err != nil {
+			return err
+		}
+		return p.writeOutboxEvent(ctx, OutboxEventTokenRevoked, sqlTableRefresh, id, "")
+	})
+}
+
+func (p *Persister) RevokeAccessToken(ctx context.Context, id string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeAccessToken")
+	defer otelx.End(span, &err)
+	defer p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	return p.revokeAccessToken(ctx, id)
+}
+
+// revokeAccessToken revokes the access tokens of the request without evicting
+// them from the access token cache. Callers revoking within a transaction of
+// their own evict the request once the transaction was committed, as a
+// concurrent read could otherwise cache the token again before the commit.
+func (p *Persister) revokeAccessToken(ctx context.Context, id string) error {
+	return p.withOutbox(ctx, func(ctx context.Context) error {
+		// Requests without access tokens, e.g. because they were flushed, are
+		// revoked already.
+		if err := p.deleteSessionByRequestID(ctx, id, sqlTableAccess); err != nil && !errors.Is(err, fosite.ErrNotFound) {
+			return err
+		}
+		return p.writeOutboxEvent(ctx, OutboxEventTokenRevoked, sqlTableAccess, id, "")
+	})
+}
+
+// RevokeDeviceGrantedTokens revokes the access and refresh tokens of all
+// requests of the client which were granted through the device authorization
+// grant, including the tokens those requests obtained by refreshing.
+func (p *Persister) RevokeDeviceGrantedTokens(ctx context.Context, clientID string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeDeviceGrantedTokens")
+	defer otelx.End(span, &err)
+
+	var requestIDs []string
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+			var ids []string
+			/* #nosec G201 table name is validated by SetTokenTableNames */
+			if err := c.RawQuery(
+				fmt.Sprintf("SELECT DISTINCT request_id FROM %s WHERE %s AND grant_type = ? AND nid = ? AND active = true", p.tokenTable(ctx, table).TableName(), p.clientIDCondition(ctx, "client_id")),
+				clientID,
+				string(fosite.GrantTypeDeviceCode),
+				p.NetworkID(ctx),
+			).All(&ids); err != nil {
+				return sqlcon.HandleError(err)
+			}
+			requestIDs = append(requestIDs, ids...)
+		}
+
+		slices.Sort(requestIDs)
+		requestIDs = slices.Compact(requestIDs)
+		for _, id := range requestIDs {
+			if err := p.RevokeRefreshToken(ctx, id); err != nil {
+				return err
+			}
+			if err := p.revokeAccessToken(ctx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return nil
+}
+
+// CountTokensByGrantType returns how many tokens of the access or refresh table
+// were issued by each grant type, keyed by grant type. Tokens issued by the
+// refresh grant are counted under the grant they originate from, see
+// grantTypeOrigin. Tokens issued before the grant type was recorded have it
+// extracted from their form data instead, which holds the grant of the request
+// itself, and tokens without any grant type are counted under "".
+func (p *Persister) CountTokensByGrantType(ctx context.Context, table tableName) (_ map[string]int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CountTokensByGrantType")
+	defer otelx.End(span, &err)
+
+	if table != sqlTableAccess && table != sqlTableRefresh {
+		return nil, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Tokens of table %q have no grant type.", table))
+	}
+	t := p.tokenTable(ctx, table).TableName()
+
+	var rows []struct {
+		GrantType string `db:"grant_type"`
+		Count     int    `db:"count"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT grant_type, COUNT(*) AS count FROM %s WHERE grant_type IS NOT NULL AND nid = ? GROUP BY grant_type", t),
+		p.NetworkID(ctx),
+	).All(&rows); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.GrantType] = row.Count
+	}
+
+	var forms []string
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT form_data FROM %s WHERE grant_type IS NULL AND nid = ?", t),
+		p.NetworkID(ctx),
+	).All(&forms); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	for _, form := range forms {
+		// Forms which cannot be parsed are counted without grant type.
+		values, _ := url.ParseQuery(form)
+		counts[values.Get("grant_type")]++
+	}
+	return counts, nil
+}
+
+// GetTokensByDeviceChallenge returns the active access and refresh tokens which
+// were granted through the device challenge, including the tokens obtained by
+// refreshing them.
+func (p *Persister) GetTokensByDeviceChallenge(ctx context.Context, challenge string) (_ []fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetTokensByDeviceChallenge")
+	defer otelx.End(span, &err)
+
+	var requests []fosite.Requester
+	for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+		var rows []OAuth2RequestSQL
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("SELECT %s FROM %s WHERE device_challenge = ? AND nid = ? AND active = true", strings.Join(tokenColumns(table), ", "), p.tokenTable(ctx, table).TableName()),
+			challenge,
+			p.NetworkID(ctx),
+		).All(&rows); err != nil {
+			return nil, sqlcon.HandleError(err)
+		}
+
+		listed, err := p.toListedRequests(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, listed...)
+	}
+	return requests, nil
+}
+
+// RevokeTokensByDeviceChallenge revokes the access and refresh tokens of all
+// requests which were granted through the device challenge, e.g. when the
+// user reports the device as lost.
+func (p *Persister) RevokeTokensByDeviceChallenge(ctx context.Context, challenge string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeTokensByDeviceChallenge")
+	defer otelx.End(span, &err)
+
+	var requestIDs []string
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+			var ids []string
+			/* #nosec G201 table name is validated by SetTokenTableNames */
+			if err := c.RawQuery(
+				fmt.Sprintf("SELECT DISTINCT request_id FROM %s WHERE device_challenge = ? AND nid = ? AND active = true", p.tokenTable(ctx, table).TableName()),
+				challenge,
+				p.NetworkID(ctx),
+			).All(&ids); err != nil {
+				return sqlcon.HandleError(err)
+			}
+			requestIDs = append(requestIDs, ids...)
+		}
+
+		slices.Sort(requestIDs)
+		requestIDs = slices.Compact(requestIDs)
+		for _, id := range requestIDs {
+			if err := p.RevokeRefreshToken(ctx, id); err != nil {
+				return err
+			}
+			if err := p.revokeAccessToken(ctx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return nil
+}
+
+// RevokeTokensByAMR revokes the access and refresh tokens of all requests of
+// the client whose session was authenticated with the given method, e.g. after
+// the method was found to be insecure. The method is matched exactly against
+// the amr claim.
+func (p *Persister) RevokeTokensByAMR(ctx context.Context, clientID, method string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeTokensByAMR")
+	defer otelx.End(span, &err)
+
+	var requestIDs []string
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+			var rows []struct {
+				Request string `db:"request_id"`
+				AMR     string `db:"amr"`
+			}
+			// The LIKE only narrows down the candidates, as the method may
+			// contain wildcards. Exact matching happens below.
+			/* #nosec G201 table name is validated by SetTokenTableNames */
+			if err := c.RawQuery(
+				fmt.Sprintf("SELECT request_id, amr FROM %s WHERE %s AND nid = ? AND active = true AND amr LIKE ?", p.tokenTable(ctx, table).TableName(), p.clientIDCondition(ctx, "client_id")),
+				clientID,
+				p.NetworkID(ctx),
+				"%"+method+"%",
+			).All(&rows); err != nil {
+				return sqlcon.HandleError(err)
+			}
+
+			for _, row := range rows {
+				var methods []string
+				if err := json.Unmarshal([]byte(row.AMR), &methods); err != nil {
+					return errorsx.WithStack(err)
+				}
+				if slices.Contains(methods, method) {
+					requestIDs = append(requestIDs, row.Request)
+				}
+			}
+		}
+
+		slices.Sort(requestIDs)
+		requestIDs = slices.Compact(requestIDs)
+		for _, id := range requestIDs {
+			if err := p.RevokeRefreshToken(ctx, id); err != nil {
+				return err
+			}
+			if err := p.revokeAccessToken(ctx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return nil
+}
+
+// InvalidateAllTokensForClient deactivates all active access and refresh tokens
+// of the client in the current network at once, e.g. when the client was
+// compromised. Unlike revocation, the rows are kept for auditing. A revocation
+// event is written to the outbox for every affected token, in the same
+// transaction.
+func (p *Persister) InvalidateAllTokensForClient(ctx context.Context, clientID string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateAllTokensForClient")
+	defer otelx.End(span, &err)
+
+	var requestIDs []string
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+			name := p.tokenTable(ctx, table).TableName()
+			condition := p.clientIDCondition(ctx, "client_id") + " AND nid = ? AND active = true"
+
+			var ids []string
+			/* #nosec G201 table and condition are static */
+			if err := c.RawQuery(
+				fmt.Sprintf("SELECT request_id FROM %s WHERE %s", name, condition),
+				clientID,
+				p.NetworkID(ctx),
+			).All(&ids); err != nil {
+				return sqlcon.HandleError(err)
+			}
+
+			/* #nosec G201 table and condition are static */
+			if err := c.RawQuery(
+				fmt.Sprintf("UPDATE %s SET active = false WHERE %s", name, condition),
+				clientID,
+				p.NetworkID(ctx),
+			).Exec(); err != nil {
+				return sqlcon.HandleError(err)
+			}
+
+			for _, id := range ids {
+				if err := p.writeOutboxEvent(ctx, OutboxEventTokenRevoked, table, id, clientID); err != nil {
+					return err
+				}
+			}
+			requestIDs = append(requestIDs, ids...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return nil
+}
+
+// RevokeSessionForLogout revokes the access and refresh tokens and deletes the
+// OpenID Connect sessions which the client obtained for the subject within the
+// login session sid, e.g. on RP-initiated logout. All of them are revoked in a
+// single transaction, so that a failure leaves the login session untouched.
+func (p *Persister) RevokeSessionForLogout(ctx context.Context, subject, clientID, sid string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeSessionForLogout")
+	defer otelx.End(span, &err)
+	return p.revokeSessionsBySID(ctx, "sid = ? AND subject = ? AND "+p.clientIDCondition(ctx, "client_id"), sid, subject, clientID)
+}
+
+// RevokeSessionsBySID revokes the access and refresh tokens and deletes the
+// OpenID Connect sessions of all clients which were obtained within the login
+// session sid, e.g. on back-channel logout. Like RevokeSessionForLogout, all of
+// them are revoked in a single transaction.
+func (p *Persister) RevokeSessionsBySID(ctx context.Context, sid string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeSessionsBySID")
+	defer otelx.End(span, &err)
+	return p.revokeSessionsBySID(ctx, "sid = ?", sid)
+}
+
+// revokeSessionsBySID revokes the tokens and OpenID Connect sessions of all
+// requests whose sessions match the condition on the sid column.
+func (p *Persister) revokeSessionsBySID(ctx context.Context, condition string, args ...interface{}) error {
+	var requestIDs []string
+	err := p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		for _, table := range []tableName{sqlTableAccess, sqlTableRefresh, sqlTableOpenID} {
+			var ids []string
+			/* #nosec G201 table and condition are static */
+			if err := c.RawQuery(
+				fmt.Sprintf("SELECT DISTINCT request_id FROM %s WHERE %s AND nid = ?", p.tokenTable(ctx, table).TableName(), condition),
+				append(args, p.NetworkID(ctx))...,
+			).All(&ids); err != nil {
+				return sqlcon.HandleError(err)
+			}
+			requestIDs = append(requestIDs, ids...)
+		}
+
+		slices.Sort(requestIDs)
+		requestIDs = slices.Compact(requestIDs)
+		for _, id := range requestIDs {
+			if err := p.RevokeRefreshToken(ctx, id); err != nil {
+				return err
+			}
+			if err := p.revokeAccessToken(ctx, id); err != nil {
+				return err
+			}
+			if err := p.deleteSessionByRequestID(ctx, id, sqlTableOpenID); err != nil && !errors.Is(err, fosite.ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return nil
+}
+
+// RelinkSessionsConsentChallenge links the sessions of all token tables which
+// were issued from the old consent challenge to the new one, e.g. after the
+// user consented again, so that revoking the new consent also revokes them.
+// It returns how many sessions were relinked, and fosite.ErrNotFound if the
+// network has no flow with the new consent challenge.
+func (p *Persister) RelinkSessionsConsentChallenge(ctx context.Context, oldChallenge, newChallenge string) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RelinkSessionsConsentChallenge")
+	defer otelx.End(span, &err)
+
+	if err := p.requireSQLSessionBackend(tokenTables...); err != nil {
+		return 0, err
+	}
+	defer p.accessTokenCache.removeConsentChallenge(p.NetworkID(ctx), oldChallenge)
+
+	var relinked int
+	if err := p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		// The foreign key rejects unknown challenges, but not the challenges
+		// of other networks.
+		var flows int
+		/* #nosec G201 table is static */
+		if err := c.RawQuery(
+			fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE consent_challenge_id = ? AND nid = ?", (&flow.Flow{}).TableName()),
+			newChallenge,
+			p.NetworkID(ctx),
+		).First(&flows); err != nil {
+			return sqlcon.HandleError(err)
+		}
+		if flows == 0 {
+			return errorsx.WithStack(fosite.ErrNotFound.WithDebugf("The consent challenge %q does not exist.", newChallenge))
+		}
+
+		for _, table := range tokenTables {
+			/* #nosec G201 table name is validated by SetTokenTableNames */
+			n, err := c.RawQuery(
+				fmt.Sprintf("UPDATE %s SET challenge_id = ? WHERE challenge_id = ? AND nid = ?", p.tokenTable(ctx, table).TableName()),
+				newChallenge,
+				oldChallenge,
+				p.NetworkID(ctx),
+			).ExecWithCount()
+			if err != nil {
+				return sqlcon.HandleError(err)
+			}
+			relinked += n
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return relinked, nil
+}
+
+// TokenConsistencyReport lists the token families of a client whose access and
+// refresh tokens contradict each other, see ReconcileTokenConsistency.
+type TokenConsistencyReport struct {
+	ClientID string
+	// RefreshWithoutAccess are the request IDs with an active refresh token
+	// but no access token at all. Besides data corruption, flushing expired
+	// access tokens while their refresh token is still valid leads to this.
+	RefreshWithoutAccess []string
+	// AccessWithRevokedRefresh are the request IDs with an active access
+	// token whose refresh tokens are all inactive. Revoking or rotating a
+	// refresh token always revokes the access tokens of its family.
+	AccessWithRevokedRefresh []string
+}
+
+// Consistent reports whether no mismatches were found.
+func (r *TokenConsistencyReport) Consistent() bool {
+	return len(r.RefreshWithoutAccess) == 0 && len(r.AccessWithRevokedRefresh) == 0
+}
+
+// ReconcileTokenConsistency cross-checks the request IDs of the client's access
+// and refresh tokens and reports orphaned and mismatched token families. It is
+// a read-only diagnostic and does not repair anything.
+func (p *Persister) ReconcileTokenConsistency(ctx context.Context, clientID string) (_ *TokenConsistencyReport, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ReconcileTokenConsistency")
+	defer otelx.End(span, &err)
+
+	access := p.tokenTable(ctx, sqlTableAccess).TableName()
+	refresh := p.tokenTable(ctx, sqlTableRefresh).TableName()
+	report := &TokenConsistencyReport{ClientID: clientID}
+
+	/* #nosec G201 tables are static */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf(`SELECT DISTINCT r.request_id FROM %s r
+			WHERE %s AND r.nid = ? AND r.active = true
+			AND NOT EXISTS (SELECT 1 FROM %s a WHERE a.request_id = r.request_id AND a.nid = r.nid)
+			ORDER BY r.request_id`, refresh, p.clientIDCondition(ctx, "r.client_id"), access),
+		clientID,
+		p.NetworkID(ctx),
+	).All(&report.RefreshWithoutAccess); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	/* #nosec G201 tables are static */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf(`SELECT DISTINCT a.request_id FROM %s a
+			WHERE %s AND a.nid = ? AND a.active = true
+			AND EXISTS (SELECT 1 FROM %s r WHERE r.request_id = a.request_id AND r.nid = a.nid)
+			AND NOT EXISTS (SELECT 1 FROM %s r WHERE r.request_id = a.request_id AND r.nid = a.nid AND r.active = true)
+			ORDER BY a.request_id`, access, p.clientIDCondition(ctx, "a.client_id"), refresh, refresh),
+		clientID,
+		p.NetworkID(ctx),
+	).All(&report.AccessWithRevokedRefresh); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+
+	return report, nil
+}
+
+func (p *Persister) flushInactiveTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int, table tableName, lifespan time.Duration) (res x.FlushResult, err error) {
+	return p.flushInactiveTokensWhere(ctx, notAfter, limit, batchSize, table, lifespan, "1=1")
+}
+
+// flushInactiveTokensWhere flushes inactive tokens matching the additional,
+// static SQL condition.
+func (p *Persister) flushInactiveTokensWhere(ctx context.Context, notAfter time.Time, limit int, batchSize int, table tableName, lifespan time.Duration, condition string) (res x.FlushResult, err error) {
+	if err := p.checkFlushIndex(ctx, table); err != nil {
+		return res, err
+	}
+
+	minAge := p.config.DbFlushMinAge(ctx)
+	condition, conditionArgs := flushExpiryCondition(condition, notAfter, flushCutoff(notAfter, lifespan, minAge))
+	notAfter = flushCutoff(notAfter, 0, minAge)
+
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+
+	var deadline time.Time
+	if budget := p.config.DbFlushTimeBudget(ctx); budget > 0 {
+		deadline = start.Add(budget)
+	}
+
+	// Larger batches run as more batches of the maximum size instead. The
+	// batch time budget never grows batches beyond it either.
+	if maxBatchSize := p.config.DbFlushMaxBatchSize(ctx); maxBatchSize > 0 && batchSize > maxBatchSize {
+		batchSize = maxBatchSize
+	}
+
+	batchBudget := p.config.DbFlushBatchTimeBudget(ctx)
+	currentBatchSize := batchSize
+
+	totalDeletedCount := 0
+	for full := true; totalDeletedCount < limit && full; {
+		if !deadline.IsZero() && totalDeletedCount > 0 && time.Now().After(deadline) {
+			p.l.Debugf("Flush %s tokens stopped after exhausting its time budget, flushed_records: %d", table, totalDeletedCount)
+			res.StoppedReason = x.FlushStoppedDeadline
+			return res, nil
+		}
+
+		d := currentBatchSize
+		if limit-totalDeletedCount < d {
+			d = limit - totalDeletedCount
+		}
+		batchStart := time.Now()
+		var deletedRecords int
+		if p.flushArchiveSink != nil {
+			deletedRecords, err = p.flushArchivedBatch(ctx, table, condition, conditionArgs, notAfter, d)
+		} else {
+			// Delete in batches
+			// The outer SELECT is necessary because our version of MySQL doesn't yet support 'LIMIT & IN/ALL/ANY/SOME subquery
+			deletedRecords, err = p.execBulkStatement(ctx, p.FlushConnection(ctx), func(c *pop.Connection) (int, error) {
+				return c.RawQuery(
+					fmt.Sprintf(`DELETE FROM %s WHERE signature in (
+						SELECT signature FROM (SELECT signature FROM %s hoa WHERE requested_at < ? and nid = ? AND (%s) ORDER BY requested_at LIMIT %d ) as s
+					)`, p.tokenTable(ctx, table).TableName(), p.tokenTable(ctx, table).TableName(), condition, d),
+					append([]interface{}{notAfter, p.NetworkID(ctx)}, conditionArgs...)...,
+				).ExecWithCount()
+			})
+		}
+		totalDeletedCount += deletedRecords
+		res.Deleted = totalDeletedCount
+		res.Batches++
+
+		if err != nil {
+			break
+		}
+		full = deletedRecords == d
+		if batchBudget > 0 {
+			currentBatchSize = adaptFlushBatchSize(currentBatchSize, batchSize, time.Since(batchStart), batchBudget)
+		}
+		p.l.Debugf("Flushing tokens...: %d/%d", totalDeletedCount, limit)
+	}
+	p.l.Debugf("Flush Refresh Tokens flushed_records: %d", totalDeletedCount)
+	if err != nil {
+		return res, sqlcon.HandleError(err)
+	}
+
+	res.StoppedReason = x.FlushStoppedDrained
+	if totalDeletedCount >= limit {
+		res.StoppedReason = x.FlushStoppedLimit
+	}
+	if threshold := p.config.DbFlushMaintenanceThreshold(ctx); threshold > 0 && totalDeletedCount >= threshold {
+		p.maintainFlushedTable(ctx, table)
+	}
+	return res, nil
+}
+
+// adaptFlushBatchSize returns the size of the next flush batch, given that the
+// previous batch of the current size took elapsed. Batches exceeding the budget
+// are shrunk proportionally, down to a single row, and batches taking less than
+// half of it are doubled, up to the requested batch size.
+func adaptFlushBatchSize(current, requested int, elapsed, budget time.Duration) int {
+	switch {
+	case elapsed > budget:
+		next := int(float64(current) * float64(budget) / float64(elapsed))
+		return max(next, 1)
+	case elapsed < budget/2:
+		return min(current*2, requested)
+	default:
+		return current
+	}
+}
+
+// flushMaintenanceStatements returns the statements which reclaim the space of
+// rows deleted from the table on the dialect. VACUUM does not lock out reads
+// and writes on PostgreSQL, and only releases free pages on SQLite databases
+// with incremental auto-vacuum. MySQL reclaims space on its own.
+func flushMaintenanceStatements(dialect, table string) []string {
+	switch dialect {
+	case "postgres":
+		return []string{"VACUUM (ANALYZE) " + table}
+	case "cockroach":
+		return []string{"ANALYZE " + table}
+	case "sqlite3":
+		return []string{"PRAGMA incremental_vacuum", "ANALYZE " + table}
+	default:
+		return nil
+	}
 }
 
-func (p *Persister) GetRefreshTokenSession(ctx context.Context, signature string, session fosite.Session) (request fosite.Requester, err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetRefreshTokenSession")
-	defer otelx.End(span, &err)
-	return p.findSessionBySignature(ctx, signature, session, sqlTableRefresh)
+// maintainFlushedTable vacuums and analyzes the table after a large flush.
+// Failures are only logged, as the flush itself succeeded. Within a transaction
+// nothing is done, because VACUUM cannot run inside one.
+func (p *Persister) maintainFlushedTable(ctx context.Context, table tableName) {
+	c := p.FlushConnection(ctx)
+	if c.TX != nil {
+		return
+	}
+	for _, stmt := range flushMaintenanceStatements(c.Dialect.Name(), p.tokenTable(ctx, table).TableName()) {
+		if err := c.RawQuery(stmt).Exec(); err != nil {
+			p.l.WithError(err).WithField("statement", stmt).Warn("Unable to reclaim the space of flushed tokens.")
+			return
+		}
+	}
 }
 
-func (p *Persister) DeleteRefreshTokenSession(ctx context.Context, signature string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteRefreshTokenSession")
-	defer otelx.End(span, &err)
-	return p.deleteSessionBySignature(ctx, signature, sqlTableRefresh)
+// flushExpiryCondition extends the flush condition so that tokens with a
+// stored expiry, because their lifespan was extended or frozen at issuance, are
+// flushed once that expiry has passed notAfter, regardless of the configured
+// lifespan. All other tokens are flushed once they were requested before
+// lifespanCutoff.
+func flushExpiryCondition(condition string, notAfter, lifespanCutoff time.Time) (string, []interface{}) {
+	return fmt.Sprintf("(%s) AND ((expires_at IS NULL AND requested_at < ?) OR expires_at < ?)", condition), []interface{}{lifespanCutoff, notAfter}
 }
 
-func (p *Persister) CreateOpenIDConnectSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateOpenIDConnectSession")
-	defer otelx.End(span, &err)
-	events.Trace(ctx, events.IdentityTokenIssued, toEventOptions(requester)...)
-	return p.createSession(ctx, signature, requester, sqlTableOpenID)
+// flushCutoff returns the requested_at before which tokens are flushed. Tokens
+// younger than minAge are never flushed, whatever notAfter is.
+func flushCutoff(notAfter time.Time, lifespan, minAge time.Duration) time.Time {
+	// The value of notAfter should be the minimum between input parameter and token max expire based on its configured age
+	requestMaxExpire := time.Now().Add(-lifespan)
+	if requestMaxExpire.Before(notAfter) {
+		notAfter = requestMaxExpire
+	}
+	if minAge > 0 {
+		if floor := time.Now().Add(-minAge); floor.Before(notAfter) {
+			notAfter = floor
+		}
+	}
+	return notAfter
 }
 
-// UpdateOpenIDConnectSessionByRequestID updates an OpenID session by requestID
-func (p *Persister) UpdateOpenIDConnectSessionByRequestID(ctx context.Context, requestID string, requester fosite.Requester) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.UpdateOpenIDConnectSessionByRequestID")
+// FlushPreviewByClient returns how many tokens of the table each client has
+// that a flush with the given notAfter would delete, keyed by client ID. It
+// applies the same selection as FlushInactiveAccessTokens and
+// FlushInactiveRefreshTokens, but deletes nothing. Only the access and refresh
+// tables can be flushed.
+func (p *Persister) FlushPreviewByClient(ctx context.Context, table tableName, notAfter time.Time) (_ map[string]int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushPreviewByClient")
 	defer otelx.End(span, &err)
 
-	req, err := p.sqlSchemaFromRequest(ctx, requestID, requester, sqlTableOpenID)
-	if err != nil {
-		return err
+	var lifespan time.Duration
+	switch table {
+	case sqlTableAccess:
+		lifespan = p.config.GetAccessTokenLifespan(ctx)
+	case sqlTableRefresh:
+		lifespan = p.config.GetRefreshTokenLifespan(ctx)
+	default:
+		return nil, errors.Errorf("tokens of table %q are not flushed", table)
 	}
 
-	stmt := fmt.Sprintf(
-		"UPDATE %s SET granted_scope=?, granted_audience=?, session_data=? WHERE request_id=? AND nid = ?",
-		OAuth2RequestSQL{Table: sqlTableOpenID}.TableName(),
-	)
-
-	/* #nosec G201 table is static */
-	err = p.Connection(ctx).RawQuery(stmt, req.GrantedScope, req.GrantedAudience, req.Session, requestID, p.NetworkID(ctx)).Exec()
-	if err != nil {
-		return sqlcon.HandleError(err)
+	var rows []struct {
+		ClientID string `db:"client_id"`
+		Count    int    `db:"count"`
+	}
+	minAge := p.config.DbFlushMinAge(ctx)
+	condition, conditionArgs := flushExpiryCondition("1=1", notAfter, flushCutoff(notAfter, lifespan, minAge))
+	/* #nosec G201 table and condition are static */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT client_id, COUNT(*) AS count FROM %s WHERE requested_at < ? AND nid = ? AND (%s) GROUP BY client_id", p.tokenTable(ctx, table).TableName(), condition),
+		append([]interface{}{flushCutoff(notAfter, 0, minAge), p.NetworkID(ctx)}, conditionArgs...)...,
+	).All(&rows); err != nil {
+		return nil, sqlcon.HandleError(err)
 	}
 
-	return nil
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.ClientID] = row.Count
+	}
+	return counts, nil
 }
 
-func (p *Persister) GetOpenIDConnectSession(ctx context.Context, signature string, requester fosite.Requester) (_ fosite.Requester, err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetOpenIDConnectSession")
+func (p *Persister) FlushInactiveAccessTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) (_ x.FlushResult, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushInactiveAccessTokens")
 	defer otelx.End(span, &err)
-	return p.findSessionBySignature(ctx, signature, requester.GetSession(), sqlTableOpenID)
+	return p.flushInactiveTokens(ctx, notAfter, limit, batchSize, sqlTableAccess, p.config.GetAccessTokenLifespan(ctx))
 }
 
-func (p *Persister) DeleteOpenIDConnectSession(ctx context.Context, signature string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteOpenIDConnectSession")
+// FlushInactiveAccessTokensParallel flushes inactive access tokens in shards
+// which are partitioned by the first character of the signature. At most
+// maxConcurrency shards are flushed at the same time, and each shard deletes up
+// to limitPerShard tokens. It returns the total number of deleted tokens.
+func (p *Persister) FlushInactiveAccessTokensParallel(ctx context.Context, notAfter time.Time, limitPerShard, batchSize, shards, maxConcurrency int) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushInactiveAccessTokensParallel")
 	defer otelx.End(span, &err)
-	return p.deleteSessionBySignature(ctx, signature, sqlTableOpenID)
+
+	lifespan := p.config.GetAccessTokenLifespan(ctx)
+	return runShardFlushes(ctx, shards, maxConcurrency, func(ctx context.Context, shard, shards int) (int, error) {
+		res, err := p.flushInactiveTokensWhere(ctx, notAfter, limitPerShard, batchSize, sqlTableAccess, lifespan, signatureShardCondition(shard, shards))
+		return res.Deleted, err
+	})
 }
 
-func (p *Persister) GetPKCERequestSession(ctx context.Context, signature string, session fosite.Session) (_ fosite.Requester, err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetPKCERequestSession")
-	defer otelx.End(span, &err)
-	return p.findSessionBySignature(ctx, signature, session, sqlTablePKCE)
+// signatureShardAlphabet holds the characters of hashed signatures.
+const signatureShardAlphabet = "0123456789abcdef"
+
+// maxSignatureShards is the maximum number of shards signatures can be
+// partitioned in, one per character of signatureShardAlphabet.
+const maxSignatureShards = len(signatureShardAlphabet)
+
+// signatureShardCondition returns the SQL condition selecting the signatures
+// of the given shard. Characters of signatureShardAlphabet are distributed
+// round-robin over the shards. Signatures starting with any other character
+// (e.g. legacy, unhashed signatures) belong to the first shard. Because the
+// conditions only compare for equality, every signature matches exactly one
+// shard regardless of the collation of the database.
+func signatureShardCondition(shard, shards int) string {
+	var own, all []string
+	for i, c := range signatureShardAlphabet {
+		quoted := "'" + string(c) + "'"
+		all = append(all, quoted)
+		if i%shards == shard {
+			own = append(own, quoted)
+		}
+	}
+
+	condition := fmt.Sprintf("SUBSTR(signature, 1, 1) IN (%s)", strings.Join(own, ", "))
+	if shard == 0 {
+		condition += fmt.Sprintf(" OR SUBSTR(signature, 1, 1) NOT IN (%s)", strings.Join(all, ", "))
+	}
+	return condition
 }
 
-func (p *Persister) CreatePKCERequestSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreatePKCERequestSession")
-	defer otelx.End(span, &err)
-	return p.createSession(ctx, signature, requester, sqlTablePKCE)
+// runShardFlushes runs flush once for every shard, with at most
+// maxConcurrency shards running at the same time, and sums up the number of
+// deleted records. The number of shards is clamped to [1, maxSignatureShards].
+func runShardFlushes(ctx context.Context, shards, maxConcurrency int, flush func(ctx context.Context, shard, shards int) (int, error)) (int, error) {
+	shards = max(1, min(shards, maxSignatureShards))
+	maxConcurrency = max(1, maxConcurrency)
+
+	var deleted atomic.Int64
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxConcurrency)
+	for shard := 0; shard < shards; shard++ {
+		shard := shard
+		eg.Go(func() error {
+			n, err := flush(ctx, shard, shards)
+			deleted.Add(int64(n))
+			return err
+		})
+	}
+
+	err := eg.Wait()
+	return int(deleted.Load()), err
 }
 
-func (p *Persister) DeletePKCERequestSession(ctx context.Context, signature string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeletePKCERequestSession")
+func (p *Persister) FlushInactiveRefreshTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) (_ x.FlushResult, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushInactiveRefreshTokens")
 	defer otelx.End(span, &err)
-	return p.deleteSessionBySignature(ctx, signature, sqlTablePKCE)
+	return p.flushInactiveTokens(ctx, notAfter, limit, batchSize, sqlTableRefresh, p.config.GetRefreshTokenLifespan(ctx))
 }
 
-func (p *Persister) RevokeRefreshToken(ctx context.Context, id string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeRefreshToken")
+// ListNetworksWithTokens returns the networks which have sessions stored in
+// any of the token tables, e.g. so that maintenance jobs can flush each of
+// them. Unlike most methods, it is not limited to the network of the context.
+func (p *Persister) ListNetworksWithTokens(ctx context.Context) (_ []uuid.UUID, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ListNetworksWithTokens")
 	defer otelx.End(span, &err)
-	return p.deactivateSessionByRequestID(ctx, id, sqlTableRefresh)
+
+	if err := p.requireSQLSessionBackend(tokenTables...); err != nil {
+		return nil, err
+	}
+
+	queries := make([]string, len(tokenTables))
+	for i, table := range tokenTables {
+		queries[i] = "SELECT nid FROM " + p.tokenTable(ctx, table).TableName()
+	}
+
+	var nids []uuid.UUID
+	/* #nosec G202 tables are static */
+	if err := p.Connection(ctx).RawQuery(strings.Join(queries, " UNION ") + " ORDER BY nid").All(&nids); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return nids, nil
 }
 
-func (p *Persister) RevokeRefreshTokenMaybeGracePeriod(ctx context.Context, id string, _ string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeRefreshTokenMaybeGracePeriod")
-	defer otelx.End(span, &err)
-	return p.deactivateSessionByRequestID(ctx, id, sqlTableRefresh)
+// refreshTokenGrantTypes are the grants which issue a refresh token together
+// with the access token if the offline scope was granted.
+var refreshTokenGrantTypes = []string{
+	string(fosite.GrantTypeAuthorizationCode),
+	string(fosite.GrantTypeDeviceCode),
+	string(fosite.GrantTypePassword),
 }
 
-func (p *Persister) RevokeAccessToken(ctx context.Context, id string) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.RevokeAccessToken")
+// refreshTokenScopes are the scopes which make these grants issue a refresh
+// token, see fositex.Config.GetRefreshTokenScopes.
+var refreshTokenScopes = []string{"offline", "offline_access"}
+
+// CleanupOrphanedGrantSessions deletes access tokens older than olderThan whose
+// refresh token is missing although the grant should have issued one, e.g.
+// because the process crashed between storing the access and the refresh
+// token. It returns the number of deleted access tokens.
+//
+// Only the access token side is cleaned up: access tokens are stored before
+// refresh tokens, and a refresh token without access token is legitimate once
+// the access token was flushed or revoked. Tokens whose grant is unknown are
+// never considered orphaned.
+func (p *Persister) CleanupOrphanedGrantSessions(ctx context.Context, olderThan time.Duration) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CleanupOrphanedGrantSessions")
 	defer otelx.End(span, &err)
-	return p.deleteSessionByRequestID(ctx, id, sqlTableAccess)
-}
 
-func (p *Persister) flushInactiveTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int, table tableName, lifespan time.Duration) (err error) {
-	/* #nosec G201 table is static */
-	// The value of notAfter should be the minimum between input parameter and token max expire based on its configured age
-	requestMaxExpire := time.Now().Add(-lifespan)
-	if requestMaxExpire.Before(notAfter) {
-		notAfter = requestMaxExpire
-	}
+	var deleted int
+	var requestIDs []string
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		var rows []struct {
+			Signature    string `db:"signature"`
+			Request      string `db:"request_id"`
+			GrantedScope string `db:"granted_scope"`
+		}
+		/* #nosec G201 tables are static */
+		if err := c.RawQuery(
+			fmt.Sprintf(`SELECT signature, request_id, granted_scope FROM %s a
+				WHERE a.nid = ? AND a.requested_at < ? AND a.grant_type IN (?) AND a.granted_scope LIKE ?
+				AND NOT EXISTS (SELECT 1 FROM %s r WHERE r.request_id = a.request_id AND r.nid = a.nid)`,
+				p.tokenTable(ctx, sqlTableAccess).TableName(),
+				p.tokenTable(ctx, sqlTableRefresh).TableName(),
+			),
+			p.NetworkID(ctx),
+			time.Now().UTC().Add(-olderThan),
+			refreshTokenGrantTypes,
+			"%offline%",
+		).All(&rows); err != nil {
+			return sqlcon.HandleError(err)
+		}
 
-	totalDeletedCount := 0
-	for deletedRecords := batchSize; totalDeletedCount < limit && deletedRecords == batchSize; {
-		d := batchSize
-		if limit-totalDeletedCount < batchSize {
-			d = limit - totalDeletedCount
+		// The LIKE condition also matches scopes such as "offline.read", so
+		// the granted scopes are checked exactly here.
+		var signatures []string
+		for _, row := range rows {
+			for _, scope := range stringsx.Splitx(row.GrantedScope, "|") {
+				if slices.Contains(refreshTokenScopes, scope) {
+					signatures = append(signatures, row.Signature)
+					requestIDs = append(requestIDs, row.Request)
+					break
+				}
+			}
 		}
-		// Delete in batches
-		// The outer SELECT is necessary because our version of MySQL doesn't yet support 'LIMIT & IN/ALL/ANY/SOME subquery
-		deletedRecords, err = p.Connection(ctx).RawQuery(
-			fmt.Sprintf(`DELETE FROM %s WHERE signature in (
-				SELECT signature FROM (SELECT signature FROM %s hoa WHERE requested_at < ? and nid = ? ORDER BY requested_at LIMIT %d ) as s
-			)`, OAuth2RequestSQL{Table: table}.TableName(), OAuth2RequestSQL{Table: table}.TableName(), d),
-			notAfter,
+		if len(signatures) == 0 {
+			return nil
+		}
+
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		n, err := c.RawQuery(
+			fmt.Sprintf("DELETE FROM %s WHERE signature IN (?) AND nid = ?", p.tokenTable(ctx, sqlTableAccess).TableName()),
+			signatures,
 			p.NetworkID(ctx),
 		).ExecWithCount()
-		totalDeletedCount += deletedRecords
-
 		if err != nil {
-			break
+			return sqlcon.HandleError(err)
 		}
-		p.l.Debugf("Flushing tokens...: %d/%d", totalDeletedCount, limit)
+		deleted = n
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	p.l.Debugf("Flush Refresh Tokens flushed_records: %d", totalDeletedCount)
-	return sqlcon.HandleError(err)
-}
-
-func (p *Persister) FlushInactiveAccessTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushInactiveAccessTokens")
-	defer otelx.End(span, &err)
-	return p.flushInactiveTokens(ctx, notAfter, limit, batchSize, sqlTableAccess, p.config.GetAccessTokenLifespan(ctx))
-}
 
-func (p *Persister) FlushInactiveRefreshTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) (err error) {
-	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlushInactiveRefreshTokens")
-	defer otelx.End(span, &err)
-	return p.flushInactiveTokens(ctx, notAfter, limit, batchSize, sqlTableRefresh, p.config.GetRefreshTokenLifespan(ctx))
+	for _, id := range requestIDs {
+		p.accessTokenCache.removeRequest(p.NetworkID(ctx), id)
+	}
+	return deleted, nil
 }
 
 func (p *Persister) DeleteAccessTokens(ctx context.Context, clientID string) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteAccessTokens")
 	defer otelx.End(span, &err)
-	/* #nosec G201 table is static */
+	defer p.accessTokenCache.removeNetwork(p.NetworkID(ctx))
+
+	if p.Connection(ctx).Dialect.Name() == "postgres" {
+		_, err := p.deleteAccessTokensByCTID(ctx, clientID, deleteAccessTokensBatchSize)
+		return err
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
 	return sqlcon.HandleError(
-		p.QueryWithNetwork(ctx).Where("client_id=?", clientID).Delete(&OAuth2RequestSQL{Table: sqlTableAccess}),
+		p.QueryWithNetwork(ctx).Where(p.clientIDCondition(ctx, "client_id"), clientID).Delete(p.tokenTable(ctx, sqlTableAccess)),
 	)
 }
 
+// deleteAccessTokensBatchSize is the number of rows deleted per statement by
+// deleteAccessTokensByCTID.
+const deleteAccessTokensBatchSize = 10000
+
+// deleteAccessTokensByCTID deletes the access tokens of the client in batches
+// of up to batchSize rows on PostgreSQL, addressing each batch by the physical
+// row locations collected for it. This avoids looking the rows up again through
+// the indexes, which is expensive for clients with very many tokens. Each batch
+// is committed in its own transaction, so that locks are only held per batch.
+// Should a batch fail, the tokens deleted by the previous batches stay deleted.
+// Within a transaction of the caller, all batches run in that transaction. It
+// returns the number of deleted rows.
+func (p *Persister) deleteAccessTokensByCTID(ctx context.Context, clientID string, batchSize int) (int, error) {
+	table := p.tokenTable(ctx, sqlTableAccess).TableName()
+
+	var deleted int
+	for {
+		var n int
+		if err := p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) (err error) {
+			n, err = p.execBulkStatement(ctx, c, func(c *pop.Connection) (int, error) {
+				/* #nosec G201 table name is validated by SetTokenTableNames */
+				return c.RawQuery(
+					fmt.Sprintf(
+						"DELETE FROM %[1]s WHERE ctid = ANY(ARRAY(SELECT ctid FROM %[1]s WHERE %[2]s AND nid = ? LIMIT %[3]d))",
+						table, p.clientIDCondition(ctx, "client_id"), batchSize,
+					),
+					clientID,
+					p.NetworkID(ctx),
+				).ExecWithCount()
+			})
+			return sqlcon.HandleError(err)
+		}); err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < batchSize {
+			return deleted, nil
+		}
+	}
+}
+
 // CreateDeviceCodeSession creates a new device code session and stores it in the database
 func (p *Persister) CreateDeviceCodeSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateDeviceCodeSession")
 	defer otelx.End(span, &err)
-	return p.createSession(ctx, signature, requester, sqlTableDeviceCode)
+	signature = normalizeSignature(signature)
+
+	limit := p.config.GetDeviceAuthMaxActiveFlowsPerClient(ctx)
+	if limit <= 0 {
+		return p.createSession(ctx, signature, requester, sqlTableDeviceCode)
+	}
+
+	// The count and the insert are not serialized, so concurrent requests may
+	// slightly exceed the limit.
+	return p.Transaction(ctx, func(ctx context.Context, _ *pop.Connection) error {
+		pending, err := p.countPendingDeviceCodes(ctx, requester.GetClient().GetID())
+		if err != nil {
+			return err
+		}
+		if pending >= limit {
+			return errorsx.WithStack(&x.DeviceFlowLimitError{ClientID: requester.GetClient().GetID(), Limit: limit})
+		}
+		return p.createSession(ctx, signature, requester, sqlTableDeviceCode)
+	})
+}
+
+// countPendingDeviceCodes returns the number of device codes of the client
+// which have neither expired nor been exchanged for tokens.
+func (p *Persister) countPendingDeviceCodes(ctx context.Context, clientID string) (int, error) {
+	var count int
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE client_id = ? AND nid = ? AND active = ? AND requested_at > ?", p.tokenTable(ctx, sqlTableDeviceCode).TableName()),
+			clientID,
+			p.NetworkID(ctx),
+			true,
+			time.Now().UTC().Add(-p.config.GetDeviceAndUserCodeLifespan(ctx)),
+		).
+		First(&count)
+	return count, sqlcon.HandleError(err)
 }
 
 // UpdateDeviceCodeSession updates a device code session by requestID
@@ -614,12 +3073,12 @@ func (p *Persister) UpdateDeviceCodeSessionByRequestID(ctx context.Context, requ
 	}
 
 	stmt := fmt.Sprintf(
-		"UPDATE %s SET granted_scope=?, granted_audience=?, session_data=? WHERE request_id=? AND nid = ?",
-		OAuth2RequestSQL{Table: sqlTableDeviceCode}.TableName(),
+		"UPDATE %s SET granted_scope=?, granted_audience=?, session_data=?, device_challenge=? WHERE request_id=? AND nid = ?",
+		p.tokenTable(ctx, sqlTableDeviceCode).TableName(),
 	)
 
-	/* #nosec G201 table is static */
-	err = p.Connection(ctx).RawQuery(stmt, req.GrantedScope, req.GrantedAudience, req.Session, requestID, p.NetworkID(ctx)).Exec()
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err = p.Connection(ctx).RawQuery(stmt, req.GrantedScope, req.GrantedAudience, req.Session, req.DeviceChallenge, requestID, p.NetworkID(ctx)).Exec()
 	if err != nil {
 		return sqlcon.HandleError(err)
 	}
@@ -627,11 +3086,86 @@ func (p *Persister) UpdateDeviceCodeSessionByRequestID(ctx context.Context, requ
 	return nil
 }
 
-// GetDeviceCodeSession returns a device code session from the database
+// GetDeviceCodeSession returns a device code session from the database. Device
+// codes which cannot be exchanged yet fail with the errors of RFC 8628:
+// fosite.ErrAccessDenied if the end user rejected the request,
+// fosite.ErrDeviceExpiredToken once the device code expired, and
+// fosite.ErrAuthorizationPending while the user has not completed the flow.
+// If the user has not even handled the device flow yet, the pending error wraps
+// x.ErrDeviceFlowNotHandled. Device codes which were already exchanged return
+// the request together with fosite.ErrInvalidatedDeviceCode.
 func (p *Persister) GetDeviceCodeSession(ctx context.Context, signature string, session fosite.Session) (_ fosite.Requester, err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetDeviceCodeSession")
 	defer otelx.End(span, &err)
-	return p.findSessionBySignature(ctx, signature, session, sqlTableDeviceCode)
+	signature = normalizeSignature(signature)
+
+	r, err := p.findSessionBySignature(ctx, signature, session, sqlTableDeviceCode)
+	if errors.Is(err, fosite.ErrInactiveToken) {
+		// The device code was already exchanged for tokens.
+		return r, errorsx.WithStack(fosite.ErrInvalidatedDeviceCode)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Map the state of the device flow to the errors of RFC 8628, section 3.5.
+	states, err := p.deviceFlowStates(ctx, r.GetID())
+	if err != nil {
+		return nil, err
+	} else if slices.ContainsFunc(states, isDeniedFlowState) {
+		return nil, errorsx.WithStack(fosite.ErrAccessDenied.WithHint("The end user denied the authorization request."))
+	}
+
+	expiresAt := r.GetSession().GetExpiresAt(fosite.DeviceCode)
+	if expiresAt.IsZero() {
+		expiresAt = r.GetRequestedAt().Add(p.config.GetDeviceAndUserCodeLifespan(ctx))
+	}
+	if expiresAt.Before(time.Now().UTC()) {
+		return nil, errorsx.WithStack(fosite.ErrDeviceExpiredToken.WithHintf("Device code expired at '%s'.", expiresAt))
+	}
+
+	if s, ok := r.GetSession().(rfc8628.DeviceFlowSession); ok && !s.GetBrowserFlowCompleted() {
+		return nil, errorsx.WithStack(authorizationPending(slices.ContainsFunc(states, isHandledDeviceFlowState)))
+	}
+
+	return r, nil
+}
+
+// authorizationPending returns the error for device codes whose device flow
+// the user has not completed yet. Whether the user handled the device flow is
+// only recorded in the wrapped error, which is not sent to the device, so that
+// polling does not reveal whether the user code was entered already.
+func authorizationPending(handled bool) *fosite.RFC6749Error {
+	if !handled {
+		return fosite.ErrAuthorizationPending.WithWrap(x.ErrDeviceFlowNotHandled)
+	}
+	return fosite.ErrAuthorizationPending
+}
+
+// deviceFlowStates returns the states of the device flows which created the
+// device code with the given request ID. Flows are only linked to the device
+// code once the user handled the device flow, so there are none while the flow
+// is in DeviceFlowStateInitialized or DeviceFlowStateUnused, which only exist
+// in the encoded device challenge and verifier.
+func (p *Persister) deviceFlowStates(ctx context.Context, requestID string) ([]int16, error) {
+	var states []int16
+	if err := p.Connection(ctx).
+		RawQuery("SELECT state FROM hydra_oauth2_flow WHERE device_code_request_id = ? AND nid = ?", requestID, p.NetworkID(ctx)).
+		All(&states); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return states, nil
+}
+
+// isDeniedFlowState reports whether the device, login or consent step of a
+// flow was rejected.
+func isDeniedFlowState(state int16) bool {
+	return state == flow.DeviceFlowStateError || state == flow.FlowStateLoginError || state == flow.FlowStateConsentError
+}
+
+// isHandledDeviceFlowState reports whether the user handled the device flow
+// and continued with the login or consent.
+func isHandledDeviceFlowState(state int16) bool {
+	return state != flow.DeviceFlowStateInitialized && state != flow.DeviceFlowStateUnused
 }
 
 // GetDeviceCodeSessionByRequestID returns a device code session from the database
@@ -645,12 +3179,13 @@ func (p *Persister) GetDeviceCodeSessionByRequestID(ctx context.Context, request
 func (p *Persister) InvalidateDeviceCodeSession(ctx context.Context, signature string) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateDeviceCodeSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 
-	/* #nosec G201 table is static */
+	/* #nosec G201 table name is validated by SetTokenTableNames */
 	return sqlcon.HandleError(
 		p.Connection(ctx).
 			RawQuery(
-				fmt.Sprintf("UPDATE %s SET active=false WHERE signature=? AND nid = ?", OAuth2RequestSQL{Table: sqlTableDeviceCode}.TableName()),
+				fmt.Sprintf("UPDATE %s SET active=false WHERE signature=? AND nid = ?", p.tokenTable(ctx, sqlTableDeviceCode).TableName()),
 				signature,
 				p.NetworkID(ctx),
 			).
@@ -658,10 +3193,103 @@ func (p *Persister) InvalidateDeviceCodeSession(ctx context.Context, signature s
 	)
 }
 
+// ExchangeDeviceCode atomically marks the device code session stored under
+// deviceSignature as used and stores the access token and, if refreshSignature
+// is not empty, the refresh token issued for it. Either all of them succeed or
+// nothing is changed, so that tokens are never issued for a device code which
+// could be used again. It fails with fosite.ErrNotFound if the device code
+// does not exist, and with fosite.ErrInvalidatedDeviceCode if it was already
+// used, including by a concurrent exchange which won the race.
+func (p *Persister) ExchangeDeviceCode(ctx context.Context, deviceSignature, accessSignature string, access fosite.Requester, refreshSignature string, refresh fosite.Requester) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ExchangeDeviceCode")
+	defer otelx.End(span, &err)
+	deviceSignature = normalizeSignature(deviceSignature)
+
+	return p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		if _, err := p.findSessionBySignature(ctx, deviceSignature, oauth2.NewSession(""), sqlTableDeviceCode); errors.Is(err, fosite.ErrInactiveToken) {
+			return errorsx.WithStack(fosite.ErrInvalidatedDeviceCode)
+		} else if err != nil {
+			return err
+		}
+
+		// Guard on active to fail if a concurrent exchange won the race.
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		updated, err := c.RawQuery(
+			fmt.Sprintf("UPDATE %s SET active = false WHERE signature = ? AND nid = ? AND active = true", p.tokenTable(ctx, sqlTableDeviceCode).TableName()),
+			deviceSignature,
+			p.NetworkID(ctx),
+		).ExecWithCount()
+		if err != nil {
+			return sqlcon.HandleError(err)
+		} else if updated == 0 {
+			return errorsx.WithStack(fosite.ErrInvalidatedDeviceCode)
+		}
+
+		if err := p.CreateAccessTokenSession(ctx, accessSignature, access); err != nil {
+			return err
+		}
+		if refreshSignature == "" {
+			return nil
+		}
+		return p.CreateRefreshTokenSession(ctx, refreshSignature, refresh)
+	})
+}
+
+// CheckDevicePollAllowed records a token poll for the device code session with
+// the given signature. It rejects polls arriving less than minInterval after the
+// previous accepted poll and reports how long the device has to wait before
+// polling again. Concurrent polls are serialized by the database, so only one
+// of them is accepted per interval.
+func (p *Persister) CheckDevicePollAllowed(ctx context.Context, signature string, minInterval time.Duration) (allowed bool, retryAfter time.Duration, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CheckDevicePollAllowed")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	now := time.Now().UTC()
+	table := p.tokenTable(ctx, sqlTableDeviceCode).TableName()
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	updated, err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("UPDATE %s SET last_polled_at=? WHERE signature=? AND nid=? AND (last_polled_at IS NULL OR last_polled_at <= ?)", table),
+			now,
+			signature,
+			p.NetworkID(ctx),
+			now.Add(-minInterval),
+		).
+		ExecWithCount()
+	if err != nil {
+		return false, 0, sqlcon.HandleError(err)
+	}
+	if updated > 0 {
+		return true, 0, nil
+	}
+
+	var row struct {
+		LastPolledAt sql.NullTime `db:"last_polled_at"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err = p.Connection(ctx).
+		RawQuery(fmt.Sprintf("SELECT last_polled_at FROM %s WHERE signature=? AND nid=?", table), signature, p.NetworkID(ctx)).
+		First(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, 0, errorsx.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return false, 0, sqlcon.HandleError(err)
+	}
+
+	retryAfter = row.LastPolledAt.Time.Add(minInterval).Sub(now)
+	if retryAfter < 0 {
+		retryAfter = 0
+	}
+	return false, retryAfter, nil
+}
+
 // CreateUserCodeSession creates a new user code session and stores it in the database
 func (p *Persister) CreateUserCodeSession(ctx context.Context, signature string, requester fosite.Requester) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CreateUserCodeSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 	return p.createSession(ctx, signature, requester, sqlTableUserCode)
 }
 
@@ -669,6 +3297,7 @@ func (p *Persister) CreateUserCodeSession(ctx context.Context, signature string,
 func (p *Persister) GetUserCodeSession(ctx context.Context, signature string, session fosite.Session) (_ fosite.Requester, err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetUserCodeSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 	if session == nil {
 		session = oauth2.NewSession("")
 	}
@@ -679,12 +3308,13 @@ func (p *Persister) GetUserCodeSession(ctx context.Context, signature string, se
 func (p *Persister) InvalidateUserCodeSession(ctx context.Context, signature string) (err error) {
 	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.InvalidateUserCodeSession")
 	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
 
-	/* #nosec G201 table is static */
+	/* #nosec G201 table name is validated by SetTokenTableNames */
 	return sqlcon.HandleError(
 		p.Connection(ctx).
 			RawQuery(
-				fmt.Sprintf("UPDATE %s SET active=false WHERE signature=? AND nid = ?", OAuth2RequestSQL{Table: sqlTableUserCode}.TableName()),
+				fmt.Sprintf("UPDATE %s SET active=false WHERE signature=? AND nid = ?", p.tokenTable(ctx, sqlTableUserCode).TableName()),
 				signature,
 				p.NetworkID(ctx),
 			).
@@ -699,11 +3329,11 @@ func (p *Persister) UpdateAndInvalidateUserCodeSessionByRequestID(ctx context.Co
 
 	// TODO(nsklikas): afaict this is supposed to return an error if no rows were updated, but this is not the actual behavior.
 	// We need to either fix this OR do a select -> check -> update (this would require 2 queries instead of 1).
-	/* #nosec G201 table is static */
+	/* #nosec G201 table name is validated by SetTokenTableNames */
 	return sqlcon.HandleError(
 		p.Connection(ctx).
 			RawQuery(
-				fmt.Sprintf("UPDATE %s SET active=false, challenge_id=? WHERE request_id=? AND nid = ? AND active=true", OAuth2RequestSQL{Table: sqlTableUserCode}.TableName()),
+				fmt.Sprintf("UPDATE %s SET active=false, challenge_id=? WHERE request_id=? AND nid = ? AND active=true", p.tokenTable(ctx, sqlTableUserCode).TableName()),
 				challenge_id,
 				request_id,
 				p.NetworkID(ctx),
@@ -711,3 +3341,191 @@ func (p *Persister) UpdateAndInvalidateUserCodeSessionByRequestID(ctx context.Co
 			Exec(),
 	)
 }
+
+// ConsumeUserCodeSessionByRequestID atomically invalidates the active user code
+// session for the given device flow request ID and connects it with the
+// challenge ID. It returns x.ErrConflict if the user code was already used and
+// fosite.ErrNotFound if there is no user code session for the request ID, so
+// that a user code can be acted upon at most once.
+func (p *Persister) ConsumeUserCodeSessionByRequestID(ctx context.Context, requestID, challengeID string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ConsumeUserCodeSessionByRequestID")
+	defer otelx.End(span, &err)
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	consumed, err := p.Connection(ctx).
+		RawQuery(
+			fmt.Sprintf("UPDATE %s SET active=false, challenge_id=? WHERE request_id=? AND nid = ? AND active=true", p.tokenTable(ctx, sqlTableUserCode).TableName()),
+			challengeID,
+			requestID,
+			p.NetworkID(ctx),
+		).
+		ExecWithCount()
+	if err != nil {
+		return sqlcon.HandleError(err)
+	}
+	if consumed > 0 {
+		return nil
+	}
+
+	exists, err := p.QueryWithNetwork(ctx).Where("request_id = ?", requestID).Exists(p.tokenTable(ctx, sqlTableUserCode))
+	if err != nil {
+		return sqlcon.HandleError(err)
+	}
+	if !exists {
+		return errorsx.WithStack(fosite.ErrNotFound)
+	}
+	return errorsx.WithStack(x.ErrConflict.WithHint("The user code was already used."))
+}
+
+// DeleteExpiredUserCodeSessions deletes user code sessions which were requested
+// longer than the device and user code lifespan ago, so that user codes of
+// abandoned device logins do not accumulate. It deletes in batches of
+// batchSize and returns the number of deleted sessions.
+func (p *Persister) DeleteExpiredUserCodeSessions(ctx context.Context, batchSize int) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeleteExpiredUserCodeSessions")
+	defer otelx.End(span, &err)
+
+	if batchSize <= 0 {
+		return 0, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebug("The batch size must be positive."))
+	}
+
+	expiredBefore := time.Now().UTC().Add(-p.config.GetDeviceAndUserCodeLifespan(ctx))
+	table := p.tokenTable(ctx, sqlTableUserCode).TableName()
+
+	total := 0
+	for {
+		// The outer SELECT is necessary because our version of MySQL doesn't yet support 'LIMIT & IN/ALL/ANY/SOME subquery
+		deleted, err := p.execBulkStatement(ctx, p.FlushConnection(ctx), func(c *pop.Connection) (int, error) {
+			/* #nosec G201 table name is validated by SetTokenTableNames */
+			return c.RawQuery(
+				fmt.Sprintf(`DELETE FROM %s WHERE signature in (
+					SELECT signature FROM (SELECT signature FROM %s WHERE requested_at < ? AND nid = ? ORDER BY requested_at LIMIT %d) as s
+				)`, table, table, batchSize),
+				expiredBefore,
+				p.NetworkID(ctx),
+			).ExecWithCount()
+		})
+		total += deleted
+		if err != nil {
+			return total, sqlcon.HandleError(err)
+		}
+		if deleted < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// HasActiveTokens returns whether the subject holds any active access or
+// refresh token in the current network, e.g. to tell whether a user is logged
+// in anywhere. It stops at the first token found instead of loading them.
+// Tokens which expired but were not revoked or flushed yet count as active.
+func (p *Persister) HasActiveTokens(ctx context.Context, subject string) (_ bool, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.HasActiveTokens")
+	defer otelx.End(span, &err)
+
+	for _, table := range []tableName{sqlTableAccess, sqlTableRefresh} {
+		var found []int
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("SELECT 1 FROM %s WHERE subject = ? AND nid = ? AND active = ? LIMIT 1", p.tokenTable(ctx, table).TableName()),
+			subject,
+			p.NetworkID(ctx),
+			true,
+		).All(&found); err != nil {
+			return false, sqlcon.HandleError(err)
+		}
+		if len(found) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeduplicateActiveAuthorizeCodes deactivates all but the earliest of the
+// active authorize codes which share a request ID in the current network, and
+// returns how many codes it deactivated. Each authorization stores a single
+// code, so duplicates only arise from bugs or races, and it serves as a
+// diagnostic and repair tool. Codes requested at the same time are ordered by
+// signature.
+func (p *Persister) DeduplicateActiveAuthorizeCodes(ctx context.Context) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.DeduplicateActiveAuthorizeCodes")
+	defer otelx.End(span, &err)
+
+	if err := p.requireSQLSessionBackend(sqlTableCode); err != nil {
+		return 0, err
+	}
+
+	table := p.tokenTable(ctx, sqlTableCode).TableName()
+	var deactivated int
+	err = p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		var rows []struct {
+			Signature string `db:"signature"`
+			Request   string `db:"request_id"`
+		}
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := c.RawQuery(
+			fmt.Sprintf(`SELECT signature, request_id FROM %[1]s
+				WHERE nid = ? AND active = ? AND request_id IN (
+					SELECT request_id FROM %[1]s WHERE nid = ? AND active = ? GROUP BY request_id HAVING COUNT(*) > 1
+				)
+				ORDER BY request_id, requested_at, signature`, table),
+			p.NetworkID(ctx), true,
+			p.NetworkID(ctx), true,
+		).All(&rows); err != nil {
+			return sqlcon.HandleError(err)
+		}
+
+		var duplicates []string
+		for i, row := range rows {
+			if i > 0 && rows[i-1].Request == row.Request {
+				duplicates = append(duplicates, row.Signature)
+			}
+		}
+		if len(duplicates) == 0 {
+			return nil
+		}
+
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		n, err := c.RawQuery(
+			fmt.Sprintf("UPDATE %s SET active = ? WHERE signature IN (?) AND nid = ?", table),
+			false,
+			duplicates,
+			p.NetworkID(ctx),
+		).ExecWithCount()
+		if err != nil {
+			return sqlcon.HandleError(err)
+		}
+		deactivated = n
+		return nil
+	})
+	return deactivated, err
+}
+
+// GetSession returns the session stored under the signature of a token of the
+// given type, dispatching to the Get*Session method of the type, e.g.
+// GetAccessTokenSession for fosite.AccessToken. Signatures are looked up and
+// errors are returned exactly as by that method, so authorize codes which
+// were already used return the request together with
+// fosite.ErrInvalidatedAuthorizeCode. Token types without a table fail with
+// fosite.ErrInvalidRequest.
+func (p *Persister) GetSession(ctx context.Context, tokenType fosite.TokenType, signature string, session fosite.Session) (_ fosite.Requester, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetSession")
+	defer otelx.End(span, &err)
+
+	switch tokenType {
+	case fosite.AccessToken:
+		return p.GetAccessTokenSession(ctx, signature, session)
+	case fosite.RefreshToken:
+		return p.GetRefreshTokenSession(ctx, signature, session)
+	case fosite.AuthorizeCode:
+		return p.GetAuthorizeCodeSession(ctx, signature, session)
+	case fosite.IDToken:
+		return p.GetOpenIDConnectSession(ctx, signature, &fosite.Request{Session: session})
+	case fosite.DeviceCode:
+		return p.GetDeviceCodeSession(ctx, signature, session)
+	case fosite.UserCode:
+		return p.GetUserCodeSession(ctx, signature, session)
+	default:
+		return nil, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token type %q.", tokenType))
+	}
+}
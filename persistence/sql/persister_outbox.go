@@ -0,0 +1,69 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gofrs/uuid"
+
+	"github.com/ory/x/sqlcon"
+)
+
+const (
+	// OutboxEventTokenIssued is written to the outbox when a token is stored.
+	OutboxEventTokenIssued = "token_issued"
+	// OutboxEventTokenRevoked is written to the outbox when the tokens of a
+	// request are revoked.
+	OutboxEventTokenRevoked = "token_revoked"
+)
+
+// OutboxEvent is a token issuance or revocation event. With the outbox enabled,
+// it is written in the same transaction as the token change, so that a
+// separate relay can publish it with guaranteed delivery.
+type OutboxEvent struct {
+	ID        uuid.UUID `db:"id"`
+	NID       uuid.UUID `db:"nid"`
+	Event     string    `db:"event"`
+	TokenType string    `db:"token_type"`
+	RequestID string    `db:"request_id"`
+	// ClientID is empty for revocations, which only know the request ID.
+	ClientID  string    `db:"client_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (OutboxEvent) TableName() string {
+	return "hydra_oauth2_outbox"
+}
+
+// withOutbox runs f in a transaction if the outbox is enabled, so that the
+// outbox events written by f are committed or rolled back with its token
+// changes.
+func (p *Persister) withOutbox(ctx context.Context, f func(ctx context.Context) error) error {
+	if !p.config.OutboxEnabled(ctx) {
+		return f(ctx)
+	}
+	return p.Transaction(ctx, func(ctx context.Context, _ *pop.Connection) error {
+		return f(ctx)
+	})
+}
+
+// writeOutboxEvent writes an event for the token table to the outbox, if
+// enabled. It must be called within withOutbox to be atomic with the token
+// change.
+func (p *Persister) writeOutboxEvent(ctx context.Context, event string, table tableName, requestID, clientID string) error {
+	if !p.config.OutboxEnabled(ctx) {
+		return nil
+	}
+	return sqlcon.HandleError(p.CreateWithNetwork(ctx, &OutboxEvent{
+		ID:        uuid.Must(uuid.NewV4()),
+		Event:     event,
+		TokenType: string(table),
+		RequestID: requestID,
+		ClientID:  clientID,
+		CreatedAt: time.Now().UTC().Round(time.Second),
+	}))
+}
@@ -0,0 +1,96 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// Common reasons for revoking refresh tokens. Any other reason may be recorded
+// as well.
+const (
+	RevocationReasonTokenTheft = "token_theft"
+	RevocationReasonLogout     = "logout"
+	RevocationReasonAdmin      = "admin"
+)
+
+type revocationReasonKey struct{}
+
+// WithRevocationReason returns a context in which the refresh tokens revoked
+// by RevokeRefreshToken and RevokeRefreshTokenMaybeGracePeriod are recorded as
+// revoked for the reason, for later audit. This lets callers record a reason
+// when the revocation is triggered through fosite, whose storage interface has
+// no room for one.
+func WithRevocationReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, revocationReasonKey{}, reason)
+}
+
+func revocationReasonFromContext(ctx context.Context) string {
+	reason, _ := ctx.Value(revocationReasonKey{}).(string)
+	return reason
+}
+
+// RevokedRefreshToken is a refresh token which was revoked for a reason, as
+// returned by ListRevokedRefreshTokens.
+type RevokedRefreshToken struct {
+	Signature string    `db:"signature" json:"signature"`
+	RequestID string    `db:"request_id" json:"request_id"`
+	ClientID  string    `db:"client_id" json:"client_id"`
+	Subject   string    `db:"subject" json:"subject"`
+	RevokedAt time.Time `db:"revoked_at" json:"revoked_at"`
+	Reason    string    `db:"revocation_reason" json:"reason"`
+}
+
+// RevokeRefreshTokenWithReason revokes the refresh tokens of the request like
+// RevokeRefreshToken, and records them as revoked for the reason.
+func (p *Persister) RevokeRefreshTokenWithReason(ctx context.Context, id, reason string) error {
+	return p.RevokeRefreshToken(WithRevocationReason(ctx, reason), id)
+}
+
+// deactivateRefreshTokensByRequestID deactivates the refresh tokens of the
+// request, recording the revocation reason of the context, if any, on the
+// tokens which were still active. Tokens which were deactivated before, e.g. by
+// rotation, keep their reason. Reasons are only recorded for refresh tokens
+// stored in SQL.
+func (p *Persister) deactivateRefreshTokensByRequestID(ctx context.Context, id string) (err error) {
+	reason := revocationReasonFromContext(ctx)
+	if reason == "" || !p.hasSQLSessionBackend(sqlTableRefresh) {
+		return p.deactivateSessionByRequestID(ctx, id, sqlTableRefresh)
+	}
+
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.deactivateRefreshTokensByRequestID")
+	defer otelx.End(span, &err)
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	return sqlcon.HandleError(p.Connection(ctx).RawQuery(
+		fmt.Sprintf("UPDATE %s SET active = false, revocation_reason = ?, revoked_at = ? WHERE request_id = ? AND nid = ? AND active = true", p.tokenTable(ctx, sqlTableRefresh).TableName()),
+		reason,
+		time.Now().UTC().Round(time.Second),
+		id,
+		p.NetworkID(ctx),
+	).Exec())
+}
+
+// ListRevokedRefreshTokens returns the refresh tokens of the current network
+// which were revoked for the reason, the most recently revoked first.
+func (p *Persister) ListRevokedRefreshTokens(ctx context.Context, reason string) (_ []RevokedRefreshToken, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ListRevokedRefreshTokens")
+	defer otelx.End(span, &err)
+
+	var tokens []RevokedRefreshToken
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT signature, request_id, client_id, subject, revoked_at, revocation_reason FROM %s WHERE revocation_reason = ? AND nid = ? ORDER BY revoked_at DESC, signature", p.tokenTable(ctx, sqlTableRefresh).TableName()),
+		reason,
+		p.NetworkID(ctx),
+	).All(&tokens); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return tokens, nil
+}
@@ -0,0 +1,227 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/v2/x"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/sqlcon"
+)
+
+// SessionBackend stores the sessions of a single token table, for example the
+// authorization codes. Signatures passed to a backend are already normalized,
+// and access token signatures are already hashed where configured.
+//
+// By default, every table is stored in SQL. SetSessionBackend replaces the
+// backend of the authorization code and PKCE tables, e.g. to keep these
+// short-lived sessions in an ephemeral store. Only the basic create, get,
+// delete and deactivate operations are dispatched to the backend. Operations
+// which query the SQL tables directly, such as erasure by subject or session
+// export, return an error for tables stored in another backend.
+type SessionBackend interface {
+	// CreateSession stores a new, active session under the signature.
+	CreateSession(ctx context.Context, signature string, requester fosite.Requester) error
+
+	// GetSession returns the session stored under the signature, and whether
+	// it is still active. It returns fosite.ErrNotFound if there is none.
+	GetSession(ctx context.Context, signature string, session fosite.Session) (_ fosite.Requester, active bool, _ error)
+
+	// GetSessionByRequestID returns a session of the request, and whether it
+	// is still active. It returns fosite.ErrNotFound if there is none.
+	GetSessionByRequestID(ctx context.Context, requestID string, session fosite.Session) (_ fosite.Requester, active bool, _ error)
+
+	// DeleteSession deletes the session stored under the signature. It
+	// returns fosite.ErrNotFound if there is none.
+	DeleteSession(ctx context.Context, signature string) error
+
+	// DeleteSessionsByRequestID deletes all sessions of the request. It
+	// returns fosite.ErrNotFound if there are none.
+	DeleteSessionsByRequestID(ctx context.Context, requestID string) error
+
+	// DeactivateSession marks the session stored under the signature as
+	// inactive.
+	DeactivateSession(ctx context.Context, signature string) error
+
+	// DeactivateSessionsByRequestID marks all sessions of the request as
+	// inactive.
+	DeactivateSessionsByRequestID(ctx context.Context, requestID string) error
+}
+
+// sessionBackendTables lists the token tables whose sessions may be stored in
+// another SessionBackend. The flows of the other tables depend on operations
+// which query the SQL tables directly, e.g. refresh token rotation.
+var sessionBackendTables = []tableName{sqlTableCode, sqlTablePKCE}
+
+// SetSessionBackend stores the sessions of the table in the given backend
+// instead of SQL. Passing a nil backend restores SQL storage. It must be called
+// before the persister handles requests.
+func (p *Persister) SetSessionBackend(table tableName, backend SessionBackend) error {
+	if !slices.Contains(tokenTables, table) {
+		return errors.Errorf("unknown token table %q", table)
+	}
+
+	if backend == nil {
+		delete(p.sessionBackends, table)
+		return nil
+	}
+	if !slices.Contains(sessionBackendTables, table) {
+		return errors.Errorf("the sessions of token table %q must be stored in SQL", table)
+	}
+	if p.sessionBackends == nil {
+		p.sessionBackends = make(map[tableName]SessionBackend)
+	}
+	p.sessionBackends[table] = backend
+	return nil
+}
+
+// sessionBackend returns the backend storing the sessions of the table.
+func (p *Persister) sessionBackend(table tableName) SessionBackend {
+	if b, ok := p.sessionBackends[table]; ok {
+		return b
+	}
+	return &sqlSessionBackend{p: p, table: table}
+}
+
+// hasSQLSessionBackend returns whether the sessions of the table are stored in
+// SQL.
+func (p *Persister) hasSQLSessionBackend(table tableName) bool {
+	_, ok := p.sessionBackends[table]
+	return !ok
+}
+
+// requireSQLSessionBackend returns an error if the sessions of one of the
+// tables are not stored in SQL. Operations which query the SQL tables directly
+// call it, as they would silently miss the sessions of other backends.
+func (p *Persister) requireSQLSessionBackend(tables ...tableName) error {
+	for _, table := range tables {
+		if !p.hasSQLSessionBackend(table) {
+			return errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("The sessions of token table %q are not stored in SQL.", table))
+		}
+	}
+	return nil
+}
+
+// sqlSessionBackend is the default SessionBackend, storing sessions in the
+// table's hydra_oauth2_* SQL table.
+type sqlSessionBackend struct {
+	p     *Persister
+	table tableName
+}
+
+var _ SessionBackend = (*sqlSessionBackend)(nil)
+
+func (b *sqlSessionBackend) CreateSession(ctx context.Context, signature string, requester fosite.Requester) error {
+	p := b.p
+	req, err := p.sqlSchemaFromRequest(ctx, signature, requester, b.table)
+	if err != nil {
+		return err
+	}
+
+	return p.withOutbox(ctx, func(ctx context.Context) error {
+		// A duplicate signature is never treated as an idempotent retry: the
+		// stored payload cannot be compared reliably because sessions may be
+		// encrypted, and the failed insert aborts an enclosing transaction
+		// on PostgreSQL anyway.
+		if err := p.insertSession(ctx, req); errors.Is(err, sqlcon.ErrConcurrentUpdate) {
+			return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+		} else if errors.Is(err, sqlcon.ErrUniqueViolation) {
+			return errorsx.WithStack(&x.DuplicateSignatureError{Table: string(b.table)})
+		} else if err != nil {
+			return err
+		}
+		return p.writeOutboxEvent(ctx, OutboxEventTokenIssued, b.table, req.Request, req.Client)
+	})
+}
+
+func (b *sqlSessionBackend) GetSession(ctx context.Context, signature string, session fosite.Session) (fosite.Requester, bool, error) {
+	return b.find(ctx, "signature", signature, session)
+}
+
+func (b *sqlSessionBackend) GetSessionByRequestID(ctx context.Context, requestID string, session fosite.Session) (fosite.Requester, bool, error) {
+	return b.find(ctx, "request_id", requestID, session)
+}
+
+func (b *sqlSessionBackend) find(ctx context.Context, column, value string, session fosite.Session) (fosite.Requester, bool, error) {
+	r := b.p.tokenTable(ctx, b.table)
+	err := b.p.tokenQuery(ctx, b.table).Where(column+" = ?", value).First(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, errorsx.WithStack(fosite.ErrNotFound)
+	}
+	if err != nil {
+		return nil, false, sqlcon.HandleError(err)
+	}
+
+	fr, err := r.toRequest(ctx, session, b.p)
+	if err != nil {
+		return nil, false, err
+	}
+	return fr, r.Active, nil
+}
+
+func (b *sqlSessionBackend) DeleteSession(ctx context.Context, signature string) error {
+	return b.delete(ctx, "signature", signature)
+}
+
+func (b *sqlSessionBackend) DeleteSessionsByRequestID(ctx context.Context, requestID string) error {
+	return b.delete(ctx, "request_id", requestID)
+}
+
+func (b *sqlSessionBackend) delete(ctx context.Context, column, value string) error {
+	/* #nosec G201 table and column are static */
+	return handleDeleteError(
+		b.p.Connection(ctx).
+			RawQuery(
+				fmt.Sprintf("DELETE FROM %s WHERE %s=? AND nid = ?", b.p.tokenTable(ctx, b.table).TableName(), column),
+				value,
+				b.p.NetworkID(ctx),
+			).
+			ExecWithCount(),
+	)
+}
+
+// handleDeleteError maps the result of deleting sessions: deleting no rows
+// yields fosite.ErrNotFound, and serialization failures, including InnoDB
+// deadlocks, yield fosite.ErrSerializationFailure so that they can be retried.
+func handleDeleteError(deleted int, err error) error {
+	if err := sqlcon.HandleError(err); err != nil {
+		if errors.Is(err, sqlcon.ErrConcurrentUpdate) || strings.Contains(err.Error(), "Error 1213") { // InnoDB Deadlock?
+			return errors.Wrap(fosite.ErrSerializationFailure, err.Error())
+		}
+		return err
+	}
+	if deleted == 0 {
+		return errorsx.WithStack(fosite.ErrNotFound)
+	}
+	return nil
+}
+
+func (b *sqlSessionBackend) DeactivateSession(ctx context.Context, signature string) error {
+	return b.deactivate(ctx, "signature", signature)
+}
+
+func (b *sqlSessionBackend) DeactivateSessionsByRequestID(ctx context.Context, requestID string) error {
+	return b.deactivate(ctx, "request_id", requestID)
+}
+
+func (b *sqlSessionBackend) deactivate(ctx context.Context, column, value string) error {
+	/* #nosec G201 table and column are static */
+	return sqlcon.HandleError(
+		b.p.Connection(ctx).
+			RawQuery(
+				fmt.Sprintf("UPDATE %s SET active=false WHERE %s=? AND nid = ? AND active=true", b.p.tokenTable(ctx, b.table).TableName(), column),
+				value,
+				b.p.NetworkID(ctx),
+			).
+			Exec(),
+	)
+}
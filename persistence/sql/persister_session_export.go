@@ -0,0 +1,352 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+
+	"github.com/ory/fosite"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// exportSessionsPageSize is the number of rows ExportActiveSessions reads from
+// the database at once.
+const exportSessionsPageSize = 1000
+
+// ExportedSession is a row of a token table as written by ExportActiveSessions
+// and read by ImportSessions. SessionData holds the stored session as-is, so
+// encrypted sessions can only be read by a deployment using the same system
+// secrets as the exporting one.
+type ExportedSession struct {
+	Signature             string     `json:"signature"`
+	RequestID             string     `json:"request_id"`
+	ConsentChallenge      *string    `json:"challenge_id,omitempty"`
+	RequestedAt           time.Time  `json:"requested_at"`
+	ClientID              string     `json:"client_id"`
+	Scope                 string     `json:"scope"`
+	GrantedScope          string     `json:"granted_scope"`
+	RequestedAudience     string     `json:"requested_audience"`
+	GrantedAudience       string     `json:"granted_audience"`
+	Form                  string     `json:"form_data"`
+	Subject               string     `json:"subject"`
+	SessionData           []byte     `json:"session_data"`
+	AuthTime              *time.Time `json:"auth_time,omitempty"`
+	ClientSnapshot        *string    `json:"client_snapshot,omitempty"`
+	NonceHash             *string    `json:"nonce_hash,omitempty"`
+	IntrospectionAudience *string    `json:"introspection_audience,omitempty"`
+	GrantType             *string    `json:"grant_type,omitempty"`
+	ExpiresAt             *time.Time `json:"expires_at,omitempty"`
+	DeviceChallenge       *string    `json:"device_challenge,omitempty"`
+	AMR                   *string    `json:"amr,omitempty"`
+	SID                   *string    `json:"sid,omitempty"`
+	Issuer                *string    `json:"issuer,omitempty"`
+	FlaggedAt             *time.Time `json:"flagged_at,omitempty"`
+	FlaggedReason         *string    `json:"flagged_reason,omitempty"`
+
+	// The following columns only exist in some token tables.
+	SlidingExpiresAt        *time.Time `json:"sliding_expires_at,omitempty"`
+	AbsoluteExpiresAt       *time.Time `json:"absolute_expires_at,omitempty"`
+	ChainLength             *int64     `json:"chain_length,omitempty"`
+	GracedUntil             *time.Time `json:"graced_until,omitempty"`
+	LastPolledAt            *time.Time `json:"last_polled_at,omitempty"`
+	PreviousGrantedScope    *string    `json:"previous_granted_scope,omitempty"`
+	PreviousGrantedAudience *string    `json:"previous_granted_audience,omitempty"`
+	GrantUpdatedAt          *time.Time `json:"grant_updated_at,omitempty"`
+}
+
+// exportedRow is a row of a token table as read by ExportActiveSessions. Next
+// to the columns of OAuth2RequestSQL, it holds the other columns which only
+// some token tables have, which are selected as NULL from the other tables.
+type exportedRow struct {
+	OAuth2RequestSQL
+	SlidingExpiresAt        sql.NullTime   `db:"sliding_expires_at"`
+	AbsoluteExpiresAt       sql.NullTime   `db:"absolute_expires_at"`
+	ChainLength             sql.NullInt64  `db:"chain_length"`
+	GracedUntil             sql.NullTime   `db:"graced_until"`
+	LastPolledAt            sql.NullTime   `db:"last_polled_at"`
+	PreviousGrantedScope    sql.NullString `db:"previous_granted_scope"`
+	PreviousGrantedAudience sql.NullString `db:"previous_granted_audience"`
+	GrantUpdatedAt          sql.NullTime   `db:"grant_updated_at"`
+}
+
+// exportedTableColumns are the columns of exportedRow which only some token
+// tables have.
+var exportedTableColumns = []string{
+	"sliding_expires_at", "absolute_expires_at", "chain_length",
+	"graced_until",
+	"last_polled_at",
+	"previous_granted_scope", "previous_granted_audience", "grant_updated_at",
+}
+
+// exportedColumns returns the columns of the table to select into exportedRow.
+func exportedColumns(table tableName) string {
+	selected := tokenColumns(table)
+	for _, column := range exportedTableColumns {
+		if slices.Contains(optionalTokenTableColumns[table], column) {
+			selected = append(selected, column)
+		} else {
+			selected = append(selected, "NULL AS "+column)
+		}
+	}
+	return strings.Join(selected, ", ")
+}
+
+func newExportedSession(row *exportedRow) *ExportedSession {
+	r := &row.OAuth2RequestSQL
+	return &ExportedSession{
+		Signature:             r.ID,
+		RequestID:             r.Request,
+		ConsentChallenge:      exportedString(r.ConsentChallenge),
+		RequestedAt:           r.RequestedAt,
+		ClientID:              r.Client,
+		Scope:                 r.Scopes,
+		GrantedScope:          r.GrantedScope,
+		RequestedAudience:     r.RequestedAudience,
+		GrantedAudience:       r.GrantedAudience,
+		Form:                  r.Form,
+		Subject:               r.Subject,
+		SessionData:           r.Session,
+		AuthTime:              exportedTime(r.AuthTime),
+		ClientSnapshot:        exportedString(r.ClientSnapshot),
+		NonceHash:             exportedString(r.NonceHash),
+		IntrospectionAudience: exportedString(r.IntrospectionAudience),
+		GrantType:             exportedString(r.GrantType),
+		ExpiresAt:             exportedTime(r.ExpiresAt),
+		DeviceChallenge:       exportedString(r.DeviceChallenge),
+		AMR:                   exportedString(r.AMR),
+		SID:                   exportedString(r.SID),
+		Issuer:                exportedString(r.Issuer),
+		FlaggedAt:             exportedTime(r.FlaggedAt),
+		FlaggedReason:         exportedString(r.FlaggedReason),
+
+		SlidingExpiresAt:        exportedTime(row.SlidingExpiresAt),
+		AbsoluteExpiresAt:       exportedTime(row.AbsoluteExpiresAt),
+		ChainLength:             exportedInt(row.ChainLength),
+		GracedUntil:             exportedTime(row.GracedUntil),
+		LastPolledAt:            exportedTime(row.LastPolledAt),
+		PreviousGrantedScope:    exportedString(row.PreviousGrantedScope),
+		PreviousGrantedAudience: exportedString(row.PreviousGrantedAudience),
+		GrantUpdatedAt:          exportedTime(row.GrantUpdatedAt),
+	}
+}
+
+// toRow copies the exported session into the row, which is imported as an
+// active token.
+func (s *ExportedSession) toRow(r *OAuth2RequestSQL) {
+	r.ID = s.Signature
+	r.Request = s.RequestID
+	r.ConsentChallenge = importedString(s.ConsentChallenge)
+	r.RequestedAt = s.RequestedAt
+	r.Client = s.ClientID
+	r.Scopes = s.Scope
+	r.GrantedScope = s.GrantedScope
+	r.RequestedAudience = s.RequestedAudience
+	r.GrantedAudience = s.GrantedAudience
+	r.Form = s.Form
+	r.Subject = s.Subject
+	r.Active = true
+	r.Session = s.SessionData
+	r.AuthTime = importedTime(s.AuthTime)
+	r.ClientSnapshot = importedString(s.ClientSnapshot)
+	r.NonceHash = importedString(s.NonceHash)
+	r.IntrospectionAudience = importedString(s.IntrospectionAudience)
+	r.GrantType = importedString(s.GrantType)
+	r.ExpiresAt = importedTime(s.ExpiresAt)
+	r.DeviceChallenge = importedString(s.DeviceChallenge)
+	r.AMR = importedString(s.AMR)
+	r.SID = importedString(s.SID)
+	r.Issuer = importedString(s.Issuer)
+	r.FlaggedAt = importedTime(s.FlaggedAt)
+	r.FlaggedReason = importedString(s.FlaggedReason)
+}
+
+// tableColumns returns the values of the exported columns which the table has,
+// but which are not part of OAuth2RequestSQL, keyed by column. Columns without
+// a value are left out.
+func (s *ExportedSession) tableColumns(table tableName) map[string]driver.Valuer {
+	values := make(map[string]driver.Valuer)
+	for column, value := range map[string]driver.Valuer{
+		"sliding_expires_at":        importedTime(s.SlidingExpiresAt),
+		"absolute_expires_at":       importedTime(s.AbsoluteExpiresAt),
+		"chain_length":              importedInt(s.ChainLength),
+		"graced_until":              importedTime(s.GracedUntil),
+		"last_polled_at":            importedTime(s.LastPolledAt),
+		"previous_granted_scope":    importedString(s.PreviousGrantedScope),
+		"previous_granted_audience": importedString(s.PreviousGrantedAudience),
+		"grant_updated_at":          importedTime(s.GrantUpdatedAt),
+	} {
+		if v, _ := value.Value(); v != nil && slices.Contains(optionalTokenTableColumns[table], column) {
+			values[column] = value
+		}
+	}
+	return values
+}
+
+// importTableColumns writes the table-specific columns of the exported session
+// to its imported row, see ExportedSession.tableColumns.
+func (p *Persister) importTableColumns(ctx context.Context, c *pop.Connection, table tableName, s *ExportedSession) error {
+	values := s.tableColumns(table)
+	if len(values) == 0 {
+		return nil
+	}
+
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		columns = append(columns, column)
+	}
+	slices.Sort(columns)
+
+	assignments := make([]string, len(columns))
+	args := make([]interface{}, 0, len(columns)+2)
+	for i, column := range columns {
+		assignments[i] = column + " = ?"
+		args = append(args, values[column])
+	}
+	args = append(args, s.Signature, p.NetworkID(ctx))
+
+	/* #nosec G201 table and columns are static */
+	return sqlcon.HandleError(c.RawQuery(
+		fmt.Sprintf("UPDATE %s SET %s WHERE signature = ? AND nid = ?", p.tokenTable(ctx, table).TableName(), strings.Join(assignments, ", ")),
+		args...,
+	).Exec())
+}
+
+func exportedString(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	return &s.String
+}
+
+func importedString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+func exportedInt(i sql.NullInt64) *int64 {
+	if !i.Valid {
+		return nil
+	}
+	return &i.Int64
+}
+
+func importedInt(i *int64) sql.NullInt64 {
+	if i == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: *i, Valid: true}
+}
+
+func exportedTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func importedTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
+
+// ExportActiveSessions writes all active rows of the token table in the
+// current network to w as newline-delimited JSON, one ExportedSession per line,
+// and returns the number of exported rows. Sessions are not decrypted, so the
+// system secrets must be migrated alongside the export. Pair it with
+// ImportSessions to move sessions between deployments.
+func (p *Persister) ExportActiveSessions(ctx context.Context, table tableName, w io.Writer) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ExportActiveSessions")
+	defer otelx.End(span, &err)
+
+	if !slices.Contains(tokenTables, table) {
+		return 0, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
+	} else if err := p.requireSQLSessionBackend(table); err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	var count int
+	var last string
+	for {
+		var rows []exportedRow
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("SELECT %s FROM %s WHERE nid = ? AND active = true AND signature > ? ORDER BY signature LIMIT %d", exportedColumns(table), p.tokenTable(ctx, table).TableName(), exportSessionsPageSize),
+			p.NetworkID(ctx),
+			last,
+		).All(&rows); err != nil {
+			return count, sqlcon.HandleError(err)
+		}
+
+		for i := range rows {
+			if err := enc.Encode(newExportedSession(&rows[i])); err != nil {
+				return count, errorsx.WithStack(err)
+			}
+			count++
+		}
+		if len(rows) < exportSessionsPageSize {
+			return count, nil
+		}
+		last = rows[len(rows)-1].ID
+	}
+}
+
+// ImportSessions reads sessions written by ExportActiveSessions from r and
+// stores them as active rows of the token table in the current network. All
+// sessions are imported in a single transaction, so either all or none of them
+// are stored. It returns the number of imported rows.
+func (p *Persister) ImportSessions(ctx context.Context, table tableName, r io.Reader) (_ int, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ImportSessions")
+	defer otelx.End(span, &err)
+
+	if !slices.Contains(tokenTables, table) {
+		return 0, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
+	} else if err := p.requireSQLSessionBackend(table); err != nil {
+		return 0, err
+	}
+
+	var signatures []string
+	if err := p.Transaction(ctx, func(ctx context.Context, c *pop.Connection) error {
+		dec := json.NewDecoder(r)
+		for {
+			var s ExportedSession
+			if err := dec.Decode(&s); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return errorsx.WithStack(fosite.ErrInvalidRequest.WithWrap(err).WithDebugf("Unable to decode the session at position %d: %s", len(signatures), err))
+			}
+
+			row := p.tokenTable(ctx, table)
+			s.toRow(row)
+			if err := p.createTokenRow(ctx, row); err != nil {
+				return sqlcon.HandleError(err)
+			}
+			if err := p.importTableColumns(ctx, c, table, &s); err != nil {
+				return err
+			}
+			signatures = append(signatures, row.ID)
+		}
+	}); err != nil {
+		return 0, err
+	}
+
+	return len(signatures), nil
+}
@@ -0,0 +1,88 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// flaggedTables are the token tables whose sessions can be flagged.
+var flaggedTables = []tableName{sqlTableAccess, sqlTableRefresh}
+
+// FlaggedSession is a row of a token table which was flagged for review, as
+// returned by ListFlaggedSessions.
+type FlaggedSession struct {
+	Signature string    `db:"signature" json:"signature"`
+	RequestID string    `db:"request_id" json:"request_id"`
+	ClientID  string    `db:"client_id" json:"client_id"`
+	Subject   string    `db:"subject" json:"subject"`
+	Active    bool      `db:"active" json:"active"`
+	FlaggedAt time.Time `db:"flagged_at" json:"flagged_at"`
+	Reason    string    `db:"flagged_reason" json:"reason"`
+}
+
+// FlagSession flags the session stored under the signature in the access or
+// refresh token table for review, e.g. by a fraud detection system. Flagging
+// does not affect the validity of the session, which keeps working until it is
+// revoked. Flagging a session again replaces its reason. It returns
+// fosite.ErrNotFound if no session is stored under the signature.
+func (p *Persister) FlagSession(ctx context.Context, table tableName, signature, reason string) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.FlagSession")
+	defer otelx.End(span, &err)
+	signature = normalizeSignature(signature)
+
+	if !slices.Contains(flaggedTables, table) {
+		return errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Sessions of table %q cannot be flagged.", table))
+	}
+
+	candidates := []string{signature}
+	if table == sqlTableAccess {
+		candidates = p.accessTokenSignatureCandidates(signature)
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	updated, err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("UPDATE %s SET flagged_at = ?, flagged_reason = ? WHERE signature IN (?) AND nid = ?", p.tokenTable(ctx, table).TableName()),
+		time.Now().UTC().Round(time.Second),
+		reason,
+		candidates,
+		p.NetworkID(ctx),
+	).ExecWithCount()
+	if err != nil {
+		return sqlcon.HandleError(err)
+	} else if updated == 0 {
+		return errorsx.WithStack(fosite.ErrNotFound)
+	}
+	return nil
+}
+
+// ListFlaggedSessions returns the flagged sessions of the access or refresh
+// token table in the current network, the most recently flagged first. Inactive sessions are
+// included, so that their flags can be triaged after revocation as well.
+func (p *Persister) ListFlaggedSessions(ctx context.Context, table tableName) (_ []FlaggedSession, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.ListFlaggedSessions")
+	defer otelx.End(span, &err)
+
+	if !slices.Contains(flaggedTables, table) {
+		return nil, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Sessions of table %q cannot be flagged.", table))
+	}
+
+	var sessions []FlaggedSession
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT signature, request_id, client_id, subject, active, flagged_at, COALESCE(flagged_reason, '') AS flagged_reason FROM %s WHERE flagged_at IS NOT NULL AND nid = ? ORDER BY flagged_at DESC, signature", p.tokenTable(ctx, table).TableName()),
+		p.NetworkID(ctx),
+	).All(&sessions); err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return sessions, nil
+}
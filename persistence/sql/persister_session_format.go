@@ -0,0 +1,131 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/ory/fosite"
+	"github.com/ory/hydra/v2/driver/config"
+	"github.com/ory/x/errorsx"
+)
+
+// sessionSerializer serializes the session_data of token sessions.
+type sessionSerializer interface {
+	// Marshal encodes the session.
+	Marshal(session fosite.Session) ([]byte, error)
+	// Unmarshal decodes data written by Marshal into the session.
+	Unmarshal(data []byte, session fosite.Session) error
+}
+
+// msgpackSessionTag prefixes session data serialized with msgpack. 0xc1 is
+// never used in msgpack and can neither start JSON nor valid UTF-8, so sessions
+// written before the format was configurable keep being read as JSON.
+var msgpackSessionTag = []byte{0xc1, 'm', 'p', '1'}
+
+var sessionSerializers = map[string]sessionSerializer{
+	config.SessionSerializationFormatJSON:    jsonSessionSerializer{},
+	config.SessionSerializationFormatMsgpack: msgpackSessionSerializer{},
+}
+
+type jsonSessionSerializer struct{}
+
+func (jsonSessionSerializer) Marshal(session fosite.Session) ([]byte, error) {
+	data, err := json.Marshal(session)
+	return data, errorsx.WithStack(err)
+}
+
+func (jsonSessionSerializer) Unmarshal(data []byte, session fosite.Session) error {
+	return errorsx.WithStack(json.Unmarshal(data, session))
+}
+
+// msgpackSessionSerializer encodes the session struct directly, using the
+// names of its JSON fields but inlining embedded structs. Unlike JSON, it keeps
+// the types of numbers in extra claims, which decode as int64, uint64 or
+// float64, and decodes times in the local time zone.
+type msgpackSessionSerializer struct{}
+
+func (msgpackSessionSerializer) Marshal(session fosite.Session) ([]byte, error) {
+	buf := bytes.NewBuffer(bytes.Clone(msgpackSessionTag))
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(session); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackSessionSerializer) Unmarshal(data []byte, session fosite.Session) error {
+	return errorsx.WithStack(newMsgpackSessionDecoder(data).Decode(session))
+}
+
+func newMsgpackSessionDecoder(data []byte) *msgpack.Decoder {
+	dec := msgpack.NewDecoder(bytes.NewReader(bytes.TrimPrefix(data, msgpackSessionTag)))
+	dec.SetCustomStructTag("json")
+	dec.UseLooseInterfaceDecoding(true)
+	return dec
+}
+
+// marshalSession serializes the session in the configured format. The
+// session_data column holds text, so binary formats are only used for sessions
+// that are encrypted afterwards; plain text sessions are always stored as JSON.
+func (p *Persister) marshalSession(ctx context.Context, session fosite.Session, encrypted bool) ([]byte, error) {
+	s, ok := sessionSerializers[p.config.SessionSerializationFormat(ctx)]
+	if !ok || !encrypted {
+		s = jsonSessionSerializer{}
+	}
+	return s.Marshal(session)
+}
+
+// unmarshalSession decodes session data written by marshalSession into the
+// session. The format is detected from the data, so that changing the
+// configured format does not affect existing sessions.
+func unmarshalSession(data []byte, session fosite.Session) error {
+	var s sessionSerializer = jsonSessionSerializer{}
+	if bytes.HasPrefix(data, msgpackSessionTag) {
+		s = msgpackSessionSerializer{}
+	}
+	return s.Unmarshal(data, session)
+}
+
+// unmarshalSessionTolerantly is unmarshalSession for sessions stored under an
+// older shape of the session type. If the session data does not decode as a
+// whole, its top-level fields are decoded one by one, and the fields which do
+// not match the session type are left out and returned. It only fails if the
+// session data is no JSON object. Sessions serialized with msgpack are always
+// decoded as a whole.
+func unmarshalSessionTolerantly(data []byte, session fosite.Session) (mismatched []string, err error) {
+	if bytes.HasPrefix(data, msgpackSessionTag) {
+		return nil, msgpackSessionSerializer{}.Unmarshal(data, session)
+	}
+	if err := json.Unmarshal(data, session); err == nil {
+		return nil, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, errorsx.WithStack(err)
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		field, err := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		if err != nil {
+			return nil, errorsx.WithStack(err)
+		}
+		if err := json.Unmarshal(field, session); err != nil {
+			mismatched = append(mismatched, key)
+		}
+	}
+	return mismatched, nil
+}
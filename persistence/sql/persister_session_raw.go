@@ -0,0 +1,106 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/ory/fosite"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// rawSessionSignatures validates that the sessions of the table are stored in
+// SQL, and returns the signatures under which the session of the signature may
+// be stored.
+func (p *Persister) rawSessionSignatures(table tableName, signature string) ([]string, error) {
+	if !slices.Contains(tokenTables, table) {
+		return nil, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
+	} else if err := p.requireSQLSessionBackend(table); err != nil {
+		return nil, err
+	}
+
+	signature = normalizeSignature(signature)
+	if table == sqlTableAccess {
+		return p.accessTokenSignatureCandidates(signature), nil
+	}
+	return []string{signature}, nil
+}
+
+// GetRawSessionBlob returns the session data of the session stored under the
+// signature in the token table exactly as stored, e.g. for external key
+// rotation tooling which re-encrypts it with another key. The data is neither
+// decrypted nor decoded, so it is ciphertext if the session was encrypted at
+// rest and the encoded session otherwise. It returns fosite.ErrNotFound if no
+// session is stored under the signature.
+//
+// The session data holds the claims of the tokens, so it must only be handed
+// to trusted tooling.
+func (p *Persister) GetRawSessionBlob(ctx context.Context, table tableName, signature string) (_ []byte, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.GetRawSessionBlob")
+	defer otelx.End(span, &err)
+
+	candidates, err := p.rawSessionSignatures(table, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var row struct {
+		Session []byte `db:"session_data"`
+	}
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	err = p.Connection(ctx).RawQuery(
+		fmt.Sprintf("SELECT session_data FROM %s WHERE signature IN (?) AND nid = ? LIMIT 1", p.tokenTable(ctx, table).TableName()),
+		candidates,
+		p.NetworkID(ctx),
+	).First(&row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errorsx.WithStack(fosite.ErrNotFound)
+	} else if err != nil {
+		return nil, sqlcon.HandleError(err)
+	}
+	return row.Session, nil
+}
+
+// SetRawSessionBlob replaces the session data of the session stored under the
+// signature in the token table with the blob, exactly as given. It returns
+// fosite.ErrNotFound if no session is stored under the signature.
+//
+// This is dangerous: the blob is neither validated nor encrypted, so it must
+// be readable by Hydra, i.e. encrypted with a key known to the key cipher or
+// an encoded session, or the session can no longer be read and its tokens stop
+// working. Writing an unencrypted blob stores the session in plaintext,
+// regardless of the configuration. Only trusted tooling may call it.
+func (p *Persister) SetRawSessionBlob(ctx context.Context, table tableName, signature string, blob []byte) (err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.SetRawSessionBlob")
+	defer otelx.End(span, &err)
+
+	candidates, err := p.rawSessionSignatures(table, signature)
+	if err != nil {
+		return err
+	}
+	if table == sqlTableAccess {
+		defer p.accessTokenCache.remove(accessTokenCacheKey(p.NetworkID(ctx), normalizeSignature(signature)))
+	}
+
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	updated, err := p.Connection(ctx).RawQuery(
+		fmt.Sprintf("UPDATE %s SET session_data = ? WHERE signature IN (?) AND nid = ?", p.tokenTable(ctx, table).TableName()),
+		blob,
+		candidates,
+		p.NetworkID(ctx),
+	).ExecWithCount()
+	if err != nil {
+		return sqlcon.HandleError(err)
+	} else if updated == 0 {
+		return errorsx.WithStack(fosite.ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ory/fosite"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/sqlcon"
+)
+
+// SignatureStrategy derives the signature under which an access token is
+// stored from the signature fosite computes for the token.
+type SignatureStrategy struct {
+	// Name identifies the strategy, e.g. in metrics.
+	Name string
+	// Derive returns the stored signature of the token signature.
+	Derive func(signature string) string
+}
+
+var (
+	// HashedSignatureStrategy stores the SignatureHash of the signature.
+	HashedSignatureStrategy = SignatureStrategy{Name: "hashed", Derive: SignatureHash}
+	// LegacySignatureStrategy stores the signature as-is, like older versions
+	// did.
+	LegacySignatureStrategy = SignatureStrategy{Name: "legacy", Derive: func(signature string) string { return signature }}
+
+	defaultSignatureStrategies = []SignatureStrategy{HashedSignatureStrategy, LegacySignatureStrategy}
+)
+
+// SetAccessTokenSignatureStrategies sets the strategies which derive the stored
+// signatures of access tokens. New tokens are stored under the first strategy,
+// and lookups try all strategies in order, so that tokens stored under previous
+// strategies keep resolving while the signature scheme is migrated. Read repair
+// rewrites such tokens to the first strategy. Passing no strategies restores
+// the default of HashedSignatureStrategy followed by LegacySignatureStrategy.
+// It must be called before the persister handles requests.
+func (p *Persister) SetAccessTokenSignatureStrategies(strategies ...SignatureStrategy) {
+	p.signatureStrategies = strategies
+}
+
+func (p *Persister) accessTokenSignatureStrategies() []SignatureStrategy {
+	if len(p.signatureStrategies) == 0 {
+		return defaultSignatureStrategies
+	}
+	return p.signatureStrategies
+}
+
+// storedAccessTokenSignature returns the signature under which a new access
+// token is stored.
+func (p *Persister) storedAccessTokenSignature(signature string) string {
+	return p.accessTokenSignatureStrategies()[0].Derive(signature)
+}
+
+// accessTokenSignatureCandidates returns the signatures under which the access
+// token may be stored, one per strategy and in the same order.
+func (p *Persister) accessTokenSignatureCandidates(signature string) []string {
+	strategies := p.accessTokenSignatureStrategies()
+	candidates := make([]string, len(strategies))
+	for i, s := range strategies {
+		candidates[i] = s.Derive(signature)
+	}
+	return candidates
+}
+
+// accessTokenLookupCandidates returns the signatures under which the access
+// token is looked up. Once the configured legacy fallback period has passed,
+// no token stored under a previous strategy can be valid anymore, so only the
+// signature of the current strategy is looked up.
+func (p *Persister) accessTokenLookupCandidates(ctx context.Context, signature string) []string {
+	candidates := p.accessTokenSignatureCandidates(signature)
+	if disabledAt := p.config.AccessTokenLegacyFallbackDisabledAt(ctx); !disabledAt.IsZero() && time.Now().After(disabledAt) {
+		return candidates[:1]
+	}
+	return candidates
+}
+
+// findAccessToken loads the access token row stored under any of the lookup
+// candidates into r, selecting only the given columns if any are given and
+// all columns of the table otherwise. It returns the index of the strategy the
+// row was found under, where 0 means that it is stored under the current
+// strategy.
+func (p *Persister) findAccessToken(ctx context.Context, r *OAuth2RequestSQL, signature string, columns ...string) (int, error) {
+	if len(columns) == 0 {
+		columns = tokenColumns(sqlTableAccess)
+	}
+	for i, candidate := range p.accessTokenLookupCandidates(ctx, signature) {
+		err := p.QueryWithNetwork(ctx).Select(columns...).Where("signature = ?", candidate).First(r)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return 0, sqlcon.HandleError(err)
+		}
+		if i == 0 {
+			recordCompatPath(ctx, CompatPathHashedSignature)
+		} else {
+			recordCompatPath(ctx, CompatPathLegacySignature)
+		}
+		return i, nil
+	}
+	return 0, errorsx.WithStack(fosite.ErrNotFound)
+}
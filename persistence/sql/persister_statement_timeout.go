@@ -0,0 +1,72 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+
+	"github.com/ory/x/sqlcon"
+)
+
+// statementTimeoutStatement returns the statement which limits the statements
+// following it in the current transaction to the timeout on the dialect, or an
+// empty string if the dialect has no such limit for DELETE and UPDATE
+// statements. MySQL's max_execution_time only applies to SELECT statements.
+func statementTimeoutStatement(dialect string, timeout time.Duration) string {
+	switch dialect {
+	case "postgres", "cockroach":
+		return fmt.Sprintf("SET LOCAL statement_timeout = '%dms'", timeout.Milliseconds())
+	default:
+		return ""
+	}
+}
+
+// execBulkStatement runs exec, which issues a bulk DELETE or UPDATE statement on
+// the given connection. If configured, the statement is limited to the bulk
+// statement timeout, so that the database aborts a runaway statement and
+// releases its locks. As the timeout is local to a transaction, exec runs in
+// the transaction of the caller if there is one, with the previous timeout
+// restored afterwards, and in a transaction of its own otherwise.
+func (p *Persister) execBulkStatement(ctx context.Context, c *pop.Connection, exec func(c *pop.Connection) (int, error)) (int, error) {
+	timeout := p.config.DbBulkStatementTimeout(ctx)
+	stmt := statementTimeoutStatement(c.Dialect.Name(), timeout)
+	if timeout <= 0 || stmt == "" {
+		return exec(c)
+	}
+
+	if c.TX != nil {
+		// Committing is up to the caller, whose transaction this is.
+		var previous string
+		if err := c.RawQuery("SHOW statement_timeout").First(&previous); err != nil {
+			return 0, sqlcon.HandleError(err)
+		}
+		if err := c.RawQuery(stmt).Exec(); err != nil {
+			return 0, sqlcon.HandleError(err)
+		}
+		n, err := exec(c)
+		if err != nil {
+			return n, err
+		}
+		/* #nosec G201 previous is quoted */
+		if err := c.RawQuery(fmt.Sprintf("SET LOCAL statement_timeout = '%s'", strings.ReplaceAll(previous, "'", "''"))).Exec(); err != nil {
+			return n, sqlcon.HandleError(err)
+		}
+		return n, nil
+	}
+
+	var n int
+	err := c.Transaction(func(tx *pop.Connection) (err error) {
+		if err := tx.RawQuery(stmt).Exec(); err != nil {
+			return sqlcon.HandleError(err)
+		}
+		n, err = exec(tx)
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,69 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var tokenTableNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,31}$`)
+
+// SetTokenTableNames overrides the names of token tables, which are keyed by
+// their default names, e.g. "access" or "device_code". The names follow the
+// "hydra_oauth2_" prefix, so mapping "access" to "tokens" stores access tokens
+// in hydra_oauth2_tokens. Tables which are not listed keep their default names.
+//
+// The migrations only create the default tables, so remapped tables must be
+// created with the same schema by the integrator. SetTokenTableNames checks
+// that every remapped table exists with all columns of its default table, and
+// returns an error otherwise, so that a missing or outdated table fails at
+// startup instead of on the first request using it. It must be called before
+// the persister handles requests, and not within a transaction.
+func (p *Persister) SetTokenTableNames(ctx context.Context, names map[string]string) error {
+	remapped := make(map[tableName]string, len(names))
+	for table, name := range names {
+		if !slices.Contains(tokenTables, tableName(table)) {
+			return errors.Errorf("unknown token table %q", table)
+		}
+		if !tokenTableNamePattern.MatchString(name) {
+			return errors.Errorf("invalid name %q for token table %q", name, table)
+		}
+		remapped[tableName(table)] = name
+	}
+
+	for table, name := range remapped {
+		if err := p.checkTokenTableSchema(ctx, table, "hydra_oauth2_"+name); err != nil {
+			return err
+		}
+	}
+
+	p.tokenTableNames = remapped
+	return nil
+}
+
+// checkTokenTableSchema returns an error unless the table exists with all
+// columns the default table of the token table has.
+func (p *Persister) checkTokenTableSchema(ctx context.Context, table tableName, name string) error {
+	columns := append(slices.Clone(tokenTableColumns), optionalTokenTableColumns[table]...)
+	/* #nosec G201 name matches tokenTableNamePattern and columns are static */
+	if err := p.Connection(ctx).RawQuery(fmt.Sprintf("SELECT %s FROM %s WHERE 1 = 0", strings.Join(columns, ", "), name)).Exec(); err != nil {
+		return errors.Wrapf(err, "token table %q must be created as %s with the columns %s", table, name, strings.Join(columns, ", "))
+	}
+	return nil
+}
+
+// tokenTableName returns the name of the table without the "hydra_oauth2_"
+// prefix.
+func (p *Persister) tokenTableName(table tableName) string {
+	if name, ok := p.tokenTableNames[table]; ok {
+		return name
+	}
+	return string(table)
+}
@@ -0,0 +1,87 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/ory/fosite"
+	"github.com/ory/x/errorsx"
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// CountSessions returns the number of rows of the token table which belong to
+// the network of the context. The statistics of the database catalog are not
+// kept per network, so the rows are counted exactly, which reads every row of
+// the network and takes long on large networks. Use
+// EstimateSessionTableSizeAcrossNetworks for a cheap estimate of the whole
+// table instead.
+func (p *Persister) CountSessions(ctx context.Context, table tableName) (_ int64, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.CountSessions")
+	defer otelx.End(span, &err)
+
+	if !slices.Contains(tokenTables, table) {
+		return 0, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
+	} else if err := p.requireSQLSessionBackend(table); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := p.Connection(ctx).RawQuery(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE nid = ?", p.tokenTable(ctx, table).TableName()), p.NetworkID(ctx)).First(&count); err != nil {
+		return 0, sqlcon.HandleError(err)
+	}
+	return count, nil
+}
+
+// EstimateSessionTableSizeAcrossNetworks returns the approximate number of rows
+// of the token table across all networks, e.g. for dashboards of operators. It
+// ignores the network of the context and must not be exposed to tenants. On
+// PostgreSQL and MySQL the estimate is read from the statistics of the database
+// catalog without scanning the table, so it may lag behind recent writes until
+// the table is analyzed again. On other databases, or if the table has no
+// statistics yet, the rows are counted exactly.
+func (p *Persister) EstimateSessionTableSizeAcrossNetworks(ctx context.Context, table tableName) (_ int64, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.EstimateSessionTableSizeAcrossNetworks")
+	defer otelx.End(span, &err)
+
+	if !slices.Contains(tokenTables, table) {
+		return 0, errorsx.WithStack(fosite.ErrInvalidRequest.WithDebugf("Unknown token table %q.", table))
+	} else if err := p.requireSQLSessionBackend(table); err != nil {
+		return 0, err
+	}
+
+	c := p.Connection(ctx)
+	name := p.tokenTable(ctx, table).TableName()
+
+	var query string
+	switch c.Dialect.Name() {
+	case "postgres":
+		// reltuples is -1 if the table was never analyzed.
+		query = "SELECT CASE WHEN reltuples < 0 THEN NULL ELSE reltuples::bigint END FROM pg_class WHERE oid = to_regclass(?)"
+	case "mysql":
+		query = "SELECT table_rows FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?"
+	}
+	if query != "" {
+		var estimate sql.NullInt64
+		if err := c.RawQuery(query, name).First(&estimate); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, sqlcon.HandleError(err)
+		} else if estimate.Valid {
+			return estimate.Int64, nil
+		}
+	}
+
+	var count int64
+	/* #nosec G201 table name is validated by SetTokenTableNames */
+	if err := c.RawQuery(fmt.Sprintf("SELECT COUNT(*) FROM %s", name)).First(&count); err != nil {
+		return 0, sqlcon.HandleError(err)
+	}
+	return count, nil
+}
@@ -5,6 +5,9 @@ package sql_test
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,10 +19,15 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/ory/fosite"
+	"github.com/ory/fosite/handler/openid"
 	"github.com/ory/hydra/v2/client"
 	"github.com/ory/hydra/v2/consent"
+	"github.com/ory/hydra/v2/driver/config"
 	"github.com/ory/hydra/v2/internal/testhelpers"
+	"github.com/ory/hydra/v2/oauth2"
 	"github.com/ory/hydra/v2/oauth2/trust"
+	persistencesql "github.com/ory/hydra/v2/persistence/sql"
 	"github.com/ory/x/contextx"
 	"github.com/ory/x/dbal"
 	"github.com/ory/x/networkx"
@@ -190,3 +198,266 @@ func TestManagers(t *testing.T) {
 		)
 	}
 }
+
+func newSerializationTestSession() *oauth2.Session {
+	session := oauth2.NewSession("sub")
+	session.Extra = map[string]interface{}{"number": 42.0, "list": []interface{}{"a", "b"}, "nested": map[string]interface{}{"key": "value"}}
+	session.ClientID = "client"
+	session.ConsentChallenge = "challenge"
+	session.Claims.Issuer = "https://issuer"
+	session.Claims.AuthenticationMethodsReferences = []string{"pwd"}
+	session.Claims.AuthTime = time.Now().Round(time.Second)
+	session.SetExpiresAt(fosite.AccessToken, time.Now().Add(time.Hour).Round(time.Second))
+	return session
+}
+
+func TestSessionSerializationRoundTrip(t *testing.T) {
+	for _, format := range []string{config.SessionSerializationFormatJSON, config.SessionSerializationFormatMsgpack} {
+		t.Run("format="+format, func(t *testing.T) {
+			expected := newSerializationTestSession()
+			data, err := persistencesql.MarshalSessionAs(format, expected)
+			require.NoError(t, err)
+
+			actual := oauth2.NewSession("")
+			require.NoError(t, persistencesql.UnmarshalSession(data, actual))
+			assert.Equal(t, expected.GetSubject(), actual.GetSubject())
+			assert.Equal(t, expected.Extra, actual.Extra)
+			assert.Equal(t, expected.ClientID, actual.ClientID)
+			assert.Equal(t, expected.ConsentChallenge, actual.ConsentChallenge)
+			assert.Equal(t, expected.Claims.Issuer, actual.Claims.Issuer)
+			assert.Equal(t, expected.Claims.AuthenticationMethodsReferences, actual.Claims.AuthenticationMethodsReferences)
+			assert.True(t, expected.Claims.AuthTime.Equal(actual.Claims.AuthTime))
+			assert.True(t, expected.GetExpiresAt(fosite.AccessToken).Equal(actual.GetExpiresAt(fosite.AccessToken)))
+		})
+	}
+}
+
+func BenchmarkSessionSerialization(b *testing.B) {
+	session := newSerializationTestSession()
+	for _, format := range []string{config.SessionSerializationFormatJSON, config.SessionSerializationFormatMsgpack} {
+		data, err := persistencesql.MarshalSessionAs(format, session)
+		require.NoError(b, err)
+
+		b.Run("format="+format+"/op=marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := persistencesql.MarshalSessionAs(format, session); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("format="+format+"/op=unmarshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				target := &oauth2.Session{DefaultSession: new(openid.DefaultSession)}
+				if err := persistencesql.UnmarshalSession(data, target); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDeleteAccessTokens compares deleting the access tokens of a client
+// by ctid in batches to deleting them in a single statement on PostgreSQL.
+func BenchmarkDeleteAccessTokens(b *testing.B) {
+	if testing.Short() {
+		b.Skip("The benchmark requires PostgreSQL.")
+	}
+	ctx := context.Background()
+	reg := internal.NewRegistrySQLFromURL(b, internal.ConnectToPG(b), true, &contextx.Default{})
+	p, ok := reg.Persister().(*persistencesql.Persister)
+	require.True(b, ok)
+
+	cl := &client.Client{ID: "bulk-benchmark-client"}
+	require.NoError(b, p.CreateClient(ctx, cl))
+
+	const n = 1000
+	createTokens := func(b *testing.B) {
+		for i := 0; i < n; i++ {
+			require.NoError(b, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Round(time.Second),
+				Client:      cl,
+				Session:     oauth2.NewSession("sub"),
+			}))
+		}
+	}
+
+	for name, deleteTokens := range map[string]func() error{
+		"path=ctid": func() error {
+			_, err := p.DeleteAccessTokensByCTID(ctx, cl.ID, 100)
+			return err
+		},
+		"path=portable": func() error {
+			return p.Connection(ctx).RawQuery("DELETE FROM hydra_oauth2_access WHERE client_id = ? AND nid = ?", cl.ID, p.NetworkID(ctx)).Exec()
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				createTokens(b)
+				b.StartTimer()
+				if err := deleteTokens(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetAccessTokenSession(b *testing.B) {
+	ctx := context.Background()
+	reg := internal.NewRegistrySQLFromURL(b, dbal.NewSQLiteTestDatabase(b), true, &contextx.Default{})
+	p, ok := reg.Persister().(*persistencesql.Persister)
+	require.True(b, ok)
+	reg.Config().MustSet(ctx, config.KeyEncryptSessionData, false)
+
+	cl := &client.Client{ID: "benchmark-client"}
+	require.NoError(b, p.CreateClient(ctx, cl))
+
+	signature := uuid.Must(uuid.NewV4()).String()
+	session := oauth2.NewSession("sub")
+	session.Extra = map[string]interface{}{"foo": strings.Repeat("bar", 1024)}
+	require.NoError(b, p.CreateAccessTokenSession(ctx, signature, &fosite.Request{
+		ID:          uuid.Must(uuid.NewV4()).String(),
+		RequestedAt: time.Now().UTC().Round(time.Second),
+		Client:      cl,
+		Session:     session,
+	}))
+
+	for _, assume := range []bool{false, true} {
+		b.Run(fmt.Sprintf("assume_plaintext=%t", assume), func(b *testing.B) {
+			reg.Config().MustSet(ctx, config.KeyAssumePlaintextSessionData, assume)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.GetAccessTokenSession(ctx, signature, new(oauth2.Session)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// seedSubjectTokens stores access, refresh, and OpenID Connect sessions for
+// requests of the given number of subjects and returns the subjects.
+func seedSubjectTokens(ctx context.Context, tb testing.TB, p *persistencesql.Persister, cl *client.Client, subjects, requestsPerSubject int) []string {
+	seeded := make([]string, subjects)
+	for i := range seeded {
+		seeded[i] = fmt.Sprintf("subject-%d", i)
+		for j := 0; j < requestsPerSubject; j++ {
+			r := &fosite.Request{
+				ID:          uuid.Must(uuid.NewV4()).String(),
+				RequestedAt: time.Now().UTC().Add(time.Duration(j) * time.Second).Round(time.Second),
+				Client:      cl,
+				Session:     oauth2.NewSession(seeded[i]),
+			}
+			require.NoError(tb, p.CreateAccessTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), r))
+			require.NoError(tb, p.CreateRefreshTokenSession(ctx, uuid.Must(uuid.NewV4()).String(), r))
+			require.NoError(tb, p.CreateOpenIDConnectSession(ctx, uuid.Must(uuid.NewV4()).String(), r))
+		}
+	}
+	return seeded
+}
+
+func BenchmarkErasureBySubject(b *testing.B) {
+	ctx := context.Background()
+	reg := internal.NewRegistrySQLFromURL(b, dbal.NewSQLiteTestDatabase(b), true, &contextx.Default{})
+	p, ok := reg.Persister().(*persistencesql.Persister)
+	require.True(b, ok)
+
+	cl := &client.Client{ID: "benchmark-client"}
+	require.NoError(b, p.CreateClient(ctx, cl))
+	seedSubjectTokens(ctx, b, p, cl, 500, 4)
+
+	// Erasing unknown subjects deletes nothing, so every iteration looks up
+	// the same number of token rows.
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.ErasureBySubject(ctx, fmt.Sprintf("unknown-%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRunShardFlushes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("case=concurrency never exceeds the cap", func(t *testing.T) {
+		const shards, maxConcurrency = 12, 3
+
+		var running, peak atomic.Int32
+		var calls [shards]atomic.Int32
+		deleted, err := persistencesql.RunShardFlushes(ctx, shards, maxConcurrency, func(_ context.Context, shard, n int) (int, error) {
+			assert.Equal(t, shards, n)
+			calls[shard].Add(1)
+
+			current := running.Add(1)
+			defer running.Add(-1)
+			for {
+				prev := peak.Load()
+				if current <= prev || peak.CompareAndSwap(prev, current) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return 1, nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, shards, deleted)
+		assert.LessOrEqual(t, peak.Load(), int32(maxConcurrency))
+		for shard := range calls {
+			assert.EqualValues(t, 1, calls[shard].Load(), "shard=%d", shard)
+		}
+	})
+
+	t.Run("case=returns shard errors", func(t *testing.T) {
+		_, err := persistencesql.RunShardFlushes(ctx, 4, 2, func(_ context.Context, shard, _ int) (int, error) {
+			if shard == 2 {
+				return 0, errors.New("shard failed")
+			}
+			return 1, nil
+		})
+		assert.EqualError(t, err, "shard failed")
+	})
+}
+
+func TestHandleDeleteError(t *testing.T) {
+	assert.NoError(t, persistencesql.HandleDeleteError(2, nil))
+	assert.ErrorIs(t, persistencesql.HandleDeleteError(0, nil), fosite.ErrNotFound)
+
+	deadlock := errors.New("Error 1213 (40001): Deadlock found when trying to get lock; try restarting transaction")
+	assert.ErrorIs(t, persistencesql.HandleDeleteError(0, deadlock), fosite.ErrSerializationFailure)
+
+	boom := errors.New("boom")
+	assert.ErrorIs(t, persistencesql.HandleDeleteError(0, boom), boom)
+}
+
+func TestFlushMaintenanceStatements(t *testing.T) {
+	assert.Equal(t, []string{"VACUUM (ANALYZE) hydra_oauth2_access"}, persistencesql.FlushMaintenanceStatements("postgres", "hydra_oauth2_access"))
+	assert.Equal(t, []string{"ANALYZE hydra_oauth2_access"}, persistencesql.FlushMaintenanceStatements("cockroach", "hydra_oauth2_access"))
+	assert.Equal(t, []string{"PRAGMA incremental_vacuum", "ANALYZE hydra_oauth2_access"}, persistencesql.FlushMaintenanceStatements("sqlite3", "hydra_oauth2_access"))
+	assert.Empty(t, persistencesql.FlushMaintenanceStatements("mysql", "hydra_oauth2_access"))
+}
+
+func TestAdaptFlushBatchSize(t *testing.T) {
+	budget := 100 * time.Millisecond
+	assert.Equal(t, 50, persistencesql.AdaptFlushBatchSize(100, 100, 200*time.Millisecond, budget))
+	assert.Equal(t, 1, persistencesql.AdaptFlushBatchSize(10, 100, time.Hour, budget))
+	assert.Equal(t, 40, persistencesql.AdaptFlushBatchSize(40, 100, 80*time.Millisecond, budget))
+	assert.Equal(t, 80, persistencesql.AdaptFlushBatchSize(40, 100, 10*time.Millisecond, budget))
+	assert.Equal(t, 100, persistencesql.AdaptFlushBatchSize(80, 100, 10*time.Millisecond, budget))
+}
+
+func TestStatementTimeoutStatement(t *testing.T) {
+	for dialect, expected := range map[string]string{
+		"postgres":  "SET LOCAL statement_timeout = '1500ms'",
+		"cockroach": "SET LOCAL statement_timeout = '1500ms'",
+		"mysql":     "",
+		"sqlite3":   "",
+	} {
+		assert.Equal(t, expected, persistencesql.StatementTimeoutStatement(dialect, 1500*time.Millisecond), dialect)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package sql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ory/x/otelx"
+	"github.com/ory/x/sqlcon"
+)
+
+// TokenGraph is the graph of the tokens of a subject, as returned by
+// BuildTokenGraphBySubject.
+type TokenGraph struct {
+	Subject string `json:"subject"`
+	// Families are the token families of the subject, the earliest issued
+	// first. A family consists of the tokens issued for one request ID.
+	Families []TokenGraphFamily `json:"families"`
+}
+
+// TokenGraphFamily are the tokens issued for one request ID: the authorization
+// code exchanged, and the tokens issued by the exchange and by every rotation
+// of the refresh token since.
+type TokenGraphFamily struct {
+	RequestID string `json:"request_id"`
+	ClientID  string `json:"client_id"`
+
+	AuthorizeCodes        []TokenGraphNode `json:"authorize_codes"`
+	OpenIDConnectSessions []TokenGraphNode `json:"openid_connect_sessions"`
+	// RefreshTokens are the refresh tokens of the family in the order they
+	// were rotated.
+	RefreshTokens []TokenGraphRefreshToken `json:"refresh_tokens"`
+	// UnlinkedAccessTokens are the access tokens which were not issued
+	// together with any refresh token of the family. Grants which issue no
+	// refresh token lead to these, as do refresh tokens which were flushed
+	// or whose rows were tampered with.
+	UnlinkedAccessTokens []TokenGraphNode `json:"unlinked_access_tokens"`
+}
+
+// TokenGraphRefreshToken is a refresh token in a TokenGraphFamily.
+type TokenGraphRefreshToken struct {
+	TokenGraphNode
+	// ChainLength is the number of rotations which led to the refresh token.
+	ChainLength int `json:"chain_length"`
+	// AccessTokens are the access tokens issued together with the refresh
+	// token.
+	AccessTokens []TokenGraphNode `json:"access_tokens"`
+}
+
+// TokenGraphNode is a token in a TokenGraph.
+type TokenGraphNode struct {
+	Signature   string    `json:"signature"`
+	RequestedAt time.Time `json:"requested_at"`
+	Active      bool      `json:"active"`
+}
+
+// tokenGraphRow is a row of a token table read by BuildTokenGraphBySubject.
+type tokenGraphRow struct {
+	Signature   string    `db:"signature"`
+	Request     string    `db:"request_id"`
+	Client      string    `db:"client_id"`
+	RequestedAt time.Time `db:"requested_at"`
+	Active      bool      `db:"active"`
+	ChainLength int       `db:"chain_length"`
+}
+
+func (r tokenGraphRow) node() TokenGraphNode {
+	return TokenGraphNode{Signature: r.Signature, RequestedAt: r.RequestedAt, Active: r.Active}
+}
+
+// BuildTokenGraphBySubject returns the graph of the authorization codes,
+// OpenID Connect sessions, refresh and access tokens of the subject in the
+// current network, e.g. to assess which tokens an incident affects. Tokens are
+// grouped into families by their request ID. Within a family, access tokens
+// are linked to the refresh token issued together with them, which fosite
+// stores with the same request time, so that the graph also reveals access
+// tokens without their refresh token. Inactive tokens are included.
+func (p *Persister) BuildTokenGraphBySubject(ctx context.Context, subject string) (_ *TokenGraph, err error) {
+	ctx, span := p.r.Tracer(ctx).Tracer().Start(ctx, "persistence.sql.BuildTokenGraphBySubject")
+	defer otelx.End(span, &err)
+
+	if err := p.requireSQLSessionBackend(sqlTableCode); err != nil {
+		return nil, err
+	}
+
+	rows := make(map[tableName][]tokenGraphRow, 4)
+	for _, table := range []tableName{sqlTableCode, sqlTableOpenID, sqlTableRefresh, sqlTableAccess} {
+		chainLength := "0"
+		if table == sqlTableRefresh {
+			chainLength = "chain_length"
+		}
+
+		var r []tokenGraphRow
+		/* #nosec G201 table name is validated by SetTokenTableNames */
+		if err := p.Connection(ctx).RawQuery(
+			fmt.Sprintf("SELECT signature, request_id, client_id, requested_at, active, %s AS chain_length FROM %s WHERE subject = ? AND nid = ? ORDER BY requested_at, signature", chainLength, p.tokenTable(ctx, table).TableName()),
+			subject,
+			p.NetworkID(ctx),
+		).All(&r); err != nil {
+			return nil, sqlcon.HandleError(err)
+		}
+		rows[table] = r
+	}
+
+	families := map[string]*TokenGraphFamily{}
+	firstIssued := map[string]time.Time{}
+	family := func(r tokenGraphRow) *TokenGraphFamily {
+		f, ok := families[r.Request]
+		if !ok {
+			f = &TokenGraphFamily{RequestID: r.Request, ClientID: r.Client}
+			families[r.Request] = f
+		}
+		if t, ok := firstIssued[r.Request]; !ok || r.RequestedAt.Before(t) {
+			firstIssued[r.Request] = r.RequestedAt
+		}
+		return f
+	}
+
+	for _, r := range rows[sqlTableCode] {
+		f := family(r)
+		f.AuthorizeCodes = append(f.AuthorizeCodes, r.node())
+	}
+	for _, r := range rows[sqlTableOpenID] {
+		f := family(r)
+		f.OpenIDConnectSessions = append(f.OpenIDConnectSessions, r.node())
+	}
+	for _, r := range rows[sqlTableRefresh] {
+		f := family(r)
+		f.RefreshTokens = append(f.RefreshTokens, TokenGraphRefreshToken{TokenGraphNode: r.node(), ChainLength: r.ChainLength})
+	}
+	for _, r := range rows[sqlTableAccess] {
+		f := family(r)
+		linked := false
+		for i := range f.RefreshTokens {
+			if f.RefreshTokens[i].RequestedAt.Equal(r.RequestedAt) {
+				f.RefreshTokens[i].AccessTokens = append(f.RefreshTokens[i].AccessTokens, r.node())
+				linked = true
+				break
+			}
+		}
+		if !linked {
+			f.UnlinkedAccessTokens = append(f.UnlinkedAccessTokens, r.node())
+		}
+	}
+
+	graph := &TokenGraph{Subject: subject, Families: make([]TokenGraphFamily, 0, len(families))}
+	for _, f := range families {
+		graph.Families = append(graph.Families, *f)
+	}
+	sort.Slice(graph.Families, func(i, j int) bool {
+		a, b := graph.Families[i].RequestID, graph.Families[j].RequestID
+		if !firstIssued[a].Equal(firstIssued[b]) {
+			return firstIssued[a].Before(firstIssued[b])
+		}
+		return a < b
+	})
+	return graph, nil
+}
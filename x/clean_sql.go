@@ -18,6 +18,7 @@ func DeleteHydraRows(t *testing.T, c *pop.Connection) {
 		"hydra_oauth2_pkce",
 		"hydra_oauth2_device_code",
 		"hydra_oauth2_user_code",
+		"hydra_oauth2_outbox",
 		"hydra_oauth2_flow",
 		"hydra_oauth2_device_flow",
 		"hydra_oauth2_authentication_session",
@@ -44,6 +45,7 @@ func CleanSQLPop(t *testing.T, c *pop.Connection) {
 		"hydra_oauth2_pkce",
 		"hydra_oauth2_device_code",
 		"hydra_oauth2_user_code",
+		"hydra_oauth2_outbox",
 		"hydra_oauth2_flow",
 		"hydra_oauth2_device_flow",
 		"hydra_oauth2_authentication_session",
@@ -4,6 +4,8 @@
 package x
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/ory/fosite"
@@ -21,8 +23,127 @@ var (
 		ErrorField:       http.StatusText(http.StatusConflict),
 		DescriptionField: "Unable to process the requested resource because of conflict in the current state",
 	}
+	// ErrClientDeleted is wrapped in fosite.ErrNotFound when the client a stored
+	// request was issued to no longer exists.
+	ErrClientDeleted = errors.New("the client of the stored request no longer exists")
+	// ErrClientCredentialsRotated is wrapped in fosite.ErrNotFound when a token
+	// was requested before the credentials of its client were rotated.
+	ErrClientCredentialsRotated = errors.New("the token was issued before the client credentials were rotated")
+	// ErrGrantedScopeErasure is wrapped in fosite.ErrServerError when an update
+	// would remove all previously granted scopes of an OpenID Connect session.
+	ErrGrantedScopeErasure = errors.New("the update would erase all granted scopes of the session")
+	// ErrDeviceFlowNotHandled is wrapped in fosite.ErrAuthorizationPending when
+	// a device polls for tokens before the end-user handled its device flow.
+	ErrDeviceFlowNotHandled = errors.New("the device flow has not been handled by the end-user yet")
+	// ErrDeviceFlowExpired is wrapped in fosite.ErrDeviceExpiredToken when a
+	// device flow is completed after it expired.
+	ErrDeviceFlowExpired = errors.New("the device flow expired before it was completed")
+	// ErrFlushIndexMissing is wrapped in fosite.ErrServerError when a token
+	// table lacks the index supporting flushes and flushing it is refused.
+	ErrFlushIndexMissing = errors.New("the token table has no index supporting the flush")
 )
 
+// TooManyAudiencesError is returned when a request asks for more audiences than
+// allowed by the configuration. It unwraps to fosite.ErrInvalidRequest.
+type TooManyAudiencesError struct {
+	// Count is the number of requested audiences.
+	Count int
+	// Limit is the configured maximum.
+	Limit int
+}
+
+func (e *TooManyAudiencesError) Error() string {
+	return fmt.Sprintf("the request asks for %d audiences, but at most %d are allowed", e.Count, e.Limit)
+}
+
+func (e *TooManyAudiencesError) Unwrap() error {
+	return fosite.ErrInvalidRequest.WithHintf("At most %d audiences may be requested.", e.Limit)
+}
+
+// IntrospectionAudienceError is returned when a resource server introspects a
+// token which is bound to other resource servers. It unwraps to
+// fosite.ErrRequestForbidden.
+type IntrospectionAudienceError struct {
+	// ResourceServer is the resource server which introspected the token.
+	ResourceServer string
+}
+
+func (e *IntrospectionAudienceError) Error() string {
+	return fmt.Sprintf("the token may not be introspected by resource server %q", e.ResourceServer)
+}
+
+func (e *IntrospectionAudienceError) Unwrap() error {
+	return fosite.ErrRequestForbidden.WithHint("The token may not be introspected by this resource server.")
+}
+
+// RefreshTokenChainLengthError is returned when a refresh token would be
+// rotated beyond the configured maximum chain length. It unwraps to
+// fosite.ErrInvalidGrant, so that the client has the end-user authenticate
+// again.
+type RefreshTokenChainLengthError struct {
+	// Limit is the configured maximum chain length.
+	Limit int
+}
+
+func (e *RefreshTokenChainLengthError) Error() string {
+	return fmt.Sprintf("the refresh token chain reached its maximum length of %d rotations", e.Limit)
+}
+
+func (e *RefreshTokenChainLengthError) Unwrap() error {
+	return fosite.ErrInvalidGrant.WithHint("The refresh token was rotated too often, the end-user has to authenticate again.")
+}
+
+// DuplicateSignatureError is returned when a token is stored under a signature
+// which is already taken. Signatures are random, so this indicates a broken
+// token generator or a retried write. It unwraps to fosite.ErrServerError.
+type DuplicateSignatureError struct {
+	// Table is the token table, e.g. "access".
+	Table string
+}
+
+func (e *DuplicateSignatureError) Error() string {
+	return fmt.Sprintf("a token with the same signature already exists in token table %q", e.Table)
+}
+
+func (e *DuplicateSignatureError) Unwrap() error {
+	return fosite.ErrServerError.WithDebugf("A token with the same signature already exists in token table %q.", e.Table)
+}
+
+// EmptySubjectError is returned when a token would be issued without a subject
+// by a grant which is configured to require one. For grants acting on behalf
+// of an end-user this indicates a bug in the login or consent handling. It
+// unwraps to fosite.ErrServerError.
+type EmptySubjectError struct {
+	// GrantType is the grant which issued the token, e.g. "authorization_code".
+	GrantType string
+}
+
+func (e *EmptySubjectError) Error() string {
+	return fmt.Sprintf("a token issued by grant %q has no subject", e.GrantType)
+}
+
+func (e *EmptySubjectError) Unwrap() error {
+	return fosite.ErrServerError.WithDebugf("A token issued by grant %q has no subject.", e.GrantType)
+}
+
+// DeviceFlowLimitError is returned when a client requests a device flow while
+// it already has the maximum number of pending device flows. It unwraps to
+// fosite.ErrPollingRateLimited.
+type DeviceFlowLimitError struct {
+	// ClientID is the client which exceeded the limit.
+	ClientID string
+	// Limit is the maximum number of pending device flows per client.
+	Limit int
+}
+
+func (e *DeviceFlowLimitError) Error() string {
+	return fmt.Sprintf("client %q already has the maximum of %d pending device flows", e.ClientID, e.Limit)
+}
+
+func (e *DeviceFlowLimitError) Unwrap() error {
+	return fosite.ErrPollingRateLimited.WithHint("The client has too many pending device authorization requests.")
+}
+
 func LogError(r *http.Request, err error, logger *logrusx.Logger) {
 	if logger == nil {
 		logger = logrusx.New("", "")
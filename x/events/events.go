@@ -52,6 +52,10 @@ const (
 	// AccessTokenRevoked will be emitted by requests to POST /oauth2/revoke.
 	AccessTokenRevoked semconv.Event = "OAuth2AccessTokenRevoked" //nolint:gosec
 
+	// AccessTokenDeleted will be emitted when an access token is deleted by its
+	// signature.
+	AccessTokenDeleted semconv.Event = "OAuth2AccessTokenDeleted" //nolint:gosec
+
 	// RefreshTokenIssued will be emitted when a refresh token is issued.
 	RefreshTokenIssued semconv.Event = "OAuth2RefreshTokenIssued" //nolint:gosec
 
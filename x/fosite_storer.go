@@ -16,6 +16,32 @@ import (
 	"github.com/ory/fosite/handler/verifiable"
 )
 
+// FlushStopReason tells why a flush stopped deleting records.
+type FlushStopReason string
+
+const (
+	// FlushStoppedDrained means that no more eligible records were left.
+	FlushStoppedDrained FlushStopReason = "drained"
+	// FlushStoppedLimit means that the flush deleted as many records as the
+	// limit allowed.
+	FlushStoppedLimit FlushStopReason = "limit"
+	// FlushStoppedDeadline means that the flush time budget was exhausted.
+	FlushStoppedDeadline FlushStopReason = "deadline"
+)
+
+// FlushResult summarizes a flush run.
+type FlushResult struct {
+	// Deleted is the number of deleted records.
+	Deleted int
+	// Batches is the number of delete statements which were executed.
+	Batches int
+	// Duration is the wall-clock time the flush took.
+	Duration time.Duration
+	// StoppedReason tells why the flush stopped. It is empty if the flush
+	// failed.
+	StoppedReason FlushStopReason
+}
+
 type FositeStorer interface {
 	fosite.Storage
 	oauth2.CoreStorage
@@ -28,11 +54,19 @@ type FositeStorer interface {
 
 	RevokeRefreshToken(ctx context.Context, requestID string) error
 
+	// ReduceRefreshTokenScope removes scopes from the grant of a refresh token,
+	// revoking it if no scope remains.
+	ReduceRefreshTokenScope(ctx context.Context, requestID string, removeScopes []string) error
+
 	RevokeAccessToken(ctx context.Context, requestID string) error
 
 	// flush the access token requests from the database.
 	// no data will be deleted after the 'notAfter' timeframe.
-	FlushInactiveAccessTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) error
+	FlushInactiveAccessTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) (FlushResult, error)
+
+	// FlushInactiveAccessTokensParallel flushes the access token requests in
+	// shards, running at most maxConcurrency shards at the same time.
+	FlushInactiveAccessTokensParallel(ctx context.Context, notAfter time.Time, limitPerShard, batchSize, shards, maxConcurrency int) (int, error)
 
 	// flush the login requests from the database.
 	// this will address the database long-term growth issues discussed in https://github.com/ory/hydra/issues/1574.
@@ -41,9 +75,17 @@ type FositeStorer interface {
 
 	DeleteAccessTokens(ctx context.Context, clientID string) error
 
-	FlushInactiveRefreshTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) error
+	FlushInactiveRefreshTokens(ctx context.Context, notAfter time.Time, limit int, batchSize int) (FlushResult, error)
+
+	// CleanupOrphanedGrantSessions deletes access tokens older than olderThan
+	// whose refresh token was never stored, and returns how many it deleted.
+	CleanupOrphanedGrantSessions(ctx context.Context, olderThan time.Duration) (int, error)
 
 	UpdateOpenIDConnectSessionByRequestID(ctx context.Context, requestID string, requester fosite.Requester) error
+	// UpsertOpenIDConnectSession updates the OpenID Connect session of the
+	// request, or creates it if there is none yet.
+	UpsertOpenIDConnectSession(ctx context.Context, requestID string, requester fosite.Requester) error
+	GetOpenIDConnectSessionByRequestID(ctx context.Context, requestID string, session fosite.Session) (fosite.Requester, error)
 
 	// DeleteOpenIDConnectSession deletes an OpenID Connect session.
 	// This is duplicated from Ory Fosite to help against deprecation linting errors.
@@ -51,5 +93,70 @@ type FositeStorer interface {
 
 	GetDeviceCodeSessionByRequestID(ctx context.Context, requestID string, requester fosite.Session) (fosite.Requester, error)
 	UpdateDeviceCodeSessionByRequestID(ctx context.Context, requestID string, requester fosite.Requester) error
+	// CheckDevicePollAllowed records a token poll for a device code and reports
+	// whether it arrived at least minInterval after the previous one.
+	CheckDevicePollAllowed(ctx context.Context, signature string, minInterval time.Duration) (allowed bool, retryAfter time.Duration, err error)
+	// ExchangeDeviceCode atomically marks the device code as used and stores
+	// the access and, if refreshSignature is not empty, refresh token.
+	ExchangeDeviceCode(ctx context.Context, deviceSignature, accessSignature string, access fosite.Requester, refreshSignature string, refresh fosite.Requester) error
+	// DeleteClientAssertionJWTsByClient deletes the JTIs of the client's
+	// assertions and returns how many it deleted.
+	DeleteClientAssertionJWTsByClient(ctx context.Context, clientID string) (int, error)
+	// IsAuthTimeWithin reports whether the authentication behind a refresh token
+	// happened within maxAge, e.g. to enforce max_age on the refresh grant.
+	IsAuthTimeWithin(ctx context.Context, signature string, maxAge time.Duration) (bool, error)
+	// RotateRefreshToken atomically deactivates the old refresh token, stores
+	// the new one, and returns the requester of the old one.
+	RotateRefreshToken(ctx context.Context, oldSignature, newSignature string, requester fosite.Requester) (fosite.Requester, error)
+	// GetActiveTokensByGrantedScope returns the active access and refresh
+	// tokens of the client which were granted exactly the given scope.
+	GetActiveTokensByGrantedScope(ctx context.Context, clientID, scope string) ([]fosite.Requester, error)
+	// IsNonceUsed reports whether an OpenID Connect or authorize code session
+	// with the given nonce was already stored for the client.
+	IsNonceUsed(ctx context.Context, clientID, nonce string) (bool, error)
+	// CheckIntrospectionAudience returns an error if the access token is
+	// bound to an introspection audience which lacks the resource server.
+	CheckIntrospectionAudience(ctx context.Context, signature, resourceServer string) error
+	// RevokeDeviceGrantedTokens revokes the access and refresh tokens of the
+	// client which were granted through the device authorization grant.
+	RevokeDeviceGrantedTokens(ctx context.Context, clientID string) error
+	// GetTokensByDeviceChallenge returns the active access and refresh tokens
+	// which were granted through the device challenge.
+	GetTokensByDeviceChallenge(ctx context.Context, challenge string) ([]fosite.Requester, error)
+	// RevokeTokensByDeviceChallenge revokes the access and refresh tokens
+	// which were granted through the device challenge.
+	RevokeTokensByDeviceChallenge(ctx context.Context, challenge string) error
+	// RevokeTokensByAMR revokes the access and refresh tokens of the client
+	// whose session was authenticated with the given method.
+	RevokeTokensByAMR(ctx context.Context, clientID, method string) error
+	// InvalidateAllTokensForClient deactivates all access and refresh tokens
+	// of the client at once, keeping them for auditing.
+	InvalidateAllTokensForClient(ctx context.Context, clientID string) error
+	// RevokeSessionForLogout revokes the tokens and OpenID Connect sessions
+	// of the subject and client within the login session sid at once.
+	RevokeSessionForLogout(ctx context.Context, subject, clientID, sid string) error
+	// RevokeSessionsBySID revokes the tokens and OpenID Connect sessions of
+	// all clients within the login session sid at once.
+	RevokeSessionsBySID(ctx context.Context, sid string) error
+	// GetLatestAccessTokenSession returns the most recently issued access
+	// token of the subject and client.
+	GetLatestAccessTokenSession(ctx context.Context, subject, clientID string) (fosite.Requester, error)
+	// RelinkSessionsConsentChallenge links the sessions issued from the old
+	// consent challenge to the new one and returns how many it relinked.
+	RelinkSessionsConsentChallenge(ctx context.Context, oldChallenge, newChallenge string) (int, error)
+	// InvalidateAuthorizeCodeSessionsByRequestIDs deactivates the active
+	// authorization codes of the requests and returns how many it deactivated.
+	InvalidateAuthorizeCodeSessionsByRequestIDs(ctx context.Context, ids []string) (int, error)
+	// InvalidateRefreshTokenBySignature deactivates a single refresh token but
+	// keeps it for audit. It returns fosite.ErrNotFound for unknown signatures.
+	InvalidateRefreshTokenBySignature(ctx context.Context, signature string) error
+
 	UpdateAndInvalidateUserCodeSessionByRequestID(ctx context.Context, signature, request_id string) (err error)
+	// ConsumeUserCodeSessionByRequestID atomically invalidates an active user
+	// code session and fails with ErrConflict if it was already used.
+	ConsumeUserCodeSessionByRequestID(ctx context.Context, requestID, challengeID string) error
+	// DeleteExpiredUserCodeSessions deletes user code sessions whose lifespan
+	// has passed, in batches of batchSize, and returns the number of deleted
+	// sessions.
+	DeleteExpiredUserCodeSessions(ctx context.Context, batchSize int) (int, error)
 }
@@ -4,7 +4,9 @@
 package x
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"strings"
 )
 
@@ -16,3 +18,56 @@ func DecodeSegment(seg string) ([]byte, error) {
 
 	return base64.URLEncoding.DecodeString(seg)
 }
+
+// TokenSignature returns the signature under which an opaque or JWT access
+// token is stored, regardless of the strategy which issued it.
+func TokenSignature(token string) string {
+	switch parts := strings.Split(token, "."); len(parts) {
+	case 2:
+		return parts[1]
+	case 3:
+		return parts[2]
+	default:
+		return ""
+	}
+}
+
+type clientAssertionClientIDKey struct{}
+
+// WithClientAssertionClientID returns a context in which the JTIs of client
+// assertions are stored as belonging to the client, so that they can be
+// deleted when the client is offboarded.
+func WithClientAssertionClientID(ctx context.Context, clientID string) context.Context {
+	if clientID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, clientAssertionClientIDKey{}, clientID)
+}
+
+// ClientAssertionClientID returns the client set by
+// WithClientAssertionClientID, or an empty string.
+func ClientAssertionClientID(ctx context.Context) string {
+	id, _ := ctx.Value(clientAssertionClientIDKey{}).(string)
+	return id
+}
+
+// UnverifiedJWTIssuer returns the iss claim of the JWT without verifying its
+// signature, or an empty string if it has none or is malformed. The result
+// must not be trusted for anything but bookkeeping.
+func UnverifiedJWTIssuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := DecodeSegment(parts[1])
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
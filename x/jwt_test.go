@@ -0,0 +1,30 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package x
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnverifiedJWTIssuer(t *testing.T) {
+	segment := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	header := segment(`{"alg":"RS256"}`)
+
+	assert.Equal(t, "my-client", UnverifiedJWTIssuer(header+"."+segment(`{"iss":"my-client","sub":"my-client"}`)+".signature"))
+	assert.Empty(t, UnverifiedJWTIssuer(header+"."+segment(`{"sub":"my-client"}`)+".signature"))
+	assert.Empty(t, UnverifiedJWTIssuer(header+"."+segment(`not json`)+".signature"))
+	assert.Empty(t, UnverifiedJWTIssuer("not a jwt"))
+	assert.Empty(t, UnverifiedJWTIssuer(""))
+}
+
+func TestClientAssertionClientID(t *testing.T) {
+	ctx := context.Background()
+	assert.Empty(t, ClientAssertionClientID(ctx))
+	assert.Empty(t, ClientAssertionClientID(WithClientAssertionClientID(ctx, "")))
+	assert.Equal(t, "my-client", ClientAssertionClientID(WithClientAssertionClientID(ctx, "my-client")))
+}
@@ -0,0 +1,28 @@
+// Copyright © 2024 Ory Corp
+// SPDX-License-Identifier: Apache-2.0
+
+package x
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AuthorizeCodeReuseDetections counts authorization codes which were presented
+// again after they had been invalidated. A spike is a strong signal for an
+// attack. The counter is not labeled by client to keep its cardinality bounded;
+// the client ID of every detection is logged instead.
+var AuthorizeCodeReuseDetections = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "hydra",
+	Name:      "oauth2_authorize_code_reuse_detections_total",
+	Help:      "Number of invalidated authorization codes which were presented again.",
+})
+
+// AccessTokenDeletions counts deleted access tokens, labeled by whether they
+// were stored under their "hashed" signature or under the "legacy", unhashed
+// signature of older versions, to gauge the progress of the migration.
+var AccessTokenDeletions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "hydra",
+	Name:      "oauth2_access_token_deletions_total",
+	Help:      "Number of deleted access tokens by signature format.",
+}, []string{"signature"})